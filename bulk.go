@@ -0,0 +1,269 @@
+package trireme
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aporeto-inc/trireme/policy"
+	"github.com/aporeto-inc/trireme/supervisor"
+)
+
+// bulkUpdate is the update of the policy of a PU in a bulk update
+type bulkUpdate struct {
+	contextID string
+	state     PUState
+	policy    *policy.PUPolicy
+	previous  *policy.PUPolicy
+
+	// puInfo is nil for the frozen PUs, that get their policy when they are
+	// unpaused
+	puInfo *policy.PUInfo
+
+	err error
+}
+
+// UpdatePolicies updates the policies of several PUs. The workers wait while
+// the policies are enforced in parallel, so that the update is ordered with the
+// other requests of the PUs.
+func (t *trireme) UpdatePolicies(policies map[string]*policy.PUPolicy, atomic bool) <-chan map[string]error {
+
+	c := make(chan map[string]error, 1)
+
+	copies := map[string]*policy.PUPolicy{}
+	for contextID, p := range policies {
+		if p != nil {
+			p = p.Clone()
+		}
+		copies[contextID] = p
+	}
+
+	req := &triremeRequest{
+		reqType:    policiesUpdate,
+		policies:   copies,
+		atomic:     atomic,
+		returnChan: make(chan error, 1),
+	}
+
+	t.submit(req)
+
+	go func() {
+		<-req.returnChan
+		c <- req.results
+	}()
+
+	return c
+}
+
+// doUpdatePolicies validates the policies of a bulk update and enforces them.
+// The workers are waiting, so the PUs cannot change while they are updated.
+func (t *trireme) doUpdatePolicies(ctx context.Context, policies map[string]*policy.PUPolicy, atomic bool) map[string]error {
+
+	updates := []*bulkUpdate{}
+	var invalid error
+
+	for contextID, p := range policies {
+		u := &bulkUpdate{
+			contextID: contextID,
+			policy:    p,
+		}
+		updates = append(updates, u)
+
+		if u.err = t.validateUpdate(u); u.err != nil && invalid == nil {
+			invalid = u.err
+		}
+	}
+
+	results := map[string]error{}
+
+	// Nothing is updated unless all the policies are valid
+	if atomic && invalid != nil {
+		for _, u := range updates {
+			results[u.contextID] = u.err
+			if u.err == nil {
+				results[u.contextID] = fmt.Errorf("Policy update of PU %s aborted: %s", u.contextID, invalid)
+			}
+		}
+		return results
+	}
+
+	valid := []*bulkUpdate{}
+	for _, u := range updates {
+		results[u.contextID] = u.err
+		if u.err == nil {
+			valid = append(valid, u)
+		}
+	}
+
+	t.enforceUpdates(ctx, valid)
+
+	var failed error
+	for _, u := range valid {
+		if u.err != nil && failed == nil {
+			failed = u.err
+		}
+	}
+
+	if atomic && failed != nil {
+		t.rollbackUpdates(valid)
+
+		for _, u := range valid {
+			results[u.contextID] = u.err
+			if u.err == nil {
+				results[u.contextID] = fmt.Errorf("Policy update of PU %s rolled back: %s", u.contextID, failed)
+				continue
+			}
+			t.policyUpdated(u.contextID, u.state, u.err)
+		}
+		return results
+	}
+
+	for _, u := range valid {
+		results[u.contextID] = u.err
+		if u.err == nil {
+			t.setPolicy(u.contextID, u.policy, PolicySourceUpdate)
+		}
+		t.policyUpdated(u.contextID, u.state, u.err)
+	}
+
+	return results
+}
+
+// validateUpdate checks that the policy of a PU can be updated and prepares
+// the information given to the enforcer and the supervisor
+func (t *trireme) validateUpdate(u *bulkUpdate) error {
+
+	state, err := t.updatableState(u.contextID)
+	if err != nil {
+		return err
+	}
+
+	if u.policy == nil {
+		return fmt.Errorf("Nil policy for PU %s", u.contextID)
+	}
+
+	u.state = state
+	u.previous, _ = t.activePolicy(u.contextID)
+
+	// A paused PU that is quarantined or released gets its new policy when it
+	// is unpaused
+	if t.isFrozen(u.contextID) {
+		if _, err := t.PURuntime(u.contextID); err != nil {
+			return fmt.Errorf("Policy Update failed because couldn't find runtime for contextID %s", u.contextID)
+		}
+		return nil
+	}
+
+	u.puInfo, err = t.puInfo(u.contextID, u.policy)
+
+	return err
+}
+
+// enforceUpdates enforces the new policies of the PUs in parallel and programs
+// them in the supervisor, in a single batch if it supports it
+func (t *trireme) enforceUpdates(ctx context.Context, updates []*bulkUpdate) {
+
+	enforced := map[string]*policy.PUInfo{}
+	for _, u := range updates {
+		if u.puInfo != nil {
+			enforced[u.contextID] = u.puInfo
+		}
+	}
+
+	errs := t.parallel(enforced, func(contextID string) error {
+		return t.enforce(ctx, contextID, enforced[contextID])
+	})
+
+	for _, u := range updates {
+		if err := errs[u.contextID]; err != nil {
+			u.err = fmt.Errorf("Policy Update failed for Enforcer %s", err)
+			delete(enforced, u.contextID)
+		}
+	}
+
+	if len(enforced) == 0 {
+		return
+	}
+
+	if s, ok := t.supervisor.(supervisor.BatchSupervisor); ok && ctx.Err() == nil {
+		errs = s.SuperviseBatch(enforced)
+	} else {
+		errs = t.parallel(enforced, func(contextID string) error {
+			return t.supervise(ctx, contextID, enforced[contextID])
+		})
+	}
+
+	for _, u := range updates {
+		if _, ok := enforced[u.contextID]; !ok {
+			continue
+		}
+
+		if err := errs[u.contextID]; err != nil {
+			t.enforcer.Unenforce(u.contextID)
+			u.err = fmt.Errorf("Policy Update failed for Supervisor %s", err)
+		}
+	}
+}
+
+// rollbackUpdates enforces again the previous policies of the PUs of a failed
+// atomic update
+func (t *trireme) rollbackUpdates(updates []*bulkUpdate) {
+
+	previous := map[string]*policy.PUInfo{}
+	for _, u := range updates {
+		if u.puInfo != nil && u.previous != nil {
+			previous[u.contextID] = u.puInfo
+		}
+	}
+
+	// The rollback is not abandoned with the request
+	errs := t.parallel(previous, func(contextID string) error {
+		p, _ := t.activePolicy(contextID)
+		return t.applyPolicy(context.Background(), contextID, p)
+	})
+
+	for contextID, err := range errs {
+		if err != nil {
+			log.WithFields(log.Fields{
+				"package":   "trireme",
+				"contextID": contextID,
+				"error":     err.Error(),
+			}).Error("Cannot roll back the policy of the PU")
+
+			t.setError(contextID, err)
+		}
+	}
+}
+
+// parallel calls f for each PU with as many goroutines as workers and returns
+// the errors
+func (t *trireme) parallel(puInfos map[string]*policy.PUInfo, f func(contextID string) error) map[string]error {
+
+	errs := map[string]error{}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+
+	tokens := make(chan struct{}, len(t.queues))
+
+	for contextID := range puInfos {
+		wg.Add(1)
+		tokens <- struct{}{}
+
+		go func(contextID string) {
+			defer wg.Done()
+
+			err := f(contextID)
+
+			lock.Lock()
+			errs[contextID] = err
+			lock.Unlock()
+
+			<-tokens
+		}(contextID)
+	}
+
+	wg.Wait()
+
+	return errs
+}
@@ -0,0 +1,130 @@
+package trireme
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/aporeto-inc/trireme/policy"
+)
+
+// bulkPolicy returns a policy with the given management ID
+func bulkPolicy(managementID string) *policy.PUPolicy {
+
+	ipaddrs := policy.NewIPMap(map[string]string{policy.DefaultNamespace: "127.0.0.1"})
+
+	return policy.NewPUPolicy(managementID, policy.AllowAll, nil, nil, nil, nil, nil, nil, ipaddrs, nil)
+}
+
+func TestUpdatePolicies(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, tmonitor := createMocks()
+	trireme := NewTrireme("serverID", tresolver, tsupervisor, tenforcer)
+	trireme.Start()
+	defer trireme.Stop()
+
+	for _, contextID := range []string{"1", "2", "3"} {
+		doTestCreate(t, trireme, tresolver, tsupervisor, tenforcer, tmonitor, contextID, policy.NewPURuntimeWithDefaults())
+	}
+
+	tsupervisor.MockSupervise(t, func(contextID string, puInfo *policy.PUInfo) error {
+		return nil
+	})
+
+	var lock sync.Mutex
+	enforced := map[string]string{}
+	tenforcer.MockEnforce(t, func(contextID string, puInfo *policy.PUInfo) error {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if contextID == "3" {
+			return fmt.Errorf("Enforcer error")
+		}
+		enforced[contextID] = puInfo.Policy.ManagementID
+		return nil
+	})
+
+	results := <-trireme.UpdatePolicies(map[string]*policy.PUPolicy{
+		"1":       bulkPolicy("new"),
+		"2":       bulkPolicy("new"),
+		"3":       bulkPolicy("new"),
+		"unknown": bulkPolicy("new"),
+	}, false)
+
+	if results["1"] != nil || results["2"] != nil {
+		t.Errorf("Expected the valid PUs to be updated, got %v", results)
+	}
+
+	if results["3"] == nil || results["unknown"] == nil {
+		t.Errorf("Expected the failed and the unknown PUs to fail, got %v", results)
+	}
+
+	if enforced["1"] != "new" || enforced["2"] != "new" {
+		t.Errorf("Expected the new policies to be enforced, got %v", enforced)
+	}
+
+	for contextID, version := range map[string]int{"1": 2, "2": 2, "3": 1} {
+		if status := expectState(t, trireme, contextID, PUStateEnforced); status.PolicyVersion != version {
+			t.Errorf("Policy version of %s was supposed to be %d, was %d", contextID, version, status.PolicyVersion)
+		}
+	}
+}
+
+func TestUpdatePoliciesAtomic(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, tmonitor := createMocks()
+	trireme := NewTrireme("serverID", tresolver, tsupervisor, tenforcer)
+	trireme.Start()
+	defer trireme.Stop()
+
+	for _, contextID := range []string{"1", "2"} {
+		doTestCreate(t, trireme, tresolver, tsupervisor, tenforcer, tmonitor, contextID, policy.NewPURuntimeWithDefaults())
+	}
+
+	tsupervisor.MockSupervise(t, func(contextID string, puInfo *policy.PUInfo) error {
+		return nil
+	})
+
+	var lock sync.Mutex
+	enforced := map[string][]string{}
+	tenforcer.MockEnforce(t, func(contextID string, puInfo *policy.PUInfo) error {
+		lock.Lock()
+		defer lock.Unlock()
+
+		enforced[contextID] = append(enforced[contextID], puInfo.Policy.ManagementID)
+		if contextID == "2" && puInfo.Policy.ManagementID == "new" {
+			return fmt.Errorf("Enforcer error")
+		}
+		return nil
+	})
+
+	results := <-trireme.UpdatePolicies(map[string]*policy.PUPolicy{
+		"1":       bulkPolicy("new"),
+		"unknown": bulkPolicy("new"),
+	}, true)
+
+	if results["1"] == nil || results["unknown"] == nil {
+		t.Errorf("Expected the update to be aborted, got %v", results)
+	}
+
+	if len(enforced) != 0 {
+		t.Errorf("Nothing was supposed to be enforced for an invalid update, got %v", enforced)
+	}
+
+	results = <-trireme.UpdatePolicies(map[string]*policy.PUPolicy{
+		"1": bulkPolicy("new"),
+		"2": bulkPolicy("new"),
+	}, true)
+
+	if results["1"] == nil || results["2"] == nil {
+		t.Errorf("Expected the update to be rolled back, got %v", results)
+	}
+
+	if fmt.Sprint(enforced["1"]) != "[new SomeId]" || fmt.Sprint(enforced["2"]) != "[new SomeId]" {
+		t.Errorf("Expected the previous policies to be enforced again, got %v", enforced)
+	}
+
+	for _, contextID := range []string{"1", "2"} {
+		if status := expectState(t, trireme, contextID, PUStateEnforced); status.PolicyVersion != 1 {
+			t.Errorf("Policy version of %s was supposed to be 1, was %d", contextID, status.PolicyVersion)
+		}
+	}
+}
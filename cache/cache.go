@@ -18,6 +18,7 @@ type DataStore interface {
 	Remove(u interface{}) (err error)
 	Refresh(d time.Duration)
 	DumpStore()
+	KeyList() []interface{}
 	LockedModify(u interface{}, add func(a, b interface{}) interface{}, increment interface{}) (interface{}, error)
 }
 
@@ -210,6 +211,19 @@ func (c *Cache) SizeOf() int {
 
 }
 
+//KeyList returns all the keys of the cache
+func (c *Cache) KeyList() []interface{} {
+	c.RLock()
+	defer c.RUnlock()
+
+	list := []interface{}{}
+	for k := range c.data {
+		list = append(list, k)
+	}
+
+	return list
+}
+
 //LockedModify  locks the data store
 func (c *Cache) LockedModify(u interface{}, add func(a, b interface{}) interface{}, increment interface{}) (interface{}, error) {
 	c.Lock()
@@ -78,6 +78,13 @@ func TestElements(t *testing.T) {
 			So(err, ShouldEqual, nil)
 		})
 
+		Convey("Given that I have elements in the cache, I should be able to list their keys", func() {
+			keys := c.KeyList()
+			So(len(keys), ShouldEqual, 2)
+			So(keys, ShouldContain, id)
+			So(keys, ShouldContain, newid)
+		})
+
 		Convey("Given that I have an element in the cache, I should be able to delete it", func() {
 			err := c.Remove(id)
 			So(err, ShouldEqual, nil)
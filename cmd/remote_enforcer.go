@@ -87,7 +87,8 @@ type Server struct {
 	PrivatePEM  []byte
 	pupolicy    *policy.PUPolicy
 	rpcchannel  string
-	rpchdl      *rpcwrapper.RPCWrapper
+	secret      string
+	rpchdl      rpcwrapper.RPCServer
 	StatsClient *rpcwrapper.RPCWrapper
 	Enforcer    enforcer.PolicyEnforcer
 	Collector   collector.EventCollector
@@ -139,6 +140,7 @@ func (s *StatsClient) SendStats() {
 		if time.Since(starttime) > statsInterval {
 			//Send out everything we have in the payload
 			request.Payload = rpcPayload
+			request.ContextID = s.server.ContextID
 			err = s.Rpchdl.RemoteCall(statsContextID,
 				"StatsServer.GetStats",
 				&request,
@@ -155,7 +157,7 @@ func (s *StatsClient) SendStats() {
 func (s *Server) connectStatsClient(statsClient *StatsClient) error {
 
 	statsChannel := os.Getenv(envStatsChannelPath)
-	err := statsClient.Rpchdl.NewRPCClient(statsContextID, statsChannel)
+	err := statsClient.Rpchdl.NewRPCClient(statsContextID, statsChannel, s.secret)
 	if err != nil {
 		log.WithFields(log.Fields{"package": "remote_enforcer",
 			"error": err.Error(),
@@ -171,7 +173,7 @@ func (s *Server) connectStatsClient(statsClient *StatsClient) error {
 // remote enforcer
 func (s *Server) InitEnforcer(req rpcwrapper.Request, resp *rpcwrapper.Response) error {
 
-	if !s.rpchdl.CheckValidity(&req) {
+	if !s.rpchdl.ProcessMessage(&req) {
 		resp.Status = errors.New("Message Auth Failed")
 		return resp.Status
 	}
@@ -227,7 +229,7 @@ func (s *Server) InitEnforcer(req rpcwrapper.Request, resp *rpcwrapper.Response)
 // InitSupervisor is a function called from the controller over RPC. It initializes data structure required by the supervisor
 func (s *Server) InitSupervisor(req rpcwrapper.Request, resp *rpcwrapper.Response) error {
 
-	if !s.rpchdl.CheckValidity(&req) {
+	if !s.rpchdl.ProcessMessage(&req) {
 		resp.Status = errors.New("Message Auth Failed")
 		return resp.Status
 	}
@@ -258,6 +260,17 @@ func (s *Server) InitSupervisor(req rpcwrapper.Request, resp *rpcwrapper.Respons
 
 	s.Supervisor.Start()
 
+	excluder := s.Supervisor.(supervisor.Excluder)
+	for _, exclusion := range payload.ExcludedIPs {
+		if err := excluder.AddExclusion(exclusion); err != nil {
+			log.WithFields(log.Fields{
+				"package":   "remote_enforcer",
+				"exclusion": exclusion.Key(),
+				"Error":     err.Error(),
+			}).Error("Failed to add exclusion")
+		}
+	}
+
 	resp.Status = nil
 	return resp.Status
 }
@@ -265,7 +278,7 @@ func (s *Server) InitSupervisor(req rpcwrapper.Request, resp *rpcwrapper.Respons
 //Supervise This method calls the supervisor method on the supervisor created during initsupervisor
 func (s *Server) Supervise(req rpcwrapper.Request, resp *rpcwrapper.Response) error {
 
-	if !s.rpchdl.CheckValidity(&req) {
+	if !s.rpchdl.ProcessMessage(&req) {
 		resp.Status = errors.New("Message Auth Failed")
 		return resp.Status
 	}
@@ -308,7 +321,7 @@ func (s *Server) Supervise(req rpcwrapper.Request, resp *rpcwrapper.Response) er
 //Unenforce this method calls the unenforce method on the enforcer created from initenforcer
 func (s *Server) Unenforce(req rpcwrapper.Request, resp *rpcwrapper.Response) error {
 
-	if !s.rpchdl.CheckValidity(&req) {
+	if !s.rpchdl.ProcessMessage(&req) {
 		resp.Status = errors.New("Message Auth Failed")
 		return resp.Status
 	}
@@ -319,7 +332,7 @@ func (s *Server) Unenforce(req rpcwrapper.Request, resp *rpcwrapper.Response) er
 //Unsupervise This method calls the unsupervise method on the supervisor created during initsupervisor
 func (s *Server) Unsupervise(req rpcwrapper.Request, resp *rpcwrapper.Response) error {
 
-	if !s.rpchdl.CheckValidity(&req) {
+	if !s.rpchdl.ProcessMessage(&req) {
 		resp.Status = errors.New("Message Auth Failed")
 		return resp.Status
 	}
@@ -327,10 +340,32 @@ func (s *Server) Unsupervise(req rpcwrapper.Request, resp *rpcwrapper.Response)
 	return s.Supervisor.Unsupervise(payload.ContextID)
 }
 
+//AddExclusion This method calls the AddExclusion method on the supervisor created during initsupervisor
+func (s *Server) AddExclusion(req rpcwrapper.Request, resp *rpcwrapper.Response) error {
+
+	if !s.rpchdl.ProcessMessage(&req) {
+		resp.Status = errors.New("Message Auth Failed")
+		return resp.Status
+	}
+	payload := req.Payload.(rpcwrapper.ExcludeIPPayload)
+	return s.Supervisor.(supervisor.Excluder).AddExclusion(payload.Exclusion)
+}
+
+//RemoveExclusion This method calls the RemoveExclusion method on the supervisor created during initsupervisor
+func (s *Server) RemoveExclusion(req rpcwrapper.Request, resp *rpcwrapper.Response) error {
+
+	if !s.rpchdl.ProcessMessage(&req) {
+		resp.Status = errors.New("Message Auth Failed")
+		return resp.Status
+	}
+	payload := req.Payload.(rpcwrapper.ExcludeIPPayload)
+	return s.Supervisor.(supervisor.Excluder).RemoveExclusion(payload.Exclusion)
+}
+
 //Enforce this method calls the enforce method on the enforcer created during initenforcer
 func (s *Server) Enforce(req rpcwrapper.Request, resp *rpcwrapper.Response) error {
 
-	if !s.rpchdl.CheckValidity(&req) {
+	if !s.rpchdl.ProcessMessage(&req) {
 		resp.Status = errors.New("Message Auth Failed")
 		return resp.Status
 	}
@@ -377,18 +412,30 @@ func main() {
 	log.SetLevel(log.DebugLevel)
 	log.SetFormatter(&log.TextFormatter{})
 	namedPipe := os.Getenv(envSocketPath)
+
+	// The secret is not inherited by the processes started by the enforcer
+	secret := os.Getenv(rpcwrapper.EnvSecret)
+	os.Unsetenv(rpcwrapper.EnvSecret)
+
 	server := &Server{pupolicy: nil}
-	rpchdl := rpcwrapper.NewRPCServer()
+	rpchdl, err := rpcwrapper.NewRPCServer(secret)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
 	//Map not initialized here since we don't use it on the server
+	server.rpchdl = rpchdl
 	server.rpcchannel = namedPipe
+	server.secret = secret
 	flag.Parse()
+	server.ContextID = flag.Arg(0)
 	userDetails, _ := user.Current()
 	log.WithFields(log.Fields{"package": "remote_enforcer",
 		"uid":      userDetails.Uid,
 		"gid":      userDetails.Gid,
 		"username": userDetails.Username,
 	}).Info("Enforcer user id")
-	err := rpchdl.StartServer("unix", namedPipe, server)
+	err = rpchdl.StartServer("unix", namedPipe, server)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(-1)
@@ -34,6 +34,12 @@ const (
 	ContainerDelete = "delete"
 	// ContainerFailed indicates an event that a container was stopped because of policy issues
 	ContainerFailed = "forcestop"
+	// ContainerDrift indicates that the rules of a container were modified outside of Trireme and have been repaired
+	ContainerDrift = "drift"
+	// ContainerPolicyPending indicates that the policy of a container could not be resolved and that it is retried
+	ContainerPolicyPending = "policypending"
+	// ContainerPolicyFailed indicates that the resolution of the policy of a container was given up
+	ContainerPolicyFailed = "policyfailed"
 	// UnknownContainerDelete indicates that policy for an unknwon container was deleted
 	UnknownContainerDelete = "unknowncontainer"
 	// PolicyValid Normal flow accept
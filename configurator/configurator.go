@@ -15,6 +15,7 @@ import (
 	"github.com/aporeto-inc/trireme/enforcer/proxy"
 	"github.com/aporeto-inc/trireme/enforcer/utils/rpcwrapper"
 	"github.com/aporeto-inc/trireme/monitor"
+	"github.com/aporeto-inc/trireme/remote/launch"
 	"github.com/aporeto-inc/trireme/supervisor"
 	"github.com/aporeto-inc/trireme/supervisor/proxy"
 )
@@ -41,6 +42,14 @@ func NewIPTablesSupervisor(eventCollector collector.EventCollector, enforcer enf
 
 }
 
+// NewServerSupervisor is the Supervisor of Linux services. Their traffic is
+// matched on their cgroup with IPTables.
+func NewServerSupervisor(eventCollector collector.EventCollector, enforcer enforcer.PolicyEnforcer, networks []string) (supervisor.Supervisor, error) {
+
+	return supervisor.NewSupervisor(eventCollector, enforcer, networks, supervisor.LocalServer, supervisor.IPTables)
+
+}
+
 // NewDefaultSupervisor returns the IPTables supervisor
 func NewDefaultSupervisor(eventCollector collector.EventCollector, enforcer enforcer.PolicyEnforcer, networks []string) (supervisor.Supervisor, error) {
 	return NewIPTablesSupervisor(eventCollector, enforcer, networks)
@@ -80,6 +89,7 @@ func NewTriremeWithDockerMonitor(
 
 		}
 		trireme := trireme.NewTrireme(serverID, resolver, proxySupervise, proxyEnforce)
+		ProcessMon.GetProcessMonHdl().SetExitHandler(trireme.HandleEnforcerExit)
 		monitor := monitor.NewDockerMonitor(DefaultDockerSocketType, DefaultDockerSocket, trireme, dockerMetadataExtractor, eventCollector, syncAtStart)
 		return trireme, monitor, proxySupervise.(supervisor.Excluder)
 	}
@@ -0,0 +1,112 @@
+package trireme
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aporeto-inc/trireme/enforcer"
+	"github.com/aporeto-inc/trireme/monitor"
+	"github.com/aporeto-inc/trireme/policy"
+	"github.com/aporeto-inc/trireme/supervisor"
+)
+
+// HandlePUEventWithContext handles an event of a PU and waits for the result.
+// It gives up when the context is done, while the request is queued or while
+// it is processed.
+func (t *trireme) HandlePUEventWithContext(ctx context.Context, contextID string, event monitor.Event) error {
+
+	return t.submitWithContext(ctx, &triremeRequest{
+		contextID:  contextID,
+		reqType:    handleEvent,
+		eventType:  event,
+		returnChan: make(chan error, 1),
+	})
+}
+
+// UpdatePolicyWithContext updates the policy of a PU and waits for the result.
+// It gives up when the context is done.
+func (t *trireme) UpdatePolicyWithContext(ctx context.Context, contextID string, newPolicy *policy.PUPolicy) error {
+
+	return t.submitWithContext(ctx, &triremeRequest{
+		contextID:  contextID,
+		reqType:    policyUpdate,
+		policyInfo: newPolicy.Clone(),
+		returnChan: make(chan error, 1),
+	})
+}
+
+// submitWithContext queues a request of a PU and waits for its result until the
+// context is done
+func (t *trireme) submitWithContext(ctx context.Context, req *triremeRequest) error {
+
+	req.ctx = ctx
+
+	select {
+	case t.queue(req.contextID) <- req:
+	case <-ctx.Done():
+		return fmt.Errorf("Request for contextID %s not queued: %s", req.contextID, ctx.Err())
+	}
+
+	select {
+	case err := <-req.returnChan:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("Request for contextID %s abandoned: %s", req.contextID, ctx.Err())
+	}
+}
+
+// resolvePolicy resolves the policy of a PU until the context is done
+func (t *trireme) resolvePolicy(ctx context.Context, contextID string, runtimeInfo policy.RuntimeReader) (*policy.PUPolicy, error) {
+
+	if r, ok := t.resolver.(ContextPolicyResolver); ok {
+		return r.ResolvePolicyWithContext(ctx, contextID, runtimeInfo)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return t.resolver.ResolvePolicy(contextID, runtimeInfo)
+}
+
+// supervise programs the rules of a PU until the context is done
+func (t *trireme) supervise(ctx context.Context, contextID string, puInfo *policy.PUInfo) error {
+
+	if s, ok := t.supervisor.(supervisor.ContextSupervisor); ok {
+		return s.SuperviseWithContext(ctx, contextID, puInfo)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return t.supervisor.Supervise(contextID, puInfo)
+}
+
+// unsupervise removes the rules of a PU. The state of the PU is already gone
+// when it is called, so it is not abandoned when the request is.
+func (t *trireme) unsupervise(contextID string) error {
+
+	return t.supervisor.Unsupervise(contextID)
+}
+
+// enforce enforces the policy of a PU until the context is done
+func (t *trireme) enforce(ctx context.Context, contextID string, puInfo *policy.PUInfo) error {
+
+	if e, ok := t.enforcer.(enforcer.ContextPolicyEnforcer); ok {
+		return e.EnforceWithContext(ctx, contextID, puInfo)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return t.enforcer.Enforce(contextID, puInfo)
+}
+
+// unenforce stops enforcing the policy of a PU. The state of the PU is already
+// gone when it is called, so it is not abandoned when the request is.
+func (t *trireme) unenforce(contextID string) error {
+
+	return t.enforcer.Unenforce(contextID)
+}
@@ -0,0 +1,154 @@
+package trireme
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aporeto-inc/trireme/monitor"
+	"github.com/aporeto-inc/trireme/policy"
+)
+
+// contextResolver is a resolver that records the context of the resolutions
+type contextResolver struct {
+	TestPolicyResolver
+	deadlines chan bool
+}
+
+func (r *contextResolver) ResolvePolicyWithContext(ctx context.Context, contextID string, RuntimeReader policy.RuntimeReader) (*policy.PUPolicy, error) {
+
+	_, ok := ctx.Deadline()
+	r.deadlines <- ok
+
+	return r.ResolvePolicy(contextID, RuntimeReader)
+}
+
+func TestContextCanceled(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, _ := createMocks()
+	trireme := NewTrireme("serverID", tresolver, tsupervisor, tenforcer)
+	trireme.Start()
+	defer trireme.Stop()
+
+	resolved := false
+	tresolver.MockResolvePolicy(t, func(contextID string, RuntimeReader policy.RuntimeReader) (*policy.PUPolicy, error) {
+		resolved = true
+		return policy.NewPUPolicyWithDefaults(), nil
+	})
+
+	contextID := "123123"
+	trireme.SetPURuntime(contextID, policy.NewPURuntimeWithDefaults())
+
+	if err := trireme.HandlePUEventWithContext(context.Background(), contextID, monitor.EventCreate); err != nil {
+		t.Errorf("Create was supposed to be nil, was %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := trireme.HandlePUEventWithContext(ctx, contextID, monitor.EventStart); err == nil {
+		t.Errorf("Start with a canceled context was supposed to fail")
+	}
+
+	// The request is processed after the previous ones if it was queued
+	<-trireme.HandlePUEvent(contextID, monitor.EventUpdate)
+
+	if resolved {
+		t.Errorf("The policy was not supposed to be resolved for a canceled request")
+	}
+
+	expectState(t, trireme, contextID, PUStateCreated)
+}
+
+func TestContextDeadline(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, tmonitor := createMocks()
+	trireme := NewTrireme("serverID", tresolver, tsupervisor, tenforcer)
+	trireme.SetConcurrency(1, 1)
+	trireme.Start()
+	defer trireme.Stop()
+
+	contextID := "123123"
+	doTestCreate(t, trireme, tresolver, tsupervisor, tenforcer, tmonitor, contextID, policy.NewPURuntimeWithDefaults())
+
+	block := make(chan bool)
+	tenforcer.MockEnforce(t, func(contextID string, puInfo *policy.PUInfo) error {
+		<-block
+		return nil
+	})
+
+	p, _ := trireme.PUPolicy(contextID)
+
+	// The first update blocks the worker and the second one fills its queue
+	trireme.UpdatePolicy(contextID, p)
+	trireme.UpdatePolicy(contextID, p)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := trireme.UpdatePolicyWithContext(ctx, contextID, p); err == nil {
+		t.Errorf("Update was supposed to fail when the deadline is exceeded")
+	}
+
+	close(block)
+}
+
+func TestContextResolver(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, _ := createMocks()
+	resolver := &contextResolver{
+		TestPolicyResolver: tresolver,
+		deadlines:          make(chan bool, 1),
+	}
+	trireme := NewTrireme("serverID", resolver, tsupervisor, tenforcer)
+	trireme.Start()
+	defer trireme.Stop()
+
+	tresolver.MockResolvePolicy(t, func(contextID string, RuntimeReader policy.RuntimeReader) (*policy.PUPolicy, error) {
+		return policy.NewPUPolicyWithDefaults(), nil
+	})
+
+	contextID := "123123"
+	trireme.SetPURuntime(contextID, policy.NewPURuntimeWithDefaults())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := trireme.HandlePUEventWithContext(ctx, contextID, monitor.EventStart); err != nil {
+		t.Errorf("Start was supposed to be nil, was %s", err)
+	}
+
+	if deadline := <-resolver.deadlines; !deadline {
+		t.Errorf("The deadline of the request was not given to the resolver")
+	}
+}
+
+func TestContextTeardown(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, tmonitor := createMocks()
+	trireme := NewTrireme("serverID", tresolver, tsupervisor, tenforcer)
+	trireme.Start()
+	defer trireme.Stop()
+
+	contextID := "123123"
+	doTestCreate(t, trireme, tresolver, tsupervisor, tenforcer, tmonitor, contextID, policy.NewPURuntimeWithDefaults())
+
+	// The deadline of the request expires while the rules are removed
+	tsupervisor.MockUnsupervise(t, func(contextID string) error {
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	})
+
+	unenforced := make(chan bool, 1)
+	tenforcer.MockUnenforce(t, func(contextID string) error {
+		unenforced <- true
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	trireme.HandlePUEventWithContext(ctx, contextID, monitor.EventStop)
+
+	select {
+	case <-unenforced:
+	case <-time.After(time.Second):
+		t.Errorf("The PU was not unenforced after the deadline of the delete expired")
+	}
+}
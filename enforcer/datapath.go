@@ -3,6 +3,7 @@ package enforcer
 // Go libraries
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"net"
 	"strconv"
@@ -29,9 +30,11 @@ type datapathEnforcer struct {
 	service             PacketProcessor
 
 	// Internal structures and caches
-	// Key=ContextId Value=ContainerIP
+	// Key=ContextId Value=All the keys of the PU in the puTracker
 	contextTracker cache.DataStore
-	puTracker      cache.DataStore
+	// Key=ContainerIP Value=PUContext. There is one entry per IP of the container.
+	// Linux services are tracked with their mark and their ports instead.
+	puTracker cache.DataStore
 	// Key=FlowHash Value=Connection. Created on syn packet from network with regular flow hash
 	networkConnectionTracker cache.DataStore
 	// Key=FlowHash Value=Connection. Created on syn packet from application with regular flow hash
@@ -139,6 +142,26 @@ func NewDefaultDatapathEnforcer(
 	)
 }
 
+// EnforceWithContext is Enforce giving up when the context is done
+func (d *datapathEnforcer) EnforceWithContext(ctx context.Context, contextID string, puInfo *policy.PUInfo) error {
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("Enforce of %s abandoned: %s", contextID, err)
+	}
+
+	return d.Enforce(contextID, puInfo)
+}
+
+// UnenforceWithContext is Unenforce giving up when the context is done
+func (d *datapathEnforcer) UnenforceWithContext(ctx context.Context, contextID string) error {
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("Unenforce of %s abandoned: %s", contextID, err)
+	}
+
+	return d.Unenforce(contextID)
+}
+
 func (d *datapathEnforcer) Enforce(contextID string, puInfo *policy.PUInfo) error {
 
 	log.WithFields(log.Fields{
@@ -146,41 +169,102 @@ func (d *datapathEnforcer) Enforce(contextID string, puInfo *policy.PUInfo) erro
 		"contextID": contextID,
 	}).Debug("Enforce IP")
 
-	ip, err := d.contextTracker.Get(contextID)
+	ips, err := d.contextTracker.Get(contextID)
 
 	if err != nil {
 		return d.doCreatePU(contextID, puInfo)
 	}
 
-	puContext, err := d.puTracker.Get(ip)
+	puContext, err := d.puTracker.Get(ips.([]string)[0])
 
 	if err != nil {
 		return d.doCreatePU(contextID, puInfo)
 	}
 
+	if err := d.doUpdateAddresses(contextID, ips.([]string), puContext.(*PUContext), puInfo); err != nil {
+		return err
+	}
+
 	return d.doUpdatePU(puContext.(*PUContext), puInfo)
 }
 
-func (d *datapathEnforcer) doCreatePU(contextID string, puInfo *policy.PUInfo) error {
+// puAddresses returns all the addresses the PU is tracked with. A remote
+// enforcer only processes one PU and ignores the addresses. Linux services
+// share the addresses of the host and are tracked with the mark of their
+// packets and the ports they listen on.
+func (d *datapathEnforcer) puAddresses(puInfo *policy.PUInfo) ([]string, error) {
 
-	ip := DefaultNetwork
-	if !d.remote {
-		if _, ok := puInfo.Policy.DefaultIPAddress(); !ok {
-			return fmt.Errorf("No IP address found")
+	if d.remote {
+		return []string{DefaultNetwork}, nil
+	}
+
+	if mark := puInfo.Policy.Mark(); mark != "" {
+		keys := []string{markKey(mark)}
+		for _, port := range puInfo.Policy.Ports() {
+			if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+				return nil, fmt.Errorf("Invalid port %s", port)
+			}
+			keys = append(keys, portKey(port))
 		}
-		ip, _ = puInfo.Policy.DefaultIPAddress()
+		return keys, nil
+	}
+
+	addresses := puInfo.Policy.IPAddresses().Addresses()
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("No IP address found")
+	}
+
+	for _, ip := range addresses {
 		if net.ParseIP(ip) == nil {
-			return fmt.Errorf("Invalid up address %s\n", ip)
+			return nil, fmt.Errorf("Invalid up address %s\n", ip)
 		}
 	}
 
+	return addresses, nil
+}
+
+func (d *datapathEnforcer) doCreatePU(contextID string, puInfo *policy.PUInfo) error {
+
+	addresses, err := d.puAddresses(puInfo)
+	if err != nil {
+		return err
+	}
+
 	pu := &PUContext{
 		ID: contextID,
 	}
 
 	d.doUpdatePU(pu, puInfo)
-	d.contextTracker.AddOrUpdate(contextID, ip)
-	d.puTracker.AddOrUpdate(ip, pu)
+	d.contextTracker.AddOrUpdate(contextID, addresses)
+	for _, ip := range addresses {
+		d.puTracker.AddOrUpdate(ip, pu)
+	}
+
+	return nil
+}
+
+// doUpdateAddresses tracks the PU with the addresses of the new policy and
+// stops tracking it with the addresses that were removed
+func (d *datapathEnforcer) doUpdateAddresses(contextID string, oldAddresses []string, puContext *PUContext, puInfo *policy.PUInfo) error {
+
+	addresses, err := d.puAddresses(puInfo)
+	if err != nil {
+		return err
+	}
+
+	current := map[string]bool{}
+	for _, ip := range addresses {
+		current[ip] = true
+		d.puTracker.AddOrUpdate(ip, puContext)
+	}
+
+	for _, ip := range oldAddresses {
+		if !current[ip] {
+			d.puTracker.Remove(ip)
+		}
+	}
+
+	d.contextTracker.AddOrUpdate(contextID, addresses)
 
 	return nil
 }
@@ -199,7 +283,7 @@ func (d *datapathEnforcer) Unenforce(contextID string) error {
 		"contextID": contextID,
 	}).Debug("Unenforce IP")
 
-	ip, err := d.contextTracker.Get(contextID)
+	ips, err := d.contextTracker.Get(contextID)
 
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -210,7 +294,11 @@ func (d *datapathEnforcer) Unenforce(contextID string) error {
 		return fmt.Errorf("ContextID not found in Enforcer")
 	}
 
-	err = d.puTracker.Remove(ip)
+	for _, ip := range ips.([]string) {
+		if rerr := d.puTracker.Remove(ip); rerr != nil {
+			err = rerr
+		}
+	}
 
 	d.contextTracker.Remove(contextID)
 
@@ -335,6 +423,14 @@ func createRuleDB(policyRules *policy.TagSelectorList) (*lookup.PolicyDB, *looku
 	return acceptRules, rejectRules
 }
 
+// packetMark returns the mark of a queued packet. Unmarked packets have no mark.
+func packetMark(p *netfilter.NFPacket) string {
+	if p.Mark == 0 {
+		return ""
+	}
+	return strconv.Itoa(p.Mark)
+}
+
 // processNetworkPacketsFromNFQ processes packets arriving from the network in an NF queue
 func (d *datapathEnforcer) processNetworkPacketsFromNFQ(p *netfilter.NFPacket) {
 
@@ -350,6 +446,7 @@ func (d *datapathEnforcer) processNetworkPacketsFromNFQ(p *netfilter.NFPacket) {
 		d.net.CreateDropPackets++
 		tcpPacket.Print(packet.PacketFailureCreate)
 	} else {
+		tcpPacket.Mark = packetMark(p)
 		err = d.processNetworkPackets(tcpPacket)
 	}
 
@@ -401,6 +498,7 @@ func (d *datapathEnforcer) processApplicationPacketsFromNFQ(p *netfilter.NFPacke
 		d.app.CreateDropPackets++
 		tcpPacket.Print(packet.PacketFailureCreate)
 	} else {
+		tcpPacket.Mark = packetMark(p)
 		err = d.processApplicationPackets(tcpPacket)
 	}
 
@@ -614,13 +712,40 @@ func (d *datapathEnforcer) parsePacketToken(connection *Connection, data []byte)
 	return claims, nil
 }
 
+// markKey returns the key of a Linux service in the puTracker from its mark
+func markKey(mark string) string {
+	return "mark:" + mark
+}
+
+// portKey returns the key of a Linux service in the puTracker from a port it listens on
+func portKey(port string) string {
+	return "port:" + port
+}
+
 // contextFromIP returns the context from the default IP if remote. otherwise
-// it returns the context from the passed IP
-func (d *datapathEnforcer) contextFromIP(ip string) (interface{}, error) {
+// it returns the context from the passed IP. The packets of a Linux service are
+// identified by their mark. The application packets are marked by the service
+// chain and the network packets get the mark of their connection, so that the
+// replies to the connections initiated by the service are identified. The
+// other packets of a Linux service are identified by the port of the service
+// when no PU has the address.
+func (d *datapathEnforcer) contextFromIP(app bool, ip string, mark string, port uint16) (interface{}, error) {
 	if d.remote {
 		return d.puTracker.Get(DefaultNetwork)
 	}
-	return d.puTracker.Get(ip)
+
+	if mark != "" {
+		if context, err := d.puTracker.Get(markKey(mark)); err == nil {
+			return context, nil
+		}
+	}
+
+	context, err := d.puTracker.Get(ip)
+	if err == nil {
+		return context, nil
+	}
+
+	return d.puTracker.Get(portKey(strconv.Itoa(int(port))))
 }
 
 func (d *datapathEnforcer) processApplicationSynPacket(tcpPacket *packet.Packet) (interface{}, error) {
@@ -632,7 +757,7 @@ func (d *datapathEnforcer) processApplicationSynPacket(tcpPacket *packet.Packet)
 	var connection *Connection
 
 	// Find the container context
-	context, cerr := d.contextFromIP(tcpPacket.SourceAddress.String())
+	context, cerr := d.contextFromIP(true, tcpPacket.SourceAddress.String(), tcpPacket.Mark, tcpPacket.SourcePort)
 
 	if cerr != nil {
 		log.WithFields(log.Fields{
@@ -683,7 +808,7 @@ func (d *datapathEnforcer) processApplicationSynAckPacket(tcpPacket *packet.Pack
 	}).Debug("process application syn ack packet")
 
 	// Find the container context
-	context, cerr := d.contextFromIP(tcpPacket.SourceAddress.String())
+	context, cerr := d.contextFromIP(true, tcpPacket.SourceAddress.String(), tcpPacket.Mark, tcpPacket.SourcePort)
 
 	if cerr != nil {
 		log.WithFields(log.Fields{
@@ -739,7 +864,7 @@ func (d *datapathEnforcer) processApplicationAckPacket(tcpPacket *packet.Packet)
 	}).Debug("process application ack packet")
 
 	// Find the container context
-	context, cerr := d.contextFromIP(tcpPacket.SourceAddress.String())
+	context, cerr := d.contextFromIP(true, tcpPacket.SourceAddress.String(), tcpPacket.Mark, tcpPacket.SourcePort)
 
 	if cerr != nil {
 		log.WithFields(log.Fields{
@@ -1146,7 +1271,7 @@ func (d *datapathEnforcer) processNetworkAckPacket(context *PUContext, tcpPacket
 func (d *datapathEnforcer) processNetworkTCPPacket(tcpPacket *packet.Packet) (interface{}, error) {
 
 	// Lookup the policy rules for the packet - Return false if they don't exist
-	context, err := d.contextFromIP(tcpPacket.DestinationAddress.String())
+	context, err := d.contextFromIP(false, tcpPacket.DestinationAddress.String(), tcpPacket.Mark, tcpPacket.DestinationPort)
 
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -294,3 +294,162 @@ func TestCacheState(t *testing.T) {
 		t.Errorf("Expected failure, no IP but passed %s", err)
 	}
 }
+
+func TestMultipleAddresses(t *testing.T) {
+
+	Convey("Given I create a new enforcer instance", t, func() {
+		secret := tokens.NewPSKSecrets([]byte("Dummy Test Password"))
+		collector := &collector.DefaultCollector{}
+		enforcer := NewDefaultDatapathEnforcer("SomeServerId", collector, nil, secret, false).(*datapathEnforcer)
+		contextID := "123"
+
+		puInfo := policy.NewPUInfo(contextID)
+		puInfo.Policy.SetIPAddresses(policy.NewIPMap(map[string]string{"bridge": "10.1.1.1", "backend": "10.2.2.2"}))
+
+		Convey("When I enforce a PU with two addresses", func() {
+			err := enforcer.Enforce(contextID, puInfo)
+
+			Convey("Both addresses should lead to the PU", func() {
+				So(err, ShouldBeNil)
+				_, err = enforcer.puTracker.Get("10.1.1.1")
+				So(err, ShouldBeNil)
+				_, err = enforcer.puTracker.Get("10.2.2.2")
+				So(err, ShouldBeNil)
+			})
+
+			Convey("When the PU is disconnected from one network", func() {
+				puInfo.Policy.SetIPAddresses(policy.NewIPMap(map[string]string{"bridge": "10.1.1.1"}))
+				err := enforcer.Enforce(contextID, puInfo)
+
+				Convey("Only the remaining address should lead to the PU", func() {
+					So(err, ShouldBeNil)
+					_, err = enforcer.puTracker.Get("10.1.1.1")
+					So(err, ShouldBeNil)
+					_, err = enforcer.puTracker.Get("10.2.2.2")
+					So(err, ShouldNotBeNil)
+				})
+			})
+
+			Convey("When I unenforce the PU", func() {
+				err := enforcer.Unenforce(contextID)
+
+				Convey("No address should lead to the PU", func() {
+					So(err, ShouldBeNil)
+					_, err = enforcer.puTracker.Get("10.1.1.1")
+					So(err, ShouldNotBeNil)
+					_, err = enforcer.puTracker.Get("10.2.2.2")
+					So(err, ShouldNotBeNil)
+				})
+			})
+		})
+	})
+}
+
+func TestLinuxServices(t *testing.T) {
+
+	Convey("Given I create a new enforcer instance", t, func() {
+		secret := tokens.NewPSKSecrets([]byte("Dummy Test Password"))
+		collector := &collector.DefaultCollector{}
+		enforcer := NewDefaultDatapathEnforcer("SomeServerId", collector, nil, secret, false).(*datapathEnforcer)
+		contextID := "service"
+
+		puInfo := policy.NewPUInfo(contextID)
+		puInfo.Policy.SetMark("100")
+		puInfo.Policy.SetPorts([]string{"80", "443"})
+
+		Convey("When I enforce a Linux service", func() {
+			err := enforcer.Enforce(contextID, puInfo)
+			So(err, ShouldBeNil)
+
+			Convey("Its application packets should be identified by their mark", func() {
+				context, err := enforcer.contextFromIP(true, "10.1.1.1", "100", 32000)
+				So(err, ShouldBeNil)
+				So(context.(*PUContext).ID, ShouldEqual, contextID)
+			})
+
+			Convey("Its network packets should be identified by their destination port", func() {
+				context, err := enforcer.contextFromIP(false, "10.1.1.1", "", 443)
+				So(err, ShouldBeNil)
+				So(context.(*PUContext).ID, ShouldEqual, contextID)
+
+				_, err = enforcer.contextFromIP(false, "10.1.1.1", "", 22)
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("When I unenforce it, its packets should not be identified", func() {
+				So(enforcer.Unenforce(contextID), ShouldBeNil)
+				_, err := enforcer.contextFromIP(true, "10.1.1.1", "100", 32000)
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When a Linux service initiates a connection to a PU", func() {
+			tagSelector := policy.TagSelector{
+				Clause: []policy.KeyValueOperator{
+					{
+						Key:      TransmitterLabel,
+						Value:    []string{"value"},
+						Operator: policy.Equal,
+					},
+				},
+				Action: policy.Accept,
+			}
+
+			puInfo.Policy.SetPorts(nil)
+			puInfo.Policy.AddIdentityTag(TransmitterLabel, "value")
+			puInfo.Policy.AddReceiverRules(&tagSelector)
+			So(enforcer.Enforce(contextID, puInfo), ShouldBeNil)
+
+			server := policy.NewPUInfo("server")
+			server.Policy.SetIPAddresses(policy.NewIPMap(map[string]string{policy.DefaultNamespace: "164.67.228.152"}))
+			server.Policy.AddIdentityTag(TransmitterLabel, "value")
+			server.Policy.AddReceiverRules(&tagSelector)
+			So(enforcer.Enforce("server", server), ShouldBeNil)
+
+			// The SYN, SYN-ACK and ACK packets of a connection from 10.1.10.76,
+			// the address of the host, to the server
+			serviceIP := "10.1.10.76"
+
+			Convey("The replies to the service should be identified by the mark of the connection", func() {
+				for i, p := range TCPFlow[:3] {
+					input := make([]byte, len(p))
+					copy(input, p)
+
+					tcpPacket, err := packet.New(0, input)
+					So(err, ShouldBeNil)
+					tcpPacket.UpdateIPChecksum()
+					tcpPacket.UpdateTCPChecksum()
+
+					if tcpPacket.SourceAddress.String() == serviceIP {
+						tcpPacket.Mark = "100"
+					}
+
+					So(enforcer.processApplicationPackets(tcpPacket), ShouldBeNil)
+
+					output := make([]byte, len(tcpPacket.GetBytes()))
+					copy(output, tcpPacket.GetBytes())
+
+					outPacket, err := packet.New(0, output)
+					So(err, ShouldBeNil)
+
+					if outPacket.DestinationAddress.String() == serviceIP {
+						outPacket.Mark = "100"
+					}
+
+					if err := enforcer.processNetworkPackets(outPacket); err != nil {
+						t.Errorf("Packet %d of the connection of the service was rejected: %s", i, err)
+					}
+				}
+			})
+		})
+
+		Convey("When I enforce a Linux service with an invalid port", func() {
+			puInfo.Policy.SetPorts([]string{"http"})
+			err := enforcer.Enforce(contextID, puInfo)
+
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
@@ -1,6 +1,10 @@
 package enforcer
 
-import "github.com/aporeto-inc/trireme/policy"
+import (
+	"context"
+
+	"github.com/aporeto-inc/trireme/policy"
+)
 
 // A PolicyEnforcer is implementing the enforcer that will modify//analyze the capture packets
 type PolicyEnforcer interface {
@@ -21,6 +25,18 @@ type PolicyEnforcer interface {
 	Stop() error
 }
 
+// A ContextPolicyEnforcer is a PolicyEnforcer that gives up when the context of
+// a request is done.
+type ContextPolicyEnforcer interface {
+	PolicyEnforcer
+
+	// EnforceWithContext is Enforce with a context.
+	EnforceWithContext(ctx context.Context, contextID string, puInfo *policy.PUInfo) error
+
+	// UnenforceWithContext is Unenforce with a context.
+	UnenforceWithContext(ctx context.Context, contextID string) error
+}
+
 // PublicKeyAdder register a publicKey for a Node.
 type PublicKeyAdder interface {
 
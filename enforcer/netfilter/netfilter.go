@@ -50,6 +50,8 @@ type NFPacket struct {
 	Xbuffer     *C.uchar
 	QueueHandle *C.struct_nfq_q_handle
 	ID          int
+	// Mark is the netfilter mark of the packet
+	Mark int
 }
 
 //NFQueue implements the queue and holds all related state information
@@ -94,7 +96,7 @@ func (nfq *NFQueue) run() {
 }
 
 //export processPacket
-func processPacket(queueID C.int, data *C.uchar, len C.int, newData *C.uchar, newLength *C.int, idx uint32) verdictType {
+func processPacket(queueID C.int, data *C.uchar, len C.int, newData *C.uchar, newLength *C.int, mark C.uint, idx uint32) verdictType {
 
 	return NfDrop
 
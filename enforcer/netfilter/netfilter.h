@@ -25,7 +25,7 @@
 #include <errno.h>
 #include <libnetfilter_queue/libnetfilter_queue.h>
 
-extern uint processPacket(int id, unsigned char* data, int len, unsigned char* newData, u_int32_t idx);
+extern uint processPacket(int id, unsigned char* data, int len, unsigned char* newData, u_int32_t mark, u_int32_t idx);
 
 
 // Callback for the nf handler. Follows standard message. Passes control to the Go call back
@@ -49,7 +49,7 @@ static int nf_callback(struct nfq_q_handle *qh, struct nfgenmsg *nfmsg, struct n
 
     new_data = (unsigned char *) malloc(buffer_length+1440);
 
-    return processPacket(id, buffer, buffer_length, new_data, (uint32_t)((uintptr_t)cb_func) );
+    return processPacket(id, buffer, buffer_length, new_data, nfq_get_nfmark(nfa), (uint32_t)((uintptr_t)cb_func) );
 
 }
 
@@ -72,6 +72,8 @@ type NFPacket struct {
 	Xbuffer     *C.uchar
 	QueueHandle *C.struct_nfq_q_handle
 	ID          int
+	// Mark is the netfilter mark of the packet
+	Mark int
 }
 
 //NFQueue implements the queue and holds all related state information
@@ -231,7 +233,7 @@ func (nfq *NFQueue) run() {
 }
 
 //export processPacket
-func processPacket(packetID C.int, data *C.uchar, len C.int, newData *C.uchar, idx uint32) verdictType {
+func processPacket(packetID C.int, data *C.uchar, len C.int, newData *C.uchar, mark C.u_int32_t, idx uint32) verdictType {
 
 	nfq, ok := theTable[idx]
 	if !ok {
@@ -249,6 +251,7 @@ func processPacket(packetID C.int, data *C.uchar, len C.int, newData *C.uchar, i
 		Xbuffer:     newData,
 		ID:          int(packetID),
 		QueueHandle: nfq.qh,
+		Mark:        int(mark),
 	}
 
 	select {
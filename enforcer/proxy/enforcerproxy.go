@@ -4,8 +4,10 @@
 package enforcerproxy
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -46,12 +48,19 @@ type proxyInfo struct {
 	prochdl     ProcessMon.ProcessManager
 	rpchdl      rpcwrapper.RPCClient
 	initDone    map[string]bool
+	initLock    sync.Mutex
 	filterQueue *enforcer.FilterQueue
 }
 
 //InitRemoteEnforcer method makes a RPC call to the remote enforcer
 func (s *proxyInfo) InitRemoteEnforcer(contextID string) error {
 
+	return s.initRemoteEnforcer(context.Background(), contextID)
+}
+
+//initRemoteEnforcer initializes the remote enforcer until the context is done
+func (s *proxyInfo) initRemoteEnforcer(ctx context.Context, contextID string) error {
+
 	resp := &rpcwrapper.Response{}
 	request := &rpcwrapper.Request{
 		Payload: &rpcwrapper.InitRequestPayload{
@@ -66,14 +75,16 @@ func (s *proxyInfo) InitRemoteEnforcer(contextID string) error {
 		},
 	}
 
-	if err := s.rpchdl.RemoteCall(contextID, "Server.InitEnforcer", request, resp); err != nil {
+	if err := s.rpchdl.RemoteCallWithContext(ctx, contextID, "Server.InitEnforcer", request, resp); err != nil {
 		log.WithFields(log.Fields{
 			"package": "enforcerproxy",
 		}).Debug("Failed to initialize enforcer")
 		return fmt.Errorf("Failed ot initialize remote enforcer")
 	}
 
+	s.initLock.Lock()
 	s.initDone[contextID] = true
+	s.initLock.Unlock()
 
 	return nil
 }
@@ -81,6 +92,13 @@ func (s *proxyInfo) InitRemoteEnforcer(contextID string) error {
 //Enforcer: Enforce method makes a RPC call for the remote enforcer enforce emthod
 func (s *proxyInfo) Enforce(contextID string, puInfo *policy.PUInfo) error {
 
+	return s.EnforceWithContext(context.Background(), contextID, puInfo)
+}
+
+//EnforceWithContext is Enforce giving up when the context is done. The calls
+//to a remote enforcer that does not answer are abandoned.
+func (s *proxyInfo) EnforceWithContext(ctx context.Context, contextID string, puInfo *policy.PUInfo) error {
+
 	log.WithFields(log.Fields{
 		"package": "enforcerproxy",
 		"pid":     puInfo.Runtime.Pid(),
@@ -96,8 +114,12 @@ func (s *proxyInfo) Enforce(contextID string, puInfo *policy.PUInfo) error {
 		"Lauch Process": err,
 	}).Info("Called enforce and launched process")
 
-	if _, ok := s.initDone[contextID]; !ok {
-		if err = s.InitRemoteEnforcer(contextID); err != nil {
+	s.initLock.Lock()
+	_, ok := s.initDone[contextID]
+	s.initLock.Unlock()
+
+	if !ok {
+		if err = s.initRemoteEnforcer(ctx, contextID); err != nil {
 			return err
 		}
 
@@ -118,12 +140,12 @@ func (s *proxyInfo) Enforce(contextID string, puInfo *policy.PUInfo) error {
 		},
 	}
 
-	err = s.rpchdl.RemoteCall(contextID, "Server.Enforce", request, &rpcwrapper.Response{})
+	err = s.rpchdl.RemoteCallWithContext(ctx, contextID, "Server.Enforce", request, &rpcwrapper.Response{})
 	if err != nil {
 		log.WithFields(log.Fields{
 			"package": "remenforcer",
 			"error":   err,
-		}).Fatal("Failed to Enforce remote enforcer")
+		}).Error("Failed to Enforce remote enforcer")
 		return ErrEnforceFailed
 	}
 
@@ -133,22 +155,30 @@ func (s *proxyInfo) Enforce(contextID string, puInfo *policy.PUInfo) error {
 // Unenforce stops enforcing policy for the given contexID.
 func (s *proxyInfo) Unenforce(contextID string) error {
 
+	return s.UnenforceWithContext(context.Background(), contextID)
+}
+
+// UnenforceWithContext is Unenforce giving up when the context is done.
+func (s *proxyInfo) UnenforceWithContext(ctx context.Context, contextID string) error {
+
 	request := &rpcwrapper.Request{
 		Payload: &rpcwrapper.UnEnforcePayload{
 			ContextID: contextID,
 		},
 	}
 
-	err := s.rpchdl.RemoteCall(contextID, "Server.Unenforce", request, &rpcwrapper.Response{})
+	err := s.rpchdl.RemoteCallWithContext(ctx, contextID, "Server.Unenforce", request, &rpcwrapper.Response{})
 	if err != nil {
 		log.WithFields(log.Fields{
 			"package": "remenforcer",
 			"error":   err,
-		}).Fatal("Failed to Enforce remote enforcer")
+		}).Error("Failed to Unenforce remote enforcer")
 		return ErrEnforceFailed
 	}
 
+	s.initLock.Lock()
 	delete(s.initDone, contextID)
+	s.initLock.Unlock()
 
 	if s.prochdl.GetExitStatus(contextID) == false {
 		s.prochdl.SetExitStatus(contextID, true)
@@ -210,7 +240,13 @@ func NewProxyEnforcer(mutualAuth bool,
 		"method":  "NewDataPathEnforcer",
 	}).Info("Called NewDataPathEnforcer")
 
-	statsServer := rpcwrapper.NewRPCWrapper()
+	// The stats reports are authenticated with the secrets of the remote
+	// enforcers when they share the RPC handle. Otherwise they are rejected
+	// since their senders are unknown.
+	var statsServer rpcwrapper.RPCServer = rpcwrapper.NewRPCWrapper()
+	if server, ok := rpchdl.(rpcwrapper.RPCServer); ok {
+		statsServer = server
+	}
 	rpcServer := &StatsServer{rpchdl: statsServer, collector: collector}
 
 	// Start hte server for statistics collection
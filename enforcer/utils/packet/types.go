@@ -103,6 +103,8 @@ func tcpFlagsToStr(flags uint8) string {
 type Packet struct {
 	// Metadata
 	context uint64
+	// Mark is the netfilter mark of the packet when it was queued
+	Mark string
 
 	// Buffers : input/output buffer
 	Buffer     []byte
@@ -1,9 +1,12 @@
 package rpcwrapper
 
+import "context"
+
 type RPCClient interface {
-	NewRPCClient(contextID string, channel string) error
+	NewRPCClient(contextID string, channel string, secret string) error
 	GetRPCClient(contextID string) (*RPCHdl, error)
 	RemoteCall(contextID string, methodName string, req *Request, resp *Response) error
+	RemoteCallWithContext(ctx context.Context, contextID string, methodName string, req *Request, resp *Response) error
 	DestroyRPCClient(contextID string)
 }
 
@@ -0,0 +1,154 @@
+package rpcwrapper
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+)
+
+const (
+	// ProtocolV1 is the protocol of the remote enforcers that do not negotiate
+	// a version. Its messages are authenticated with a key shared by all the
+	// remote enforcers.
+	ProtocolV1 = 1
+
+	// ProtocolV2 authenticates the encoded payload of each message with the
+	// secret given to the remote enforcer when it is launched
+	ProtocolV2 = 2
+
+	// ProtocolVersion is the latest version of the protocol
+	ProtocolVersion = ProtocolV2
+
+	// EnvSecret is the environment variable giving its secret to a remote enforcer
+	EnvSecret = "ENFORCER_SECRET"
+
+	// protocolService is the name of the RPC service negotiating the version
+	protocolService = "Protocol"
+
+	secretSize = 32
+)
+
+//NegotiateRequest is sent by a client when it connects with the latest version
+//it supports
+type NegotiateRequest struct {
+	MaxVersion int
+}
+
+//NegotiateResponse is the version used on the connection
+type NegotiateResponse struct {
+	Version int
+}
+
+//Protocol is the RPC service negotiating the version of the protocol
+type Protocol struct{}
+
+//Negotiate returns the latest version supported by both ends
+func (p *Protocol) Negotiate(req NegotiateRequest, resp *NegotiateResponse) error {
+
+	resp.Version = req.MaxVersion
+	if resp.Version > ProtocolVersion {
+		resp.Version = ProtocolVersion
+	}
+
+	if resp.Version < ProtocolV1 {
+		return fmt.Errorf("Unsupported protocol version %d", req.MaxVersion)
+	}
+
+	return nil
+}
+
+//NewSecret returns a random secret for a remote enforcer
+func NewSecret() (string, error) {
+
+	secret := make([]byte, secretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("Cannot generate secret: %s", err)
+	}
+
+	return hex.EncodeToString(secret), nil
+}
+
+//envelope holds the payload of a request so that its concrete type is encoded
+type envelope struct {
+	Payload interface{}
+}
+
+//sign returns the request sent on the wire for a version of the protocol
+func sign(version int, secret []byte, req *Request) (*Request, error) {
+
+	if version < ProtocolV2 {
+		signed := *req
+		signed.Version = 0
+		signed.Data = nil
+		signed.HashAuth = legacyHash(req)
+		return &signed, nil
+	}
+
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(&envelope{Payload: req.Payload}); err != nil {
+		return nil, fmt.Errorf("Cannot encode payload: %s", err)
+	}
+
+	signed := &Request{
+		MethodIdentifier: req.MethodIdentifier,
+		Version:          version,
+		ContextID:        req.ContextID,
+		Data:             data.Bytes(),
+	}
+	signed.HashAuth = messageHash(secret, signed)
+
+	return signed, nil
+}
+
+//verify checks the authentication of a request of the version 2 and decodes
+//its payload
+func verify(secret []byte, req *Request) bool {
+
+	if len(secret) == 0 || !hmac.Equal(req.HashAuth, messageHash(secret, req)) {
+		return false
+	}
+
+	var e envelope
+	if err := gob.NewDecoder(bytes.NewReader(req.Data)).Decode(&e); err != nil {
+		return false
+	}
+
+	req.Payload = e.Payload
+
+	return true
+}
+
+//messageHash authenticates the version, the sender and the encoded payload of
+//a request
+func messageHash(secret []byte, req *Request) []byte {
+
+	digest := hmac.New(sha256.New, secret)
+	digest.Write([]byte(strconv.Itoa(req.Version) + "\x00" + strconv.Itoa(req.MethodIdentifier) + "\x00" + req.ContextID + "\x00"))
+	digest.Write(req.Data)
+
+	return digest.Sum(nil)
+}
+
+//verifyLegacy checks the authentication of a request of the version 1
+func verifyLegacy(req *Request) bool {
+
+	return hmac.Equal(req.HashAuth, legacyHash(req))
+}
+
+//legacyHash is the authentication of the version 1. It is kept for the remote
+//enforcers that were launched before the upgrade of the agent.
+func legacyHash(req *Request) []byte {
+
+	var rpcBuf bytes.Buffer
+	binary.Write(&rpcBuf, binary.BigEndian, req.Payload)
+	digest := hmac.New(sha256.New, sharedKey())
+	digest.Write(rpcBuf.Bytes())
+
+	return digest.Sum(nil)
+}
@@ -0,0 +1,231 @@
+package rpcwrapper
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/rpc"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNegotiate(t *testing.T) {
+
+	Convey("Given the protocol service", t, func() {
+		p := &Protocol{}
+		resp := &NegotiateResponse{}
+
+		Convey("When a client supports a later version, the latest version of the server should be used", func() {
+			So(p.Negotiate(NegotiateRequest{MaxVersion: ProtocolVersion + 1}, resp), ShouldBeNil)
+			So(resp.Version, ShouldEqual, ProtocolVersion)
+		})
+
+		Convey("When a client supports an earlier version, the version of the client should be used", func() {
+			So(p.Negotiate(NegotiateRequest{MaxVersion: ProtocolV1}, resp), ShouldBeNil)
+			So(resp.Version, ShouldEqual, ProtocolV1)
+		})
+	})
+}
+
+// failingProtocol is a protocol service that cannot negotiate
+type failingProtocol struct{}
+
+func (p *failingProtocol) Negotiate(req NegotiateRequest, resp *NegotiateResponse) error {
+	return fmt.Errorf("Busy")
+}
+
+// otherService is a service of a server without the protocol service
+type otherService struct{}
+
+func (s *otherService) Call(req Request, resp *Response) error {
+	return nil
+}
+
+// testClient returns a client of a server serving the service
+func testClient(name string, service interface{}) *rpc.Client {
+
+	server := rpc.NewServer()
+	server.RegisterName(name, service)
+
+	clientConn, serverConn := net.Pipe()
+	go server.ServeConn(serverConn)
+
+	return rpc.NewClient(clientConn)
+}
+
+func TestNegotiateClient(t *testing.T) {
+
+	Convey("Given a server with the protocol service", t, func() {
+		client := testClient(protocolService, &Protocol{})
+		defer client.Close()
+
+		Convey("The latest version should be negotiated", func() {
+			version, err := negotiate(client)
+			So(err, ShouldBeNil)
+			So(version, ShouldEqual, ProtocolVersion)
+		})
+	})
+
+	Convey("Given a server without the protocol service", t, func() {
+		client := testClient("Server", &otherService{})
+		defer client.Close()
+
+		Convey("The version 1 should be used", func() {
+			version, err := negotiate(client)
+			So(err, ShouldBeNil)
+			So(version, ShouldEqual, ProtocolV1)
+		})
+	})
+
+	Convey("Given a server that fails to negotiate", t, func() {
+		client := testClient(protocolService, &failingProtocol{})
+		defer client.Close()
+
+		Convey("The error should be returned instead of falling back to the version 1", func() {
+			_, err := negotiate(client)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given a closed connection", t, func() {
+		client := testClient(protocolService, &Protocol{})
+		client.Close()
+
+		Convey("The error should be returned instead of falling back to the version 1", func() {
+			_, err := negotiate(client)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestCheckValidity(t *testing.T) {
+
+	RegisterTypes()
+
+	Convey("Given a server with a secret", t, func() {
+		secret, err := NewSecret()
+		So(err, ShouldBeNil)
+		key, _ := hex.DecodeString(secret)
+
+		server, err := NewRPCServer(secret)
+		So(err, ShouldBeNil)
+
+		req := &Request{
+			ContextID: "pu1",
+			Payload:   UnEnforcePayload{ContextID: "pu1"},
+		}
+
+		Convey("When a request is signed with the secret, its payload should be decoded", func() {
+			signed, err := sign(ProtocolV2, key, req)
+			So(err, ShouldBeNil)
+			So(signed.Payload, ShouldBeNil)
+			So(server.ProcessMessage(signed), ShouldBeTrue)
+			So(signed.Payload, ShouldResemble, UnEnforcePayload{ContextID: "pu1"})
+		})
+
+		Convey("When a signed request is modified, it should be rejected", func() {
+			signed, err := sign(ProtocolV2, key, req)
+			So(err, ShouldBeNil)
+			signed.ContextID = "pu2"
+			So(server.ProcessMessage(signed), ShouldBeFalse)
+		})
+
+		Convey("When a request is signed with another secret, it should be rejected", func() {
+			other, _ := NewSecret()
+			otherKey, _ := hex.DecodeString(other)
+			signed, err := sign(ProtocolV2, otherKey, req)
+			So(err, ShouldBeNil)
+			So(server.ProcessMessage(signed), ShouldBeFalse)
+		})
+
+		Convey("When a request of the version 1 is received, it should be rejected", func() {
+			signed, err := sign(ProtocolV1, key, req)
+			So(err, ShouldBeNil)
+			So(server.ProcessMessage(signed), ShouldBeFalse)
+		})
+	})
+
+	Convey("Given a server without a secret", t, func() {
+		server, err := NewRPCServer("")
+		So(err, ShouldBeNil)
+
+		req := &Request{Payload: UnEnforcePayload{ContextID: "pu1"}}
+
+		Convey("When a request of the version 1 is received, it should be accepted", func() {
+			signed, err := sign(ProtocolV1, nil, req)
+			So(err, ShouldBeNil)
+			So(server.ProcessMessage(signed), ShouldBeTrue)
+		})
+
+		Convey("When a request of the version 2 is received, it should be rejected", func() {
+			signed, err := sign(ProtocolV2, []byte("key"), req)
+			So(err, ShouldBeNil)
+			So(server.ProcessMessage(signed), ShouldBeFalse)
+		})
+	})
+
+	Convey("Given a wrapper of clients receiving the stats of the enforcers", t, func() {
+		secret, _ := NewSecret()
+		key, _ := hex.DecodeString(secret)
+
+		w := NewRPCWrapper()
+		w.rpcClientMap.Add("pu1", &RPCHdl{Secret: key, Version: ProtocolV2})
+		w.rpcClientMap.Add("pu2", &RPCHdl{Version: ProtocolV1})
+
+		stats := func(contextID string) *Request {
+			return &Request{ContextID: contextID, Payload: StatsPayload{NumFlows: 1}}
+		}
+
+		Convey("When an enforcer sends stats signed with its secret, they should be accepted", func() {
+			signed, err := sign(ProtocolV2, key, stats("pu1"))
+			So(err, ShouldBeNil)
+			So(w.ProcessMessage(signed), ShouldBeTrue)
+			So(signed.Payload, ShouldResemble, StatsPayload{NumFlows: 1})
+		})
+
+		Convey("When stats are signed for another context, they should be rejected", func() {
+			signed, err := sign(ProtocolV2, key, stats("pu2"))
+			So(err, ShouldBeNil)
+			So(w.ProcessMessage(signed), ShouldBeFalse)
+		})
+
+		Convey("When stats of the version 1 come from an enforcer the wrapper is not connected to, they should be accepted", func() {
+			for _, contextID := range []string{"", "unknown"} {
+				signed, err := sign(ProtocolV1, nil, stats(contextID))
+				So(err, ShouldBeNil)
+				So(w.ProcessMessage(signed), ShouldBeTrue)
+			}
+		})
+
+		Convey("When stats of the version 1 from an unknown context are not authenticated, they should be rejected", func() {
+			signed, err := sign(ProtocolV1, nil, stats("unknown"))
+			So(err, ShouldBeNil)
+			signed.HashAuth = []byte("invalid")
+			So(w.ProcessMessage(signed), ShouldBeFalse)
+		})
+
+		Convey("When stats of the version 2 claim an unknown context, they should be rejected", func() {
+			signed, err := sign(ProtocolV2, key, stats("unknown"))
+			So(err, ShouldBeNil)
+			So(w.ProcessMessage(signed), ShouldBeFalse)
+		})
+
+		Convey("When stats of the version 1 claim a context of the version 2, they should be rejected", func() {
+			signed, err := sign(ProtocolV1, nil, stats("pu1"))
+			So(err, ShouldBeNil)
+			So(w.ProcessMessage(signed), ShouldBeFalse)
+		})
+
+		Convey("When stats of the version 1 come from a context of the version 1, they should be accepted", func() {
+			signed, err := sign(ProtocolV1, nil, stats("pu2"))
+			So(err, ShouldBeNil)
+			So(w.ProcessMessage(signed), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given an invalid secret, the server should not be created", t, func() {
+		_, err := NewRPCServer("not hex")
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -1,18 +1,19 @@
 package rpcwrapper
 
 import (
-	"bytes"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/binary"
+	"context"
 	"encoding/gob"
+	"encoding/hex"
+	"fmt"
 	"net"
 	"net/http"
 	"net/rpc"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/aporeto-inc/trireme/cache"
 )
 
@@ -20,11 +21,21 @@ import (
 type RPCHdl struct {
 	Client  *rpc.Client
 	Channel string
+
+	// Secret authenticates the messages of the version 2
+	Secret []byte
+
+	// Version is the version of the protocol negotiated with the server
+	Version int
 }
 
 //RPCWrapper  is a struct which holds stats for all rpc sesions
 type RPCWrapper struct {
 	rpcClientMap *cache.Cache
+
+	// secret authenticates the requests received by a server. The servers
+	// without secret accept the version 1.
+	secret []byte
 }
 
 //NewRPCWrapper creates a new rpcwrapper
@@ -37,32 +48,91 @@ func NewRPCWrapper() *RPCWrapper {
 
 const (
 	maxRetries = 100
+
+	// DefaultRPCTimeout is the time given to a remote call without deadline
+	DefaultRPCTimeout = 30 * time.Second
 )
 
 //NewRPCClient exported
 //Will worry about locking later ... there is a small case where two callers
 //call NewRPCClient from a different thread
-func (r *RPCWrapper) NewRPCClient(contextID string, channel string) error {
+//The version of the protocol is negotiated with the server when a secret is
+//given. The servers that do not know the negotiation are spoken to with the
+//version 1. The connection is retried when the negotiation fails.
+func (r *RPCWrapper) NewRPCClient(contextID string, channel string, secret string) error {
+
+	key, err := hex.DecodeString(secret)
+	if err != nil {
+		return fmt.Errorf("Invalid secret for %s: %s", contextID, err)
+	}
 
 	//establish new connection to context/container
 	RegisterTypes()
 	numRetries := 0
-	client, err := rpc.DialHTTP("unix", channel)
+	client, version, err := dial(channel, len(key) > 0)
 
 	for err != nil {
 		time.Sleep(5 * time.Millisecond)
 
 		numRetries = numRetries + 1
 		if numRetries < maxRetries {
-			client, err = rpc.DialHTTP("unix", channel)
+			client, version, err = dial(channel, len(key) > 0)
 		} else {
 			return err
 		}
 	}
-	return r.rpcClientMap.Add(contextID, &RPCHdl{Client: client, Channel: channel})
+
+	log.WithFields(log.Fields{
+		"package":   "rpcwrapper",
+		"contextID": contextID,
+		"version":   version,
+	}).Debug("Protocol negotiated")
+
+	return r.rpcClientMap.Add(contextID, &RPCHdl{Client: client, Channel: channel, Secret: key, Version: version})
 
 }
 
+//dial connects to the server on the channel and negotiates the version of the
+//protocol if required. The connection is closed if the negotiation fails.
+func dial(channel string, negotiated bool) (*rpc.Client, int, error) {
+
+	client, err := rpc.DialHTTP("unix", channel)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if !negotiated {
+		return client, ProtocolV1, nil
+	}
+
+	version, err := negotiate(client)
+	if err != nil {
+		client.Close()
+		return nil, 0, err
+	}
+
+	return client, version, nil
+}
+
+//negotiate returns the version of the protocol supported by the server. The
+//servers without the protocol service only support the version 1. The other
+//errors are returned so that the negotiation is retried.
+func negotiate(client *rpc.Client) (int, error) {
+
+	resp := &NegotiateResponse{}
+	err := client.Call(protocolService+".Negotiate", &NegotiateRequest{MaxVersion: ProtocolVersion}, resp)
+	if err == nil {
+		return resp.Version, nil
+	}
+
+	// The errors of net/rpc for an unknown service or method
+	if serverErr, ok := err.(rpc.ServerError); ok && strings.HasPrefix(string(serverErr), "rpc: can't find ") {
+		return ProtocolV1, nil
+	}
+
+	return 0, fmt.Errorf("Cannot negotiate the protocol: %s", err)
+}
+
 //GetRPCClient gets a handle to the rpc client for the contextID( enforcer in the container)
 func (r *RPCWrapper) GetRPCClient(contextID string) (*RPCHdl, error) {
 
@@ -79,36 +149,91 @@ func sharedKey() []byte {
 	return sharedKey
 }
 
-//RemoteCall is a wrapper around rpc.Call and also ensure message integrity by adding a hmac
+//RemoteCall is a wrapper around rpc.Call and also ensure message integrity by adding a hmac.
+//It gives up after DefaultRPCTimeout.
 func (r *RPCWrapper) RemoteCall(contextID string, methodName string, req *Request, resp *Response) error {
 
-	var rpcBuf bytes.Buffer
-	binary.Write(&rpcBuf, binary.BigEndian, req.Payload)
-	digest := hmac.New(sha256.New, sharedKey())
-	digest.Write(rpcBuf.Bytes())
-	req.HashAuth = digest.Sum(nil)
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultRPCTimeout)
+	defer cancel()
+
+	return r.RemoteCallWithContext(ctx, contextID, methodName, req, resp)
+}
+
+//RemoteCallWithContext is RemoteCall giving up when the context is done. The
+//response must not be used when an error is returned.
+func (r *RPCWrapper) RemoteCallWithContext(ctx context.Context, contextID string, methodName string, req *Request, resp *Response) error {
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultRPCTimeout)
+		defer cancel()
+	}
+
 	rpcClient, err := r.GetRPCClient(contextID)
 	if err != nil {
 		return err
 	}
-	return rpcClient.Client.Call(methodName, req, resp)
+
+	if req.ContextID == "" {
+		req.ContextID = contextID
+	}
+
+	signed, err := sign(rpcClient.Version, rpcClient.Secret, req)
+	if err != nil {
+		return err
+	}
+
+	call := rpcClient.Client.Go(methodName, signed, resp, make(chan *rpc.Call, 1))
+
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		return fmt.Errorf("Remote call %s to %s abandoned: %s", methodName, contextID, ctx.Err())
+	}
 
 }
 
-//CheckValidity checks if the received message is valid
+//CheckValidity checks if the received message is valid. The payload of a
+//message of the version 2 is decoded once it is authenticated. A server
+//created with NewRPCServer accepts the version 1 only if it was not given a
+//secret. A wrapper of clients only accepts the version 2 from the contexts it
+//is connected to. It accepts the version 1 from the contexts that negotiated
+//it and from the contexts it does not know, since the remote enforcers of the
+//version 1 launched before a restart of the agent are not connected to it and
+//may not give their context.
 func (r *RPCWrapper) CheckValidity(req *Request) bool {
 
-	var rpcBuf bytes.Buffer
-	binary.Write(&rpcBuf, binary.BigEndian, req.Payload)
-	digest := hmac.New(sha256.New, sharedKey())
-	digest.Write(rpcBuf.Bytes())
-	return hmac.Equal(req.HashAuth, digest.Sum(nil))
+	if r.rpcClientMap == nil {
+		if req.Version >= ProtocolV2 {
+			return verify(r.secret, req)
+		}
+
+		return len(r.secret) == 0 && verifyLegacy(req)
+	}
+
+	rpcClient, err := r.GetRPCClient(req.ContextID)
+	if err != nil {
+		return req.Version < ProtocolV2 && verifyLegacy(req)
+	}
+
+	if req.Version >= ProtocolV2 {
+		return verify(rpcClient.Secret, req)
+	}
+
+	return rpcClient.Version == ProtocolV1 && verifyLegacy(req)
 }
 
-//NewRPCServer returns an interface RPCServer
-func NewRPCServer() RPCServer {
+//NewRPCServer returns an interface RPCServer. The requests are authenticated
+//with the secret if it is not empty.
+func NewRPCServer(secret string) (RPCServer, error) {
+
+	key, err := hex.DecodeString(secret)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid secret: %s", err)
+	}
 
-	return &RPCWrapper{}
+	return &RPCWrapper{secret: key}, nil
 }
 
 //StartServer Starts a server and waits for new connections this function never returns
@@ -116,6 +241,8 @@ func (r *RPCWrapper) StartServer(protocol string, path string, handler interface
 
 	RegisterTypes()
 	rpc.Register(handler)
+	// Only the first server of the process registers the protocol service
+	rpc.RegisterName(protocolService, &Protocol{})
 	rpc.HandleHTTP()
 	os.Remove(path)
 	if len(path) == 0 {
@@ -169,5 +296,6 @@ func RegisterTypes() {
 
 	gob.RegisterName("github.com/aporeto-inc/enforcer/utils/rpcwrapper.Supervise_Request_Payload", *(&SuperviseRequestPayload{}))
 	gob.RegisterName("github.com/aporeto-inc/enforcer/utils/rpcwrapper.UnSupervise_Payload", *(&UnSupervisePayload{}))
+	gob.RegisterName("github.com/aporeto-inc/enforcer/utils/rpcwrapper.Exclude_IP_Payload", *(&ExcludeIPPayload{}))
 	gob.RegisterName("github.com/aporeto-inc/enforcer/utils/rpcwrapper.Stats_Payload", *(&StatsPayload{}))
 }
@@ -1,6 +1,7 @@
 package rpcwrapper
 
 import (
+	"context"
 	"net/rpc"
 	"sync"
 	"testing"
@@ -12,7 +13,7 @@ type MockRPCHdl struct {
 }
 
 type mockedMethods struct {
-	NewRPCClientMock     func(contextID string, channel string) error
+	NewRPCClientMock     func(contextID string, channel string, secret string) error
 	GetRPCClientMock     func(contextID string) (*RPCHdl, error)
 	RemoteCallMock       func(contextID string, methodName string, req *Request, resp *Response) error
 	DestroyRPCClientMock func(contextID string)
@@ -22,7 +23,7 @@ type mockedMethods struct {
 
 type TestRPCClient interface {
 	RPCClient
-	MockNewRPCClient(t *testing.T, impl func(contextID string, channel string) error)
+	MockNewRPCClient(t *testing.T, impl func(contextID string, channel string, secret string) error)
 	MockGetRPCClient(t *testing.T, impl func(contextID string) (*RPCHdl, error))
 	MockRemoteCall(t *testing.T, impl func(contextID string, methodName string, req *Request, resp *Response) error)
 	MockDestroyRPCClient(t *testing.T, impl func(contextID string))
@@ -53,7 +54,7 @@ func NewTestRPCClient() TestRPCClient {
 		mocks: map[*testing.T]*mockedMethods{},
 	}
 }
-func (m *testRPC) MockNewRPCClient(t *testing.T, impl func(contextID string, channel string) error) {
+func (m *testRPC) MockNewRPCClient(t *testing.T, impl func(contextID string, channel string, secret string) error) {
 	m.currentMocks(t).NewRPCClientMock = impl
 }
 
@@ -78,9 +79,9 @@ func (m *testRPC) MockProcessMessage(t *testing.T, impl func(req *Request) bool)
 	m.currentMocks(t).ProcessMessageMock = impl
 }
 
-func (m *testRPC) NewRPCClient(contextID string, channel string) error {
+func (m *testRPC) NewRPCClient(contextID string, channel string, secret string) error {
 	if mock := m.currentMocks(m.currentTest); mock != nil && mock.NewRPCClientMock != nil {
-		return mock.NewRPCClientMock(contextID, channel)
+		return mock.NewRPCClientMock(contextID, channel, secret)
 
 	}
 	return nil
@@ -97,6 +98,12 @@ func (m *testRPC) RemoteCall(contextID string, methodName string, req *Request,
 	}
 	return nil
 }
+func (m *testRPC) RemoteCallWithContext(ctx context.Context, contextID string, methodName string, req *Request, resp *Response) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.RemoteCall(contextID, methodName, req, resp)
+}
 func (m *testRPC) DestroyRPCClient(contextID string) {
 	if mock := m.currentMocks(m.currentTest); mock != nil && mock.DestroyRPCClientMock != nil {
 		mock.DestroyRPCClientMock(contextID)
@@ -27,7 +27,7 @@ func TestNewRPCClient(t *testing.T) {
 		t.Errorf("RPCClient blocked and does not return")
 
 	}
-	err := rpchdl.NewRPCClient("12345", defaultchannel)
+	err := rpchdl.NewRPCClient("12345", defaultchannel, "")
 	if err == nil {
 		t.Errorf("No error returned when there is not server")
 	}
@@ -16,6 +16,7 @@ var gobTypes = []interface{}{
 	UnEnforcePayload{},
 	SuperviseRequestPayload{},
 	UnSupervisePayload{},
+	ExcludeIPPayload{},
 }
 
 // CaptureType identifies the type of iptables implementation that should be used
@@ -33,6 +34,17 @@ type Request struct {
 	MethodIdentifier int
 	HashAuth         []byte
 	Payload          interface{}
+
+	// Version is the version of the protocol of the request. It is not set
+	// for the version 1.
+	Version int
+
+	// ContextID is the PU of the remote enforcer sending the request. It
+	// selects the secret of its stats reports.
+	ContextID string
+
+	// Data is the encoded payload of the version 2
+	Data []byte
 }
 
 //exported
@@ -63,6 +75,7 @@ type InitRequestPayload struct {
 type InitSupervisorPayload struct {
 	CaptureMethod  CaptureType
 	TargetNetworks []string
+	ExcludedIPs    []*policy.ExcludedIP
 }
 
 // EnforcePayload exported
@@ -105,6 +118,11 @@ type UnSupervisePayload struct {
 	ContextID string
 }
 
+//ExcludeIPPayload exported
+type ExcludeIPPayload struct {
+	Exclusion *policy.ExcludedIP
+}
+
 //InitResponsePayload exported
 type InitResponsePayload struct {
 	Status int
@@ -1,7 +1,6 @@
 package common
 
 import (
-	"context"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
@@ -9,6 +8,7 @@ import (
 	"github.com/aporeto-inc/trireme"
 	"github.com/aporeto-inc/trireme/configurator"
 	"github.com/aporeto-inc/trireme/monitor"
+	"github.com/aporeto-inc/trireme/monitor/extractor"
 	"github.com/aporeto-inc/trireme/policy"
 	"github.com/aporeto-inc/trireme/supervisor"
 	"github.com/docker/docker/api/types"
@@ -190,37 +190,10 @@ func SwarmExtractor(info *types.ContainerJSON) (*policy.PURuntime, error) {
 		return nil, fmt.Errorf("Error creating Docker Client %s", err)
 	}
 
-	// Get the labels from Docker. If it is a swarm service, get the labels from
-	// the service definition instead.
-	dockerLabels := info.Config.Labels
-	if _, ok := info.Config.Labels["com.docker.swarm.service.id"]; ok {
-
-		serviceID := info.Config.Labels["com.docker.swarm.service.id"]
-
-		service, _, err := cli.ServiceInspectWithRaw(context.Background(), serviceID)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"Package": "main",
-				"error":   err.Error(),
-			}).Debug("Failed get swarm labels")
-			return nil, fmt.Errorf("Error creating Docker Client %s", err)
-		}
-
-		dockerLabels = service.Spec.Labels
-	}
-
-	// Create the tags based on the docker labels
-	tags := policy.NewTagsMap(map[string]string{
-		"image": info.Config.Image,
-		"name":  info.Name,
-	})
-	for k, v := range dockerLabels {
-		tags.Add(k, v)
-	}
-
-	ipa := policy.NewIPMap(map[string]string{
-		"bridge": info.NetworkSettings.IPAddress,
-	})
-
-	return policy.NewPURuntime(info.Name, info.State.Pid, tags, ipa), nil
+	// The labels of the swarm service take precedence over the labels of the
+	// container.
+	return extractor.NewChainExtractor(
+		extractor.Link{Extractor: monitor.DefaultDockerMetadataExtractor},
+		extractor.Link{Extractor: extractor.NewSwarmServiceExtractor(cli)},
+	)(info)
 }
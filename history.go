@@ -0,0 +1,158 @@
+package trireme
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aporeto-inc/trireme/policy"
+)
+
+// PolicySource is what applied a version of the policy of a PU
+type PolicySource string
+
+const (
+	// PolicySourceResolver is a policy resolved by the PolicyResolver
+	PolicySourceResolver PolicySource = "resolver"
+
+	// PolicySourceUpdate is a policy given with UpdatePolicy or UpdatePolicies
+	PolicySourceUpdate PolicySource = "update"
+
+	// PolicySourceFallback is the fallback policy of a PU whose resolution is
+	// retried
+	PolicySourceFallback PolicySource = "fallback"
+
+	// PolicySourceRollback is a policy restored by RollbackPolicy
+	PolicySourceRollback PolicySource = "rollback"
+)
+
+// DefaultPolicyHistory is the default number of policies kept for each PU
+const DefaultPolicyHistory = 10
+
+// A PolicyRecord is a version of the policy of a PU in its history
+type PolicyRecord struct {
+	// Version is the version of the policy in the status of the PU
+	Version int
+
+	// VersionID and Hash are given by the policy implementation
+	VersionID string
+	Hash      string
+
+	AppliedBy PolicySource
+	AppliedAt time.Time
+
+	// RollbackOf is the version restored by a rollback
+	RollbackOf int
+
+	Policy *policy.PUPolicy
+}
+
+// SetPolicyHistory sets the number of policies kept in the history of each PU
+func (t *trireme) SetPolicyHistory(size int) {
+
+	if size <= 0 {
+		size = DefaultPolicyHistory
+	}
+
+	t.historySize = size
+}
+
+// PolicyHistory returns a copy of the history of the policies of a PU
+func (t *trireme) PolicyHistory(contextID string) ([]*PolicyRecord, error) {
+
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+
+	if _, ok := t.status[contextID]; !ok {
+		return nil, fmt.Errorf("Unknown PU %s", contextID)
+	}
+
+	history := []*PolicyRecord{}
+	for _, r := range t.history[contextID] {
+		record := *r
+		record.Policy = r.Policy.Clone()
+		history = append(history, &record)
+	}
+
+	return history, nil
+}
+
+// RollbackPolicy enforces again a version of the policy of a PU
+func (t *trireme) RollbackPolicy(contextID string, version int) <-chan error {
+
+	c := make(chan error, 1)
+
+	req := &triremeRequest{
+		contextID:  contextID,
+		reqType:    policyRollback,
+		version:    version,
+		returnChan: c,
+	}
+
+	t.submit(req)
+
+	return c
+}
+
+// doRollbackPolicy enforces again a version of the policy of a PU from its
+// history
+func (t *trireme) doRollbackPolicy(ctx context.Context, contextID string, version int) error {
+
+	record, ok := t.policyRecord(contextID, version)
+	if !ok {
+		return fmt.Errorf("Version %d of the policy of PU %s is not in its history", version, contextID)
+	}
+
+	state, err := t.updatableState(contextID)
+	if err != nil {
+		return err
+	}
+
+	err = t.updatePolicy(ctx, contextID, record.Policy.Clone(), PolicySourceRollback)
+	if err == nil {
+		t.setRollbackOf(contextID, version)
+	}
+
+	t.policyUpdated(contextID, state, err)
+
+	return err
+}
+
+// recordPolicy adds a policy to the history of a PU. It must be called with the
+// state lock held.
+func (t *trireme) recordPolicy(contextID string, record *PolicyRecord) {
+
+	history := append(t.history[contextID], record)
+
+	if len(history) > t.historySize {
+		history = append([]*PolicyRecord(nil), history[len(history)-t.historySize:]...)
+	}
+
+	t.history[contextID] = history
+}
+
+// policyRecord returns a version of the policy of a PU from its history
+func (t *trireme) policyRecord(contextID string, version int) (*PolicyRecord, bool) {
+
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+
+	for _, r := range t.history[contextID] {
+		if r.Version == version {
+			return r, true
+		}
+	}
+
+	return nil, false
+}
+
+// setRollbackOf records the version restored by the last policy of a PU
+func (t *trireme) setRollbackOf(contextID string, version int) {
+
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+
+	if history := t.history[contextID]; len(history) > 0 {
+		history[len(history)-1].RollbackOf = version
+	}
+}
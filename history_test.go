@@ -0,0 +1,72 @@
+package trireme
+
+import (
+	"testing"
+
+	"github.com/aporeto-inc/trireme/monitor"
+	"github.com/aporeto-inc/trireme/policy"
+)
+
+func TestPolicyHistory(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, tmonitor := createMocks()
+	trireme := NewTrireme("serverID", tresolver, tsupervisor, tenforcer)
+	trireme.SetPolicyHistory(2)
+	trireme.Start()
+	defer trireme.Stop()
+
+	contextID := "123123"
+	doTestCreate(t, trireme, tresolver, tsupervisor, tenforcer, tmonitor, contextID, policy.NewPURuntimeWithDefaults())
+
+	var enforced *policy.PUPolicy
+	tenforcer.MockEnforce(t, func(contextID string, puInfo *policy.PUInfo) error {
+		enforced = puInfo.Policy
+		return nil
+	})
+
+	p, _ := trireme.PUPolicy(contextID)
+	for _, versionID := range []string{"v2", "v3"} {
+		p.VersionID = versionID
+		p.Hash = "hash-" + versionID
+		if err := <-trireme.UpdatePolicy(contextID, p); err != nil {
+			t.Fatalf("Update was supposed to be nil, was %s", err)
+		}
+	}
+
+	history, err := trireme.PolicyHistory(contextID)
+	if err != nil {
+		t.Fatalf("History was supposed to be nil, was %s", err)
+	}
+
+	if len(history) != 2 || history[0].Version != 2 || history[1].Version != 3 {
+		t.Fatalf("Expected the last 2 versions in the history, got %+v", history)
+	}
+
+	if history[0].VersionID != "v2" || history[0].Hash != "hash-v2" || history[0].AppliedBy != PolicySourceUpdate || history[0].AppliedAt.IsZero() {
+		t.Errorf("Version 2 was not recorded, got %+v", history[0])
+	}
+
+	if err := <-trireme.RollbackPolicy(contextID, 1); err == nil {
+		t.Errorf("Rollback to a version that is not in the history was supposed to fail")
+	}
+
+	if err := <-trireme.RollbackPolicy(contextID, 2); err != nil {
+		t.Errorf("Rollback was supposed to be nil, was %s", err)
+	}
+
+	if enforced.VersionID != "v2" {
+		t.Errorf("Expected version 2 to be enforced again, got %s", enforced.VersionID)
+	}
+
+	history, _ = trireme.PolicyHistory(contextID)
+	if last := history[len(history)-1]; last.Version != 4 || last.VersionID != "v2" || last.AppliedBy != PolicySourceRollback || last.RollbackOf != 2 {
+		t.Errorf("Expected the rollback to be recorded as a new version, got %+v", last)
+	}
+
+	expectState(t, trireme, contextID, PUStateEnforced)
+
+	<-trireme.HandlePUEvent(contextID, monitor.EventDestroy)
+
+	if _, err := trireme.PolicyHistory(contextID); err == nil {
+		t.Errorf("A destroyed PU was not supposed to have a history")
+	}
+}
@@ -1,6 +1,10 @@
 package trireme
 
 import (
+	"context"
+	"time"
+
+	"github.com/aporeto-inc/trireme/collector"
 	"github.com/aporeto-inc/trireme/monitor"
 	"github.com/aporeto-inc/trireme/policy"
 )
@@ -11,12 +15,71 @@ type Trireme interface {
 	// PURuntime returns a getter for a specific contextID.
 	PURuntime(contextID string) (policy.RuntimeReader, error)
 
+	// ListPUs returns the status of all the PUs that are not destroyed.
+	ListPUs() []*PUStatus
+
+	// PUStatus returns the state of a PU, the version of its policy and the
+	// last error of its requests.
+	PUStatus(contextID string) (*PUStatus, error)
+
+	// PUPolicy returns a copy of the policy of a PU.
+	PUPolicy(contextID string) (*policy.PUPolicy, error)
+
+	// PolicyHistory returns the last policies applied to a PU, oldest first.
+	PolicyHistory(contextID string) ([]*PolicyRecord, error)
+
+	// RollbackPolicy enforces again a version of the policy of a PU from its
+	// history. The restored policy is recorded as a new version.
+	RollbackPolicy(contextID string, version int) <-chan error
+
+	// SetPolicyHistory sets the number of policies kept in the history of
+	// each PU. It must be called before Start.
+	SetPolicyHistory(size int)
+
+	// Subscribe returns a subscription to the lifecycle events of the PUs
+	// selected by the filter. Up to bufferSize events are buffered for it.
+	Subscribe(filter LifecycleFilter, bufferSize int) *Subscription
+
+	// SubscribeFunc calls the handler with the lifecycle events of the PUs
+	// selected by the filter, in order, until the subscription is canceled.
+	SubscribeFunc(filter LifecycleFilter, handler func(*LifecycleEvent)) *Subscription
+
+	// HandleEnforcerExit reports that the remote enforcer of a PU exited
+	// while it was in use.
+	HandleEnforcerExit(contextID string, status error)
+
 	// Start starts the component.
 	Start() error
 
 	// Stop stops the component.
 	Stop() error
 
+	// SetPauseBehavior sets how paused PUs are handled. The resources of a PU
+	// paused for longer than releaseAfter are released. A zero releaseAfter
+	// keeps them. It must be called before Start.
+	SetPauseBehavior(mode PauseMode, releaseAfter time.Duration)
+
+	// SetResolverRetry sets how the resolution of a policy is retried when the
+	// PolicyResolver fails and the collector of the failures. The PU gets a
+	// fallback policy until its policy is resolved. A nil retry fails the PU
+	// immediately. It must be called before Start.
+	SetResolverRetry(retry *ResolverRetry, eventCollector collector.EventCollector)
+
+	// SetConcurrency sets the number of workers processing the events and the
+	// policy updates of the PUs in parallel and the number of requests queued
+	// for each of them. The requests of a PU are processed in order. It must
+	// be called before Start.
+	SetConcurrency(workers int, queueSize int)
+
+	// HandlePUEventWithContext is HandlePUEvent waiting for the result. The
+	// request is abandoned when the context is done, and the deadline of the
+	// context applies to the resolver, the supervisor and the enforcer.
+	HandlePUEventWithContext(ctx context.Context, contextID string, event monitor.Event) error
+
+	// UpdatePolicyWithContext is UpdatePolicy waiting for the result. The
+	// request is abandoned when the context is done.
+	UpdatePolicyWithContext(ctx context.Context, contextID string, newPolicy *policy.PUPolicy) error
+
 	monitor.ProcessingUnitsHandler
 
 	PolicyUpdater
@@ -27,6 +90,12 @@ type PolicyUpdater interface {
 
 	// UpdatePolicy updates the policy of the isolator for a container.
 	UpdatePolicy(contextID string, newPolicy *policy.PUPolicy) <-chan error
+
+	// UpdatePolicies updates the policies of several PUs at once and returns
+	// the result of each of them. When atomic is set, no policy is updated
+	// unless all of them are valid and the PUs are rolled back to their
+	// previous policy if one of them fails.
+	UpdatePolicies(policies map[string]*policy.PUPolicy, atomic bool) <-chan map[string]error
 }
 
 // A PolicyResolver is responsible of creating the Policies for a specific Processing Unit.
@@ -39,3 +108,12 @@ type PolicyResolver interface {
 	// HandleDeletePU is called when a PU is stopped/killed.
 	HandlePUEvent(contextID string, eventType monitor.Event)
 }
+
+// A ContextPolicyResolver is a PolicyResolver that gives up the resolution of
+// a policy when the context of the request is done.
+type ContextPolicyResolver interface {
+	PolicyResolver
+
+	// ResolvePolicyWithContext is ResolvePolicy with a context.
+	ResolvePolicyWithContext(ctx context.Context, contextID string, RuntimeReader policy.RuntimeReader) (*policy.PUPolicy, error)
+}
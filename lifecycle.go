@@ -0,0 +1,230 @@
+package trireme
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// LifecycleEventType is the type of a lifecycle event of a PU
+type LifecycleEventType string
+
+const (
+	// LifecyclePUEnforced is sent when the policy of a started PU is enforced
+	LifecyclePUEnforced LifecycleEventType = "pu-enforced"
+
+	// LifecyclePolicyUpdated is sent when a new policy is set for a PU
+	LifecyclePolicyUpdated LifecycleEventType = "policy-updated"
+
+	// LifecycleEnforcementFailed is sent when the policy of a PU cannot be
+	// enforced when it starts or when it is updated
+	LifecycleEnforcementFailed LifecycleEventType = "enforcement-failed"
+
+	// LifecyclePURemoved is sent when a PU is destroyed
+	LifecyclePURemoved LifecycleEventType = "pu-removed"
+
+	// LifecycleEnforcerCrashed is sent when the remote enforcer of a PU exits
+	// while it is in use
+	LifecycleEnforcerCrashed LifecycleEventType = "enforcer-crashed"
+)
+
+// DefaultSubscriptionBuffer is the default number of events buffered for a
+// subscription
+const DefaultSubscriptionBuffer = 100
+
+// A LifecycleEvent is a change in the lifecycle of a PU
+type LifecycleEvent struct {
+	Type      LifecycleEventType
+	ContextID string
+
+	// PolicyVersion is the version of the policy of the PU when the event was sent
+	PolicyVersion int
+
+	// Error is set for the failures
+	Error error
+
+	Time time.Time
+}
+
+// A LifecycleFilter selects the lifecycle events of a subscription. Empty
+// fields select all the events.
+type LifecycleFilter struct {
+	ContextIDs []string
+	Types      []LifecycleEventType
+}
+
+// matches returns true if the event is selected by the filter
+func (f *LifecycleFilter) matches(event *LifecycleEvent) bool {
+
+	if len(f.ContextIDs) > 0 {
+		found := false
+		for _, contextID := range f.ContextIDs {
+			found = found || contextID == event.ContextID
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.Types) > 0 {
+		found := false
+		for _, eventType := range f.Types {
+			found = found || eventType == event.Type
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// A Subscription receives the lifecycle events selected by its filter. The
+// events are dropped when its buffer is full, so that a slow subscriber never
+// slows down trireme.
+type Subscription struct {
+	events   chan *LifecycleEvent
+	filter   LifecycleFilter
+	dropped  int
+	notifier *lifecycleNotifier
+}
+
+// Events returns the channel of the events. It is closed when the subscription
+// is canceled.
+func (s *Subscription) Events() <-chan *LifecycleEvent {
+
+	return s.events
+}
+
+// Dropped returns the number of events dropped because the buffer was full
+func (s *Subscription) Dropped() int {
+
+	s.notifier.Lock()
+	defer s.notifier.Unlock()
+
+	return s.dropped
+}
+
+// Cancel stops the subscription
+func (s *Subscription) Cancel() {
+
+	s.notifier.Lock()
+	defer s.notifier.Unlock()
+
+	if s.notifier.subscriptions[s] {
+		delete(s.notifier.subscriptions, s)
+		close(s.events)
+	}
+}
+
+// lifecycleNotifier delivers the lifecycle events to the subscriptions
+type lifecycleNotifier struct {
+	subscriptions map[*Subscription]bool
+	sync.Mutex
+}
+
+// Subscribe returns a subscription to the lifecycle events selected by the filter
+func (t *trireme) Subscribe(filter LifecycleFilter, bufferSize int) *Subscription {
+
+	if bufferSize <= 0 {
+		bufferSize = DefaultSubscriptionBuffer
+	}
+
+	s := &Subscription{
+		events:   make(chan *LifecycleEvent, bufferSize),
+		filter:   filter,
+		notifier: &t.notifier,
+	}
+
+	t.notifier.Lock()
+	defer t.notifier.Unlock()
+
+	t.notifier.subscriptions[s] = true
+
+	return s
+}
+
+// SubscribeFunc calls the handler with the lifecycle events selected by the
+// filter, in order, until the subscription is canceled
+func (t *trireme) SubscribeFunc(filter LifecycleFilter, handler func(*LifecycleEvent)) *Subscription {
+
+	s := t.Subscribe(filter, DefaultSubscriptionBuffer)
+
+	go func() {
+		for event := range s.events {
+			handler(event)
+		}
+	}()
+
+	return s
+}
+
+// notify sends a lifecycle event of a PU to the subscriptions
+func (t *trireme) notify(eventType LifecycleEventType, contextID string, err error) {
+
+	event := &LifecycleEvent{
+		Type:      eventType,
+		ContextID: contextID,
+		Error:     err,
+		Time:      time.Now(),
+	}
+
+	if status, ok := t.puStatus(contextID); ok {
+		event.PolicyVersion = status.PolicyVersion
+	}
+
+	t.notifier.Lock()
+	defer t.notifier.Unlock()
+
+	for s := range t.notifier.subscriptions {
+		if !s.filter.matches(event) {
+			continue
+		}
+
+		select {
+		case s.events <- event:
+		default:
+			s.dropped++
+			log.WithFields(log.Fields{
+				"package":   "trireme",
+				"contextID": contextID,
+				"type":      eventType,
+			}).Debug("Lifecycle event dropped for a slow subscriber")
+		}
+	}
+}
+
+// HandleEnforcerExit reports that the remote enforcer of a PU exited while it
+// was in use. The PU is failed until it is started again.
+func (t *trireme) HandleEnforcerExit(contextID string, status error) {
+
+	t.submit(&triremeRequest{
+		contextID:  contextID,
+		reqType:    enforcerExit,
+		status:     status,
+		returnChan: make(chan error, 1),
+	})
+}
+
+// doHandleEnforcerExit fails a PU whose remote enforcer exited
+func (t *trireme) doHandleEnforcerExit(contextID string, status error) error {
+
+	if state := t.puState(contextID); state != PUStateEnforced && state != PUStatePaused {
+		return nil
+	}
+
+	if status == nil {
+		status = fmt.Errorf("Remote enforcer of PU %s exited", contextID)
+	} else {
+		status = fmt.Errorf("Remote enforcer of PU %s exited: %s", contextID, status)
+	}
+
+	t.setState(contextID, PUStateFailed, status)
+	t.notify(LifecycleEnforcerCrashed, contextID, status)
+
+	return nil
+}
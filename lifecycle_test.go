@@ -0,0 +1,131 @@
+package trireme
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aporeto-inc/trireme/monitor"
+	"github.com/aporeto-inc/trireme/policy"
+)
+
+// nextEvent returns the next event of a subscription
+func nextEvent(t *testing.T, s *Subscription) *LifecycleEvent {
+
+	select {
+	case event := <-s.Events():
+		return event
+	case <-time.After(time.Second):
+		t.Fatalf("No lifecycle event received")
+	}
+
+	return nil
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, tmonitor := createMocks()
+	trireme := NewTrireme("serverID", tresolver, tsupervisor, tenforcer)
+	trireme.Start()
+	defer trireme.Stop()
+
+	contextID := "123123"
+	runtime := policy.NewPURuntimeWithDefaults()
+
+	all := trireme.Subscribe(LifecycleFilter{}, 10)
+	failures := trireme.Subscribe(LifecycleFilter{Types: []LifecycleEventType{LifecycleEnforcementFailed}}, 10)
+	other := trireme.Subscribe(LifecycleFilter{ContextIDs: []string{"other"}}, 10)
+
+	doTestCreate(t, trireme, tresolver, tsupervisor, tenforcer, tmonitor, contextID, runtime)
+
+	if event := nextEvent(t, all); event.Type != LifecyclePUEnforced || event.ContextID != contextID || event.PolicyVersion != 1 {
+		t.Errorf("Expected the PU to be enforced, got %+v", event)
+	}
+
+	p, _ := trireme.PUPolicy(contextID)
+	<-trireme.UpdatePolicy(contextID, p)
+
+	if event := nextEvent(t, all); event.Type != LifecyclePolicyUpdated || event.PolicyVersion != 2 {
+		t.Errorf("Expected the policy to be updated, got %+v", event)
+	}
+
+	tenforcer.MockEnforce(t, func(contextID string, puInfo *policy.PUInfo) error {
+		return fmt.Errorf("Enforcer error")
+	})
+
+	<-trireme.UpdatePolicy(contextID, p)
+
+	if event := nextEvent(t, all); event.Type != LifecycleEnforcementFailed || event.Error == nil {
+		t.Errorf("Expected the update to fail, got %+v", event)
+	}
+
+	if event := nextEvent(t, failures); event.Type != LifecycleEnforcementFailed {
+		t.Errorf("Expected only the failures, got %+v", event)
+	}
+
+	<-trireme.HandlePUEvent(contextID, monitor.EventDestroy)
+
+	if event := nextEvent(t, all); event.Type != LifecyclePURemoved {
+		t.Errorf("Expected the PU to be removed, got %+v", event)
+	}
+
+	all.Cancel()
+	if _, ok := <-all.Events(); ok {
+		t.Errorf("Events were not supposed to be sent after cancel")
+	}
+
+	if len(other.Events()) != 0 || len(failures.Events()) != 0 {
+		t.Errorf("Events were sent to subscriptions that did not select them")
+	}
+}
+
+func TestLifecycleSlowSubscriber(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, _ := createMocks()
+	trireme := NewTrireme("serverID", tresolver, tsupervisor, tenforcer)
+	trireme.Start()
+	defer trireme.Stop()
+
+	slow := trireme.Subscribe(LifecycleFilter{}, 1)
+
+	received := make(chan *LifecycleEvent, 10)
+	trireme.SubscribeFunc(LifecycleFilter{}, func(event *LifecycleEvent) {
+		received <- event
+	})
+
+	for _, contextID := range []string{"1", "2", "3"} {
+		<-trireme.HandlePUEvent(contextID, monitor.EventCreate)
+		<-trireme.HandlePUEvent(contextID, monitor.EventDestroy)
+	}
+
+	for _, contextID := range []string{"1", "2", "3"} {
+		if event := <-received; event.ContextID != contextID {
+			t.Errorf("Expected the events in order, got %s instead of %s", event.ContextID, contextID)
+		}
+	}
+
+	if slow.Dropped() != 2 {
+		t.Errorf("Expected 2 events dropped for the slow subscriber, got %d", slow.Dropped())
+	}
+}
+
+func TestEnforcerExit(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, tmonitor := createMocks()
+	trireme := NewTrireme("serverID", tresolver, tsupervisor, tenforcer)
+	trireme.Start()
+	defer trireme.Stop()
+
+	contextID := "123123"
+	doTestCreate(t, trireme, tresolver, tsupervisor, tenforcer, tmonitor, contextID, policy.NewPURuntimeWithDefaults())
+
+	s := trireme.Subscribe(LifecycleFilter{ContextIDs: []string{contextID}}, 10)
+
+	trireme.HandleEnforcerExit(contextID, fmt.Errorf("signal: killed"))
+
+	if event := nextEvent(t, s); event.Type != LifecycleEnforcerCrashed || event.Error == nil {
+		t.Errorf("Expected the enforcer to crash, got %+v", event)
+	}
+
+	status, _ := trireme.PUStatus(contextID)
+	if status.State != PUStateFailed || status.LastError == nil {
+		t.Errorf("Expected the PU to fail, got %+v", status)
+	}
+}
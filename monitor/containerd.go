@@ -0,0 +1,611 @@
+package monitor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aporeto-inc/trireme/collector"
+	"github.com/aporeto-inc/trireme/policy"
+)
+
+const (
+	// ContainerdTopicContainerCreate is the topic of the containerd events of
+	// the creation of containers
+	ContainerdTopicContainerCreate = "/containers/create"
+
+	// ContainerdTopicContainerDelete is the topic of the containerd events of
+	// the deletion of containers
+	ContainerdTopicContainerDelete = "/containers/delete"
+
+	// ContainerdTopicTaskStart is the topic of the containerd events of the
+	// start of tasks
+	ContainerdTopicTaskStart = "/tasks/start"
+
+	// ContainerdTopicTaskExit is the topic of the containerd events of the exit
+	// of the processes of tasks
+	ContainerdTopicTaskExit = "/tasks/exit"
+
+	// ContainerdTopicTaskPaused is the topic of the containerd events of the
+	// pause of tasks
+	ContainerdTopicTaskPaused = "/tasks/paused"
+
+	// ContainerdTopicTaskResumed is the topic of the containerd events of the
+	// resume of tasks
+	ContainerdTopicTaskResumed = "/tasks/resumed"
+
+	// ContainerdKindLabel is the label set by the CRI plugin of containerd on
+	// its containers. The containers of a pod share the network namespace of
+	// its sandbox.
+	ContainerdKindLabel = "io.cri-containerd.kind"
+
+	// ContainerdKindContainer is the kind of the containers of a pod that are
+	// not its sandbox
+	ContainerdKindContainer = "container"
+
+	// ContainerdResubscribeDelay is the delay before subscribing again to the
+	// containerd events when the subscription fails
+	ContainerdResubscribeDelay = time.Second
+)
+
+// A ContainerdEvent is an event of the containerd events service
+type ContainerdEvent struct {
+	Topic       string
+	ContainerID string
+
+	// ProcessID is the ID of the process that exited for the exit events. It
+	// is the ID of the container for the init process of the task.
+	ProcessID string
+}
+
+// A ContainerdContainer is the information of a containerd container and of
+// its task
+type ContainerdContainer struct {
+	ID          string
+	Image       string
+	Labels      map[string]string
+	Annotations map[string]string
+
+	// NetworkNamespace is the path of the network namespace joined by the
+	// container in its OCI spec. It is empty if the container has its own
+	// network namespace.
+	NetworkNamespace string
+
+	// Pid is the pid of the task. Running is false if the container has no
+	// running task.
+	Pid     int
+	Running bool
+}
+
+// A ContainerdClient is the part of the containerd API used by the containerd
+// monitor
+type ContainerdClient interface {
+
+	// Namespace returns the containerd namespace of the containers
+	Namespace() string
+
+	// Subscribe returns the events of containerd until the context is cancelled
+	Subscribe(ctx context.Context) (<-chan *ContainerdEvent, <-chan error)
+
+	// ContainerList returns the IDs of the containers
+	ContainerList(ctx context.Context) ([]string, error)
+
+	// ContainerInspect returns the information of a container
+	ContainerInspect(ctx context.Context, containerID string) (*ContainerdContainer, error)
+
+	// TaskKill kills the task of a container
+	TaskKill(ctx context.Context, containerID string) error
+}
+
+// A ContainerdMetadataExtractor is a function used to extract a *policy.PURuntime
+// from a given containerd container.
+type ContainerdMetadataExtractor func(*ContainerdContainer) (*policy.PURuntime, error)
+
+// DefaultContainerdMetadataExtractor is the default metadata extractor for
+// containerd. The tags are the annotations of the OCI spec, the labels of the
+// container and its image. The labels take precedence over the annotations.
+func DefaultContainerdMetadataExtractor(info *ContainerdContainer) (*policy.PURuntime, error) {
+
+	if info == nil {
+		return nil, fmt.Errorf("Container information is empty")
+	}
+
+	tags := policy.NewTagsMap(nil)
+
+	for k, v := range info.Annotations {
+		tags.Add(k, v)
+	}
+
+	for k, v := range info.Labels {
+		tags.Add(k, v)
+	}
+
+	tags.Add("image", info.Image)
+
+	return policy.NewPURuntime(info.ID, info.Pid, tags, nil), nil
+}
+
+// containerdContextID returns the context ID of the PU of a container. The
+// containerd IDs are chosen by the clients, so the ID and the namespace of the
+// container are hashed to get a context ID of the length of the others.
+func containerdContextID(namespace string, containerID string) (string, error) {
+
+	if containerID == "" {
+		return "", fmt.Errorf("Empty container ID")
+	}
+
+	hash := sha256.Sum256([]byte(namespace + "/" + containerID))
+
+	return hex.EncodeToString(hash[:])[:12], nil
+}
+
+// procNetNSPath matches the network namespaces of processes
+var procNetNSPath = regexp.MustCompile(`^/proc/([0-9]+)/ns/net$`)
+
+// containerdMonitor monitors the containers of containerd
+type containerdMonitor struct {
+	client             ContainerdClient
+	metadataExtractor  ContainerdMetadataExtractor
+	eventnotifications chan *ContainerdEvent
+	stopprocessor      chan bool
+	stoplistener       chan bool
+	syncAtStart        bool
+	procRoot           string
+	resubscribeDelay   time.Duration
+
+	// active are the context IDs of the containers activated by the monitor
+	active     map[string]bool
+	activeLock sync.Mutex
+
+	collector collector.EventCollector
+	puHandler ProcessingUnitsHandler
+}
+
+// NewContainerdMonitorWithClient returns a Monitor of the containers of
+// containerd using the given client. The PUs are given the pid of a process of
+// their network namespace so that they can be enforced by remote enforcers.
+// The containers of a pod that are not its sandbox are part of the PU of the
+// sandbox.
+func NewContainerdMonitorWithClient(
+	client ContainerdClient,
+	p ProcessingUnitsHandler,
+	m ContainerdMetadataExtractor,
+	l collector.EventCollector, syncAtStart bool,
+) Monitor {
+
+	return newContainerdMonitor(client, p, m, l, syncAtStart)
+}
+
+func newContainerdMonitor(
+	client ContainerdClient,
+	p ProcessingUnitsHandler,
+	m ContainerdMetadataExtractor,
+	l collector.EventCollector, syncAtStart bool,
+) *containerdMonitor {
+
+	if m == nil {
+		m = DefaultContainerdMetadataExtractor
+	}
+
+	if syncAtStart {
+		p.RegisterSynchronization()
+	}
+
+	return &containerdMonitor{
+		client:             client,
+		metadataExtractor:  m,
+		eventnotifications: make(chan *ContainerdEvent, 1000),
+		stopprocessor:      make(chan bool),
+		stoplistener:       make(chan bool),
+		syncAtStart:        syncAtStart,
+		procRoot:           "/proc",
+		resubscribeDelay:   ContainerdResubscribeDelay,
+		active:             map[string]bool{},
+		collector:          l,
+		puHandler:          p,
+	}
+}
+
+// Start subscribes to the containerd events and activates the running
+// containers if required
+func (c *containerdMonitor) Start() error {
+
+	log.WithFields(log.Fields{
+		"package": "monitor",
+	}).Debug("Starting the containerd monitor")
+
+	// The events received during the synchronization are queued
+	go c.eventListener()
+
+	if c.syncAtStart {
+		c.synchronize()
+	}
+
+	go c.eventProcessor()
+
+	return nil
+}
+
+// synchronize syncs the running containers. The PUs that were not synchronized
+// are cleaned only if all the containers were synchronized.
+func (c *containerdMonitor) synchronize() {
+
+	if err := c.syncContainers(); err != nil {
+		log.WithFields(log.Fields{
+			"package": "monitor",
+			"error":   err.Error(),
+		}).Error("Error Syncing existing containers")
+		return
+	}
+
+	if err := <-c.puHandler.HandleSynchronizationComplete(); err != nil {
+		log.WithFields(log.Fields{
+			"package": "monitor",
+			"error":   err.Error(),
+		}).Error("Error cleaning the state of the PUs that were not synchronized")
+	}
+}
+
+// Stop stops monitoring the containerd events. The PUs are left in place.
+func (c *containerdMonitor) Stop() error {
+
+	log.WithFields(log.Fields{
+		"package": "monitor",
+	}).Debug("Stopping the containerd monitor")
+
+	c.stoplistener <- true
+	c.stopprocessor <- true
+
+	return nil
+}
+
+// eventListener passes the containerd events to the processor. It subscribes
+// again and reconciles the containers when the subscription fails.
+func (c *containerdMonitor) eventListener() {
+
+	resubscribed := false
+
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		events, errs := c.client.Subscribe(ctx)
+
+		if resubscribed {
+			if err := c.syncContainers(); err != nil {
+				log.WithFields(log.Fields{
+					"package": "monitor",
+					"error":   err.Error(),
+				}).Error("Error reconciling the containers")
+			}
+		}
+
+		err := c.listen(events, errs)
+		cancel()
+
+		if err == nil {
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"package": "monitor",
+			"error":   err.Error(),
+		}).Error("Lost the containerd events subscription")
+
+		select {
+		case <-time.After(c.resubscribeDelay):
+		case <-c.stoplistener:
+			return
+		}
+
+		resubscribed = true
+	}
+}
+
+// listen passes the events to the processor until the subscription fails or the
+// listener is stopped. It returns nil when it is stopped.
+func (c *containerdMonitor) listen(events <-chan *ContainerdEvent, errs <-chan error) error {
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return fmt.Errorf("Containerd event stream closed")
+			}
+			c.eventnotifications <- event
+		case err := <-errs:
+			if err == nil {
+				return fmt.Errorf("Containerd event stream closed")
+			}
+			return fmt.Errorf("Containerd event stream failed: %s", err)
+		case <-c.stoplistener:
+			return nil
+		}
+	}
+}
+
+// eventProcessor processes the containerd events
+func (c *containerdMonitor) eventProcessor() {
+
+	for {
+		select {
+		case event := <-c.eventnotifications:
+			if err := c.handleEvent(event); err != nil {
+				log.WithFields(log.Fields{
+					"package": "monitor",
+					"topic":   event.Topic,
+					"error":   err.Error(),
+				}).Error("Error while handling event")
+			}
+		case <-c.stopprocessor:
+			return
+		}
+	}
+}
+
+// handleEvent sends the events of the containers upstream
+func (c *containerdMonitor) handleEvent(event *ContainerdEvent) error {
+
+	contextID, err := containerdContextID(c.client.Namespace(), event.ContainerID)
+	if err != nil {
+		return fmt.Errorf("Error Generating ContextID: %s", err)
+	}
+
+	switch event.Topic {
+
+	case ContainerdTopicContainerCreate:
+		c.collector.CollectContainerEvent(contextID, "", nil, collector.ContainerCreate)
+		return <-c.puHandler.HandlePUEvent(contextID, EventCreate)
+
+	case ContainerdTopicTaskStart:
+		info, err := c.client.ContainerInspect(context.Background(), event.ContainerID)
+		if err != nil {
+			// The container is killed for security reasons
+			c.client.TaskKill(context.Background(), event.ContainerID)
+			c.collector.CollectContainerEvent(contextID, "", nil, collector.ContainerFailed)
+			return fmt.Errorf("Cannot read container information. Killing container: %s", err)
+		}
+		return c.startContainer(info)
+
+	case ContainerdTopicTaskExit:
+		// Only the exit of the init process stops the container
+		if event.ProcessID != "" && event.ProcessID != event.ContainerID {
+			return nil
+		}
+		return c.stopContainer(contextID)
+
+	case ContainerdTopicTaskPaused:
+		if !c.isActive(contextID) {
+			return nil
+		}
+		return <-c.puHandler.HandlePUEvent(contextID, EventPause)
+
+	case ContainerdTopicTaskResumed:
+		if !c.isActive(contextID) {
+			return nil
+		}
+		return <-c.puHandler.HandlePUEvent(contextID, EventUnpause)
+
+	case ContainerdTopicContainerDelete:
+		c.collector.CollectContainerEvent(contextID, "", nil, collector.UnknownContainerDelete)
+		return <-c.puHandler.HandlePUEvent(contextID, EventDestroy)
+	}
+
+	return nil
+}
+
+// syncContainers activates the running containers that are not active and
+// stops the active PUs whose containers are not running anymore
+func (c *containerdMonitor) syncContainers() error {
+
+	log.WithFields(log.Fields{
+		"package": "monitor",
+	}).Debug("Syncing all existing containers")
+
+	ids, err := c.client.ContainerList(context.Background())
+	if err != nil {
+		return fmt.Errorf("Error Getting ContainerList: %s", err)
+	}
+
+	running := map[string]bool{}
+
+	for _, id := range ids {
+		info, err := c.client.ContainerInspect(context.Background(), id)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"package": "monitor",
+				"error":   err.Error(),
+			}).Error("Error Syncing existing Container")
+			continue
+		}
+
+		if !info.Running {
+			continue
+		}
+
+		contextID, err := containerdContextID(c.client.Namespace(), id)
+		if err != nil {
+			continue
+		}
+
+		running[contextID] = true
+
+		if c.isActive(contextID) {
+			continue
+		}
+
+		if err := c.startContainer(info); err != nil {
+			log.WithFields(log.Fields{
+				"package": "monitor",
+				"error":   err.Error(),
+			}).Error("Error Syncing existing Container")
+		}
+	}
+
+	for _, contextID := range c.activeContexts() {
+		if running[contextID] {
+			continue
+		}
+
+		if err := c.stopContainer(contextID); err != nil {
+			log.WithFields(log.Fields{
+				"package":   "monitor",
+				"contextID": contextID,
+				"error":     err.Error(),
+			}).Error("Error stopping container")
+		}
+	}
+
+	return nil
+}
+
+// startContainer activates a running container. The container is killed if its
+// policy cannot be set.
+func (c *containerdMonitor) startContainer(info *ContainerdContainer) error {
+
+	if !info.Running {
+		return nil
+	}
+
+	if info.Labels[ContainerdKindLabel] == ContainerdKindContainer {
+		log.WithFields(log.Fields{
+			"package":     "monitor",
+			"containerID": info.ID,
+		}).Debug("Container is part of the sandbox of a pod - Activation not needed.")
+
+		return nil
+	}
+
+	contextID, err := containerdContextID(c.client.Namespace(), info.ID)
+	if err != nil {
+		return fmt.Errorf("Couldn't generate ContextID: %s", err)
+	}
+
+	runtimeInfo, err := c.metadataExtractor(info)
+	if err != nil {
+		return fmt.Errorf("Error getting the metadata of the container: %s", err)
+	}
+
+	pid, err := c.networkNamespacePid(info)
+	if err != nil {
+		c.client.TaskKill(context.Background(), info.ID)
+		c.collector.CollectContainerEvent(contextID, "", nil, collector.ContainerFailed)
+		return fmt.Errorf("Cannot find the network namespace of %s. Killing container: %s", info.ID, err)
+	}
+
+	runtimeInfo.SetPid(pid)
+
+	if err := c.puHandler.SetPURuntime(contextID, runtimeInfo); err != nil {
+		return err
+	}
+
+	if err := <-c.puHandler.HandlePUEvent(contextID, EventStart); err != nil {
+		c.client.TaskKill(context.Background(), info.ID)
+		c.collector.CollectContainerEvent(contextID, "", nil, collector.ContainerFailed)
+		return fmt.Errorf("Policy cound't be set - container was killed")
+	}
+
+	c.setActive(contextID, true)
+
+	c.collector.CollectContainerEvent(contextID, "", runtimeInfo.Tags(), collector.ContainerStart)
+
+	return nil
+}
+
+// stopContainer stops the PU of a container that was activated
+func (c *containerdMonitor) stopContainer(contextID string) error {
+
+	if !c.isActive(contextID) {
+		return nil
+	}
+
+	c.setActive(contextID, false)
+
+	c.collector.CollectContainerEvent(contextID, "", nil, collector.ContainerStop)
+
+	return <-c.puHandler.HandlePUEvent(contextID, EventStop)
+}
+
+// networkNamespacePid returns the pid of a process in the network namespace of
+// a container. It is the pid of its task if it has its own namespace.
+// Otherwise the processes are searched for the namespace joined by the
+// container.
+func (c *containerdMonitor) networkNamespacePid(info *ContainerdContainer) (int, error) {
+
+	if info.NetworkNamespace == "" {
+		return info.Pid, nil
+	}
+
+	if match := procNetNSPath.FindStringSubmatch(info.NetworkNamespace); match != nil {
+		return strconv.Atoi(match[1])
+	}
+
+	target, err := os.Stat(info.NetworkNamespace)
+	if err != nil {
+		return 0, err
+	}
+
+	entries, err := ioutil.ReadDir(c.procRoot)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		ns, err := os.Stat(filepath.Join(c.procRoot, entry.Name(), "ns", "net"))
+		if err != nil {
+			continue
+		}
+
+		if os.SameFile(target, ns) {
+			return pid, nil
+		}
+	}
+
+	return 0, fmt.Errorf("No process in network namespace %s", info.NetworkNamespace)
+}
+
+func (c *containerdMonitor) setActive(contextID string, active bool) {
+
+	c.activeLock.Lock()
+	defer c.activeLock.Unlock()
+
+	if active {
+		c.active[contextID] = true
+		return
+	}
+
+	delete(c.active, contextID)
+}
+
+func (c *containerdMonitor) isActive(contextID string) bool {
+
+	c.activeLock.Lock()
+	defer c.activeLock.Unlock()
+
+	return c.active[contextID]
+}
+
+func (c *containerdMonitor) activeContexts() []string {
+
+	c.activeLock.Lock()
+	defer c.activeLock.Unlock()
+
+	contexts := []string{}
+	for contextID := range c.active {
+		contexts = append(contexts, contextID)
+	}
+
+	return contexts
+}
@@ -0,0 +1,231 @@
+// Package containerd implements the client of the containerd monitor with the
+// containerd API
+package containerd
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aporeto-inc/trireme/collector"
+	"github.com/aporeto-inc/trireme/monitor"
+	containerdapi "github.com/containerd/containerd"
+	apievents "github.com/containerd/containerd/api/events"
+	"github.com/containerd/typeurl"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const (
+	// DefaultAddress is the default address of the containerd socket
+	DefaultAddress = "/run/containerd/containerd.sock"
+
+	// DefaultNamespace is the default containerd namespace of the monitored
+	// containers. The CRI plugin uses the k8s.io namespace.
+	DefaultNamespace = "default"
+)
+
+// apiClient implements the monitor.ContainerdClient with the containerd API
+type apiClient struct {
+	client    *containerdapi.Client
+	namespace string
+}
+
+// NewClient returns a monitor.ContainerdClient of the containers of the given
+// containerd namespace, connected to the containerd socket at the given address.
+func NewClient(address string, namespace string) (monitor.ContainerdClient, error) {
+
+	if address == "" {
+		address = DefaultAddress
+	}
+
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+
+	client, err := containerdapi.New(address, containerdapi.WithDefaultNamespace(namespace))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to initialize containerd client: %s", err)
+	}
+
+	return &apiClient{client: client, namespace: namespace}, nil
+}
+
+// NewMonitor returns a Monitor of the containers of the given containerd
+// namespace, connected to the containerd socket at the given address.
+func NewMonitor(
+	address string,
+	namespace string,
+	p monitor.ProcessingUnitsHandler,
+	m monitor.ContainerdMetadataExtractor,
+	l collector.EventCollector, syncAtStart bool,
+) monitor.Monitor {
+
+	client, err := NewClient(address, namespace)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"package": "containerd",
+			"error":   err.Error(),
+		}).Fatal("Unable to initialize containerd client")
+	}
+
+	return monitor.NewContainerdMonitorWithClient(client, p, m, l, syncAtStart)
+}
+
+// Namespace implements the monitor.ContainerdClient interface
+func (c *apiClient) Namespace() string {
+
+	return c.namespace
+}
+
+// Subscribe implements the monitor.ContainerdClient interface. The events that
+// are not handled by the monitor are dropped.
+func (c *apiClient) Subscribe(ctx context.Context) (<-chan *monitor.ContainerdEvent, <-chan error) {
+
+	envelopes, errs := c.client.Subscribe(ctx)
+
+	events := make(chan *monitor.ContainerdEvent)
+	outErrs := make(chan error, 1)
+
+	go func() {
+		for {
+			select {
+			case envelope := <-envelopes:
+				if envelope == nil || envelope.Event == nil {
+					continue
+				}
+
+				v, err := typeurl.UnmarshalAny(envelope.Event)
+				if err != nil {
+					log.WithFields(log.Fields{
+						"package": "containerd",
+						"topic":   envelope.Topic,
+						"error":   err.Error(),
+					}).Warn("Cannot decode containerd event")
+					continue
+				}
+
+				event := containerdEvent(envelope.Topic, v)
+				if event == nil {
+					continue
+				}
+
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			case err := <-errs:
+				outErrs <- err
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, outErrs
+}
+
+// containerdEvent converts the events handled by the monitor
+func containerdEvent(topic string, v interface{}) *monitor.ContainerdEvent {
+
+	switch e := v.(type) {
+	case *apievents.ContainerCreate:
+		return &monitor.ContainerdEvent{Topic: topic, ContainerID: e.ID}
+	case *apievents.ContainerDelete:
+		return &monitor.ContainerdEvent{Topic: topic, ContainerID: e.ID}
+	case *apievents.TaskStart:
+		return &monitor.ContainerdEvent{Topic: topic, ContainerID: e.ContainerID}
+	case *apievents.TaskExit:
+		return &monitor.ContainerdEvent{Topic: topic, ContainerID: e.ContainerID, ProcessID: e.ID}
+	case *apievents.TaskPaused:
+		return &monitor.ContainerdEvent{Topic: topic, ContainerID: e.ContainerID}
+	case *apievents.TaskResumed:
+		return &monitor.ContainerdEvent{Topic: topic, ContainerID: e.ContainerID}
+	}
+
+	return nil
+}
+
+// ContainerList implements the monitor.ContainerdClient interface
+func (c *apiClient) ContainerList(ctx context.Context) ([]string, error) {
+
+	containers, err := c.client.Containers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, container := range containers {
+		ids = append(ids, container.ID())
+	}
+
+	return ids, nil
+}
+
+// ContainerInspect implements the monitor.ContainerdClient interface
+func (c *apiClient) ContainerInspect(ctx context.Context, containerID string) (*monitor.ContainerdContainer, error) {
+
+	container, err := c.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := container.Info(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read container %s: %s", containerID, err)
+	}
+
+	spec, err := container.Spec(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read the spec of container %s: %s", containerID, err)
+	}
+
+	result := &monitor.ContainerdContainer{
+		ID:          info.ID,
+		Image:       info.Image,
+		Labels:      info.Labels,
+		Annotations: spec.Annotations,
+	}
+
+	if spec.Linux != nil {
+		for _, ns := range spec.Linux.Namespaces {
+			if ns.Type == specs.NetworkNamespace {
+				result.NetworkNamespace = ns.Path
+			}
+		}
+	}
+
+	// A container without a task is not running
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		return result, nil
+	}
+
+	status, err := task.Status(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read the task of container %s: %s", containerID, err)
+	}
+
+	result.Pid = int(task.Pid())
+	result.Running = status.Status == containerdapi.Running
+
+	return result, nil
+}
+
+// TaskKill implements the monitor.ContainerdClient interface
+func (c *apiClient) TaskKill(ctx context.Context, containerID string) error {
+
+	container, err := c.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return err
+	}
+
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	return task.Kill(ctx, syscall.SIGKILL)
+}
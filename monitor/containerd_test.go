@@ -0,0 +1,279 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aporeto-inc/trireme/collector"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testContainerdID = "c0ffee0123456789c0ffee0123456789"
+
+// testContainerdClient is a containerd client serving the containers it holds
+// and streaming the events pushed in its events channel
+type testContainerdClient struct {
+	sync.Mutex
+	containers map[string]*ContainerdContainer
+	events     chan *ContainerdEvent
+	errs       chan error
+	killed     []string
+}
+
+func newTestContainerdClient() *testContainerdClient {
+	return &testContainerdClient{
+		containers: map[string]*ContainerdContainer{},
+		events:     make(chan *ContainerdEvent),
+		errs:       make(chan error),
+	}
+}
+
+func (c *testContainerdClient) Namespace() string {
+	return "default"
+}
+
+func (c *testContainerdClient) Subscribe(ctx context.Context) (<-chan *ContainerdEvent, <-chan error) {
+	return c.events, c.errs
+}
+
+func (c *testContainerdClient) ContainerList(ctx context.Context) ([]string, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	ids := []string{}
+	for id := range c.containers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (c *testContainerdClient) ContainerInspect(ctx context.Context, containerID string) (*ContainerdContainer, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	info, ok := c.containers[containerID]
+	if !ok {
+		return nil, fmt.Errorf("container %s: not found", containerID)
+	}
+	return info, nil
+}
+
+func (c *testContainerdClient) TaskKill(ctx context.Context, containerID string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	c.killed = append(c.killed, containerID)
+	return nil
+}
+
+func (c *testContainerdClient) setContainer(info *ContainerdContainer) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.containers[info.ID] = info
+}
+
+func (c *testContainerdClient) removeContainer(id string) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.containers, id)
+}
+
+func (c *testContainerdClient) Killed() []string {
+	c.Lock()
+	defer c.Unlock()
+
+	return append([]string(nil), c.killed...)
+}
+
+// testContainerdContextID returns the context ID of a container of the default
+// namespace
+func testContainerdContextID(containerID string) string {
+	contextID, _ := containerdContextID("default", containerID)
+	return contextID
+}
+
+func TestContainerdContextID(t *testing.T) {
+
+	Convey("Given containers whose IDs differ after 12 characters", t, func() {
+		first, err1 := containerdContextID("default", "production-api-1")
+		second, err2 := containerdContextID("default", "production-api-2")
+
+		Convey("Their context IDs should differ", func() {
+			So(err1, ShouldBeNil)
+			So(err2, ShouldBeNil)
+			So(first, ShouldNotEqual, second)
+			So(first, ShouldHaveLength, 12)
+		})
+	})
+
+	Convey("Given containers with the same ID in two namespaces", t, func() {
+		first, _ := containerdContextID("default", "web")
+		second, _ := containerdContextID("k8s.io", "web")
+
+		Convey("Their context IDs should differ", func() {
+			So(first, ShouldNotEqual, second)
+		})
+	})
+
+	Convey("Given a container with a short ID", t, func() {
+		contextID, err := containerdContextID("default", "web")
+
+		Convey("It should get a context ID", func() {
+			So(err, ShouldBeNil)
+			So(contextID, ShouldHaveLength, 12)
+		})
+	})
+
+	Convey("Given a container without ID", t, func() {
+		_, err := containerdContextID("default", "")
+
+		Convey("I should get an error", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestContainerdMonitor(t *testing.T) {
+
+	Convey("Given containerd with a pod and a stopped container", t, func() {
+		sandbox := testContainerdID
+		app := "a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0"
+		stopped := "b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0"
+
+		cli := newTestContainerdClient()
+		cli.setContainer(&ContainerdContainer{
+			ID:          sandbox,
+			Image:       "pause",
+			Labels:      map[string]string{ContainerdKindLabel: "sandbox", "app": "web"},
+			Annotations: map[string]string{"app": "annotation", "owner": "team"},
+			Pid:         1234,
+			Running:     true,
+		})
+		cli.setContainer(&ContainerdContainer{
+			ID:               app,
+			Labels:           map[string]string{ContainerdKindLabel: ContainerdKindContainer},
+			NetworkNamespace: "/proc/1234/ns/net",
+			Pid:              1300,
+			Running:          true,
+		})
+		cli.setContainer(&ContainerdContainer{ID: stopped})
+
+		h := newTestPUHandler()
+		c := newContainerdMonitor(cli, h, nil, &collector.DefaultCollector{}, true)
+		c.resubscribeDelay = time.Millisecond
+
+		So(c.Start(), ShouldBeNil)
+		defer c.Stop()
+
+		Convey("Only the sandbox should be activated with its metadata", func() {
+			So(h.synced, ShouldBeTrue)
+			So(h.Events(), ShouldResemble, []string{testContainerdContextID(sandbox) + ":" + EventStart})
+
+			h.Lock()
+			runtime := h.runtimes[testContainerdContextID(sandbox)]
+			h.Unlock()
+			So(runtime.Pid(), ShouldEqual, 1234)
+
+			tag, _ := runtime.Tag("app")
+			So(tag, ShouldEqual, "web")
+			tag, _ = runtime.Tag("owner")
+			So(tag, ShouldEqual, "team")
+			tag, _ = runtime.Tag("image")
+			So(tag, ShouldEqual, "pause")
+		})
+
+		Convey("When a container goes through its lifecycle", func() {
+			id := "d0d0d0d0d0d0d0d0d0d0d0d0d0d0d0d0"
+			cli.setContainer(&ContainerdContainer{ID: id, Image: "nginx", Pid: 2000, Running: true})
+
+			cli.events <- &ContainerdEvent{Topic: ContainerdTopicContainerCreate, ContainerID: id}
+			cli.events <- &ContainerdEvent{Topic: ContainerdTopicTaskStart, ContainerID: id}
+			cli.events <- &ContainerdEvent{Topic: ContainerdTopicTaskExit, ContainerID: id, ProcessID: "exec-1"}
+			cli.events <- &ContainerdEvent{Topic: ContainerdTopicTaskPaused, ContainerID: id}
+			cli.events <- &ContainerdEvent{Topic: ContainerdTopicTaskResumed, ContainerID: id}
+			cli.events <- &ContainerdEvent{Topic: ContainerdTopicTaskExit, ContainerID: id, ProcessID: id}
+			cli.events <- &ContainerdEvent{Topic: ContainerdTopicContainerDelete, ContainerID: id}
+
+			Convey("The events should be sent upstream and the exec exits ignored", func() {
+				So(waitForEvents(h, 7), ShouldResemble, []string{
+					testContainerdContextID(sandbox) + ":" + EventStart,
+					testContainerdContextID(id) + ":" + EventCreate,
+					testContainerdContextID(id) + ":" + EventStart,
+					testContainerdContextID(id) + ":" + EventPause,
+					testContainerdContextID(id) + ":" + EventUnpause,
+					testContainerdContextID(id) + ":" + EventStop,
+					testContainerdContextID(id) + ":" + EventDestroy,
+				})
+			})
+		})
+
+		Convey("When the policy of a new container cannot be set", func() {
+			id := "d0d0d0d0d0d0d0d0d0d0d0d0d0d0d0d0"
+			cli.setContainer(&ContainerdContainer{ID: id, Pid: 2000, Running: true})
+
+			h.Lock()
+			h.err = fmt.Errorf("No policy")
+			h.Unlock()
+
+			cli.events <- &ContainerdEvent{Topic: ContainerdTopicTaskStart, ContainerID: id}
+
+			Convey("The container should be killed", func() {
+				So(waitForEvents(h, 2), ShouldHaveLength, 2)
+				So(cli.Killed(), ShouldResemble, []string{id})
+				So(c.isActive(testContainerdContextID(id)), ShouldBeFalse)
+			})
+		})
+
+		Convey("When the subscription fails and the containers changed", func() {
+			id := "d0d0d0d0d0d0d0d0d0d0d0d0d0d0d0d0"
+			cli.removeContainer(sandbox)
+			cli.setContainer(&ContainerdContainer{ID: id, Pid: 2000, Running: true})
+
+			cli.errs <- fmt.Errorf("connection reset")
+
+			Convey("The containers should be reconciled", func() {
+				events := waitForEvents(h, 3)
+				So(events, ShouldHaveLength, 3)
+				So(events, ShouldContain, testContainerdContextID(sandbox)+":"+EventStop)
+				So(events, ShouldContain, testContainerdContextID(id)+":"+EventStart)
+			})
+		})
+	})
+
+	Convey("Given a container joining a named network namespace", t, func() {
+		dir, _ := ioutil.TempDir("", "proc")
+		defer os.RemoveAll(dir)
+
+		os.MkdirAll(filepath.Join(dir, "42", "ns"), 0700)
+		ioutil.WriteFile(filepath.Join(dir, "42", "ns", "net"), nil, 0600)
+		os.MkdirAll(filepath.Join(dir, "43", "ns"), 0700)
+		ioutil.WriteFile(filepath.Join(dir, "43", "ns", "net"), nil, 0600)
+
+		netns := filepath.Join(dir, "cni-1234")
+		So(os.Link(filepath.Join(dir, "42", "ns", "net"), netns), ShouldBeNil)
+
+		c := newContainerdMonitor(newTestContainerdClient(), newTestPUHandler(), nil, &collector.DefaultCollector{}, false)
+		c.procRoot = dir
+
+		Convey("The pid of a process in the namespace should be found", func() {
+			pid, err := c.networkNamespacePid(&ContainerdContainer{NetworkNamespace: netns, Pid: 50})
+			So(err, ShouldBeNil)
+			So(pid, ShouldEqual, 42)
+		})
+
+		Convey("A namespace without processes should be an error", func() {
+			_, err := c.networkNamespacePid(&ContainerdContainer{NetworkNamespace: filepath.Join(dir, "42")})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -41,10 +42,31 @@ const (
 	// DockerEventConnect represents the Docker "connect" event.
 	DockerEventConnect DockerEvent = "connect"
 
+	// DockerEventDisconnect represents the Docker "disconnect" event.
+	DockerEventDisconnect DockerEvent = "disconnect"
+
 	// DockerClientVersion is the version sent out as the client
 	DockerClientVersion = "v1.23"
+
+	// DockerReconnectMinBackoff is the delay before the first attempt to
+	// reconnect to the Docker daemon
+	DockerReconnectMinBackoff = time.Second
+
+	// DockerReconnectMaxBackoff is the maximum delay between two attempts to
+	// reconnect to the Docker daemon
+	DockerReconnectMaxBackoff = time.Minute
 )
 
+// DockerClient is the part of the Docker client used by the monitor. It is
+// implemented by the client of the Docker API and by the recording and replay
+// clients.
+type DockerClient interface {
+	Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
+	ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error)
+	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
+	ContainerStop(ctx context.Context, containerID string, timeout *time.Duration) error
+}
+
 // A DockerEventHandler is type of docker event handler functions.
 type DockerEventHandler func(event *events.Message) error
 
@@ -99,7 +121,10 @@ func initDockerClient(socketType string, socketAddress string) (*dockerClient.Cl
 	return dockerClient, nil
 }
 
-func defaultDockerMetadataExtractor(info *types.ContainerJSON) (*policy.PURuntime, error) {
+// DefaultDockerMetadataExtractor is the default metadata extractor for Docker.
+// The tags are the image, the name and the labels of the container and the IP
+// addresses are the ones of all its networks.
+func DefaultDockerMetadataExtractor(info *types.ContainerJSON) (*policy.PURuntime, error) {
 
 	tags := policy.NewTagsMap(map[string]string{
 		"image": info.Config.Image,
@@ -113,18 +138,35 @@ func defaultDockerMetadataExtractor(info *types.ContainerJSON) (*policy.PURuntim
 		"bridge": info.NetworkSettings.IPAddress,
 	})
 
+	// Containers can be attached to several networks
+	for name, endpoint := range info.NetworkSettings.Networks {
+		if _, ok := ipa.Get(name); ok || endpoint == nil || endpoint.IPAddress == "" {
+			continue
+		}
+		ipa.Add(name, endpoint.IPAddress)
+	}
+
 	return policy.NewPURuntime(info.Name, info.State.Pid, tags, ipa), nil
 }
 
 // dockerMonitor implements the connection to Docker and monitoring based on events
 type dockerMonitor struct {
-	dockerClient       *dockerClient.Client
+	dockerClient       DockerClient
 	metadataExtractor  DockerMetadataExtractor
 	handlers           map[DockerEvent]func(event *events.Message) error
 	eventnotifications chan *events.Message
 	stopprocessor      chan bool
 	stoplistener       chan bool
 	syncAtStart        bool
+	minBackoff         time.Duration
+	maxBackoff         time.Duration
+
+	// active are the context IDs of the containers activated by the monitor
+	active     map[string]bool
+	activeLock sync.Mutex
+
+	health     Health
+	healthLock sync.Mutex
 
 	collector collector.EventCollector
 	puHandler ProcessingUnitsHandler
@@ -153,6 +195,33 @@ func NewDockerMonitor(
 		}).Fatal("Unable to initialize Docker client")
 	}
 
+	return newDockerMonitor(cli, p, m, l, syncAtStart)
+}
+
+// NewDockerMonitorWithClient returns a DockerMonitor using the given Docker
+// client instead of connecting to the daemon.
+func NewDockerMonitorWithClient(
+	cli DockerClient,
+	p ProcessingUnitsHandler,
+	m DockerMetadataExtractor,
+	l collector.EventCollector, syncAtStart bool,
+) Monitor {
+
+	return newDockerMonitor(cli, p, m, l, syncAtStart)
+}
+
+// newDockerMonitor returns a dockerMonitor using the given Docker client
+func newDockerMonitor(
+	cli DockerClient,
+	p ProcessingUnitsHandler,
+	m DockerMetadataExtractor,
+	l collector.EventCollector, syncAtStart bool,
+) *dockerMonitor {
+
+	if syncAtStart {
+		p.RegisterSynchronization()
+	}
+
 	d := &dockerMonitor{
 		puHandler:          p,
 		collector:          l,
@@ -163,6 +232,9 @@ func NewDockerMonitor(
 		stopprocessor:      make(chan bool),
 		metadataExtractor:  m,
 		dockerClient:       cli,
+		minBackoff:         DockerReconnectMinBackoff,
+		maxBackoff:         DockerReconnectMaxBackoff,
+		active:             map[string]bool{},
 	}
 
 	// Add handlers for the events that we know how to process
@@ -173,6 +245,7 @@ func NewDockerMonitor(
 	d.addHandler(DockerEventPause, d.handlePauseEvent)
 	d.addHandler(DockerEventUnpause, d.handleUnpauseEvent)
 	d.addHandler(DockerEventConnect, d.handleNetworkConnectEvent)
+	d.addHandler(DockerEventDisconnect, d.handleNetworkDisconnectEvent)
 
 	return d
 }
@@ -199,14 +272,7 @@ func (d *dockerMonitor) Start() error {
 
 	//Syncing all Existing containers depending on MonitorSetting
 	if d.syncAtStart {
-		err := d.syncContainers()
-
-		if err != nil {
-			log.WithFields(log.Fields{
-				"package": "monitor",
-				"error":   err.Error(),
-			}).Error("Error Syncing existingContainers")
-		}
+		d.synchronize()
 	}
 
 	// Processing the events received duringthe time of Sync.
@@ -215,6 +281,26 @@ func (d *dockerMonitor) Start() error {
 	return nil
 }
 
+// synchronize syncs the existing containers. The PUs that were not synchronized
+// are cleaned only if all the containers were synchronized.
+func (d *dockerMonitor) synchronize() {
+
+	if err := d.syncContainers(); err != nil {
+		log.WithFields(log.Fields{
+			"package": "monitor",
+			"error":   err.Error(),
+		}).Error("Error Syncing existingContainers")
+		return
+	}
+
+	if err := <-d.puHandler.HandleSynchronizationComplete(); err != nil {
+		log.WithFields(log.Fields{
+			"package": "monitor",
+			"error":   err.Error(),
+		}).Error("Error cleaning the state of the PUs that were not synchronized")
+	}
+}
+
 // Stop monitoring docker events.
 func (d *dockerMonitor) Stop() error {
 
@@ -234,6 +320,9 @@ func (d *dockerMonitor) eventProcessor() {
 	for {
 		select {
 		case event := <-d.eventnotifications:
+			if !d.isHandled(event) {
+				continue
+			}
 			if event.Action != "" {
 				f, present := d.handlers[DockerEvent(event.Action)]
 				if present {
@@ -261,36 +350,259 @@ func (d *dockerMonitor) eventProcessor() {
 	}
 }
 
+// isHandled returns false for the events of networks other than the connection
+// and disconnection of containers, since their actions are the same as the
+// ones of containers.
+func (d *dockerMonitor) isHandled(event *events.Message) bool {
+
+	if event.Type != events.NetworkEventType {
+		return true
+	}
+
+	action := DockerEvent(event.Action)
+
+	return action == DockerEventConnect || action == DockerEventDisconnect
+}
+
 // eventListener listens to Docker events from the daemon and passes to
 // to the processor through a buffered channel. This minimizes the chances
-// that we will miss events because the processor is delayed
+// that we will miss events because the processor is delayed. When the
+// connection to the daemon is lost, the listener reconnects with an exponential
+// backoff and reconciles the PUs with the running containers.
 func (d *dockerMonitor) eventListener() {
 
-	messages, errs := d.dockerClient.Events(context.Background(), types.EventsOptions{})
+	backoff := d.minBackoff
+	reconnecting := false
+
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		messages, errs := d.dockerClient.Events(ctx, types.EventsOptions{})
+
+		// The events received during the reconciliation are queued by the
+		// client and processed once it is done
+		if reconnecting {
+			if err := d.resyncContainers(); err != nil {
+				cancel()
+				d.setDisconnected(err)
+
+				if !d.waitBackoff(backoff) {
+					return
+				}
+				backoff = d.nextBackoff(backoff)
+				continue
+			}
+		}
+
+		d.setConnected(reconnecting)
+		backoff = d.minBackoff
+
+		err := d.listen(messages, errs)
+		cancel()
+
+		if err == nil {
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"package": "monitor",
+			"error":   err.Error(),
+		}).Error("Lost connection to the docker daemon")
+
+		d.setDisconnected(err)
+		reconnecting = true
+
+		if !d.waitBackoff(backoff) {
+			return
+		}
+		backoff = d.nextBackoff(backoff)
+	}
+}
+
+// listen passes the events to the processor until the connection to the daemon
+// is lost or the listener is stopped. It returns nil when it is stopped.
+func (d *dockerMonitor) listen(messages <-chan events.Message, errs <-chan error) error {
 
 	for {
 		select {
-		case message := <-messages:
+		case message, ok := <-messages:
+			if !ok {
+				return fmt.Errorf("Docker event stream closed")
+			}
 			log.WithFields(log.Fields{
 				"package": "monitor",
 				"message": message,
 			}).Debug("Got message from docker client")
 			d.eventnotifications <- &message
 		case err := <-errs:
-			if err != nil && err != io.EOF {
-				log.WithFields(log.Fields{
-					"package": "monitor",
-					"error":   err.Error(),
-				}).Debug("Received docker event error")
+			if err == nil || err == io.EOF {
+				return fmt.Errorf("Docker event stream closed")
 			}
+			return fmt.Errorf("Docker event stream failed: %s", err)
 		case stop := <-d.stoplistener:
 			if stop {
-				return
+				return nil
 			}
 		}
 	}
 }
 
+// waitBackoff waits before the next attempt to reconnect. It returns false if
+// the listener is stopped in the meantime.
+func (d *dockerMonitor) waitBackoff(backoff time.Duration) bool {
+
+	select {
+	case <-time.After(backoff):
+		return true
+	case <-d.stoplistener:
+		return false
+	}
+}
+
+// nextBackoff doubles the backoff up to the maximum
+func (d *dockerMonitor) nextBackoff(backoff time.Duration) time.Duration {
+
+	if backoff*2 > d.maxBackoff {
+		return d.maxBackoff
+	}
+
+	return backoff * 2
+}
+
+// resyncContainers reconciles the PUs with the running containers after a
+// reconnection. The PUs of the containers that are gone are stopped and the
+// containers started in the meantime are activated.
+func (d *dockerMonitor) resyncContainers() error {
+
+	log.WithFields(log.Fields{
+		"package": "monitor",
+	}).Debug("Reconciling the containers after a reconnection")
+
+	containers, err := d.dockerClient.ContainerList(context.Background(), types.ContainerListOptions{})
+
+	if err != nil {
+		return fmt.Errorf("Error Getting ContainerList: %s", err)
+	}
+
+	running := map[string]bool{}
+
+	for _, c := range containers {
+		contextID, err := contextIDFromDockerID(c.ID)
+		if err != nil {
+			continue
+		}
+
+		running[contextID] = true
+
+		if d.isActive(contextID) {
+			continue
+		}
+
+		container, err := d.dockerClient.ContainerInspect(context.Background(), c.ID)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"package":   "monitor",
+				"contextID": contextID,
+				"error":     err.Error(),
+			}).Error("Error Syncing new Container")
+			continue
+		}
+
+		if err := d.startDockerContainer(&container); err != nil {
+			log.WithFields(log.Fields{
+				"package":   "monitor",
+				"contextID": contextID,
+				"error":     err.Error(),
+			}).Error("Error Syncing new Container")
+		}
+	}
+
+	for _, contextID := range d.activeContexts() {
+		if running[contextID] {
+			continue
+		}
+
+		d.collector.CollectContainerEvent(contextID, "", nil, collector.ContainerStop)
+
+		if err := d.stopProcessingUnit(contextID); err != nil {
+			log.WithFields(log.Fields{
+				"package":   "monitor",
+				"contextID": contextID,
+				"error":     err.Error(),
+			}).Error("Error stopping removed Container")
+		}
+	}
+
+	return nil
+}
+
+// Health returns the state of the connection to the docker daemon
+func (d *dockerMonitor) Health() Health {
+
+	d.healthLock.Lock()
+	defer d.healthLock.Unlock()
+
+	return d.health
+}
+
+func (d *dockerMonitor) setConnected(reconnected bool) {
+
+	d.healthLock.Lock()
+	defer d.healthLock.Unlock()
+
+	d.health.Connected = true
+	d.health.Since = time.Now()
+	if reconnected {
+		d.health.Reconnections++
+	}
+}
+
+func (d *dockerMonitor) setDisconnected(err error) {
+
+	d.healthLock.Lock()
+	defer d.healthLock.Unlock()
+
+	if d.health.Connected {
+		d.health.Since = time.Now()
+	}
+	d.health.Connected = false
+	d.health.LastError = err.Error()
+}
+
+// setActive records whether the PU of a container is active
+func (d *dockerMonitor) setActive(contextID string, active bool) {
+
+	d.activeLock.Lock()
+	defer d.activeLock.Unlock()
+
+	if active {
+		d.active[contextID] = true
+		return
+	}
+
+	delete(d.active, contextID)
+}
+
+func (d *dockerMonitor) isActive(contextID string) bool {
+
+	d.activeLock.Lock()
+	defer d.activeLock.Unlock()
+
+	return d.active[contextID]
+}
+
+func (d *dockerMonitor) activeContexts() []string {
+
+	d.activeLock.Lock()
+	defer d.activeLock.Unlock()
+
+	contexts := make([]string, 0, len(d.active))
+	for contextID := range d.active {
+		contexts = append(contexts, contextID)
+	}
+
+	return contexts
+}
+
 // syncContainers resyncs all the existing containers on the Host, using the
 // same process as when a container is initially spawn up
 func (d *dockerMonitor) syncContainers() error {
@@ -318,7 +630,9 @@ func (d *dockerMonitor) syncContainers() error {
 				"package": "monitor",
 				"error":   err.Error(),
 			}).Error("Error Syncing existing Container")
+			continue
 		}
+
 		if err := d.startDockerContainer(&container); err != nil {
 			log.WithFields(log.Fields{
 				"package": "monitor",
@@ -346,6 +660,18 @@ func (d *dockerMonitor) startDockerContainer(dockerInfo *types.ContainerJSON) er
 		return nil
 	}
 
+	// The containers that join the network namespace of another container,
+	// like the containers of a pod, are part of the PU of that container
+	if dockerInfo.HostConfig != nil && dockerInfo.HostConfig.NetworkMode.IsContainer() {
+		log.WithFields(log.Fields{
+			"package":   "monitor",
+			"dockerID":  dockerInfo.ID,
+			"namespace": dockerInfo.HostConfig.NetworkMode.ConnectedContainer(),
+		}).Debug("Container shares the network of another container - Activation not needed.")
+
+		return nil
+	}
+
 	contextID, err := contextIDFromDockerID(dockerInfo.ID)
 
 	if err != nil {
@@ -393,6 +719,8 @@ func (d *dockerMonitor) startDockerContainer(dockerInfo *types.ContainerJSON) er
 		return fmt.Errorf("Policy cound't be set - container was killed")
 	}
 
+	d.setActive(contextID, true)
+
 	d.collector.CollectContainerEvent(contextID, ip, runtimeInfo.Tags(), collector.ContainerStart)
 
 	return nil
@@ -416,6 +744,14 @@ func (d *dockerMonitor) stopDockerContainer(dockerID string) error {
 		return fmt.Errorf("Couldn't generate ContextID: %s", err)
 	}
 
+	return d.stopProcessingUnit(contextID)
+}
+
+// stopProcessingUnit sends a stop event for the PU of a container
+func (d *dockerMonitor) stopProcessingUnit(contextID string) error {
+
+	d.setActive(contextID, false)
+
 	errChan := d.puHandler.HandlePUEvent(contextID, EventStop)
 	return <-errChan
 }
@@ -436,7 +772,7 @@ func (d *dockerMonitor) extractMetadata(dockerInfo *types.ContainerJSON) (*polic
 		return d.metadataExtractor(dockerInfo)
 	}
 
-	return defaultDockerMetadataExtractor(dockerInfo)
+	return DefaultDockerMetadataExtractor(dockerInfo)
 }
 
 // handleCreateEvent generates a create event type.
@@ -579,23 +915,75 @@ func (d *dockerMonitor) handleUnpauseEvent(event *events.Message) error {
 	return <-errChan
 }
 
+// handleNetworkConnectEvent updates the PU of a container that joined a network
 func (d *dockerMonitor) handleNetworkConnectEvent(event *events.Message) error {
 
 	log.WithFields(log.Fields{
 		"package": "monitor",
 	}).Debug("Monitor handled network connect event")
 
-	id := event.Actor.Attributes["container"]
+	return d.updateDockerContainer(event.Actor.Attributes["container"])
+}
 
-	_, err := d.dockerClient.ContainerInspect(context.Background(), id)
+// handleNetworkDisconnectEvent updates the PU of a container that left a network
+func (d *dockerMonitor) handleNetworkDisconnectEvent(event *events.Message) error {
+
+	log.WithFields(log.Fields{
+		"package": "monitor",
+	}).Debug("Monitor handled network disconnect event")
+
+	return d.updateDockerContainer(event.Actor.Attributes["container"])
+}
+
+// updateDockerContainer extracts the metadata of a running container again and
+// sends it upstream with an update event, so that the policy of the PU is
+// resolved again and enforced on its new addresses. Containers that are not
+// running are activated by their start event.
+func (d *dockerMonitor) updateDockerContainer(dockerID string) error {
+
+	contextID, err := contextIDFromDockerID(dockerID)
+
+	if err != nil {
+		return fmt.Errorf("Error Generating ContextID: %s", err)
+	}
+
+	info, err := d.dockerClient.ContainerInspect(context.Background(), dockerID)
 
 	if err != nil {
 		log.WithFields(log.Fields{
-			"package": "monitor",
-			"error":   err.Error(),
+			"package":   "monitor",
+			"contextID": contextID,
+			"error":     err.Error(),
 		}).Error("Failed to read the affected container.")
 		return err
 	}
 
+	if !info.State.Running {
+		log.WithFields(log.Fields{
+			"package":   "monitor",
+			"contextID": contextID,
+		}).Debug("Container is not running - Update not needed.")
+
+		return nil
+	}
+
+	runtimeInfo, err := d.extractMetadata(&info)
+
+	if err != nil {
+		return fmt.Errorf("Error getting some of the Docker primitives: %s", err)
+	}
+
+	if err := d.puHandler.SetPURuntime(contextID, runtimeInfo); err != nil {
+		return fmt.Errorf("Error setting the runtime of the container: %s", err)
+	}
+
+	errChan := d.puHandler.HandlePUEvent(contextID, EventUpdate)
+	if err := <-errChan; err != nil {
+		return err
+	}
+
+	// The update activates the PU if its start was missed
+	d.setActive(contextID, true)
+
 	return nil
 }
@@ -0,0 +1,290 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aporeto-inc/trireme/collector"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testDockerID = "0123456789ab0123456789ab"
+
+// testDockerClient is a Docker client serving the containers it holds and
+// streaming the events pushed in its messages channel
+type testDockerClient struct {
+	sync.Mutex
+	containers map[string]types.ContainerJSON
+	messages   chan events.Message
+	errs       chan error
+	listErr    error
+}
+
+func newTestDockerClient() *testDockerClient {
+	return &testDockerClient{
+		containers: map[string]types.ContainerJSON{},
+		messages:   make(chan events.Message),
+		errs:       make(chan error),
+	}
+}
+
+func (c *testDockerClient) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	return c.messages, c.errs
+}
+
+func (c *testDockerClient) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.listErr != nil {
+		return nil, c.listErr
+	}
+
+	list := []types.Container{}
+	for id, info := range c.containers {
+		if options.All || info.State.Running {
+			list = append(list, types.Container{ID: id})
+		}
+	}
+	return list, nil
+}
+
+func (c *testDockerClient) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	info, ok := c.containers[containerID]
+	if !ok {
+		return types.ContainerJSON{}, fmt.Errorf("No such container: %s", containerID)
+	}
+	return info, nil
+}
+
+func (c *testDockerClient) ContainerStop(ctx context.Context, containerID string, timeout *time.Duration) error {
+	return nil
+}
+
+// setContainer adds or replaces a container attached to the given networks
+func (c *testDockerClient) setContainer(id string, running bool, networks map[string]string) {
+	c.Lock()
+	defer c.Unlock()
+
+	settings := &types.NetworkSettings{
+		Networks: map[string]*network.EndpointSettings{},
+	}
+	for name, ip := range networks {
+		settings.Networks[name] = &network.EndpointSettings{IPAddress: ip}
+	}
+
+	c.containers[id] = types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:    id,
+			Name:  "/container",
+			State: &types.ContainerState{Running: running, Pid: 100},
+		},
+		Config:          &container.Config{Image: "image"},
+		NetworkSettings: settings,
+	}
+}
+
+func (c *testDockerClient) removeContainer(id string) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.containers, id)
+}
+
+func (c *testDockerClient) setListError(err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.listErr = err
+}
+
+func networkEvent(action DockerEvent, id string) events.Message {
+	return events.Message{
+		Type:   events.NetworkEventType,
+		Action: string(action),
+		Actor: events.Actor{
+			ID:         "network",
+			Attributes: map[string]string{"container": id},
+		},
+	}
+}
+
+// waitForEvents waits until the handler received n events
+func waitForEvents(h *testPUHandler, n int) []string {
+	for i := 0; i < 100; i++ {
+		if events := h.Events(); len(events) >= n {
+			return events
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return h.Events()
+}
+
+func TestNetworkEvents(t *testing.T) {
+
+	Convey("Given a started docker monitor", t, func() {
+		cli := newTestDockerClient()
+		h := newTestPUHandler()
+		d := newDockerMonitor(cli, h, nil, &collector.DefaultCollector{}, false)
+		So(d.Start(), ShouldBeNil)
+		defer d.Stop()
+
+		contextID := testDockerID[:12]
+
+		Convey("When a running container joins a network", func() {
+			cli.setContainer(testDockerID, true, map[string]string{
+				"bridge": "172.17.0.2",
+				"front":  "10.1.0.2",
+			})
+			cli.messages <- networkEvent(DockerEventConnect, testDockerID)
+
+			Convey("The PU should be updated with the new address", func() {
+				So(waitForEvents(h, 1), ShouldResemble, []string{contextID + ":" + EventUpdate})
+
+				h.Lock()
+				ip, ok := h.runtimes[contextID].IPAddresses().Get("front")
+				h.Unlock()
+				So(ok, ShouldBeTrue)
+				So(ip, ShouldEqual, "10.1.0.2")
+			})
+
+			Convey("When it leaves the network", func() {
+				So(waitForEvents(h, 1), ShouldHaveLength, 1)
+
+				cli.setContainer(testDockerID, true, map[string]string{
+					"bridge": "172.17.0.2",
+				})
+				cli.messages <- networkEvent(DockerEventDisconnect, testDockerID)
+
+				Convey("The PU should be updated without the address", func() {
+					So(waitForEvents(h, 2), ShouldHaveLength, 2)
+
+					h.Lock()
+					_, ok := h.runtimes[contextID].IPAddresses().Get("front")
+					h.Unlock()
+					So(ok, ShouldBeFalse)
+				})
+			})
+		})
+
+		Convey("When a container that is not running joins a network", func() {
+			cli.setContainer(testDockerID, false, map[string]string{
+				"bridge": "172.17.0.2",
+			})
+			cli.messages <- networkEvent(DockerEventConnect, testDockerID)
+
+			other := "ba9876543210ba9876543210"
+			cli.setContainer(other, true, map[string]string{
+				"bridge": "172.17.0.3",
+			})
+			cli.messages <- networkEvent(DockerEventConnect, other)
+
+			Convey("Its PU should not be updated", func() {
+				So(waitForEvents(h, 1), ShouldResemble, []string{other[:12] + ":" + EventUpdate})
+			})
+		})
+
+		Convey("When the new runtime of a container cannot be set", func() {
+			cli.setContainer(testDockerID, true, map[string]string{
+				"bridge": "172.17.0.2",
+			})
+
+			h.Lock()
+			h.runtimeErr = fmt.Errorf("Error")
+			h.Unlock()
+
+			err := d.updateDockerContainer(testDockerID)
+
+			Convey("I should get an error and the PU should not be updated", func() {
+				So(err, ShouldNotBeNil)
+				So(h.Events(), ShouldBeEmpty)
+			})
+		})
+
+		Convey("When a network is created", func() {
+			cli.setContainer(testDockerID, true, map[string]string{
+				"bridge": "172.17.0.2",
+			})
+			created := networkEvent(DockerEventCreate, testDockerID)
+			created.ID = testDockerID
+			cli.messages <- created
+			cli.messages <- networkEvent(DockerEventConnect, testDockerID)
+
+			Convey("The event should not be handled as a container event", func() {
+				So(waitForEvents(h, 1), ShouldResemble, []string{contextID + ":" + EventUpdate})
+			})
+		})
+	})
+}
+
+// waitForHealth waits until the health of the monitor matches
+func waitForHealth(d *dockerMonitor, match func(Health) bool) Health {
+	for i := 0; i < 100; i++ {
+		if health := d.Health(); match(health) {
+			return health
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return d.Health()
+}
+
+func TestReconnection(t *testing.T) {
+
+	Convey("Given a docker monitor that synchronized a running container", t, func() {
+		cli := newTestDockerClient()
+		cli.setContainer(testDockerID, true, map[string]string{"bridge": "172.17.0.2"})
+
+		h := newTestPUHandler()
+		d := newDockerMonitor(cli, h, nil, &collector.DefaultCollector{}, true)
+		d.minBackoff = time.Millisecond
+		d.maxBackoff = 10 * time.Millisecond
+		So(d.Start(), ShouldBeNil)
+		defer d.Stop()
+
+		So(h.Events(), ShouldResemble, []string{testDockerID[:12] + ":" + EventStart})
+		So(waitForHealth(d, func(h Health) bool { return h.Connected }).Connected, ShouldBeTrue)
+
+		Convey("When the daemon restarts and the containers changed", func() {
+			other := "ba9876543210ba9876543210"
+			cli.setListError(fmt.Errorf("Cannot connect to the Docker daemon"))
+			cli.removeContainer(testDockerID)
+			cli.setContainer(other, true, map[string]string{"bridge": "172.17.0.3"})
+
+			cli.errs <- io.EOF
+
+			Convey("The monitor should report the lost connection", func() {
+				health := waitForHealth(d, func(h Health) bool {
+					return h.LastError == "Error Getting ContainerList: Cannot connect to the Docker daemon"
+				})
+				So(health.Connected, ShouldBeFalse)
+				So(h.Events(), ShouldHaveLength, 1)
+
+				Convey("When the daemon is back", func() {
+					cli.setListError(nil)
+
+					Convey("The monitor should reconnect and reconcile the containers", func() {
+						So(waitForHealth(d, func(h Health) bool { return h.Connected }).Reconnections, ShouldEqual, 1)
+
+						events := waitForEvents(h, 3)
+						So(events, ShouldHaveLength, 3)
+						So(events, ShouldContain, other[:12]+":"+EventStart)
+						So(events, ShouldContain, testDockerID[:12]+":"+EventStop)
+						So(d.isActive(other[:12]), ShouldBeTrue)
+						So(d.isActive(testDockerID[:12]), ShouldBeFalse)
+					})
+				})
+			})
+		})
+	})
+}
@@ -0,0 +1,340 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+)
+
+// DockerRecordType is the type of a recorded interaction with the Docker daemon
+type DockerRecordType string
+
+const (
+	// DockerRecordStream marks the start of an event stream
+	DockerRecordStream DockerRecordType = "stream"
+
+	// DockerRecordEvent is an event received on the current event stream
+	DockerRecordEvent DockerRecordType = "event"
+
+	// DockerRecordStreamError is the error that ended the current event stream
+	DockerRecordStreamError DockerRecordType = "streamerror"
+
+	// DockerRecordInspect is the response to a ContainerInspect
+	DockerRecordInspect DockerRecordType = "inspect"
+
+	// DockerRecordList is the response to a ContainerList
+	DockerRecordList DockerRecordType = "list"
+)
+
+// A DockerRecord is a recorded interaction with the Docker daemon. Recordings
+// are written as one JSON record per line.
+type DockerRecord struct {
+	Type       DockerRecordType
+	ID         string               `json:",omitempty"`
+	Event      *events.Message      `json:",omitempty"`
+	Container  *types.ContainerJSON `json:",omitempty"`
+	Containers []types.Container    `json:",omitempty"`
+	Error      string               `json:",omitempty"`
+}
+
+// NewDockerClient returns a client of the Docker API with the given socketType
+// ('tcp' or 'unix') and socketAddress
+func NewDockerClient(socketType string, socketAddress string) (DockerClient, error) {
+
+	cli, err := initDockerClient(socketType, socketAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	return cli, nil
+}
+
+// recordingDockerClient records the events and the responses of a Docker client
+type recordingDockerClient struct {
+	sync.Mutex
+	client  DockerClient
+	encoder *json.Encoder
+}
+
+// NewRecordingDockerClient returns a Docker client that writes the events and
+// the container information returned by the given client to w, so that they
+// can be replayed by a ReplayDockerClient.
+func NewRecordingDockerClient(client DockerClient, w io.Writer) DockerClient {
+
+	return &recordingDockerClient{
+		client:  client,
+		encoder: json.NewEncoder(w),
+	}
+}
+
+func (r *recordingDockerClient) record(record *DockerRecord) {
+
+	r.Lock()
+	defer r.Unlock()
+
+	if err := r.encoder.Encode(record); err != nil {
+		log.WithFields(log.Fields{
+			"package": "monitor",
+			"error":   err.Error(),
+		}).Warn("Cannot record docker interaction")
+	}
+}
+
+// Events records the events of the stream until it ends or the context is
+// cancelled
+func (r *recordingDockerClient) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+
+	r.record(&DockerRecord{Type: DockerRecordStream})
+
+	messages, errs := r.client.Events(ctx, options)
+
+	out := make(chan events.Message)
+	outErrs := make(chan error, 1)
+
+	go func() {
+		for {
+			select {
+			case message, ok := <-messages:
+				if !ok {
+					r.record(&DockerRecord{Type: DockerRecordStreamError})
+					close(out)
+					return
+				}
+
+				r.record(&DockerRecord{Type: DockerRecordEvent, Event: &message})
+
+				select {
+				case out <- message:
+				case <-ctx.Done():
+					return
+				}
+			case err := <-errs:
+				record := &DockerRecord{Type: DockerRecordStreamError}
+				if err != nil && err != io.EOF {
+					record.Error = err.Error()
+				}
+				r.record(record)
+
+				outErrs <- err
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out, outErrs
+}
+
+func (r *recordingDockerClient) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+
+	containers, err := r.client.ContainerList(ctx, options)
+
+	record := &DockerRecord{Type: DockerRecordList, Containers: containers}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	r.record(record)
+
+	return containers, err
+}
+
+func (r *recordingDockerClient) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+
+	info, err := r.client.ContainerInspect(ctx, containerID)
+
+	record := &DockerRecord{Type: DockerRecordInspect, ID: containerID}
+	if err != nil {
+		record.Error = err.Error()
+	} else {
+		record.Container = &info
+	}
+	r.record(record)
+
+	return info, err
+}
+
+func (r *recordingDockerClient) ContainerStop(ctx context.Context, containerID string, timeout *time.Duration) error {
+
+	return r.client.ContainerStop(ctx, containerID, timeout)
+}
+
+// replayStream is a recorded event stream
+type replayStream struct {
+	events []events.Message
+	err    *DockerRecord
+}
+
+// A ReplayDockerClient is a Docker client replaying a recording without a
+// Docker daemon. Each call to Events replays the next recorded stream. The
+// responses to ContainerInspect and ContainerList are returned in the order
+// they were recorded, the last one being returned again once they are all
+// consumed. Containers are never stopped, the calls to ContainerStop are only
+// remembered.
+type ReplayDockerClient struct {
+	sync.Mutex
+	streams  []*replayStream
+	inspects map[string][]*DockerRecord
+	lists    []*DockerRecord
+	stopped  []string
+}
+
+// NewReplayDockerClient returns a ReplayDockerClient replaying the recording
+// read from r
+func NewReplayDockerClient(r io.Reader) (*ReplayDockerClient, error) {
+
+	c := &ReplayDockerClient{
+		inspects: map[string][]*DockerRecord{},
+	}
+
+	var stream *replayStream
+
+	decoder := json.NewDecoder(r)
+
+	for {
+		record := &DockerRecord{}
+		if err := decoder.Decode(record); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("Invalid docker recording: %s", err)
+		}
+
+		switch record.Type {
+		case DockerRecordStream:
+			stream = &replayStream{}
+			c.streams = append(c.streams, stream)
+		case DockerRecordEvent:
+			if stream == nil || record.Event == nil {
+				return nil, fmt.Errorf("Invalid docker recording: event outside of a stream")
+			}
+			stream.events = append(stream.events, *record.Event)
+		case DockerRecordStreamError:
+			if stream == nil {
+				return nil, fmt.Errorf("Invalid docker recording: stream error outside of a stream")
+			}
+			stream.err = record
+			stream = nil
+		case DockerRecordInspect:
+			c.inspects[record.ID] = append(c.inspects[record.ID], record)
+		case DockerRecordList:
+			c.lists = append(c.lists, record)
+		default:
+			return nil, fmt.Errorf("Invalid docker recording: unknown record type %s", record.Type)
+		}
+	}
+
+	return c, nil
+}
+
+// Events replays the next recorded stream. The stream stays open once all its
+// events are sent, unless it was ended by an error.
+func (c *ReplayDockerClient) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+
+	c.Lock()
+	stream := &replayStream{}
+	if len(c.streams) > 0 {
+		stream = c.streams[0]
+		c.streams = c.streams[1:]
+	}
+	c.Unlock()
+
+	messages := make(chan events.Message)
+	errs := make(chan error, 1)
+
+	go func() {
+		for _, event := range stream.events {
+			select {
+			case messages <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if stream.err == nil {
+			return
+		}
+
+		if stream.err.Error == "" {
+			errs <- io.EOF
+			return
+		}
+
+		errs <- errors.New(stream.err.Error)
+	}()
+
+	return messages, errs
+}
+
+// ContainerList returns the next recorded list of containers
+func (c *ReplayDockerClient) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+
+	c.Lock()
+	defer c.Unlock()
+
+	if len(c.lists) == 0 {
+		return []types.Container{}, nil
+	}
+
+	record := c.lists[0]
+	if len(c.lists) > 1 {
+		c.lists = c.lists[1:]
+	}
+
+	if record.Error != "" {
+		return nil, errors.New(record.Error)
+	}
+
+	return record.Containers, nil
+}
+
+// ContainerInspect returns the next recorded information of the container
+func (c *ReplayDockerClient) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+
+	c.Lock()
+	defer c.Unlock()
+
+	records := c.inspects[containerID]
+	if len(records) == 0 {
+		return types.ContainerJSON{}, fmt.Errorf("No such container: %s", containerID)
+	}
+
+	record := records[0]
+	if len(records) > 1 {
+		c.inspects[containerID] = records[1:]
+	}
+
+	if record.Error != "" {
+		return types.ContainerJSON{}, errors.New(record.Error)
+	}
+
+	return *record.Container, nil
+}
+
+// ContainerStop remembers that the container was stopped
+func (c *ReplayDockerClient) ContainerStop(ctx context.Context, containerID string, timeout *time.Duration) error {
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.stopped = append(c.stopped, containerID)
+
+	return nil
+}
+
+// Stopped returns the IDs of the containers stopped by the monitor
+func (c *ReplayDockerClient) Stopped() []string {
+
+	c.Lock()
+	defer c.Unlock()
+
+	return append([]string(nil), c.stopped...)
+}
@@ -0,0 +1,204 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/aporeto-inc/trireme/collector"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func containerEvent(action DockerEvent, id string) events.Message {
+	return events.Message{
+		Type:   events.ContainerEventType,
+		Action: string(action),
+		ID:     id,
+		Actor:  events.Actor{ID: id},
+	}
+}
+
+func replayContainer(id string, running bool) *types.ContainerJSON {
+	return &types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:    id,
+			Name:  "/container",
+			State: &types.ContainerState{Running: running, Pid: 100},
+		},
+		Config:          &container.Config{Image: "image"},
+		NetworkSettings: &types.NetworkSettings{},
+	}
+}
+
+// newReplay returns a client replaying the given records
+func newReplay(records ...*DockerRecord) *ReplayDockerClient {
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	for _, record := range records {
+		encoder.Encode(record)
+	}
+
+	c, err := NewReplayDockerClient(buf)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func eventRecord(action DockerEvent, id string) *DockerRecord {
+	event := containerEvent(action, id)
+	return &DockerRecord{Type: DockerRecordEvent, Event: &event}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+
+	Convey("Given a docker monitor recording a daemon with a running container", t, func() {
+		first := testDockerID
+		second := "ba9876543210ba9876543210"
+
+		cli := newTestDockerClient()
+		cli.setContainer(first, true, nil)
+
+		recording := &bytes.Buffer{}
+		h := newTestPUHandler()
+		d := NewDockerMonitorWithClient(NewRecordingDockerClient(cli, recording), h, nil, &collector.DefaultCollector{}, true)
+		So(d.Start(), ShouldBeNil)
+
+		Convey("When a container is started and the other one is removed", func() {
+			cli.messages <- containerEvent(DockerEventCreate, second)
+			cli.setContainer(second, true, nil)
+			cli.messages <- containerEvent(DockerEventStart, second)
+			cli.messages <- containerEvent(DockerEventDie, first)
+			cli.messages <- containerEvent(DockerEventDestroy, first)
+
+			recorded := waitForEvents(h, 5)
+			d.Stop()
+
+			So(recorded, ShouldResemble, []string{
+				first[:12] + ":" + EventStart,
+				second[:12] + ":" + EventCreate,
+				second[:12] + ":" + EventStart,
+				first[:12] + ":" + EventStop,
+				first[:12] + ":" + EventDestroy,
+			})
+
+			Convey("Replaying the recording should produce the same events", func() {
+				replay, err := NewReplayDockerClient(recording)
+				So(err, ShouldBeNil)
+
+				replayed := newTestPUHandler()
+				r := NewDockerMonitorWithClient(replay, replayed, nil, &collector.DefaultCollector{}, true)
+				So(r.Start(), ShouldBeNil)
+				defer r.Stop()
+
+				So(waitForEvents(replayed, 5), ShouldResemble, recorded)
+			})
+		})
+	})
+}
+
+func TestReplay(t *testing.T) {
+
+	Convey("Given a recording of a container that died before it was inspected", t, func() {
+		replay := newReplay(
+			&DockerRecord{Type: DockerRecordList},
+			&DockerRecord{Type: DockerRecordStream},
+			eventRecord(DockerEventCreate, testDockerID),
+			eventRecord(DockerEventStart, testDockerID),
+			eventRecord(DockerEventDie, testDockerID),
+			eventRecord(DockerEventDestroy, testDockerID),
+			&DockerRecord{Type: DockerRecordInspect, ID: testDockerID, Container: replayContainer(testDockerID, false)},
+		)
+
+		Convey("When I replay it", func() {
+			h := newTestPUHandler()
+			d := NewDockerMonitorWithClient(replay, h, nil, &collector.DefaultCollector{}, true)
+			So(d.Start(), ShouldBeNil)
+			defer d.Stop()
+
+			Convey("The container should not be activated", func() {
+				So(waitForEvents(h, 3), ShouldResemble, []string{
+					testDockerID[:12] + ":" + EventCreate,
+					testDockerID[:12] + ":" + EventStop,
+					testDockerID[:12] + ":" + EventDestroy,
+				})
+				So(replay.Stopped(), ShouldBeEmpty)
+			})
+		})
+	})
+
+	Convey("Given a recording of a synchronization where a container disappeared", t, func() {
+		other := "ba9876543210ba9876543210"
+		replay := newReplay(
+			&DockerRecord{Type: DockerRecordList, Containers: []types.Container{{ID: testDockerID}, {ID: other}}},
+			&DockerRecord{Type: DockerRecordInspect, ID: testDockerID, Error: "No such container: " + testDockerID},
+			&DockerRecord{Type: DockerRecordInspect, ID: other, Container: replayContainer(other, true)},
+		)
+
+		Convey("When I replay it", func() {
+			h := newTestPUHandler()
+			d := NewDockerMonitorWithClient(replay, h, nil, &collector.DefaultCollector{}, true)
+			So(d.Start(), ShouldBeNil)
+			defer d.Stop()
+
+			Convey("Only the remaining container should be activated", func() {
+				So(h.Events(), ShouldResemble, []string{other[:12] + ":" + EventStart})
+			})
+		})
+	})
+
+	Convey("Given a recording of a container that cannot be inspected when it starts", t, func() {
+		replay := newReplay(
+			&DockerRecord{Type: DockerRecordStream},
+			eventRecord(DockerEventStart, testDockerID),
+			eventRecord(DockerEventDestroy, testDockerID),
+			&DockerRecord{Type: DockerRecordInspect, ID: testDockerID, Error: "Cannot connect to the Docker daemon"},
+		)
+
+		Convey("When I replay it", func() {
+			h := newTestPUHandler()
+			d := NewDockerMonitorWithClient(replay, h, nil, &collector.DefaultCollector{}, false)
+			So(d.Start(), ShouldBeNil)
+			defer d.Stop()
+
+			Convey("The container should be stopped", func() {
+				So(waitForEvents(h, 1), ShouldResemble, []string{testDockerID[:12] + ":" + EventDestroy})
+				So(replay.Stopped(), ShouldResemble, []string{testDockerID})
+			})
+		})
+	})
+
+	Convey("Given a recording of a synchronization of the containers of a pod", t, func() {
+		sibling := "ba9876543210ba9876543210"
+		app := replayContainer(sibling, true)
+		app.HostConfig = &container.HostConfig{NetworkMode: container.NetworkMode("container:" + testDockerID)}
+
+		replay := newReplay(
+			&DockerRecord{Type: DockerRecordList, Containers: []types.Container{{ID: testDockerID}, {ID: sibling}}},
+			&DockerRecord{Type: DockerRecordInspect, ID: testDockerID, Container: replayContainer(testDockerID, true)},
+			&DockerRecord{Type: DockerRecordInspect, ID: sibling, Container: app},
+		)
+
+		Convey("When I replay it", func() {
+			h := newTestPUHandler()
+			d := NewDockerMonitorWithClient(replay, h, nil, &collector.DefaultCollector{}, true)
+			So(d.Start(), ShouldBeNil)
+			defer d.Stop()
+
+			Convey("Only the container owning the network namespace should be activated", func() {
+				So(h.Events(), ShouldResemble, []string{testDockerID[:12] + ":" + EventStart})
+			})
+		})
+	})
+
+	Convey("When I read an invalid recording", t, func() {
+		_, err := NewReplayDockerClient(bytes.NewBufferString(`{"Type":"event"}`))
+
+		Convey("I should get an error", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
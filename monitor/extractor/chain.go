@@ -0,0 +1,194 @@
+package extractor
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aporeto-inc/trireme/monitor"
+	"github.com/aporeto-inc/trireme/policy"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// SwarmServiceLabel is the label of the containers of a swarm service
+const SwarmServiceLabel = "com.docker.swarm.service.id"
+
+// A Link is an extractor of a chain
+type Link struct {
+
+	// Extractor extracts the runtime of the link
+	Extractor monitor.DockerMetadataExtractor
+
+	// Namespace is prefixed to the keys of the tags of the link, separated by
+	// a colon. The keys are kept as they are if it is empty.
+	Namespace string
+
+	// Optional links are skipped when they fail. The chain fails otherwise.
+	Optional bool
+}
+
+// An ImageInspector returns the information of a Docker image
+type ImageInspector interface {
+	ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error)
+}
+
+// A ServiceInspector returns the information of a swarm service
+type ServiceInspector interface {
+	ServiceInspectWithRaw(ctx context.Context, serviceID string) (swarm.Service, []byte, error)
+}
+
+// NewChainExtractor returns a metadata extractor for Docker that merges the
+// runtimes of the links. The tags of a link take precedence over the tags of
+// the links before it. The name, the pid and the IP addresses are the ones of
+// the first link that provides them.
+func NewChainExtractor(links ...Link) monitor.DockerMetadataExtractor {
+
+	return func(info *types.ContainerJSON) (*policy.PURuntime, error) {
+
+		if info == nil {
+			return nil, fmt.Errorf("DockerInfo is empty")
+		}
+
+		name := ""
+		pid := 0
+		ips := policy.NewIPMap(nil)
+		tags := policy.NewTagsMap(nil)
+
+		for n, link := range links {
+			r, err := link.Extractor(info)
+			if err != nil {
+				if link.Optional {
+					log.WithFields(log.Fields{
+						"package":   "extractor",
+						"link":      n,
+						"namespace": link.Namespace,
+						"error":     err.Error(),
+					}).Debug("Skipping failed optional extractor")
+					continue
+				}
+				return nil, fmt.Errorf("Extractor %d of the chain failed: %s", n, err)
+			}
+
+			if r == nil {
+				continue
+			}
+
+			if name == "" {
+				name = r.Name()
+			}
+
+			if pid == 0 {
+				pid = r.Pid()
+			}
+
+			if len(ips.IPs) == 0 {
+				ips = r.IPAddresses()
+			}
+
+			for k, v := range r.Tags().Tags {
+				tags.Add(namespacedKey(link.Namespace, k), v)
+			}
+		}
+
+		return policy.NewPURuntime(name, pid, tags, ips), nil
+	}
+}
+
+// namespacedKey returns the key of a tag in a namespace
+func namespacedKey(namespace, key string) string {
+
+	if namespace == "" {
+		return key
+	}
+
+	return namespace + ":" + key
+}
+
+// NewEnvironmentExtractor returns an extractor whose tags are the environment
+// variables of the container that are in the whitelist
+func NewEnvironmentExtractor(whitelist []string) monitor.DockerMetadataExtractor {
+
+	allowed := map[string]bool{}
+	for _, name := range whitelist {
+		allowed[name] = true
+	}
+
+	return func(info *types.ContainerJSON) (*policy.PURuntime, error) {
+
+		tags := policy.NewTagsMap(nil)
+
+		if info.Config == nil {
+			return policy.NewPURuntime("", 0, tags, nil), nil
+		}
+
+		for _, env := range info.Config.Env {
+			kv := strings.SplitN(env, "=", 2)
+			if len(kv) != 2 || !allowed[kv[0]] {
+				continue
+			}
+			tags.Add(kv[0], kv[1])
+		}
+
+		return policy.NewPURuntime("", 0, tags, nil), nil
+	}
+}
+
+// NewImageExtractor returns an extractor whose tags are the labels of the image
+// of the container and its repository digest
+func NewImageExtractor(cli ImageInspector) monitor.DockerMetadataExtractor {
+
+	return func(info *types.ContainerJSON) (*policy.PURuntime, error) {
+
+		image, _, err := cli.ImageInspectWithRaw(context.Background(), info.Image)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot inspect image %s: %s", info.Image, err)
+		}
+
+		tags := policy.NewTagsMap(nil)
+
+		if image.Config != nil {
+			for k, v := range image.Config.Labels {
+				tags.Add(k, v)
+			}
+		}
+
+		if len(image.RepoDigests) > 0 {
+			tags.Add("digest", image.RepoDigests[0])
+		}
+
+		return policy.NewPURuntime("", 0, tags, nil), nil
+	}
+}
+
+// NewSwarmServiceExtractor returns an extractor whose tags are the labels of
+// the swarm service of the container. Containers that don't belong to a
+// service have no tags.
+func NewSwarmServiceExtractor(cli ServiceInspector) monitor.DockerMetadataExtractor {
+
+	return func(info *types.ContainerJSON) (*policy.PURuntime, error) {
+
+		tags := policy.NewTagsMap(nil)
+
+		if info.Config == nil {
+			return policy.NewPURuntime("", 0, tags, nil), nil
+		}
+
+		serviceID, ok := info.Config.Labels[SwarmServiceLabel]
+		if !ok {
+			return policy.NewPURuntime("", 0, tags, nil), nil
+		}
+
+		service, _, err := cli.ServiceInspectWithRaw(context.Background(), serviceID)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot inspect swarm service %s: %s", serviceID, err)
+		}
+
+		for k, v := range service.Spec.Labels {
+			tags.Add(k, v)
+		}
+
+		return policy.NewPURuntime("", 0, tags, nil), nil
+	}
+}
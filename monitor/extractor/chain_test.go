@@ -0,0 +1,104 @@
+package extractor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aporeto-inc/trireme/monitor"
+	"github.com/aporeto-inc/trireme/policy"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/swarm"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testInspector struct{}
+
+func (i *testInspector) ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error) {
+	return types.ImageInspect{
+		RepoDigests: []string{"nginx@sha256:1234"},
+		Config:      &container.Config{Labels: map[string]string{"maintainer": "web team"}},
+	}, nil, nil
+}
+
+func (i *testInspector) ServiceInspectWithRaw(ctx context.Context, serviceID string) (swarm.Service, []byte, error) {
+	if serviceID != "service" {
+		return swarm.Service{}, nil, fmt.Errorf("No such service: %s", serviceID)
+	}
+	return swarm.Service{
+		ID:   serviceID,
+		Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Labels: map[string]string{"app": "frontend"}}},
+	}, nil, nil
+}
+
+func failingExtractor(info *types.ContainerJSON) (*policy.PURuntime, error) {
+	return nil, fmt.Errorf("CMDB unreachable")
+}
+
+func TestChainExtractor(t *testing.T) {
+
+	Convey("Given a container of a swarm service", t, func() {
+		info := testContainer("/web")
+		info.Image = "sha256:abcd"
+		info.Config.Labels = map[string]string{
+			"app":             "container",
+			"tier":            "front",
+			SwarmServiceLabel: "service",
+		}
+		info.Config.Env = []string{"LOG_LEVEL=debug", "PASSWORD=secret"}
+		info.NetworkSettings.IPAddress = "172.17.0.2"
+
+		cli := &testInspector{}
+
+		Convey("When I chain the default, swarm, environment and image extractors", func() {
+			runtime, err := NewChainExtractor(
+				Link{Extractor: monitor.DefaultDockerMetadataExtractor},
+				Link{Extractor: NewSwarmServiceExtractor(cli)},
+				Link{Extractor: NewEnvironmentExtractor([]string{"LOG_LEVEL"}), Namespace: "env"},
+				Link{Extractor: NewImageExtractor(cli), Namespace: "image"},
+				Link{Extractor: failingExtractor, Optional: true},
+			)(info)
+
+			Convey("The tags should be merged with the later links taking precedence", func() {
+				So(err, ShouldBeNil)
+				So(runtime.Name(), ShouldEqual, "/web")
+				So(runtime.Pid(), ShouldEqual, 10)
+
+				ip, _ := runtime.DefaultIPAddress()
+				So(ip, ShouldEqual, "172.17.0.2")
+
+				So(runtime.Tags().Tags, ShouldResemble, map[string]string{
+					"image":            "nginx",
+					"name":             "/web",
+					"app":              "frontend",
+					"tier":             "front",
+					SwarmServiceLabel:  "service",
+					"env:LOG_LEVEL":    "debug",
+					"image:maintainer": "web team",
+					"image:digest":     "nginx@sha256:1234",
+				})
+			})
+		})
+
+		Convey("When a link that is not optional fails", func() {
+			_, err := NewChainExtractor(
+				Link{Extractor: monitor.DefaultDockerMetadataExtractor},
+				Link{Extractor: failingExtractor},
+			)(info)
+
+			Convey("The chain should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When the service cannot be inspected", func() {
+			info.Config.Labels[SwarmServiceLabel] = "unknown"
+			_, err := NewSwarmServiceExtractor(cli)(info)
+
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
@@ -0,0 +1,384 @@
+package extractor
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aporeto-inc/trireme/monitor"
+	"github.com/aporeto-inc/trireme/policy"
+	"github.com/docker/docker/api/types"
+)
+
+// DefaultExtractorTimeout is the default time given to a persistent extractor
+// to answer a request
+const DefaultExtractorTimeout = 5 * time.Second
+
+// maxResponseSize is the maximum size of a response line
+const maxResponseSize = 1024 * 1024
+
+// maxConsecutiveTimeouts is the number of requests in a row that an extractor
+// can leave unanswered before its connection is opened again
+const maxConsecutiveTimeouts = 3
+
+// ExtractorRequest is a request sent to a persistent extractor. Requests are
+// sent as one JSON object per line.
+type ExtractorRequest struct {
+	ID        uint64
+	Container *types.ContainerJSON
+}
+
+// ExtractorResponse is the response of a persistent extractor to the request
+// with the same ID. Responses are read as one JSON object per line and may be
+// sent in any order.
+type ExtractorResponse struct {
+	ID      uint64
+	Runtime *policy.PURuntime
+	Error   string
+}
+
+// NewPersistentExternalExtractor returns a metadata extractor for Docker that
+// starts the executable given in parameter once and keeps it running. The
+// requests are written on its standard input and the responses are read on
+// its standard output. The executable is started again if it exits. The
+// default extractor is used when the executable fails or doesn't answer within
+// the timeout.
+func NewPersistentExternalExtractor(filePath string, timeout time.Duration) (monitor.DockerMetadataExtractor, error) {
+
+	if filePath == "" {
+		return nil, fmt.Errorf("file argument is empty in NewPersistentExternalExtractor")
+	}
+
+	path, err := exec.LookPath(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("Exec file was not found at filePath %s: %s", filePath, err)
+	}
+
+	e := newPersistentExtractor(func() (*extractorConn, error) {
+		return startExtractorProcess(path)
+	}, timeout)
+
+	return e.extract, nil
+}
+
+// NewSocketExtractor returns a metadata extractor for Docker that speaks the
+// protocol of the persistent extractors with a server listening on the unix
+// socket given in parameter. The connection is opened again if it is closed.
+// The default extractor is used when the server fails or doesn't answer within
+// the timeout.
+func NewSocketExtractor(socketPath string, timeout time.Duration) (monitor.DockerMetadataExtractor, error) {
+
+	if socketPath == "" {
+		return nil, fmt.Errorf("socket argument is empty in NewSocketExtractor")
+	}
+
+	e := newPersistentExtractor(func() (*extractorConn, error) {
+		conn, err := net.DialTimeout("unix", socketPath, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot connect to extractor at %s: %s", socketPath, err)
+		}
+		return newExtractorConn(conn, conn, func() { conn.Close() }), nil
+	}, timeout)
+
+	return e.extract, nil
+}
+
+// persistentExtractor multiplexes the extraction requests on one connection
+// to an extractor
+type persistentExtractor struct {
+	sync.Mutex
+	connect func() (*extractorConn, error)
+	conn    *extractorConn
+	nextID  uint64
+	timeout time.Duration
+
+	// timeouts is the number of consecutive requests left unanswered on conn
+	timeouts int
+}
+
+func newPersistentExtractor(connect func() (*extractorConn, error), timeout time.Duration) *persistentExtractor {
+
+	if timeout <= 0 {
+		timeout = DefaultExtractorTimeout
+	}
+
+	return &persistentExtractor{
+		connect: connect,
+		timeout: timeout,
+	}
+}
+
+// extract sends the container to the extractor and waits for the runtime. The
+// default extractor is used if the extractor cannot be reached.
+func (e *persistentExtractor) extract(dockerInfo *types.ContainerJSON) (*policy.PURuntime, error) {
+
+	if dockerInfo == nil {
+		return nil, fmt.Errorf("DockerInfo is empty")
+	}
+
+	runtime, err := e.request(dockerInfo)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"package": "extractor",
+			"error":   err.Error(),
+		}).Warn("External extractor failed. Using the default extractor")
+
+		return monitor.DefaultDockerMetadataExtractor(dockerInfo)
+	}
+
+	return runtime, nil
+}
+
+// request sends a request to the extractor and waits for its response. The
+// timeout covers both. The connection is closed if the request cannot be
+// written in time or if too many requests in a row are not answered.
+func (e *persistentExtractor) request(dockerInfo *types.ContainerJSON) (*policy.PURuntime, error) {
+
+	conn, id, err := e.connection()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(&ExtractorRequest{ID: id, Container: dockerInfo})
+	if err != nil {
+		return nil, fmt.Errorf("Error marshaling dockerInfo: %s", err)
+	}
+
+	response := conn.register(id)
+	defer conn.unregister(id)
+
+	timer := time.NewTimer(e.timeout)
+	defer timer.Stop()
+
+	written := make(chan error, 1)
+	go func() {
+		written <- conn.write(append(data, '\n'))
+	}()
+
+	select {
+	case err := <-written:
+		if err != nil {
+			conn.close()
+			return nil, fmt.Errorf("Cannot send request to extractor: %s", err)
+		}
+	case <-conn.dead:
+		return nil, fmt.Errorf("Extractor exited before reading the request")
+	case <-timer.C:
+		// The pending write fails once the connection is closed
+		conn.close()
+		return nil, fmt.Errorf("Extractor didn't read the request within %s", e.timeout)
+	}
+
+	select {
+	case r := <-response:
+		e.answered(conn)
+		if r.Error != "" {
+			return nil, fmt.Errorf("Extractor returned an error: %s", r.Error)
+		}
+		if r.Runtime == nil {
+			return nil, fmt.Errorf("Extractor returned no runtime")
+		}
+		return r.Runtime, nil
+	case <-conn.dead:
+		return nil, fmt.Errorf("Extractor exited before answering")
+	case <-timer.C:
+		e.timedOut(conn)
+		return nil, fmt.Errorf("Extractor didn't answer within %s", e.timeout)
+	}
+}
+
+// answered resets the count of the unanswered requests of the connection
+func (e *persistentExtractor) answered(conn *extractorConn) {
+
+	e.Lock()
+	defer e.Unlock()
+
+	if e.conn == conn {
+		e.timeouts = 0
+	}
+}
+
+// timedOut counts an unanswered request of the connection. The connection is
+// closed when too many requests in a row are not answered.
+func (e *persistentExtractor) timedOut(conn *extractorConn) {
+
+	e.Lock()
+	defer e.Unlock()
+
+	if e.conn != conn {
+		return
+	}
+
+	e.timeouts++
+	if e.timeouts < maxConsecutiveTimeouts {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"package":  "extractor",
+		"timeouts": e.timeouts,
+	}).Warn("External extractor doesn't answer. Reconnecting")
+
+	conn.close()
+}
+
+// connection returns the connection to the extractor and an ID for a new
+// request. The connection is opened again if it was closed.
+func (e *persistentExtractor) connection() (*extractorConn, uint64, error) {
+
+	e.Lock()
+	defer e.Unlock()
+
+	if e.conn == nil || e.conn.closed() {
+		conn, err := e.connect()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		log.WithFields(log.Fields{
+			"package": "extractor",
+		}).Debug("Connected to external extractor")
+
+		e.conn = conn
+		e.timeouts = 0
+	}
+
+	e.nextID++
+
+	return e.conn, e.nextID, nil
+}
+
+// extractorConn is a connection to an extractor. The responses are read by a
+// goroutine and dispatched to the pending requests.
+type extractorConn struct {
+	sync.Mutex
+	writeLock sync.Mutex
+	w         io.Writer
+	pending   map[uint64]chan *ExtractorResponse
+	dead      chan struct{}
+	closeOnce sync.Once
+	closer    func()
+}
+
+func newExtractorConn(w io.Writer, r io.Reader, closer func()) *extractorConn {
+
+	c := &extractorConn{
+		w:       w,
+		pending: map[uint64]chan *ExtractorResponse{},
+		dead:    make(chan struct{}),
+		closer:  closer,
+	}
+
+	go c.read(r)
+
+	return c
+}
+
+// startExtractorProcess starts the executable of a persistent extractor
+func startExtractorProcess(path string) (*extractorConn, error) {
+
+	cmd := exec.Command(path)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot start extractor %s: %s", path, err)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot start extractor %s: %s", path, err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Cannot start extractor %s: %s", path, err)
+	}
+
+	return newExtractorConn(stdin, stdout, func() {
+		stdin.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+	}), nil
+}
+
+// read dispatches the responses until the connection is closed
+func (c *extractorConn) read(r io.Reader) {
+
+	defer c.close()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxResponseSize)
+
+	for scanner.Scan() {
+		response := &ExtractorResponse{}
+		if err := json.Unmarshal(scanner.Bytes(), response); err != nil {
+			log.WithFields(log.Fields{
+				"package": "extractor",
+				"error":   err.Error(),
+			}).Warn("Invalid response from external extractor")
+			continue
+		}
+
+		c.Lock()
+		if ch, ok := c.pending[response.ID]; ok {
+			ch <- response
+			delete(c.pending, response.ID)
+		}
+		c.Unlock()
+	}
+}
+
+func (c *extractorConn) register(id uint64) chan *ExtractorResponse {
+
+	c.Lock()
+	defer c.Unlock()
+
+	ch := make(chan *ExtractorResponse, 1)
+	c.pending[id] = ch
+
+	return ch
+}
+
+func (c *extractorConn) unregister(id uint64) {
+
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.pending, id)
+}
+
+func (c *extractorConn) write(data []byte) error {
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	_, err := c.w.Write(data)
+
+	return err
+}
+
+// close closes the connection once. The pending requests are notified.
+func (c *extractorConn) close() {
+
+	c.closeOnce.Do(func() {
+		close(c.dead)
+		c.closer()
+	})
+}
+
+func (c *extractorConn) closed() bool {
+
+	select {
+	case <-c.dead:
+		return true
+	default:
+		return false
+	}
+}
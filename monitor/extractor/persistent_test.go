@@ -0,0 +1,247 @@
+package extractor
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aporeto-inc/trireme/policy"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// persistentScript answers every request with a runtime named after the request
+const persistentScript = `#!/bin/sh
+n=0
+while read line; do
+	n=$((n+1))
+	echo "{\"ID\":$n,\"Runtime\":{\"Name\":\"extracted-$n\",\"IPAddresses\":{\"bridge\":\"172.17.0.2\"},\"Tags\":{}}}"
+done
+`
+
+func testContainer(name string) *types.ContainerJSON {
+	return &types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:    "0123456789ab",
+			Name:  name,
+			State: &types.ContainerState{Running: true, Pid: 10},
+		},
+		Config:          &container.Config{Image: "nginx"},
+		NetworkSettings: &types.NetworkSettings{},
+	}
+}
+
+func writeScript(dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	ioutil.WriteFile(path, []byte(content), 0700)
+	return path
+}
+
+func TestPersistentExternalExtractor(t *testing.T) {
+
+	Convey("Given a directory with extractor scripts", t, func() {
+		dir, _ := ioutil.TempDir("", "extractor")
+		defer os.RemoveAll(dir)
+
+		Convey("When I create an extractor without a file", func() {
+			_, err := NewPersistentExternalExtractor("", time.Second)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("When I extract several containers with a persistent script", func() {
+			extractor, err := NewPersistentExternalExtractor(writeScript(dir, "extractor.sh", persistentScript), time.Second)
+			So(err, ShouldBeNil)
+
+			first, err1 := extractor(testContainer("/first"))
+			second, err2 := extractor(testContainer("/second"))
+
+			Convey("The same process should answer all the requests", func() {
+				So(err1, ShouldBeNil)
+				So(err2, ShouldBeNil)
+				So(first.Name(), ShouldEqual, "extracted-1")
+				So(second.Name(), ShouldEqual, "extracted-2")
+			})
+		})
+
+		Convey("When the script exits", func() {
+			extractor, err := NewPersistentExternalExtractor(writeScript(dir, "crash.sh", "#!/bin/sh\nexit 1\n"), time.Second)
+			So(err, ShouldBeNil)
+
+			runtime, err := extractor(testContainer("/crashed"))
+
+			Convey("The default extractor should be used", func() {
+				So(err, ShouldBeNil)
+				image, _ := runtime.Tag("image")
+				So(image, ShouldEqual, "nginx")
+			})
+		})
+	})
+}
+
+// serveExtractor answers the requests received on the socket. It closes each
+// connection after the given number of responses and never answers the
+// containers named /slow.
+func serveExtractor(l net.Listener, responses int) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go func(conn net.Conn) {
+			defer conn.Close()
+
+			scanner := bufio.NewScanner(conn)
+			scanner.Buffer(make([]byte, 64*1024), maxResponseSize)
+			for n := 0; n < responses && scanner.Scan(); n++ {
+				request := &ExtractorRequest{}
+				if err := json.Unmarshal(scanner.Bytes(), request); err != nil {
+					return
+				}
+
+				if request.Container.Name == "/slow" {
+					continue
+				}
+
+				runtime := policy.NewPURuntime(request.Container.Name, 0, policy.NewTagsMap(map[string]string{"cmdb": "web"}), nil)
+				data, _ := json.Marshal(&ExtractorResponse{ID: request.ID, Runtime: runtime})
+				conn.Write(append(data, '\n'))
+			}
+		}(conn)
+	}
+}
+
+// pipeExtractor connects the persistent extractors to in-memory extractors.
+// The extractors read the requests only if read is true and never answer.
+type pipeExtractor struct {
+	sync.Mutex
+	read        bool
+	connections int
+}
+
+func (p *pipeExtractor) connect() (*extractorConn, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.connections++
+
+	client, server := net.Pipe()
+	if p.read {
+		go io.Copy(ioutil.Discard, server)
+	}
+
+	return newExtractorConn(client, client, func() {
+		client.Close()
+		server.Close()
+	}), nil
+}
+
+func (p *pipeExtractor) Connections() int {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.connections
+}
+
+func TestPersistentExtractorTimeouts(t *testing.T) {
+
+	Convey("Given an extractor that never reads its requests", t, func() {
+		p := &pipeExtractor{}
+		e := newPersistentExtractor(p.connect, 50*time.Millisecond)
+
+		Convey("When I extract containers", func() {
+			start := time.Now()
+			first, err1 := e.extract(testContainer("/first"))
+			_, err2 := e.extract(testContainer("/second"))
+
+			Convey("The default extractor should be used within the timeout", func() {
+				So(err1, ShouldBeNil)
+				image, _ := first.Tag("image")
+				So(image, ShouldEqual, "nginx")
+				So(err2, ShouldBeNil)
+				So(time.Since(start), ShouldBeLessThan, time.Second)
+			})
+
+			Convey("The connection should be opened again for each request", func() {
+				So(p.Connections(), ShouldEqual, 2)
+			})
+		})
+	})
+
+	Convey("Given an extractor that reads its requests but never answers", t, func() {
+		p := &pipeExtractor{read: true}
+		e := newPersistentExtractor(p.connect, 20*time.Millisecond)
+
+		Convey("When fewer requests than the limit time out", func() {
+			for n := 0; n < maxConsecutiveTimeouts-1; n++ {
+				e.extract(testContainer("/slow"))
+			}
+
+			Convey("The connection should be kept", func() {
+				So(p.Connections(), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When the limit of consecutive timeouts is reached", func() {
+			for n := 0; n < maxConsecutiveTimeouts+1; n++ {
+				e.extract(testContainer("/slow"))
+			}
+
+			Convey("The connection should be opened again", func() {
+				So(p.Connections(), ShouldEqual, 2)
+			})
+		})
+	})
+}
+
+func TestSocketExtractor(t *testing.T) {
+
+	Convey("Given an extractor listening on a unix socket", t, func() {
+		dir, _ := ioutil.TempDir("", "extractor")
+		defer os.RemoveAll(dir)
+
+		socket := filepath.Join(dir, "extractor.sock")
+		l, err := net.Listen("unix", socket)
+		So(err, ShouldBeNil)
+		defer l.Close()
+
+		go serveExtractor(l, 1)
+
+		extractor, err := NewSocketExtractor(socket, 100*time.Millisecond)
+		So(err, ShouldBeNil)
+
+		Convey("When I extract containers", func() {
+			first, err1 := extractor(testContainer("/first"))
+			second, err2 := extractor(testContainer("/second"))
+
+			Convey("The connection should be opened again after it was closed", func() {
+				So(err1, ShouldBeNil)
+				So(err2, ShouldBeNil)
+
+				tag, _ := first.Tag("cmdb")
+				So(tag, ShouldEqual, "web")
+				So(second.Name(), ShouldEqual, "/second")
+			})
+		})
+
+		Convey("When the extractor doesn't answer", func() {
+			runtime, err := extractor(testContainer("/slow"))
+
+			Convey("The default extractor should be used", func() {
+				So(err, ShouldBeNil)
+				_, ok := runtime.Tag("cmdb")
+				So(ok, ShouldBeFalse)
+				image, _ := runtime.Tag("image")
+				So(image, ShouldEqual, "nginx")
+			})
+		})
+	})
+}
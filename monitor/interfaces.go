@@ -1,6 +1,10 @@
 package monitor
 
-import "github.com/aporeto-inc/trireme/policy"
+import (
+	"os/exec"
+
+	"github.com/aporeto-inc/trireme/policy"
+)
 
 // A Monitor is the interface to implement low level monitoring functions on some well defined primitive.
 type Monitor interface {
@@ -12,6 +16,35 @@ type Monitor interface {
 	Stop() error
 }
 
+// A HealthReporter is a Monitor that reports the health of the connection to
+// the source of its events. The Docker monitor is a HealthReporter.
+type HealthReporter interface {
+
+	// Health returns the state of the connection.
+	Health() Health
+}
+
+// A LinuxProcessMonitor is a Monitor of Linux processes. The host starts
+// processes or adopts running processes through the monitor to make them PUs.
+type LinuxProcessMonitor interface {
+	Monitor
+
+	// StartProcess starts the command and makes it a PU listening on the
+	// given ports. It returns the context ID of the PU.
+	StartProcess(cmd *exec.Cmd, ports []string) (string, error)
+
+	// AdoptProcess makes a running process a PU listening on the given ports.
+	// It returns the context ID of the PU.
+	AdoptProcess(pid int, ports []string) (string, error)
+}
+
+// A PodSource lists the pods of the node. The Kubernetes pod monitor polls it.
+type PodSource interface {
+
+	// ListPods returns the pods scheduled on the node.
+	ListPods() ([]Pod, error)
+}
+
 // A ProcessingUnitsHandler is responsible for monitoring creation and deletion of ProcessingUnits.
 type ProcessingUnitsHandler interface {
 
@@ -20,4 +53,13 @@ type ProcessingUnitsHandler interface {
 
 	// HandlePUEvent handles the event generated by the PU.
 	HandlePUEvent(contextID string, event Event) <-chan error
+
+	// RegisterSynchronization registers a monitor that synchronizes the existing
+	// PUs at start. It must be called before the monitor is started.
+	RegisterSynchronization()
+
+	// HandleSynchronizationComplete handles the end of a successful
+	// synchronization of the existing PUs. The state left by PUs that were not
+	// synchronized is cleaned once every registered monitor has completed.
+	HandleSynchronizationComplete() <-chan error
 }
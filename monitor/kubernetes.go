@@ -0,0 +1,458 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aporeto-inc/trireme/collector"
+	"github.com/aporeto-inc/trireme/policy"
+)
+
+const (
+	// DefaultKubeletURL is the default URL of the read-only API of the kubelet
+	DefaultKubeletURL = "http://127.0.0.1:10255"
+
+	// DefaultPodPollInterval is the default interval at which the Kubernetes
+	// pod monitor lists the pods
+	DefaultPodPollInterval = 5 * time.Second
+
+	// PodRunning is the phase of a pod whose containers are started
+	PodRunning = "Running"
+)
+
+// Pod is the part of a Kubernetes pod used by the pod monitor
+type Pod struct {
+	Metadata PodMetadata `json:"metadata"`
+	Spec     PodSpec     `json:"spec"`
+	Status   PodStatus   `json:"status"`
+}
+
+// PodMetadata is the metadata of a Kubernetes pod
+type PodMetadata struct {
+	Name      string            `json:"name"`
+	Namespace string            `json:"namespace"`
+	UID       string            `json:"uid"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// PodSpec is the specification of a Kubernetes pod
+type PodSpec struct {
+	NodeName           string `json:"nodeName,omitempty"`
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+	HostNetwork        bool   `json:"hostNetwork,omitempty"`
+}
+
+// PodStatus is the status of a Kubernetes pod
+type PodStatus struct {
+	Phase string `json:"phase,omitempty"`
+	PodIP string `json:"podIP,omitempty"`
+}
+
+// PodList is a list of Kubernetes pods as returned by the kubelet and the API
+// server
+type PodList struct {
+	Items []Pod `json:"items"`
+}
+
+// httpPodSource lists the pods from an HTTP endpoint returning a PodList
+type httpPodSource struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// NewKubeletPodSource returns a PodSource listing the pods from the API of the
+// kubelet at the given URL. The default HTTP client is used if client is nil.
+func NewKubeletPodSource(kubeletURL string, client *http.Client) PodSource {
+
+	if kubeletURL == "" {
+		kubeletURL = DefaultKubeletURL
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &httpPodSource{
+		url:    strings.TrimSuffix(kubeletURL, "/") + "/pods",
+		client: client,
+	}
+}
+
+// NewAPIServerPodSource returns a PodSource listing the pods of the given node
+// from the Kubernetes API server at the given URL. The token is sent as a
+// bearer token if it is not empty. The default HTTP client is used if client
+// is nil.
+func NewAPIServerPodSource(apiURL string, nodeName string, token string, client *http.Client) PodSource {
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	query := url.Values{}
+	query.Set("fieldSelector", "spec.nodeName="+nodeName)
+
+	return &httpPodSource{
+		url:    strings.TrimSuffix(apiURL, "/") + "/api/v1/pods?" + query.Encode(),
+		token:  token,
+		client: client,
+	}
+}
+
+// ListPods implements the PodSource interface
+func (s *httpPodSource) ListPods() ([]Pod, error) {
+
+	req, err := http.NewRequest("GET", s.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid pod list request: %s", err)
+	}
+
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list pods: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Cannot list pods: %s", resp.Status)
+	}
+
+	list := &PodList{}
+	if err := json.NewDecoder(resp.Body).Decode(list); err != nil {
+		return nil, fmt.Errorf("Invalid pod list: %s", err)
+	}
+
+	return list.Items, nil
+}
+
+// podContextID returns the context ID of the PU of a pod. All the containers
+// of a pod share one network namespace, so the pod is one PU.
+func podContextID(pod *Pod) (string, error) {
+
+	uid := strings.Replace(pod.Metadata.UID, "-", "", -1)
+
+	if len(uid) < 12 {
+		return "", fmt.Errorf("Invalid UID %s for pod %s/%s", pod.Metadata.UID, pod.Metadata.Namespace, pod.Metadata.Name)
+	}
+
+	return uid[:12], nil
+}
+
+// podRuntime returns the runtime of the PU of a pod. The tags are the labels of
+// the pod, its name, its namespace and its service account. The labels cannot
+// override the other tags.
+func podRuntime(pod *Pod) *policy.PURuntime {
+
+	tags := policy.NewTagsMap(nil)
+	for k, v := range pod.Metadata.Labels {
+		tags.Add(k, v)
+	}
+
+	tags.Add("name", pod.Metadata.Name)
+	tags.Add("namespace", pod.Metadata.Namespace)
+	tags.Add("serviceaccount", pod.Spec.ServiceAccountName)
+
+	ips := policy.NewIPMap(map[string]string{policy.DefaultNamespace: pod.Status.PodIP})
+
+	// The sandbox of the pod is not known to the kubelet API, so the PU has
+	// no pid
+	return policy.NewPURuntime(pod.Metadata.Namespace+"/"+pod.Metadata.Name, 0, tags, ips)
+}
+
+// podSignature identifies the runtime of a pod. The PU is updated when it
+// changes.
+func podSignature(pod *Pod) string {
+
+	// The keys of the maps are sorted by the encoder
+	labels, _ := json.Marshal(pod.Metadata.Labels)
+
+	return pod.Status.PodIP + "|" + pod.Spec.ServiceAccountName + "|" + string(labels)
+}
+
+// podMonitor monitors the pods of a Kubernetes node
+type podMonitor struct {
+	sync.Mutex
+	source       PodSource
+	pollInterval time.Duration
+	pods         map[string]string
+	failed       map[string]bool
+	stop         chan bool
+
+	collector collector.EventCollector
+	puHandler ProcessingUnitsHandler
+}
+
+// NewPodMonitor returns a Monitor of the pods listed by the given source. Each
+// pod with its own network is one PU, whatever the number of its containers.
+// The pods of the host network are ignored. The PUs have no pid, so the pods
+// are enforced by their IP address. Only the local enforcers are supported:
+// the remote enforcers are launched in the network namespace of the pid of the
+// PU.
+func NewPodMonitor(source PodSource, p ProcessingUnitsHandler, l collector.EventCollector, pollInterval time.Duration) Monitor {
+
+	if pollInterval <= 0 {
+		pollInterval = DefaultPodPollInterval
+	}
+
+	p.RegisterSynchronization()
+
+	return &podMonitor{
+		source:       source,
+		pollInterval: pollInterval,
+		pods:         map[string]string{},
+		failed:       map[string]bool{},
+		stop:         make(chan bool),
+		collector:    l,
+		puHandler:    p,
+	}
+}
+
+// Start synchronizes the running pods and starts polling the source
+func (m *podMonitor) Start() error {
+
+	log.WithFields(log.Fields{
+		"package": "monitor",
+	}).Debug("Starting the Kubernetes pod monitor")
+
+	// The PUs that were not synchronized are cleaned only if all the pods were
+	// synchronized.
+	if err := m.syncPods(); err != nil {
+		log.WithFields(log.Fields{
+			"package": "monitor",
+			"error":   err.Error(),
+		}).Error("Error Syncing existing pods")
+	} else if err := <-m.puHandler.HandleSynchronizationComplete(); err != nil {
+		log.WithFields(log.Fields{
+			"package": "monitor",
+			"error":   err.Error(),
+		}).Error("Error cleaning the state of the PUs that were not synchronized")
+	}
+
+	go m.watchPods()
+
+	return nil
+}
+
+// Stop stops polling the source. The PUs are left in place.
+func (m *podMonitor) Stop() error {
+
+	log.WithFields(log.Fields{
+		"package": "monitor",
+	}).Debug("Stopping the Kubernetes pod monitor")
+
+	m.stop <- true
+
+	return nil
+}
+
+// watchPods polls the source until the monitor is stopped
+func (m *podMonitor) watchPods() {
+
+	ticker := time.NewTicker(m.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.syncPods(); err != nil {
+				log.WithFields(log.Fields{
+					"package": "monitor",
+					"error":   err.Error(),
+				}).Error("Error Syncing pods")
+			}
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// syncPods reconciles the PUs with the running pods. New pods are started, the
+// pods whose runtime changed are updated and the pods that are gone are
+// stopped and destroyed. The pods that failed to start are started again.
+func (m *podMonitor) syncPods() error {
+
+	pods, err := m.source.ListPods()
+	if err != nil {
+		return err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	running := map[string]bool{}
+
+	for i := range pods {
+		pod := &pods[i]
+
+		if pod.Spec.HostNetwork || pod.Status.Phase != PodRunning || pod.Status.PodIP == "" {
+			continue
+		}
+
+		contextID, err := podContextID(pod)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"package": "monitor",
+				"error":   err.Error(),
+			}).Error("Ignoring pod")
+			continue
+		}
+
+		running[contextID] = true
+
+		signature := podSignature(pod)
+
+		if m.failed[contextID] {
+			if err := m.restartPod(contextID, pod); err != nil {
+				log.WithFields(log.Fields{
+					"package":   "monitor",
+					"contextID": contextID,
+					"error":     err.Error(),
+				}).Error("Error restarting pod")
+				continue
+			}
+
+			delete(m.failed, contextID)
+			m.pods[contextID] = signature
+			continue
+		}
+
+		previous, ok := m.pods[contextID]
+		if ok && previous == signature {
+			continue
+		}
+
+		if !ok {
+			if err := m.startPod(contextID, pod); err != nil {
+				log.WithFields(log.Fields{
+					"package":   "monitor",
+					"contextID": contextID,
+					"error":     err.Error(),
+				}).Error("Error starting pod")
+				continue
+			}
+		} else if err := m.updatePod(contextID, pod); err != nil {
+			log.WithFields(log.Fields{
+				"package":   "monitor",
+				"contextID": contextID,
+				"error":     err.Error(),
+			}).Error("Error updating pod")
+			continue
+		}
+
+		m.pods[contextID] = signature
+	}
+
+	for contextID := range m.pods {
+		if running[contextID] {
+			continue
+		}
+
+		if err := m.stopPod(contextID); err != nil {
+			log.WithFields(log.Fields{
+				"package":   "monitor",
+				"contextID": contextID,
+				"error":     err.Error(),
+			}).Error("Error stopping pod")
+		}
+
+		delete(m.pods, contextID)
+	}
+
+	for contextID := range m.failed {
+		if running[contextID] {
+			continue
+		}
+
+		if err := <-m.puHandler.HandlePUEvent(contextID, EventDestroy); err != nil {
+			log.WithFields(log.Fields{
+				"package":   "monitor",
+				"contextID": contextID,
+				"error":     err.Error(),
+			}).Error("Error destroying pod")
+		}
+
+		delete(m.failed, contextID)
+	}
+
+	return nil
+}
+
+// startPod creates the PU of a pod and starts it. The PU is recorded as failed
+// if it cannot be started, so that it is started again at the next poll.
+func (m *podMonitor) startPod(contextID string, pod *Pod) error {
+
+	runtimeInfo := podRuntime(pod)
+
+	if err := m.puHandler.SetPURuntime(contextID, runtimeInfo); err != nil {
+		return err
+	}
+
+	if err := <-m.puHandler.HandlePUEvent(contextID, EventCreate); err != nil {
+		return err
+	}
+
+	if err := m.runPod(contextID, pod.Status.PodIP, runtimeInfo); err != nil {
+		m.failed[contextID] = true
+		return err
+	}
+
+	return nil
+}
+
+// restartPod starts the PU of a pod that failed to start with the current
+// runtime of the pod
+func (m *podMonitor) restartPod(contextID string, pod *Pod) error {
+
+	runtimeInfo := podRuntime(pod)
+
+	if err := m.puHandler.SetPURuntime(contextID, runtimeInfo); err != nil {
+		return err
+	}
+
+	return m.runPod(contextID, pod.Status.PodIP, runtimeInfo)
+}
+
+// runPod starts the created PU of a pod
+func (m *podMonitor) runPod(contextID string, ip string, runtimeInfo *policy.PURuntime) error {
+
+	if err := <-m.puHandler.HandlePUEvent(contextID, EventStart); err != nil {
+		m.collector.CollectContainerEvent(contextID, ip, nil, collector.ContainerFailed)
+		return err
+	}
+
+	m.collector.CollectContainerEvent(contextID, ip, runtimeInfo.Tags(), collector.ContainerStart)
+
+	return nil
+}
+
+// updatePod sends the new runtime of a pod upstream
+func (m *podMonitor) updatePod(contextID string, pod *Pod) error {
+
+	if err := m.puHandler.SetPURuntime(contextID, podRuntime(pod)); err != nil {
+		return err
+	}
+
+	return <-m.puHandler.HandlePUEvent(contextID, EventUpdate)
+}
+
+// stopPod stops and destroys the PU of a pod that is gone
+func (m *podMonitor) stopPod(contextID string) error {
+
+	m.collector.CollectContainerEvent(contextID, "", nil, collector.ContainerStop)
+
+	if err := <-m.puHandler.HandlePUEvent(contextID, EventStop); err != nil {
+		return err
+	}
+
+	return <-m.puHandler.HandlePUEvent(contextID, EventDestroy)
+}
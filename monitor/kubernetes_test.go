@@ -0,0 +1,205 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aporeto-inc/trireme/collector"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testPodUID = "8f2e4a1c-5b6d-11e7-907b-a6006ad3dba0"
+
+// testAPIServer serves the pods it holds like the API server
+type testAPIServer struct {
+	sync.Mutex
+	pods     []Pod
+	requests []*http.Request
+}
+
+func (s *testAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.requests = append(s.requests, r)
+	json.NewEncoder(w).Encode(&PodList{Items: s.pods})
+}
+
+func (s *testAPIServer) setPods(pods ...Pod) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.pods = pods
+}
+
+func testPod(uid string, ip string, labels map[string]string) Pod {
+	return Pod{
+		Metadata: PodMetadata{Name: "web", Namespace: "default", UID: uid, Labels: labels},
+		Spec:     PodSpec{NodeName: "node1", ServiceAccountName: "frontend"},
+		Status:   PodStatus{Phase: PodRunning, PodIP: ip},
+	}
+}
+
+func TestPodMonitor(t *testing.T) {
+
+	Convey("Given an API server with a running pod", t, func() {
+		api := &testAPIServer{}
+		api.setPods(testPod(testPodUID, "10.0.0.5", map[string]string{"app": "web", "namespace": "spoofed"}))
+
+		server := httptest.NewServer(api)
+		defer server.Close()
+
+		h := newTestPUHandler()
+		m := NewPodMonitor(NewAPIServerPodSource(server.URL, "node1", "secret", nil), h, &collector.DefaultCollector{}, time.Hour).(*podMonitor)
+
+		Convey("When I start the pod monitor", func() {
+			So(m.Start(), ShouldBeNil)
+			defer m.Stop()
+
+			contextID := "8f2e4a1c5b6d"
+
+			Convey("The pod should be listed for the node with the token", func() {
+				api.Lock()
+				r := api.requests[0]
+				api.Unlock()
+				So(r.URL.Path, ShouldEqual, "/api/v1/pods")
+				So(r.URL.Query().Get("fieldSelector"), ShouldEqual, "spec.nodeName=node1")
+				So(r.Header.Get("Authorization"), ShouldEqual, "Bearer secret")
+			})
+
+			Convey("The pod should be one PU with the tags of the pod", func() {
+				So(h.synced, ShouldBeTrue)
+				So(h.Events(), ShouldResemble, []string{contextID + ":create", contextID + ":start"})
+
+				h.Lock()
+				runtime := h.runtimes[contextID]
+				h.Unlock()
+
+				ip, _ := runtime.DefaultIPAddress()
+				So(ip, ShouldEqual, "10.0.0.5")
+				So(runtime.Name(), ShouldEqual, "default/web")
+				So(runtime.Tags().Tags, ShouldResemble, map[string]string{
+					"app":            "web",
+					"name":           "web",
+					"namespace":      "default",
+					"serviceaccount": "frontend",
+				})
+			})
+
+			Convey("When nothing changed", func() {
+				So(m.syncPods(), ShouldBeNil)
+
+				Convey("No event should be sent", func() {
+					So(h.Events(), ShouldHaveLength, 2)
+				})
+			})
+
+			Convey("When the labels of the pod change", func() {
+				api.setPods(testPod(testPodUID, "10.0.0.5", map[string]string{"app": "api"}))
+				So(m.syncPods(), ShouldBeNil)
+
+				Convey("The PU should be updated", func() {
+					So(h.Events(), ShouldResemble, []string{contextID + ":create", contextID + ":start", contextID + ":update"})
+
+					h.Lock()
+					tag, _ := h.runtimes[contextID].Tag("app")
+					h.Unlock()
+					So(tag, ShouldEqual, "api")
+				})
+			})
+
+			Convey("When the pod is deleted and host network pods are started", func() {
+				hostPod := testPod("aaaaaaaa-5b6d-11e7-907b-a6006ad3dba0", "192.168.0.1", nil)
+				hostPod.Spec.HostNetwork = true
+				pendingPod := testPod("bbbbbbbb-5b6d-11e7-907b-a6006ad3dba0", "", nil)
+				pendingPod.Status.Phase = "Pending"
+
+				api.setPods(hostPod, pendingPod)
+				So(m.syncPods(), ShouldBeNil)
+
+				Convey("The PU should be stopped and destroyed and the other pods ignored", func() {
+					So(h.Events(), ShouldResemble, []string{
+						contextID + ":create",
+						contextID + ":start",
+						contextID + ":stop",
+						contextID + ":destroy",
+					})
+				})
+			})
+		})
+	})
+
+	Convey("Given an API server with a pod that fails to start", t, func() {
+		api := &testAPIServer{}
+		api.setPods(testPod(testPodUID, "10.0.0.5", nil))
+
+		server := httptest.NewServer(api)
+		defer server.Close()
+
+		h := newTestPUHandler()
+		h.eventErrors = map[Event]error{EventStart: fmt.Errorf("start failed")}
+		m := NewPodMonitor(NewAPIServerPodSource(server.URL, "node1", "", nil), h, &collector.DefaultCollector{}, time.Hour).(*podMonitor)
+
+		contextID := "8f2e4a1c5b6d"
+		So(m.syncPods(), ShouldBeNil)
+
+		Convey("When the pod is polled again and it can be started", func() {
+			h.Lock()
+			h.eventErrors = nil
+			h.Unlock()
+
+			api.setPods(testPod(testPodUID, "10.0.0.5", map[string]string{"app": "web"}))
+			So(m.syncPods(), ShouldBeNil)
+			So(m.syncPods(), ShouldBeNil)
+
+			Convey("The PU should only be started again with the new runtime", func() {
+				So(h.Events(), ShouldResemble, []string{contextID + ":create", contextID + ":start", contextID + ":start"})
+
+				h.Lock()
+				tag, _ := h.runtimes[contextID].Tag("app")
+				h.Unlock()
+				So(tag, ShouldEqual, "web")
+			})
+		})
+
+		Convey("When the pod is polled again and it still cannot be started", func() {
+			So(m.syncPods(), ShouldBeNil)
+
+			Convey("The PU should not be created again", func() {
+				So(h.Events(), ShouldResemble, []string{contextID + ":create", contextID + ":start", contextID + ":start"})
+			})
+		})
+
+		Convey("When the pod is deleted", func() {
+			api.setPods()
+			So(m.syncPods(), ShouldBeNil)
+			So(m.syncPods(), ShouldBeNil)
+
+			Convey("The PU should be destroyed once", func() {
+				So(h.Events(), ShouldResemble, []string{contextID + ":create", contextID + ":start", contextID + ":destroy"})
+			})
+		})
+	})
+
+	Convey("Given a kubelet that fails", t, func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		}))
+		defer server.Close()
+
+		source := NewKubeletPodSource(server.URL, nil)
+
+		Convey("When I list the pods", func() {
+			_, err := source.ListPods()
+
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
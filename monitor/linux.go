@@ -0,0 +1,545 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aporeto-inc/trireme/collector"
+	"github.com/aporeto-inc/trireme/policy"
+)
+
+const (
+	// DefaultProcessStateFile is the default location of the state file of the
+	// Linux process monitor
+	DefaultProcessStateFile = "/var/lib/trireme/processes.json"
+
+	// DefaultProcessPollInterval is the default interval at which the Linux
+	// process monitor checks that its processes are still running
+	DefaultProcessPollInterval = time.Second
+
+	// processMarkBase is the first mark given to a Linux process. The marks
+	// stay clear of the default mark of the datapath.
+	processMarkBase = 0x20000
+)
+
+// linuxProcess is a Linux process monitored as a PU. It is also the format of
+// the state file.
+type linuxProcess struct {
+	ContextID string
+	Pid       int
+	StartTime string
+	Ports     []string
+	Mark      string `json:"-"`
+}
+
+// linuxProcessMonitor monitors Linux processes started or adopted by the host
+type linuxProcessMonitor struct {
+	sync.Mutex
+	processes    map[string]*linuxProcess
+	procRoot     string
+	stateFile    string
+	pollInterval time.Duration
+	syncAtStart  bool
+	stop         chan bool
+
+	collector collector.EventCollector
+	puHandler ProcessingUnitsHandler
+}
+
+// NewLinuxProcessMonitor returns a LinuxProcessMonitor. The processes are kept
+// in the state file so that the ones still running are synchronized again at
+// start if syncAtStart is set.
+//
+// The PUs are matched on their cgroup and should be used with a LocalServer
+// supervisor.
+func NewLinuxProcessMonitor(p ProcessingUnitsHandler, l collector.EventCollector, stateFile string, syncAtStart bool) LinuxProcessMonitor {
+
+	if syncAtStart {
+		p.RegisterSynchronization()
+	}
+
+	return &linuxProcessMonitor{
+		processes:    map[string]*linuxProcess{},
+		procRoot:     "/proc",
+		stateFile:    stateFile,
+		pollInterval: DefaultProcessPollInterval,
+		syncAtStart:  syncAtStart,
+		stop:         make(chan bool),
+		collector:    l,
+		puHandler:    p,
+	}
+}
+
+// Start synchronizes the processes of the state file that are still running
+// and starts watching for the processes that exit.
+func (m *linuxProcessMonitor) Start() error {
+
+	log.WithFields(log.Fields{
+		"package": "monitor",
+	}).Debug("Starting the Linux process monitor")
+
+	if m.syncAtStart {
+		m.synchronize()
+	}
+
+	go m.watchProcesses()
+
+	return nil
+}
+
+// synchronize syncs the processes of the state file. The PUs that were not
+// synchronized are cleaned only if all the processes were synchronized.
+func (m *linuxProcessMonitor) synchronize() {
+
+	if err := m.syncProcesses(); err != nil {
+		log.WithFields(log.Fields{
+			"package": "monitor",
+			"error":   err.Error(),
+		}).Error("Error Syncing existing processes")
+		return
+	}
+
+	if err := <-m.puHandler.HandleSynchronizationComplete(); err != nil {
+		log.WithFields(log.Fields{
+			"package": "monitor",
+			"error":   err.Error(),
+		}).Error("Error cleaning the state of the PUs that were not synchronized")
+	}
+}
+
+// Stop stops watching the processes. The PUs are left in place.
+func (m *linuxProcessMonitor) Stop() error {
+
+	log.WithFields(log.Fields{
+		"package": "monitor",
+	}).Debug("Stopping the Linux process monitor")
+
+	m.stop <- true
+
+	return nil
+}
+
+// StartProcess starts the command and makes it a PU. The process is killed if
+// its policy cannot be set. The process is started before its policy is set so
+// a process should not send traffic before it is ready to listen on its ports.
+func (m *linuxProcessMonitor) StartProcess(cmd *exec.Cmd, ports []string) (string, error) {
+
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("Cannot start process %s: %s", cmd.Path, err)
+	}
+
+	// The process is reaped here so that its exit is seen by the watcher
+	go cmd.Wait()
+
+	contextID, err := m.AdoptProcess(cmd.Process.Pid, ports)
+	if err != nil {
+		cmd.Process.Kill()
+		return "", err
+	}
+
+	return contextID, nil
+}
+
+// AdoptProcess makes a running process a PU. The process is not stopped if its
+// policy cannot be set since the monitor did not start it.
+func (m *linuxProcessMonitor) AdoptProcess(pid int, ports []string) (string, error) {
+
+	for _, port := range ports {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return "", fmt.Errorf("Invalid port %s", port)
+		}
+	}
+
+	startTime, err := m.processStartTime(pid)
+	if err != nil {
+		return "", err
+	}
+
+	process := &linuxProcess{
+		ContextID: contextIDFromPid(pid),
+		Pid:       pid,
+		StartTime: startTime,
+		Ports:     append([]string(nil), ports...),
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.processes[process.ContextID]; ok {
+		return "", fmt.Errorf("Process %d is already a processing unit", pid)
+	}
+
+	if err := m.startProcess(process); err != nil {
+		return "", err
+	}
+
+	return process.ContextID, m.save()
+}
+
+// startProcess sends the runtime of a process upstream and activates it. It
+// must be called with the lock held.
+func (m *linuxProcessMonitor) startProcess(process *linuxProcess) error {
+
+	log.WithFields(log.Fields{
+		"package":   "monitor",
+		"contextID": process.ContextID,
+		"pid":       process.Pid,
+	}).Debug("Add a Linux process")
+
+	runtimeInfo, err := m.processRuntime(process.Pid)
+	if err != nil {
+		return fmt.Errorf("Error getting the process information: %s", err)
+	}
+
+	process.Mark = m.allocateMark()
+	runtimeInfo.SetMark(process.Mark)
+	runtimeInfo.SetPorts(process.Ports)
+
+	if err := m.puHandler.SetPURuntime(process.ContextID, runtimeInfo); err != nil {
+		m.collector.CollectContainerEvent(process.ContextID, "", nil, collector.ContainerFailed)
+		return fmt.Errorf("Runtime couldn't be set for process %d: %s", process.Pid, err)
+	}
+
+	errorChan := m.puHandler.HandlePUEvent(process.ContextID, EventStart)
+
+	if err := <-errorChan; err != nil {
+		log.WithFields(log.Fields{
+			"package":   "monitor",
+			"contextID": process.ContextID,
+			"error":     err.Error(),
+		}).Debug("Setting policy failed")
+
+		m.collector.CollectContainerEvent(process.ContextID, "", nil, collector.ContainerFailed)
+		return fmt.Errorf("Policy couldn't be set for process %d: %s", process.Pid, err)
+	}
+
+	m.processes[process.ContextID] = process
+
+	m.collector.CollectContainerEvent(process.ContextID, "", runtimeInfo.Tags(), collector.ContainerStart)
+
+	return nil
+}
+
+// stopProcess generates a stop event for a process that exited. It must be
+// called with the lock held.
+func (m *linuxProcessMonitor) stopProcess(process *linuxProcess) error {
+
+	log.WithFields(log.Fields{
+		"package":   "monitor",
+		"contextID": process.ContextID,
+		"pid":       process.Pid,
+	}).Debug("Monitor removed Linux process")
+
+	delete(m.processes, process.ContextID)
+
+	m.collector.CollectContainerEvent(process.ContextID, "", nil, collector.ContainerStop)
+
+	// A process that exited is gone for good
+	err := <-m.puHandler.HandlePUEvent(process.ContextID, EventStop)
+	if err == nil {
+		err = <-m.puHandler.HandlePUEvent(process.ContextID, EventDestroy)
+	}
+
+	if serr := m.save(); serr != nil {
+		log.WithFields(log.Fields{
+			"package": "monitor",
+			"error":   serr.Error(),
+		}).Error("Failed to save the Linux processes")
+	}
+
+	return err
+}
+
+// watchProcesses periodically checks that the processes are still running
+func (m *linuxProcessMonitor) watchProcesses() {
+
+	ticker := time.NewTicker(m.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.checkProcesses()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// checkProcesses stops the PUs of the processes that exited
+func (m *linuxProcessMonitor) checkProcesses() {
+
+	m.Lock()
+	defer m.Unlock()
+
+	for _, process := range m.processes {
+		if m.isRunning(process) {
+			continue
+		}
+
+		if err := m.stopProcess(process); err != nil {
+			log.WithFields(log.Fields{
+				"package":   "monitor",
+				"contextID": process.ContextID,
+				"error":     err.Error(),
+			}).Error("Error while stopping the Linux process")
+		}
+	}
+}
+
+// syncProcesses activates again the processes of the state file that are still
+// running
+func (m *linuxProcessMonitor) syncProcesses() error {
+
+	log.WithFields(log.Fields{
+		"package": "monitor",
+	}).Debug("Syncing all existing Linux processes")
+
+	processes, err := m.load()
+	if err != nil {
+		return err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	for _, process := range processes {
+		if !m.isRunning(process) {
+			log.WithFields(log.Fields{
+				"package":   "monitor",
+				"contextID": process.ContextID,
+			}).Debug("Process is not running anymore - Activation not needed.")
+			continue
+		}
+
+		if err := m.startProcess(process); err != nil {
+			log.WithFields(log.Fields{
+				"package":   "monitor",
+				"contextID": process.ContextID,
+				"error":     err.Error(),
+			}).Error("Error Syncing existing process")
+		}
+	}
+
+	return m.save()
+}
+
+// isRunning returns true if the process is running and is not a process that
+// reused the pid of the PU
+func (m *linuxProcessMonitor) isRunning(process *linuxProcess) bool {
+
+	startTime, err := m.processStartTime(process.Pid)
+
+	return err == nil && startTime == process.StartTime
+}
+
+// allocateMark returns the lowest mark that is not used by a process. It must
+// be called with the lock held.
+func (m *linuxProcessMonitor) allocateMark() string {
+
+	used := map[string]bool{}
+	for _, process := range m.processes {
+		used[process.Mark] = true
+	}
+
+	for n := processMarkBase; ; n++ {
+		if mark := strconv.Itoa(n); !used[mark] {
+			return mark
+		}
+	}
+}
+
+// processRuntime generates the runtime of a process. The process is identified
+// by its user, its executable and the hash of the executable, and its arguments.
+func (m *linuxProcessMonitor) processRuntime(pid int) (*policy.PURuntime, error) {
+
+	dir := filepath.Join(m.procRoot, strconv.Itoa(pid))
+
+	executable, err := os.Readlink(filepath.Join(dir, "exe"))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read the executable of process %d: %s", pid, err)
+	}
+
+	// The executable is read through proc since it may have been replaced
+	hash, err := fileHash(filepath.Join(dir, "exe"))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot hash the executable of process %d: %s", pid, err)
+	}
+
+	cmdline, err := ioutil.ReadFile(filepath.Join(dir, "cmdline"))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read the arguments of process %d: %s", pid, err)
+	}
+
+	args := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+
+	uid, err := processUID(filepath.Join(dir, "status"))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read the user of process %d: %s", pid, err)
+	}
+
+	username := uid
+	if u, err := user.LookupId(uid); err == nil {
+		username = u.Username
+	}
+
+	name := filepath.Base(executable)
+
+	tags := policy.NewTagsMap(map[string]string{
+		"user":       username,
+		"executable": executable,
+		"hash":       hash,
+		"args":       strings.Join(args, " "),
+		"name":       name,
+	})
+
+	return policy.NewPURuntime(name, pid, tags, nil), nil
+}
+
+// processStartTime returns the start time of a process as found in its stat
+// file. Together with the pid it identifies a process across pid reuse.
+func (m *linuxProcessMonitor) processStartTime(pid int) (string, error) {
+
+	data, err := ioutil.ReadFile(filepath.Join(m.procRoot, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return "", fmt.Errorf("Process %d not found: %s", pid, err)
+	}
+
+	// The command name may contain spaces so the fields are counted after it
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+
+	// Fields start at the state which is the third field of the file. The
+	// start time is the twenty second field.
+	if len(fields) < 20 {
+		return "", fmt.Errorf("Invalid stat file for process %d", pid)
+	}
+
+	// Zombies are processes that exited
+	if fields[0] == "Z" || fields[0] == "X" {
+		return "", fmt.Errorf("Process %d exited", pid)
+	}
+
+	return fields[19], nil
+}
+
+// load reads the processes from the state file. A missing file is not an error.
+func (m *linuxProcessMonitor) load() ([]*linuxProcess, error) {
+
+	processes := []*linuxProcess{}
+
+	if m.stateFile == "" {
+		return processes, nil
+	}
+
+	data, err := ioutil.ReadFile(m.stateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return processes, nil
+		}
+		return nil, fmt.Errorf("Cannot read processes from %s: %s", m.stateFile, err)
+	}
+
+	if err := json.Unmarshal(data, &processes); err != nil {
+		return nil, fmt.Errorf("Invalid processes in %s: %s", m.stateFile, err)
+	}
+
+	return processes, nil
+}
+
+// save writes the state file atomically. It must be called with the lock held.
+func (m *linuxProcessMonitor) save() error {
+
+	if m.stateFile == "" {
+		return nil
+	}
+
+	keys := make([]string, 0, len(m.processes))
+	for k := range m.processes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	processes := make([]*linuxProcess, 0, len(keys))
+	for _, k := range keys {
+		processes = append(processes, m.processes[k])
+	}
+
+	data, err := json.MarshalIndent(processes, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Cannot encode processes: %s", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(m.stateFile), 0700); err != nil {
+		return fmt.Errorf("Cannot create directory for %s: %s", m.stateFile, err)
+	}
+
+	tmp := m.stateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("Cannot write processes to %s: %s", tmp, err)
+	}
+
+	if err := os.Rename(tmp, m.stateFile); err != nil {
+		return fmt.Errorf("Cannot write processes to %s: %s", m.stateFile, err)
+	}
+
+	return nil
+}
+
+// contextIDFromPid returns the context ID of the PU of a process
+func contextIDFromPid(pid int) string {
+
+	return strconv.Itoa(pid)
+}
+
+// processUID returns the real user ID of a process from its status file
+func processUID(statusFile string) (string, error) {
+
+	data, err := ioutil.ReadFile(statusFile)
+	if err != nil {
+		return "", err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[0] == "Uid:" {
+			return fields[1], nil
+		}
+	}
+
+	return "", fmt.Errorf("No Uid in %s", statusFile)
+}
+
+// fileHash returns the sha256 hash of a file
+func fileHash(file string) (string, error) {
+
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
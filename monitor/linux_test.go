@@ -0,0 +1,338 @@
+package monitor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aporeto-inc/trireme/collector"
+	"github.com/aporeto-inc/trireme/policy"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testPUHandler records the runtimes and the events it receives
+type testPUHandler struct {
+	sync.Mutex
+	runtimes map[string]*policy.PURuntime
+	events   []string
+	synced   bool
+	err      error
+
+	// registered is the number of monitors that registered a synchronization
+	registered int
+
+	// eventErrors are the errors returned for some events instead of err
+	eventErrors map[Event]error
+
+	// runtimeErr is the error returned when a runtime is set
+	runtimeErr error
+}
+
+func newTestPUHandler() *testPUHandler {
+	return &testPUHandler{
+		runtimes: map[string]*policy.PURuntime{},
+	}
+}
+
+func (h *testPUHandler) SetPURuntime(contextID string, runtimeInfo *policy.PURuntime) error {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.runtimeErr != nil {
+		return h.runtimeErr
+	}
+
+	h.runtimes[contextID] = runtimeInfo
+	return nil
+}
+
+func (h *testPUHandler) PURuntime(contextID string) (policy.RuntimeReader, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	runtime, ok := h.runtimes[contextID]
+	if !ok {
+		return nil, fmt.Errorf("Unknown PU %s", contextID)
+	}
+	return runtime, nil
+}
+
+func (h *testPUHandler) HandlePUEvent(contextID string, event Event) <-chan error {
+	h.Lock()
+	defer h.Unlock()
+
+	h.events = append(h.events, contextID+":"+string(event))
+
+	c := make(chan error, 1)
+	if err, ok := h.eventErrors[event]; ok {
+		c <- err
+		return c
+	}
+	c <- h.err
+	return c
+}
+
+func (h *testPUHandler) RegisterSynchronization() {
+	h.Lock()
+	defer h.Unlock()
+
+	h.registered++
+}
+
+func (h *testPUHandler) HandleSynchronizationComplete() <-chan error {
+	h.Lock()
+	defer h.Unlock()
+
+	h.synced = true
+
+	c := make(chan error, 1)
+	c <- nil
+	return c
+}
+
+func (h *testPUHandler) Events() []string {
+	h.Lock()
+	defer h.Unlock()
+
+	return append([]string(nil), h.events...)
+}
+
+func testLinuxProcessMonitor(h ProcessingUnitsHandler, stateFile string) *linuxProcessMonitor {
+	return NewLinuxProcessMonitor(h, &collector.DefaultCollector{}, stateFile, true).(*linuxProcessMonitor)
+}
+
+// waitExit waits for a process to exit and returns false if it is still running
+func waitExit(m *linuxProcessMonitor, pid int) bool {
+	for n := 0; n < 100; n++ {
+		if _, err := m.processStartTime(pid); err != nil {
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return false
+}
+
+func TestAdoptProcess(t *testing.T) {
+
+	Convey("Given a Linux process monitor", t, func() {
+		dir, _ := ioutil.TempDir("", "processes")
+		defer os.RemoveAll(dir)
+
+		h := newTestPUHandler()
+		m := testLinuxProcessMonitor(h, filepath.Join(dir, "processes.json"))
+
+		pid := os.Getpid()
+		contextID := strconv.Itoa(pid)
+
+		Convey("When I adopt a running process", func() {
+			id, err := m.AdoptProcess(pid, []string{"80", "443"})
+
+			Convey("The PU should be started with the process information", func() {
+				So(err, ShouldBeNil)
+				So(id, ShouldEqual, contextID)
+				So(h.Events(), ShouldResemble, []string{contextID + ":" + string(EventStart)})
+
+				runtime := h.runtimes[contextID]
+				So(runtime.Pid(), ShouldEqual, pid)
+				So(runtime.Mark(), ShouldEqual, strconv.Itoa(processMarkBase))
+				So(runtime.Ports(), ShouldResemble, []string{"80", "443"})
+
+				exe, _ := os.Executable()
+				executable, _ := runtime.Tag("executable")
+				So(executable, ShouldEqual, exe)
+				So(runtime.Name(), ShouldEqual, filepath.Base(exe))
+
+				hash, _ := runtime.Tag("hash")
+				So(hash, ShouldHaveLength, 64)
+
+				_, ok := runtime.Tag("user")
+				So(ok, ShouldBeTrue)
+			})
+
+			Convey("The process should be saved in the state file", func() {
+				processes, err := m.load()
+				So(err, ShouldBeNil)
+				So(processes, ShouldHaveLength, 1)
+				So(processes[0].Pid, ShouldEqual, pid)
+				So(processes[0].Ports, ShouldResemble, []string{"80", "443"})
+			})
+
+			Convey("I should not be able to adopt it again", func() {
+				_, err := m.AdoptProcess(pid, nil)
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When I adopt a process with an invalid port", func() {
+			_, err := m.AdoptProcess(pid, []string{"http"})
+
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+				So(h.Events(), ShouldBeEmpty)
+			})
+		})
+
+		Convey("When the policy of the process cannot be set", func() {
+			h.err = fmt.Errorf("Error")
+			_, err := m.AdoptProcess(pid, nil)
+
+			Convey("I should get an error and the process should not be monitored", func() {
+				So(err, ShouldNotBeNil)
+				So(m.processes, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When the runtime of the process cannot be set", func() {
+			h.runtimeErr = fmt.Errorf("Error")
+			_, err := m.AdoptProcess(pid, nil)
+
+			Convey("I should get an error and no event should be sent", func() {
+				So(err, ShouldNotBeNil)
+				So(h.Events(), ShouldBeEmpty)
+				So(m.processes, ShouldBeEmpty)
+			})
+		})
+	})
+}
+
+func TestStartProcess(t *testing.T) {
+
+	Convey("Given a Linux process monitor", t, func() {
+		h := newTestPUHandler()
+		m := testLinuxProcessMonitor(h, "")
+
+		Convey("When I start a process that exits", func() {
+			cmd := exec.Command("sleep", "60")
+			contextID, err := m.StartProcess(cmd, nil)
+			So(err, ShouldBeNil)
+
+			So(cmd.Process.Kill(), ShouldBeNil)
+			So(waitExit(m, cmd.Process.Pid), ShouldBeTrue)
+			m.checkProcesses()
+
+			Convey("The PU should be stopped", func() {
+				So(h.Events(), ShouldResemble, []string{
+					contextID + ":" + string(EventStart),
+					contextID + ":" + string(EventStop),
+					contextID + ":" + string(EventDestroy),
+				})
+				So(m.processes, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When the policy of a started process cannot be set", func() {
+			h.err = fmt.Errorf("Error")
+			cmd := exec.Command("sleep", "60")
+			_, err := m.StartProcess(cmd, nil)
+
+			Convey("The process should be killed", func() {
+				So(err, ShouldNotBeNil)
+				So(waitExit(m, cmd.Process.Pid), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestSyncProcesses(t *testing.T) {
+
+	Convey("Given a state file with a running and an exited process", t, func() {
+		dir, _ := ioutil.TempDir("", "processes")
+		defer os.RemoveAll(dir)
+
+		stateFile := filepath.Join(dir, "processes.json")
+
+		h := newTestPUHandler()
+		m := testLinuxProcessMonitor(h, stateFile)
+
+		pid := os.Getpid()
+		startTime, err := m.processStartTime(pid)
+		So(err, ShouldBeNil)
+
+		m.processes = map[string]*linuxProcess{
+			"1": {ContextID: "1", Pid: pid, StartTime: "0"},
+			"2": {ContextID: "2", Pid: pid, StartTime: startTime, Ports: []string{"22"}},
+		}
+		So(m.save(), ShouldBeNil)
+		m.processes = map[string]*linuxProcess{}
+
+		Convey("When I start the monitor", func() {
+			So(m.Start(), ShouldBeNil)
+			defer m.Stop()
+
+			Convey("Only the running process should be synchronized", func() {
+				So(h.Events(), ShouldResemble, []string{"2:" + string(EventStart)})
+				So(h.registered, ShouldEqual, 1)
+				So(h.synced, ShouldBeTrue)
+				So(h.runtimes["2"].Ports(), ShouldResemble, []string{"22"})
+
+				processes, err := m.load()
+				So(err, ShouldBeNil)
+				So(processes, ShouldHaveLength, 1)
+			})
+		})
+
+		Convey("When I start a monitor whose state file cannot be read", func() {
+			So(ioutil.WriteFile(stateFile, []byte("not json"), 0600), ShouldBeNil)
+			So(m.Start(), ShouldBeNil)
+			defer m.Stop()
+
+			Convey("The synchronization should not be reported as complete", func() {
+				So(h.Events(), ShouldBeEmpty)
+				So(h.synced, ShouldBeFalse)
+			})
+		})
+
+		Convey("When I start a monitor that does not synchronize", func() {
+			h := newTestPUHandler()
+			m := NewLinuxProcessMonitor(h, &collector.DefaultCollector{}, stateFile, false)
+			So(m.Start(), ShouldBeNil)
+			defer m.Stop()
+
+			Convey("It should neither register nor complete a synchronization", func() {
+				So(h.Events(), ShouldBeEmpty)
+				So(h.registered, ShouldEqual, 0)
+				So(h.synced, ShouldBeFalse)
+			})
+		})
+	})
+}
+
+func TestProcessStartTime(t *testing.T) {
+
+	Convey("Given a proc directory", t, func() {
+		root, _ := ioutil.TempDir("", "proc")
+		defer os.RemoveAll(root)
+
+		m := testLinuxProcessMonitor(newTestPUHandler(), "")
+		m.procRoot = root
+
+		stat := func(pid int, content string) {
+			os.MkdirAll(filepath.Join(root, strconv.Itoa(pid)), 0700)
+			ioutil.WriteFile(filepath.Join(root, strconv.Itoa(pid), "stat"), []byte(content), 0600)
+		}
+
+		Convey("The start time should be read after a command name with spaces", func() {
+			stat(10, "10 (my (daemon)) S 1 10 10 0 -1 4194560 1 0 0 0 0 0 0 0 20 0 1 0 4242 0 0")
+			startTime, err := m.processStartTime(10)
+			So(err, ShouldBeNil)
+			So(startTime, ShouldEqual, "4242")
+		})
+
+		Convey("A zombie should not be running", func() {
+			stat(11, "11 (daemon) Z 1 11 11 0 -1 4194560 1 0 0 0 0 0 0 0 20 0 1 0 4242 0 0")
+			_, err := m.processStartTime(11)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A missing process should not be running", func() {
+			_, err := m.processStartTime(12)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
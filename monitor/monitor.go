@@ -1,5 +1,7 @@
 package monitor
 
+import "time"
+
 // Event represents the event picked up by the monitor.
 type Event string
 
@@ -20,3 +22,23 @@ const EventPause = "pause"
 
 // EventUnpause is the event generated when a PU is unpaused.
 const EventUnpause = "unpause"
+
+// EventUpdate is the event generated when the runtime of a PU changes, for
+// instance when it joins or leaves a network.
+const EventUpdate = "update"
+
+// Health is the state of the connection of a monitor to the source of its events
+type Health struct {
+
+	// Connected is true while the monitor receives the events
+	Connected bool
+
+	// Since is the time of the last change of the connection state
+	Since time.Time
+
+	// LastError is the error that broke the connection last
+	LastError string
+
+	// Reconnections is the number of times the monitor reconnected
+	Reconnections int
+}
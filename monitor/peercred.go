@@ -0,0 +1,20 @@
+// +build !linux darwin
+
+package monitor
+
+import (
+	"fmt"
+	"net"
+)
+
+// getPeerCredentials is not supported on this platform
+func getPeerCredentials(conn net.Conn) (*peerCredentials, error) {
+
+	return nil, fmt.Errorf("Peer credentials are not supported on this platform")
+}
+
+// getProcessOwner is not supported on this platform
+func getProcessOwner(pid int) (int, error) {
+
+	return 0, fmt.Errorf("Process owners are not supported on this platform")
+}
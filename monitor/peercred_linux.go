@@ -0,0 +1,52 @@
+// +build linux,!darwin
+
+package monitor
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// getPeerCredentials returns the credentials of the process connected to a
+// unix socket
+func getPeerCredentials(conn net.Conn) (*peerCredentials, error) {
+
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("Not a unix socket")
+	}
+
+	f, err := unixConn.File()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cred, err := syscall.GetsockoptUcred(int(f.Fd()), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	if err != nil {
+		return nil, err
+	}
+
+	return &peerCredentials{
+		pid: int(cred.Pid),
+		uid: int(cred.Uid),
+		gid: int(cred.Gid),
+	}, nil
+}
+
+// getProcessOwner returns the user running a process
+func getProcessOwner(pid int) (int, error) {
+
+	if pid <= 0 {
+		return 0, fmt.Errorf("Invalid pid %d", pid)
+	}
+
+	var stat syscall.Stat_t
+	if err := syscall.Stat("/proc/"+strconv.Itoa(pid), &stat); err != nil {
+		return 0, err
+	}
+
+	return int(stat.Uid), nil
+}
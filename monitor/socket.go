@@ -0,0 +1,359 @@
+package monitor
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aporeto-inc/trireme/collector"
+	"github.com/aporeto-inc/trireme/policy"
+)
+
+// DefaultMonitorSocket is the default path of the socket of the socket monitor
+const DefaultMonitorSocket = "/var/run/trireme/monitor.sock"
+
+// maxSocketRequestSize is the maximum size of a request line
+const maxSocketRequestSize = 1024 * 1024
+
+// validSocketContextID matches the context IDs accepted by the socket monitor.
+// They are part of the names of the iptables chains of the PUs, which are
+// limited to 28 characters, so they are as long as the IDs of docker at most.
+var validSocketContextID = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.]{0,11}$`)
+
+// puRuntimeGetter is a ProcessingUnitsHandler that returns the runtimes of
+// the PUs it knows
+type puRuntimeGetter interface {
+	PURuntime(contextID string) (policy.RuntimeReader, error)
+}
+
+// A SocketRequest is a request sent to the socket monitor. Requests are sent as
+// one JSON object per line and each of them gets a SocketResponse line.
+//
+// The runtime of the PU is set first if Runtime is given, then the event is
+// sent if Event is given. A PU must be registered with its runtime before it
+// is started.
+type SocketRequest struct {
+	ContextID string
+	Event     Event             `json:",omitempty"`
+	Runtime   *policy.PURuntime `json:",omitempty"`
+}
+
+// A SocketResponse is the result of a SocketRequest. Error is empty if the
+// request succeeded.
+type SocketResponse struct {
+	Error string `json:",omitempty"`
+}
+
+// peerCredentials are the credentials of the process at the other end of a
+// unix socket
+type peerCredentials struct {
+	pid int
+	uid int
+	gid int
+}
+
+// socketMonitor receives the PUs and their events on a unix socket
+type socketMonitor struct {
+	sync.Mutex
+	socketPath  string
+	allowedUIDs map[int]bool
+	listener    net.Listener
+	conns       map[net.Conn]bool
+
+	// owners are the users that registered the PUs
+	owners map[string]int
+
+	// processOwner returns the user running a process
+	processOwner func(pid int) (int, error)
+
+	collector collector.EventCollector
+	puHandler ProcessingUnitsHandler
+}
+
+// NewSocketMonitor returns a Monitor that listens on the unix socket given in
+// parameter. Orchestrators register their PUs and send their events through
+// the socket. Callers are authenticated with the credentials of their process:
+// only root and the given users are accepted, and the events of a PU are only
+// accepted from the user that registered it or root. The other users can only
+// register PUs that are not known yet for processes they run. The PUs are not
+// persisted, so they must be registered again when the monitor is restarted.
+func NewSocketMonitor(socketPath string, p ProcessingUnitsHandler, l collector.EventCollector, allowedUIDs []int) Monitor {
+
+	if socketPath == "" {
+		socketPath = DefaultMonitorSocket
+	}
+
+	allowed := map[int]bool{0: true}
+	for _, uid := range allowedUIDs {
+		allowed[uid] = true
+	}
+
+	return &socketMonitor{
+		socketPath:   socketPath,
+		allowedUIDs:  allowed,
+		conns:        map[net.Conn]bool{},
+		owners:       map[string]int{},
+		processOwner: getProcessOwner,
+		collector:    l,
+		puHandler:    p,
+	}
+}
+
+// Start listens on the socket. The PUs are not synchronized, so the PUs left by
+// a previous run are only cleaned by the monitors that synchronize theirs.
+func (s *socketMonitor) Start() error {
+
+	log.WithFields(log.Fields{
+		"package": "monitor",
+		"socket":  s.socketPath,
+	}).Debug("Starting the socket monitor")
+
+	if err := os.Remove(s.socketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Cannot remove stale socket %s: %s", s.socketPath, err)
+	}
+
+	listener, err := net.Listen("unix", s.socketPath)
+	if err != nil {
+		return fmt.Errorf("Cannot listen on %s: %s", s.socketPath, err)
+	}
+
+	// The callers are authenticated with their credentials
+	if err := os.Chmod(s.socketPath, 0666); err != nil {
+		listener.Close()
+		return fmt.Errorf("Cannot set the permissions of %s: %s", s.socketPath, err)
+	}
+
+	s.Lock()
+	s.listener = listener
+	s.Unlock()
+
+	go s.accept(listener)
+
+	return nil
+}
+
+// Stop closes the socket and the connections. The PUs are left in place.
+func (s *socketMonitor) Stop() error {
+
+	log.WithFields(log.Fields{
+		"package": "monitor",
+	}).Debug("Stopping the socket monitor")
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.listener != nil {
+		s.listener.Close()
+		s.listener = nil
+	}
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+
+	return nil
+}
+
+// accept serves the connections until the listener is closed
+func (s *socketMonitor) accept(listener net.Listener) {
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.Lock()
+		s.conns[conn] = true
+		s.Unlock()
+
+		go s.serve(conn)
+	}
+}
+
+// serve answers the requests of an authenticated caller
+func (s *socketMonitor) serve(conn net.Conn) {
+
+	defer func() {
+		s.Lock()
+		delete(s.conns, conn)
+		s.Unlock()
+		conn.Close()
+	}()
+
+	encoder := json.NewEncoder(conn)
+
+	creds, err := getPeerCredentials(conn)
+	if err != nil {
+		encoder.Encode(&SocketResponse{Error: fmt.Sprintf("Cannot authenticate caller: %s", err)})
+		return
+	}
+
+	if !s.allowedUIDs[creds.uid] {
+		log.WithFields(log.Fields{
+			"package": "monitor",
+			"pid":     creds.pid,
+			"uid":     creds.uid,
+			"gid":     creds.gid,
+		}).Warn("Rejected connection to the socket monitor")
+
+		encoder.Encode(&SocketResponse{Error: fmt.Sprintf("User %d is not allowed", creds.uid)})
+		return
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), maxSocketRequestSize)
+
+	for scanner.Scan() {
+		response := &SocketResponse{}
+
+		request := &SocketRequest{}
+		if err := json.Unmarshal(scanner.Bytes(), request); err != nil {
+			response.Error = fmt.Sprintf("Invalid request: %s", err)
+		} else if err := s.handleRequest(creds, request); err != nil {
+			response.Error = err.Error()
+		}
+
+		if err := encoder.Encode(response); err != nil {
+			return
+		}
+	}
+}
+
+// handleRequest sets the runtime of the PU and sends its event
+func (s *socketMonitor) handleRequest(creds *peerCredentials, request *SocketRequest) error {
+
+	log.WithFields(log.Fields{
+		"package":   "monitor",
+		"contextID": request.ContextID,
+		"event":     request.Event,
+		"pid":       creds.pid,
+		"uid":       creds.uid,
+	}).Debug("Handling socket monitor request")
+
+	if !validSocketContextID.MatchString(request.ContextID) {
+		return fmt.Errorf("Invalid ContextID %q: up to 12 letters, digits, '_' or '.' are allowed", request.ContextID)
+	}
+
+	if request.Runtime == nil && request.Event == "" {
+		return fmt.Errorf("Request for %s has neither a runtime nor an event", request.ContextID)
+	}
+
+	switch request.Event {
+	case "", EventCreate, EventStart, EventStop, EventPause, EventUnpause, EventUpdate, EventDestroy:
+	default:
+		return fmt.Errorf("Unknown event %s", request.Event)
+	}
+
+	if err := s.authorize(creds, request.ContextID, request.Runtime); err != nil {
+		return err
+	}
+
+	if request.Runtime != nil {
+		if err := s.puHandler.SetPURuntime(request.ContextID, request.Runtime); err != nil {
+			return fmt.Errorf("Cannot set the runtime of %s: %s", request.ContextID, err)
+		}
+	}
+
+	if request.Event == "" {
+		return nil
+	}
+
+	err := <-s.puHandler.HandlePUEvent(request.ContextID, request.Event)
+
+	s.collectEvent(request.ContextID, request.Event, err)
+
+	if err == nil && request.Event == EventDestroy {
+		s.Lock()
+		delete(s.owners, request.ContextID)
+		s.Unlock()
+	}
+
+	return err
+}
+
+// authorize checks that the caller owns the PU. Root is allowed everything.
+// The other callers become the owner of a PU they register with the runtime
+// of one of their processes, as long as the PU is not known by another
+// monitor.
+func (s *socketMonitor) authorize(creds *peerCredentials, contextID string, runtime *policy.PURuntime) error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	owner, ok := s.owners[contextID]
+	if ok && owner != creds.uid && creds.uid != 0 {
+		return fmt.Errorf("PU %s belongs to user %d", contextID, owner)
+	}
+
+	if runtime != nil && creds.uid != 0 {
+		pidOwner, err := s.processOwner(runtime.Pid())
+		if err != nil {
+			return fmt.Errorf("Cannot find the owner of process %d: %s", runtime.Pid(), err)
+		}
+
+		if pidOwner != creds.uid {
+			return fmt.Errorf("Process %d does not belong to user %d", runtime.Pid(), creds.uid)
+		}
+	}
+
+	if ok {
+		return nil
+	}
+
+	if creds.uid != 0 {
+		if runtime == nil {
+			return fmt.Errorf("PU %s is not registered", contextID)
+		}
+
+		if err := s.checkUnknown(contextID); err != nil {
+			return err
+		}
+	}
+
+	if runtime != nil {
+		s.owners[contextID] = creds.uid
+	}
+
+	return nil
+}
+
+// checkUnknown returns an error if a PU that was not registered with the
+// socket monitor is known by the handler, or if the handler cannot tell
+func (s *socketMonitor) checkUnknown(contextID string) error {
+
+	getter, ok := s.puHandler.(puRuntimeGetter)
+	if !ok {
+		return fmt.Errorf("Cannot check that PU %s is not managed by another monitor", contextID)
+	}
+
+	if _, err := getter.PURuntime(contextID); err == nil {
+		return fmt.Errorf("PU %s is managed by another monitor", contextID)
+	}
+
+	return nil
+}
+
+// collectEvent reports the events of the PUs to the collector
+func (s *socketMonitor) collectEvent(contextID string, event Event, err error) {
+
+	switch event {
+	case EventCreate:
+		s.collector.CollectContainerEvent(contextID, "", nil, collector.ContainerCreate)
+	case EventStart:
+		if err != nil {
+			s.collector.CollectContainerEvent(contextID, "", nil, collector.ContainerFailed)
+			return
+		}
+		s.collector.CollectContainerEvent(contextID, "", nil, collector.ContainerStart)
+	case EventStop:
+		s.collector.CollectContainerEvent(contextID, "", nil, collector.ContainerStop)
+	case EventDestroy:
+		s.collector.CollectContainerEvent(contextID, "", nil, collector.ContainerDelete)
+	}
+}
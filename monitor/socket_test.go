@@ -0,0 +1,173 @@
+package monitor
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aporeto-inc/trireme/collector"
+	"github.com/aporeto-inc/trireme/policy"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// socketClient sends a request to the socket monitor and returns its response
+func socketClient(conn net.Conn, reader *bufio.Reader, request string) *SocketResponse {
+	conn.Write([]byte(request + "\n"))
+
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return &SocketResponse{Error: "Connection closed: " + err.Error()}
+	}
+
+	response := &SocketResponse{}
+	json.Unmarshal(line, response)
+	return response
+}
+
+func TestSocketMonitor(t *testing.T) {
+
+	Convey("Given a started socket monitor allowing the current user", t, func() {
+		dir, _ := ioutil.TempDir("", "monitor")
+		defer os.RemoveAll(dir)
+
+		socket := filepath.Join(dir, "monitor.sock")
+		h := newTestPUHandler()
+		m := NewSocketMonitor(socket, h, &collector.DefaultCollector{}, []int{os.Getuid()})
+		So(m.Start(), ShouldBeNil)
+		defer m.Stop()
+
+		So(h.synced, ShouldBeFalse)
+
+		conn, err := net.Dial("unix", socket)
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+
+		Convey("When I register a PU and start it", func() {
+			runtime, _ := json.Marshal(policy.NewPURuntime("job", os.Getpid(), policy.NewTagsMap(map[string]string{"app": "web"}), nil))
+
+			registered := socketClient(conn, reader, `{"ContextID":"job1","Event":"create","Runtime":`+string(runtime)+`}`)
+			started := socketClient(conn, reader, `{"ContextID":"job1","Event":"start"}`)
+
+			Convey("The runtime should be set and the events sent", func() {
+				So(registered.Error, ShouldBeEmpty)
+				So(started.Error, ShouldBeEmpty)
+				So(h.Events(), ShouldResemble, []string{"job1:create", "job1:start"})
+
+				h.Lock()
+				defer h.Unlock()
+				So(h.runtimes["job1"].Pid(), ShouldEqual, os.Getpid())
+				tag, _ := h.runtimes["job1"].Tag("app")
+				So(tag, ShouldEqual, "web")
+			})
+		})
+
+		Convey("When the handler fails", func() {
+			runtime, _ := json.Marshal(policy.NewPURuntime("job", os.Getpid(), nil, nil))
+			So(socketClient(conn, reader, `{"ContextID":"job1","Event":"create","Runtime":`+string(runtime)+`}`).Error, ShouldBeEmpty)
+
+			h.err = os.ErrInvalid
+			response := socketClient(conn, reader, `{"ContextID":"job1","Event":"start"}`)
+
+			Convey("The error should be returned", func() {
+				So(response.Error, ShouldEqual, os.ErrInvalid.Error())
+			})
+		})
+
+		Convey("When I send invalid requests", func() {
+			invalid := socketClient(conn, reader, `{"ContextID":`)
+			unknown := socketClient(conn, reader, `{"ContextID":"job1","Event":"explode"}`)
+			empty := socketClient(conn, reader, `{"ContextID":"job1"}`)
+			long := socketClient(conn, reader, `{"ContextID":"job1234567890","Event":"stop"}`)
+			chars := socketClient(conn, reader, `{"ContextID":"job-1 -j ACCEPT","Event":"stop"}`)
+
+			Convey("I should get errors and nothing should be sent", func() {
+				So(invalid.Error, ShouldNotBeEmpty)
+				So(unknown.Error, ShouldNotBeEmpty)
+				So(empty.Error, ShouldNotBeEmpty)
+				So(long.Error, ShouldNotBeEmpty)
+				So(chars.Error, ShouldNotBeEmpty)
+				So(h.Events(), ShouldBeEmpty)
+			})
+		})
+	})
+
+	Convey("Given a socket monitor", t, func() {
+		h := newTestPUHandler()
+		s := NewSocketMonitor("", h, &collector.DefaultCollector{}, []int{1000, 1001}).(*socketMonitor)
+
+		owner := &peerCredentials{uid: 1000}
+		other := &peerCredentials{uid: 1001}
+		root := &peerCredentials{uid: 0}
+
+		s.processOwner = func(pid int) (int, error) {
+			return 1000 + pid - 42, nil
+		}
+
+		So(s.allowedUIDs[0], ShouldBeTrue)
+		So(s.allowedUIDs[1002], ShouldBeFalse)
+
+		runtime := policy.NewPURuntime("job", 42, nil, nil)
+		otherRuntime := policy.NewPURuntime("job", 43, nil, nil)
+		So(s.handleRequest(owner, &SocketRequest{ContextID: "job1", Event: EventCreate, Runtime: runtime}), ShouldBeNil)
+
+		Convey("When another user sends an event for the PU", func() {
+			err := s.handleRequest(other, &SocketRequest{ContextID: "job1", Event: EventStop})
+
+			Convey("It should be rejected", func() {
+				So(err, ShouldNotBeNil)
+				So(h.Events(), ShouldResemble, []string{"job1:create"})
+			})
+		})
+
+		Convey("When a user registers a process of another user", func() {
+			err := s.handleRequest(other, &SocketRequest{ContextID: "job2", Event: EventCreate, Runtime: runtime})
+
+			Convey("It should be rejected", func() {
+				So(err, ShouldNotBeNil)
+				So(s.owners, ShouldNotContainKey, "job2")
+				So(h.Events(), ShouldResemble, []string{"job1:create"})
+			})
+		})
+
+		Convey("When a user targets a PU of another monitor", func() {
+			h.SetPURuntime("a1b2c3d4e5f6", policy.NewPURuntime("web", 1, nil, nil))
+
+			overwrite := s.handleRequest(other, &SocketRequest{ContextID: "a1b2c3d4e5f6", Runtime: otherRuntime})
+			stop := s.handleRequest(other, &SocketRequest{ContextID: "a1b2c3d4e5f6", Event: EventStop})
+			destroy := s.handleRequest(other, &SocketRequest{ContextID: "a1b2c3d4e5f6", Event: EventDestroy})
+
+			Convey("It should be rejected and the runtime should be kept", func() {
+				So(overwrite, ShouldNotBeNil)
+				So(stop, ShouldNotBeNil)
+				So(destroy, ShouldNotBeNil)
+				So(s.owners, ShouldNotContainKey, "a1b2c3d4e5f6")
+				So(h.runtimes["a1b2c3d4e5f6"].Pid(), ShouldEqual, 1)
+				So(h.Events(), ShouldResemble, []string{"job1:create"})
+			})
+		})
+
+		Convey("When root sends an event for a PU of another monitor", func() {
+			h.SetPURuntime("a1b2c3d4e5f6", policy.NewPURuntime("web", 1, nil, nil))
+
+			Convey("It should be accepted", func() {
+				So(s.handleRequest(root, &SocketRequest{ContextID: "a1b2c3d4e5f6", Event: EventStop}), ShouldBeNil)
+				So(s.owners, ShouldNotContainKey, "a1b2c3d4e5f6")
+			})
+		})
+
+		Convey("When root destroys the PU", func() {
+			So(s.handleRequest(root, &SocketRequest{ContextID: "job1", Event: EventDestroy}), ShouldBeNil)
+			delete(h.runtimes, "job1")
+
+			Convey("Another user should be able to register it", func() {
+				So(s.handleRequest(other, &SocketRequest{ContextID: "job1", Runtime: otherRuntime}), ShouldBeNil)
+				So(s.owners["job1"], ShouldEqual, 1001)
+			})
+		})
+	})
+}
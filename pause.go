@@ -0,0 +1,166 @@
+package trireme
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// PauseMode defines how the network of a paused PU is handled
+type PauseMode int
+
+const (
+	// PauseKeep keeps the policy of a paused PU in place
+	PauseKeep PauseMode = iota
+
+	// PauseQuarantine drops all the new flows of a paused PU until it is unpaused
+	PauseQuarantine
+)
+
+// pausedPU is the state of a paused PU
+type pausedPU struct {
+	since    time.Time
+	timer    *time.Timer
+	released bool
+}
+
+// SetPauseBehavior sets how paused PUs are handled
+func (t *trireme) SetPauseBehavior(mode PauseMode, releaseAfter time.Duration) {
+
+	t.pauseMode = mode
+	t.pauseRelease = releaseAfter
+}
+
+// isFrozen returns true if the policy of the PU must not be changed because it
+// is paused and quarantined or released
+func (t *trireme) isFrozen(contextID string) bool {
+
+	p, ok := t.pausedState(contextID)
+
+	return ok && (p.released || t.pauseMode == PauseQuarantine)
+}
+
+// doHandlePause quarantines a paused PU if required and schedules the release
+// of its resources
+func (t *trireme) doHandlePause(ctx context.Context, contextID string) error {
+
+	log.WithFields(log.Fields{
+		"package":   "trireme",
+		"contextID": contextID,
+	}).Debug("Started HandlePause")
+
+	activePolicy, ok := t.activePolicy(contextID)
+	if !ok {
+		return fmt.Errorf("Cannot pause unknown PU %s", contextID)
+	}
+
+	if _, ok := t.pausedState(contextID); ok {
+		return nil
+	}
+
+	if t.pauseMode == PauseQuarantine {
+		if err := t.applyPolicy(ctx, contextID, activePolicy.Quarantine()); err != nil {
+			return fmt.Errorf("Cannot quarantine paused PU %s: %s", contextID, err)
+		}
+	}
+
+	p := &pausedPU{
+		since: time.Now(),
+	}
+
+	if t.pauseRelease > 0 {
+		p.timer = time.AfterFunc(t.pauseRelease, func() {
+			t.submit(&triremeRequest{
+				contextID:  contextID,
+				reqType:    pauseExpired,
+				returnChan: make(chan error, 1),
+			})
+		})
+	}
+
+	t.stateLock.Lock()
+	t.paused[contextID] = p
+	t.stateLock.Unlock()
+
+	return nil
+}
+
+// doHandleUnpause restores the policy of a PU that was quarantined or released.
+// The policy is not resolved again.
+func (t *trireme) doHandleUnpause(ctx context.Context, contextID string) error {
+
+	log.WithFields(log.Fields{
+		"package":   "trireme",
+		"contextID": contextID,
+	}).Debug("Started HandleUnpause")
+
+	if !t.isFrozen(contextID) {
+		t.clearPause(contextID)
+		return nil
+	}
+
+	t.clearPause(contextID)
+
+	activePolicy, _ := t.activePolicy(contextID)
+
+	return t.applyPolicy(ctx, contextID, activePolicy)
+}
+
+// doReleasePU releases the resources of a PU that has been paused for too long.
+// Its runtime and its policy are kept so that it can be restored when unpaused.
+func (t *trireme) doReleasePU(ctx context.Context, contextID string) error {
+
+	p, ok := t.pausedState(contextID)
+
+	// The PU was unpaused or paused again since the release was scheduled
+	if !ok || p.released || time.Since(p.since) < t.pauseRelease {
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"package":   "trireme",
+		"contextID": contextID,
+	}).Debug("Releasing paused PU")
+
+	// The PU is only marked released if the release is carried through
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("Release abandoned for contextID %s: %s", contextID, err)
+	}
+
+	p.released = true
+
+	errS := t.unsupervise(contextID)
+	errE := t.unenforce(contextID)
+
+	if errS != nil || errE != nil {
+		return fmt.Errorf("Release Error for contextID %s. supervisor %s, enforcer %s", contextID, errS, errE)
+	}
+
+	return nil
+}
+
+// pausedState returns the pause state of a PU
+func (t *trireme) pausedState(contextID string) (*pausedPU, bool) {
+
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+
+	p, ok := t.paused[contextID]
+
+	return p, ok
+}
+
+// clearPause forgets the pause state of a PU
+func (t *trireme) clearPause(contextID string) {
+
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+
+	if p, ok := t.paused[contextID]; ok && p.timer != nil {
+		p.timer.Stop()
+	}
+
+	delete(t.paused, contextID)
+}
@@ -29,6 +29,12 @@ type RuntimeReader interface {
 
 	// IPAddresses returns a copy of all the IP addresses.
 	IPAddresses() *IPMap
+
+	// Mark returns the packet mark of a Linux service.
+	Mark() string
+
+	// Ports returns a copy of the ports a Linux service listens on.
+	Ports() []string
 }
 
 // InfoInteractor is the interface for setting up policy before providing to trireme
@@ -12,6 +12,12 @@ type PUPolicy struct {
 	// ManagementID is provided for the policy implementations as a means of
 	// holding a policy identifier related to the implementation
 	ManagementID string
+	// VersionID is the identifier of this version of the policy given by the
+	// policy implementation
+	VersionID string
+	// Hash is the hash of this version of the policy given by the policy
+	// implementation
+	Hash string
 	//TriremeAction defines what level of policy should be applied to that container.
 	TriremeAction PUAction
 	// ingressACLs is the list of ACLs to be applied when the container talks
@@ -30,6 +36,13 @@ type PUPolicy struct {
 	receiverRules *TagSelectorList
 	// ips is the set of IP addresses and namespaces that the policy must be applied to
 	ips *IPMap
+	// mark is the packet mark of the traffic of a Linux service. It is also the
+	// net_cls classid of its cgroup
+	mark string
+	// ports are the ports a Linux service listens on
+	ports []string
+	// quarantined is true when all the new flows of the PU are dropped
+	quarantined bool
 	// Extensions is an interface to a data structure that allows the policy supervisor
 	// to pass additional instructions to a plugin. Plugin and policy must be
 	// coordinated to implement the interface
@@ -98,9 +111,38 @@ func (p *PUPolicy) Clone() *PUPolicy {
 		p.ips.Clone(),
 		p.Extensions,
 	)
+	np.VersionID = p.VersionID
+	np.Hash = p.Hash
+	np.mark = p.mark
+	np.ports = append([]string(nil), p.ports...)
+	np.quarantined = p.quarantined
 	return np
 }
 
+// Quarantine returns a copy of the policy without ACLs and without rules. The
+// identity and the addresses of the PU are kept so that it is still enforced,
+// but all its new flows are dropped, whatever their protocol.
+func (p *PUPolicy) Quarantine() *PUPolicy {
+
+	np := p.Clone()
+	np.quarantined = true
+	np.TriremeAction = Police
+	np.ingressACLs = NewIPRuleList(nil)
+	np.egressACLs = NewIPRuleList(nil)
+	np.transmitterRules = NewTagSelectorList(nil)
+	np.receiverRules = NewTagSelectorList(nil)
+
+	return np
+}
+
+// Quarantined returns true if all the new flows of the PU must be dropped
+func (p *PUPolicy) Quarantined() bool {
+	p.puPolicyMutex.Lock()
+	defer p.puPolicyMutex.Unlock()
+
+	return p.quarantined
+}
+
 // IngressACLs returns a copy of IPRuleList
 func (p *PUPolicy) IngressACLs() *IPRuleList {
 	p.puPolicyMutex.Lock()
@@ -117,6 +159,22 @@ func (p *PUPolicy) EgressACLs() *IPRuleList {
 	return p.egressACLs.Clone()
 }
 
+// SetIngressACLs sets the ingress ACLs of the processing unit
+func (p *PUPolicy) SetIngressACLs(l *IPRuleList) {
+	p.puPolicyMutex.Lock()
+	defer p.puPolicyMutex.Unlock()
+
+	p.ingressACLs = l.Clone()
+}
+
+// SetEgressACLs sets the egress ACLs of the processing unit
+func (p *PUPolicy) SetEgressACLs(l *IPRuleList) {
+	p.puPolicyMutex.Lock()
+	defer p.puPolicyMutex.Unlock()
+
+	p.egressACLs = l.Clone()
+}
+
 // ReceiverRules returns a copy of TagSelectorList
 func (p *PUPolicy) ReceiverRules() *TagSelectorList {
 	p.puPolicyMutex.Lock()
@@ -189,6 +247,38 @@ func (p *PUPolicy) SetIPAddresses(l *IPMap) {
 	p.ips = l.Clone()
 }
 
+// Mark returns the packet mark of a Linux service
+func (p *PUPolicy) Mark() string {
+	p.puPolicyMutex.Lock()
+	defer p.puPolicyMutex.Unlock()
+
+	return p.mark
+}
+
+// SetMark sets the packet mark of a Linux service
+func (p *PUPolicy) SetMark(mark string) {
+	p.puPolicyMutex.Lock()
+	defer p.puPolicyMutex.Unlock()
+
+	p.mark = mark
+}
+
+// Ports returns a copy of the ports a Linux service listens on
+func (p *PUPolicy) Ports() []string {
+	p.puPolicyMutex.Lock()
+	defer p.puPolicyMutex.Unlock()
+
+	return append([]string(nil), p.ports...)
+}
+
+// SetPorts sets the ports a Linux service listens on
+func (p *PUPolicy) SetPorts(ports []string) {
+	p.puPolicyMutex.Lock()
+	defer p.puPolicyMutex.Unlock()
+
+	p.ports = append([]string(nil), ports...)
+}
+
 // DefaultIPAddress returns the default IP address for the processing unit
 func (p *PUPolicy) DefaultIPAddress() (string, bool) {
 	p.puPolicyMutex.Lock()
@@ -212,6 +302,10 @@ type PURuntime struct {
 	ips *IPMap
 	// Tags is a map of the metadata of the container
 	tags *TagsMap
+	// mark is the packet mark of a Linux service
+	mark string
+	// ports are the ports a Linux service listens on
+	ports []string
 }
 
 // NewPURuntime Generate a new RuntimeInfo
@@ -230,6 +324,7 @@ func NewPURuntime(name string, pid int, tags *TagsMap, ips *IPMap) *PURuntime {
 		tags:           t,
 		ips:            i,
 		pid:            pid,
+		name:           name,
 	}
 }
 
@@ -244,7 +339,11 @@ func (r *PURuntime) Clone() *PURuntime {
 	r.puRuntimeMutex.Lock()
 	defer r.puRuntimeMutex.Unlock()
 
-	return NewPURuntime(r.name, r.pid, r.tags.Clone(), r.ips.Clone())
+	c := NewPURuntime(r.name, r.pid, r.tags.Clone(), r.ips.Clone())
+	c.mark = r.mark
+	c.ports = append([]string(nil), r.ports...)
+
+	return c
 }
 
 // PURuntimeJSON is a Json representation of PURuntime
@@ -257,6 +356,10 @@ type PURuntimeJSON struct {
 	IPAddresses *IPMap
 	// Tags is a map of the metadata of the container
 	Tags *TagsMap
+	// Mark is the packet mark of a Linux service
+	Mark string
+	// Ports are the ports a Linux service listens on
+	Ports []string
 }
 
 // MarshalJSON Marshals this struct.
@@ -266,6 +369,8 @@ func (r *PURuntime) MarshalJSON() ([]byte, error) {
 		Name:        r.name,
 		IPAddresses: r.ips,
 		Tags:        r.tags,
+		Mark:        r.mark,
+		Ports:       r.ports,
 	})
 }
 
@@ -273,10 +378,21 @@ func (r *PURuntime) MarshalJSON() ([]byte, error) {
 func (r *PURuntime) UnmarshalJSON(param []byte) error {
 	a := &PURuntimeJSON{}
 	json.Unmarshal(param, &a)
+	if r.puRuntimeMutex == nil {
+		r.puRuntimeMutex = &sync.Mutex{}
+	}
 	r.pid = a.Pid
 	r.name = a.Name
 	r.ips = a.IPAddresses
+	if r.ips == nil {
+		r.ips = NewIPMap(nil)
+	}
 	r.tags = a.Tags
+	if r.tags == nil {
+		r.tags = NewTagsMap(nil)
+	}
+	r.mark = a.Mark
+	r.ports = a.Ports
 	return nil
 }
 
@@ -300,6 +416,38 @@ func (r *PURuntime) SetName(name string) {
 	r.name = name
 }
 
+// Mark returns the packet mark of a Linux service
+func (r *PURuntime) Mark() string {
+	r.puRuntimeMutex.Lock()
+	defer r.puRuntimeMutex.Unlock()
+
+	return r.mark
+}
+
+// SetMark sets the packet mark of a Linux service
+func (r *PURuntime) SetMark(mark string) {
+	r.puRuntimeMutex.Lock()
+	defer r.puRuntimeMutex.Unlock()
+
+	r.mark = mark
+}
+
+// Ports returns a copy of the ports a Linux service listens on
+func (r *PURuntime) Ports() []string {
+	r.puRuntimeMutex.Lock()
+	defer r.puRuntimeMutex.Unlock()
+
+	return append([]string(nil), r.ports...)
+}
+
+// SetPorts sets the ports a Linux service listens on
+func (r *PURuntime) SetPorts(ports []string) {
+	r.puRuntimeMutex.Lock()
+	defer r.puRuntimeMutex.Unlock()
+
+	r.ports = append([]string(nil), ports...)
+}
+
 // DefaultIPAddress returns the default IP address for the processing unit
 func (r *PURuntime) DefaultIPAddress() (string, bool) {
 	r.puRuntimeMutex.Lock()
@@ -1,5 +1,13 @@
 package policy
 
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
 // This file defines types and accessor methods for these types
 
 // Operator defines the operation between your key and value.
@@ -53,6 +61,55 @@ type IPRule struct {
 	Action   FlowAction
 }
 
+// IsFQDN returns true if the address of the rule is a DNS name instead of
+// an IP address or a CIDR
+func (r *IPRule) IsFQDN() bool {
+
+	return isHostname(r.Address)
+}
+
+// Validate returns an error if the address of the rule is neither an IP address,
+// a CIDR nor a DNS name. Rules without an address are valid.
+func (r *IPRule) Validate() error {
+
+	if r.Address == "" || net.ParseIP(r.Address) != nil || isHostname(r.Address) {
+		return nil
+	}
+
+	if _, _, err := net.ParseCIDR(r.Address); err != nil {
+		return fmt.Errorf("Invalid address %s", r.Address)
+	}
+
+	return nil
+}
+
+// isHostname returns true if the name is a valid DNS name. Names whose last label
+// is numeric are rejected so that mistyped IP addresses are not resolved.
+func isHostname(name string) bool {
+
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+
+	labels := strings.Split(name, ".")
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' {
+				return false
+			}
+		}
+	}
+
+	_, err := strconv.Atoi(labels[len(labels)-1])
+
+	return err != nil
+}
+
 // IPRuleList is a list of IP rules
 type IPRuleList struct {
 	Rules []IPRule
@@ -74,6 +131,82 @@ func (l *IPRuleList) Clone() *IPRuleList {
 	return NewIPRuleList(l.Rules)
 }
 
+// ExclusionDirection is the direction of the connections an exclusion applies to.
+type ExclusionDirection int
+
+const (
+	// ExcludeBoth excludes the connections to and from the excluded network
+	ExcludeBoth ExclusionDirection = iota
+	// ExcludeOutgoing excludes the connections from the PUs to the excluded network
+	ExcludeOutgoing
+	// ExcludeIncoming excludes the connections from the excluded network to the PUs
+	ExcludeIncoming
+)
+
+// ExcludedIP holds a network whose traffic bypasses Trireme. The exclusion can
+// be restricted to a protocol and a destination port or port range, and to a
+// direction when it has a port.
+type ExcludedIP struct {
+	Address   string
+	Protocol  string
+	Port      string
+	Direction ExclusionDirection
+}
+
+// NewExcludedIP returns an exclusion of all the traffic to and from the given IP or CIDR
+func NewExcludedIP(address string) *ExcludedIP {
+	return &ExcludedIP{
+		Address:   address,
+		Direction: ExcludeBoth,
+	}
+}
+
+// Validate returns an error if the exclusion cannot be programmed
+func (e *ExcludedIP) Validate() error {
+
+	if net.ParseIP(e.Address) == nil {
+		if _, _, err := net.ParseCIDR(e.Address); err != nil {
+			return fmt.Errorf("Invalid address %s", e.Address)
+		}
+	}
+
+	switch strings.ToLower(e.Protocol) {
+	case "":
+		if e.Port != "" {
+			return fmt.Errorf("A protocol is required with the port %s", e.Port)
+		}
+	case "tcp", "udp":
+	default:
+		if e.Port != "" {
+			return fmt.Errorf("Ports are not supported with the protocol %s", e.Protocol)
+		}
+	}
+
+	if e.Port != "" {
+		for _, port := range strings.SplitN(e.Port, ":", 2) {
+			if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+				return fmt.Errorf("Invalid port %s", e.Port)
+			}
+		}
+	}
+
+	if e.Direction < ExcludeBoth || e.Direction > ExcludeIncoming {
+		return fmt.Errorf("Invalid direction %d", e.Direction)
+	}
+
+	// The direction of the traffic is told by the port it goes to
+	if e.Direction != ExcludeBoth && e.Port == "" {
+		return fmt.Errorf("A port is required with the direction %d", e.Direction)
+	}
+
+	return nil
+}
+
+// Key returns a string identifying the exclusion
+func (e *ExcludedIP) Key() string {
+	return fmt.Sprintf("%s,%s,%s,%d", e.Address, strings.ToLower(e.Protocol), e.Port, e.Direction)
+}
+
 // An IPMap is a map of Key:Values used for IP Addresses.
 type IPMap struct {
 	IPs map[string]string
@@ -106,6 +239,36 @@ func (i *IPMap) Get(k string) (string, bool) {
 	return v, ok
 }
 
+// Addresses returns the unique non empty addresses of the map. The address of the
+// default namespace comes first, the others follow in the order of their namespace.
+func (i *IPMap) Addresses() []string {
+
+	namespaces := make([]string, 0, len(i.IPs))
+	for k := range i.IPs {
+		if k != DefaultNamespace {
+			namespaces = append(namespaces, k)
+		}
+	}
+	sort.Strings(namespaces)
+
+	if _, ok := i.IPs[DefaultNamespace]; ok {
+		namespaces = append([]string{DefaultNamespace}, namespaces...)
+	}
+
+	seen := map[string]bool{}
+	addresses := []string{}
+	for _, k := range namespaces {
+		ip := i.IPs[k]
+		if ip == "" || seen[ip] {
+			continue
+		}
+		seen[ip] = true
+		addresses = append(addresses, ip)
+	}
+
+	return addresses
+}
+
 // A TagsMap is a map of Key:Values used as tags.
 type TagsMap struct {
 	Tags map[string]string
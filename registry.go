@@ -0,0 +1,217 @@
+package trireme
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aporeto-inc/trireme/monitor"
+	"github.com/aporeto-inc/trireme/policy"
+)
+
+// PUState is the state of a PU in its lifecycle
+type PUState string
+
+const (
+	// PUStateCreated is the state of a PU that is created but not started
+	PUStateCreated PUState = "created"
+
+	// PUStateResolving is the state of a PU while its policy is resolved and
+	// enforced
+	PUStateResolving PUState = "resolving"
+
+	// PUStateEnforced is the state of a PU running with its policy enforced
+	PUStateEnforced PUState = "enforced"
+
+	// PUStatePending is the state of a PU running with a fallback policy while
+	// the resolution of its policy is retried
+	PUStatePending PUState = "pending"
+
+	// PUStatePaused is the state of a paused PU
+	PUStatePaused PUState = "paused"
+
+	// PUStateFailed is the state of a PU whose policy could not be enforced
+	// when it started
+	PUStateFailed PUState = "failed"
+
+	// PUStateStopped is the state of a PU that is stopped but not destroyed
+	PUStateStopped PUState = "stopped"
+)
+
+// PUStatus is the status of a PU
+type PUStatus struct {
+	ContextID string
+	State     PUState
+
+	// PolicyVersion is incremented each time a new policy is set for the PU
+	PolicyVersion int
+
+	// LastError is the error returned by the last request that failed for the PU
+	LastError error
+
+	// CreatedAt is the time the PU was first seen
+	CreatedAt time.Time
+
+	// UpdatedAt is the time of the last change of state
+	UpdatedAt time.Time
+
+	// PolicyUpdatedAt is the time the current policy was set
+	PolicyUpdatedAt time.Time
+}
+
+// puEvents are the events accepted by a PU in each state. An unknown PU has no
+// state. The other events are rejected without touching the PU.
+var puEvents = map[PUState][]monitor.Event{
+	"":              {monitor.EventCreate, monitor.EventStart, monitor.EventDestroy},
+	PUStateCreated:  {monitor.EventCreate, monitor.EventStart, monitor.EventUpdate, monitor.EventStop, monitor.EventDestroy},
+	PUStateEnforced: {monitor.EventStart, monitor.EventUpdate, monitor.EventPause, monitor.EventUnpause, monitor.EventStop, monitor.EventDestroy},
+	PUStatePending:  {monitor.EventStart, monitor.EventUpdate, monitor.EventPause, monitor.EventUnpause, monitor.EventStop, monitor.EventDestroy},
+	PUStatePaused:   {monitor.EventUpdate, monitor.EventPause, monitor.EventUnpause, monitor.EventStop, monitor.EventDestroy},
+	PUStateFailed:   {monitor.EventStart, monitor.EventUpdate, monitor.EventStop, monitor.EventDestroy},
+	PUStateStopped:  {monitor.EventCreate, monitor.EventStart, monitor.EventStop, monitor.EventDestroy},
+}
+
+// isLifecycleEvent returns true if the event changes the state of a PU
+func isLifecycleEvent(event monitor.Event) bool {
+
+	switch event {
+	case monitor.EventCreate, monitor.EventStart, monitor.EventUpdate, monitor.EventPause,
+		monitor.EventUnpause, monitor.EventStop, monitor.EventDestroy:
+		return true
+	}
+
+	return false
+}
+
+// acceptsEvent returns true if a PU in the given state accepts the event
+func acceptsEvent(state PUState, event monitor.Event) bool {
+
+	for _, e := range puEvents[state] {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ListPUs returns the status of all the PUs ordered by contextID
+func (t *trireme) ListPUs() []*PUStatus {
+
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+
+	contextIDs := make([]string, 0, len(t.status))
+	for contextID := range t.status {
+		contextIDs = append(contextIDs, contextID)
+	}
+	sort.Strings(contextIDs)
+
+	list := make([]*PUStatus, 0, len(contextIDs))
+	for _, contextID := range contextIDs {
+		s := *t.status[contextID]
+		list = append(list, &s)
+	}
+
+	return list
+}
+
+// PUStatus returns the status of a PU
+func (t *trireme) PUStatus(contextID string) (*PUStatus, error) {
+
+	status, ok := t.puStatus(contextID)
+	if !ok {
+		return nil, fmt.Errorf("Unknown PU %s", contextID)
+	}
+
+	return status, nil
+}
+
+// PUPolicy returns a copy of the policy of a PU
+func (t *trireme) PUPolicy(contextID string) (*policy.PUPolicy, error) {
+
+	p, ok := t.activePolicy(contextID)
+	if !ok {
+		return nil, fmt.Errorf("No policy for PU %s", contextID)
+	}
+
+	return p.Clone(), nil
+}
+
+// puStatus returns a copy of the status of a PU
+func (t *trireme) puStatus(contextID string) (*PUStatus, bool) {
+
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+
+	status, ok := t.status[contextID]
+	if !ok {
+		return nil, false
+	}
+
+	s := *status
+
+	return &s, true
+}
+
+// puState returns the state of a PU. It is empty for an unknown PU.
+func (t *trireme) puState(contextID string) PUState {
+
+	if status, ok := t.puStatus(contextID); ok {
+		return status.State
+	}
+
+	return ""
+}
+
+// setState moves a PU to a new state and records the error that caused it
+func (t *trireme) setState(contextID string, state PUState, err error) {
+
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+
+	now := time.Now()
+
+	status, ok := t.status[contextID]
+	if !ok {
+		status = &PUStatus{
+			ContextID: contextID,
+			CreatedAt: now,
+		}
+		t.status[contextID] = status
+	}
+
+	if status.State != state {
+		status.State = state
+		status.UpdatedAt = now
+	}
+
+	if err != nil {
+		status.LastError = err
+	}
+}
+
+// setError records the error of a request that did not change the state of a PU
+func (t *trireme) setError(contextID string, err error) {
+
+	if err == nil {
+		return
+	}
+
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+
+	if status, ok := t.status[contextID]; ok {
+		status.LastError = err
+	}
+}
+
+// deleteStatus forgets a destroyed PU
+func (t *trireme) deleteStatus(contextID string) {
+
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+
+	delete(t.status, contextID)
+	delete(t.history, contextID)
+}
@@ -0,0 +1,251 @@
+package trireme
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aporeto-inc/trireme/enforcer"
+	"github.com/aporeto-inc/trireme/monitor"
+	"github.com/aporeto-inc/trireme/policy"
+	"github.com/aporeto-inc/trireme/supervisor"
+)
+
+// countReleases counts the calls to Unsupervise and Unenforce
+func countReleases(t *testing.T, tsupervisor supervisor.TestSupervisor, tenforcer enforcer.TestPolicyEnforcer) *int {
+
+	released := 0
+
+	tsupervisor.MockUnsupervise(t, func(contextID string) error {
+		released++
+		return nil
+	})
+
+	tenforcer.MockUnenforce(t, func(contextID string) error {
+		released++
+		return nil
+	})
+
+	return &released
+}
+
+func expectState(t *testing.T, trireme Trireme, contextID string, state PUState) *PUStatus {
+
+	status, err := trireme.PUStatus(contextID)
+	if err != nil {
+		t.Fatalf("Status of %s was supposed to be %s, got %s", contextID, state, err)
+	}
+
+	if status.State != state {
+		t.Errorf("Status of %s was supposed to be %s, was %s", contextID, state, status.State)
+	}
+
+	return status
+}
+
+func TestPULifecycle(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, tmonitor := createMocks()
+	trireme := NewTrireme("serverID", tresolver, tsupervisor, tenforcer)
+	trireme.Start()
+	defer trireme.Stop()
+
+	contextID := "123123"
+	runtime := policy.NewPURuntimeWithDefaults()
+	trireme.SetPURuntime(contextID, runtime)
+
+	if err := <-trireme.HandlePUEvent(contextID, monitor.EventCreate); err != nil {
+		t.Errorf("Create was supposed to be nil, was %s", err)
+	}
+
+	status := expectState(t, trireme, contextID, PUStateCreated)
+	if status.PolicyVersion != 0 || status.CreatedAt.IsZero() {
+		t.Errorf("Status of a created PU is not empty: %+v", status)
+	}
+
+	if _, err := trireme.PUPolicy(contextID); err == nil {
+		t.Errorf("A created PU was not supposed to have a policy")
+	}
+
+	doTestCreate(t, trireme, tresolver, tsupervisor, tenforcer, tmonitor, contextID, runtime)
+
+	status = expectState(t, trireme, contextID, PUStateEnforced)
+	if status.PolicyVersion != 1 {
+		t.Errorf("Policy version was supposed to be 1, was %d", status.PolicyVersion)
+	}
+
+	p, err := trireme.PUPolicy(contextID)
+	if err != nil {
+		t.Fatalf("Policy of an enforced PU was supposed to be set, got %s", err)
+	}
+
+	if p.ManagementID != "SomeId" {
+		t.Errorf("Policy of the PU is not the resolved policy: %+v", p)
+	}
+
+	if err := <-trireme.UpdatePolicy(contextID, p); err != nil {
+		t.Errorf("Update was supposed to be nil, was %s", err)
+	}
+
+	if status = expectState(t, trireme, contextID, PUStateEnforced); status.PolicyVersion != 2 {
+		t.Errorf("Policy version was supposed to be 2, was %d", status.PolicyVersion)
+	}
+
+	released := countReleases(t, tsupervisor, tenforcer)
+
+	if err := <-trireme.HandlePUEvent(contextID, monitor.EventStop); err != nil {
+		t.Errorf("Stop was supposed to be nil, was %s", err)
+	}
+
+	expectState(t, trireme, contextID, PUStateStopped)
+	if *released != 2 {
+		t.Errorf("Stop didn't go to Supervisor and Enforcer")
+	}
+
+	if list := trireme.ListPUs(); len(list) != 1 || list[0].ContextID != contextID {
+		t.Errorf("List was supposed to have the stopped PU, got %+v", list)
+	}
+
+	if err := <-trireme.HandlePUEvent(contextID, monitor.EventDestroy); err != nil {
+		t.Errorf("Destroy was supposed to be nil, was %s", err)
+	}
+
+	if _, err := trireme.PUStatus(contextID); err == nil {
+		t.Errorf("A destroyed PU was not supposed to have a status")
+	}
+
+	if list := trireme.ListPUs(); len(list) != 0 {
+		t.Errorf("List was supposed to be empty, got %+v", list)
+	}
+}
+
+func TestInvalidTransitions(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, _ := createMocks()
+	trireme := NewTrireme("serverID", tresolver, tsupervisor, tenforcer)
+	trireme.Start()
+	defer trireme.Stop()
+
+	released := countReleases(t, tsupervisor, tenforcer)
+
+	if err := <-trireme.HandlePUEvent("unknown", monitor.EventStop); err == nil {
+		t.Errorf("Stop of an unknown PU was supposed to fail")
+	}
+
+	if _, err := trireme.PUStatus("unknown"); err == nil {
+		t.Errorf("A rejected event was not supposed to create a PU")
+	}
+
+	contextID := "123123"
+	trireme.SetPURuntime(contextID, policy.NewPURuntimeWithDefaults())
+	<-trireme.HandlePUEvent(contextID, monitor.EventCreate)
+
+	if err := <-trireme.HandlePUEvent(contextID, monitor.EventPause); err == nil {
+		t.Errorf("Pause of a created PU was supposed to fail")
+	}
+
+	if err := <-trireme.UpdatePolicy(contextID, policy.NewPUPolicyWithDefaults()); err == nil {
+		t.Errorf("Policy update of a created PU was supposed to fail")
+	}
+
+	expectState(t, trireme, contextID, PUStateCreated)
+
+	// Stop before start
+	if err := <-trireme.HandlePUEvent(contextID, monitor.EventStop); err != nil {
+		t.Errorf("Stop of a created PU was supposed to be nil, was %s", err)
+	}
+
+	if err := <-trireme.HandlePUEvent(contextID, monitor.EventStop); err != nil {
+		t.Errorf("Stop of a stopped PU was supposed to be nil, was %s", err)
+	}
+
+	expectState(t, trireme, contextID, PUStateStopped)
+
+	if *released != 0 {
+		t.Errorf("A PU that was never started was released")
+	}
+
+	if err := <-trireme.HandlePUEvent(contextID, monitor.EventUnpause); err == nil {
+		t.Errorf("Unpause of a stopped PU was supposed to fail")
+	}
+}
+
+func TestFailedStart(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, _ := createMocks()
+	trireme := NewTrireme("serverID", tresolver, tsupervisor, tenforcer)
+	trireme.Start()
+	defer trireme.Stop()
+
+	tresolver.MockResolvePolicy(t, func(contextID string, RuntimeReader policy.RuntimeReader) (*policy.PUPolicy, error) {
+		return nil, fmt.Errorf("No policy")
+	})
+
+	released := countReleases(t, tsupervisor, tenforcer)
+
+	contextID := "123123"
+	trireme.SetPURuntime(contextID, policy.NewPURuntimeWithDefaults())
+
+	if err := <-trireme.HandlePUEvent(contextID, monitor.EventStart); err == nil {
+		t.Errorf("Start was supposed to fail")
+	}
+
+	status := expectState(t, trireme, contextID, PUStateFailed)
+	if status.LastError == nil {
+		t.Errorf("The error of the start was not recorded")
+	}
+
+	if err := <-trireme.HandlePUEvent(contextID, monitor.EventStop); err != nil {
+		t.Errorf("Stop of a failed PU was supposed to be nil, was %s", err)
+	}
+
+	expectState(t, trireme, contextID, PUStateStopped)
+
+	if *released != 0 {
+		t.Errorf("A PU without policy was released")
+	}
+}
+
+func TestFailedRestart(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, _ := createMocks()
+	trireme := NewTrireme("serverID", tresolver, tsupervisor, tenforcer)
+	trireme.Start()
+	defer trireme.Stop()
+
+	tresolver.MockResolvePolicy(t, func(contextID string, RuntimeReader policy.RuntimeReader) (*policy.PUPolicy, error) {
+		return policy.NewPUPolicy("SomeId", policy.AllowAll, nil, nil, nil, nil, nil, nil, RuntimeReader.IPAddresses(), nil), nil
+	})
+
+	released := countReleases(t, tsupervisor, tenforcer)
+
+	contextID := "123123"
+	trireme.SetPURuntime(contextID, policy.NewPURuntimeWithDefaults())
+
+	if err := <-trireme.HandlePUEvent(contextID, monitor.EventStart); err != nil {
+		t.Errorf("Start was supposed to be nil, was %s", err)
+	}
+
+	expectState(t, trireme, contextID, PUStateEnforced)
+
+	tresolver.MockResolvePolicy(t, func(contextID string, RuntimeReader policy.RuntimeReader) (*policy.PUPolicy, error) {
+		return nil, fmt.Errorf("No policy")
+	})
+
+	if err := <-trireme.HandlePUEvent(contextID, monitor.EventStart); err == nil {
+		t.Errorf("Second start was supposed to fail")
+	}
+
+	expectState(t, trireme, contextID, PUStateFailed)
+
+	if err := <-trireme.HandlePUEvent(contextID, monitor.EventDestroy); err != nil {
+		t.Errorf("Destroy of a failed PU was supposed to be nil, was %s", err)
+	}
+
+	if *released != 2 {
+		t.Errorf("The rules of the previous policy of the failed PU were supposed to be released, got %d releases", *released)
+	}
+
+	if _, err := trireme.PUPolicy(contextID); err == nil {
+		t.Errorf("The policy of the destroyed PU was supposed to be removed")
+	}
+
+	if _, err := trireme.PURuntime(contextID); err == nil {
+		t.Errorf("The runtime of the destroyed PU was supposed to be removed")
+	}
+}
@@ -9,4 +9,5 @@ type ProcessManager interface {
 	KillProcess(contextID string)
 	LaunchProcess(contextID string, refPid int, rpchdl rpcwrapper.RPCClient) error
 	SetnsNetPath(netpath string)
+	SetExitHandler(handler ExitHandler)
 }
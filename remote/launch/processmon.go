@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/exec"
 	"strconv"
+	"sync"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/aporeto-inc/trireme/cache"
@@ -17,8 +18,14 @@ var processName = "./remote_enforcer"
 //ProcessMon exported
 type ProcessMon struct {
 	activeProcesses *cache.Cache
+	exitHandler     ExitHandler
+	sync.Mutex
 }
 
+// ExitHandler is called when a remote enforcer exits while it is in use, with
+// the context of the enforcer and its exit status
+type ExitHandler func(contextID string, status error)
+
 var launcher *ProcessMon
 
 //ProcessInfo exported
@@ -120,6 +127,48 @@ func (p *ProcessMon) KillProcess(contextID string) {
 
 }
 
+//SetExitHandler sets the handler called when a remote enforcer exits while it
+//is in use
+func (p *ProcessMon) SetExitHandler(handler ExitHandler) {
+
+	p.Lock()
+	defer p.Unlock()
+
+	p.exitHandler = handler
+}
+
+//processExited cleans the state of a remote enforcer that exited on its own and
+//reports it to the exit handler
+func (p *ProcessMon) processExited(status exitStatus) {
+
+	s, err := p.activeProcesses.Get(status.contextID)
+	if err != nil {
+		return
+	}
+
+	info := s.(*processInfo)
+	if info.deleted || info.process.Pid != status.process {
+		return
+	}
+
+	log.WithFields(log.Fields{"package": "ProcessMon",
+		"ContextID":  status.contextID,
+		"ExitStatus": status.exitStatus,
+	}).Error("Enforcer exited while in use")
+
+	info.RPCHdl.DestroyRPCClient(status.contextID)
+	os.Remove(netnspath + status.contextID)
+	p.activeProcesses.Remove(status.contextID)
+
+	p.Lock()
+	handler := p.exitHandler
+	p.Unlock()
+
+	if handler != nil {
+		handler(status.contextID, status.exitStatus)
+	}
+}
+
 //private function uses with test
 func setprocessname(name string) {
 
@@ -136,6 +185,10 @@ func collectChildExitStatus() {
 			"pid":        exitStatus.process,
 			"ExitStatus": exitStatus.exitStatus,
 		}).Info("Enforcer exited")
+
+		if launcher != nil {
+			launcher.processExited(exitStatus)
+		}
 	}
 }
 
@@ -167,13 +220,20 @@ func (p *ProcessMon) LaunchProcess(contextID string, refPid int, rpchdl rpcwrapp
 	}
 	namedPipe := "SOCKET_PATH=/tmp/" + strconv.Itoa(refPid) + ".sock"
 
+	// Each enforcer gets its own secret to authenticate the messages
+	secret, err := rpcwrapper.NewSecret()
+	if err != nil {
+		os.Remove(netnspath + contextID)
+		return err
+	}
+
 	cmdName := processName
 	cmdArgs := []string{contextID}
 	cmd := exec.Command(cmdName, cmdArgs...)
 	stdout, err := cmd.StdoutPipe()
 	stderr, err := cmd.StderrPipe()
 	statschannelenv := "STATSCHANNEL_PATH=" + rpcwrapper.StatsChannel
-	cmd.Env = append(os.Environ(), []string{namedPipe, statschannelenv, "CONTAINER_PID=" + strconv.Itoa(refPid)}...)
+	cmd.Env = append(os.Environ(), []string{namedPipe, statschannelenv, "CONTAINER_PID=" + strconv.Itoa(refPid), rpcwrapper.EnvSecret + "=" + secret}...)
 	err = cmd.Start()
 	if err != nil {
 		log.WithFields(log.Fields{"package": "ProcessMon",
@@ -204,7 +264,7 @@ func (p *ProcessMon) LaunchProcess(contextID string, refPid int, rpchdl rpcwrapp
 		io.Copy(os.Stderr, stderr)
 		exited <- 1
 	}()
-	rpchdl.NewRPCClient(contextID, "/tmp/"+strconv.Itoa(refPid)+".sock")
+	rpchdl.NewRPCClient(contextID, "/tmp/"+strconv.Itoa(refPid)+".sock", secret)
 	p.activeProcesses.Add(contextID, &processInfo{contextID: contextID,
 		process: cmd.Process,
 		RPCHdl:  rpchdl,
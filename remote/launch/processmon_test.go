@@ -5,6 +5,7 @@ import (
 	"os"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/aporeto-inc/trireme/enforcer/utils/rpcwrapper"
 )
@@ -50,7 +51,10 @@ func TestLaunchProcess(t *testing.T) {
 	}
 
 	os.Rename("./remote_enforcer.orig", "./remote_enforcer")
-	rpchdl.MockNewRPCClient(t, func(contextID string, channel string) error {
+	rpchdl.MockNewRPCClient(t, func(contextID string, channel string, secret string) error {
+		if len(secret) == 0 {
+			t.Errorf("TEST:No secret given to the RPC client of the enforcer")
+		}
 		return nil
 	})
 	setprocessname("cat")
@@ -114,7 +118,7 @@ func TestSetExitStatus(t *testing.T) {
 		t.Errorf("TEST:Exit status suceeds when process does not exist")
 	}
 	rpchdl := rpcwrapper.NewTestRPCClient()
-	rpchdl.MockNewRPCClient(t, func(contextID string, channel string) error {
+	rpchdl.MockNewRPCClient(t, func(contextID string, channel string, secret string) error {
 		return nil
 	})
 	err = p.LaunchProcess(contextID, refPid, rpchdl)
@@ -169,3 +173,50 @@ func TestKillProcess(t *testing.T) {
 	}
 
 }
+
+func TestExitHandler(t *testing.T) {
+	contextID := "1"
+	refPid := 1
+	exited := make(chan string, 1)
+
+	p := NewProcessMon()
+	p.SetnsNetPath("/tmp/")
+	p.SetExitHandler(func(contextID string, status error) {
+		exited <- contextID
+	})
+	setprocessname("sleep") // Sleeps for a second and exits on its own
+	rpchdl := rpcwrapper.NewTestRPCClient()
+
+	if err := p.LaunchProcess(contextID, refPid, rpchdl); err != nil {
+		t.Errorf("TEST:Launch Process Fails to launch a process %v", err)
+		t.SkipNow()
+	}
+
+	select {
+	case passed := <-exited:
+		if passed != contextID {
+			t.Errorf("TEST:Exit handler called with %s instead of %s", passed, contextID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("TEST:Exit handler not called when the process exited")
+	}
+
+	if p.GetExitStatus(contextID) != true {
+		t.Errorf("TEST:Exited process is still active")
+	}
+
+	//A killed process is not reported
+	contextID = "60"
+	p.LaunchProcess(contextID, refPid, rpchdl)
+	p.SetExitStatus(contextID, true)
+	rpchdl.MockRemoteCall(t, func(passed_contextID string, methodName string, req *rpcwrapper.Request, resp *rpcwrapper.Response) error {
+		return errors.New("Null Error")
+	})
+	p.KillProcess(contextID)
+
+	select {
+	case <-exited:
+		t.Errorf("TEST:Exit handler called for a killed process")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
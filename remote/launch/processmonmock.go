@@ -8,11 +8,12 @@ import (
 )
 
 type mockedMethods struct {
-	GetExitStatusMock func(string) bool
-	KillProcessMock   func(string)
-	LaunchProcessMock func(string, int, rpcwrapper.RPCClient) error
-	SetExitStatusMock func(string, bool) error
-	SetnsNetPathMock  func(string)
+	GetExitStatusMock  func(string) bool
+	KillProcessMock    func(string)
+	LaunchProcessMock  func(string, int, rpcwrapper.RPCClient) error
+	SetExitStatusMock  func(string, bool) error
+	SetnsNetPathMock   func(string)
+	SetExitHandlerMock func(ExitHandler)
 }
 
 type TestProcessManager interface {
@@ -22,6 +23,7 @@ type TestProcessManager interface {
 	MockLaunchProcess(t *testing.T, impl func(string, int, rpcwrapper.RPCClient) error)
 	MockSetExitStatus(t *testing.T, impl func(string, bool) error)
 	MockSetnsNetPath(t *testing.T, impl func(string))
+	MockSetExitHandler(t *testing.T, impl func(ExitHandler))
 }
 
 type testProcessMon struct {
@@ -67,6 +69,9 @@ func (m *testProcessMon) MockLaunchProcess(t *testing.T, impl func(string, int,
 func (m *testProcessMon) MockSetExitStatus(t *testing.T, impl func(string, bool) error) {
 	m.currentMocks(t).SetExitStatusMock = impl
 }
+func (m *testProcessMon) MockSetExitHandler(t *testing.T, impl func(ExitHandler)) {
+	m.currentMocks(t).SetExitHandlerMock = impl
+}
 
 func (m *testProcessMon) SetnsNetPath(netpath string) {
 	if mock := m.currentMocks(m.currentTest); mock != nil && mock.SetnsNetPathMock != nil {
@@ -102,3 +107,9 @@ func (m *testProcessMon) LaunchProcess(contextID string, refPid int, rpchdl rpcw
 	}
 	return nil
 }
+func (m *testProcessMon) SetExitHandler(handler ExitHandler) {
+	if mock := m.currentMocks(m.currentTest); mock != nil && mock.SetExitHandlerMock != nil {
+		mock.SetExitHandlerMock(handler)
+		return
+	}
+}
@@ -1,13 +1,21 @@
 package trireme
 
 import (
+	"context"
+
 	"github.com/aporeto-inc/trireme/monitor"
 	"github.com/aporeto-inc/trireme/policy"
 )
 
 const (
-	handleEvent  = 1
-	policyUpdate = 2
+	handleEvent             = 1
+	policyUpdate            = 2
+	synchronizationComplete = 3
+	pauseExpired            = 4
+	enforcerExit            = 5
+	resolveRetry            = 6
+	policiesUpdate          = 7
+	policyRollback          = 8
 )
 
 type triremeRequest struct {
@@ -16,4 +24,24 @@ type triremeRequest struct {
 	eventType  monitor.Event
 	policyInfo *policy.PUPolicy
 	returnChan chan error
+
+	// ctx is the context of the caller. The request is abandoned when it is
+	// done. It is nil for the requests that are never abandoned.
+	ctx context.Context
+
+	// policies are the policies of a bulk update. results are set with the
+	// result of each PU once it is processed.
+	policies map[string]*policy.PUPolicy
+	atomic   bool
+	results  map[string]error
+
+	// version is the version of the policy restored by a rollback
+	version int
+
+	// status is the exit status of the remote enforcer of the PU
+	status error
+
+	// barrier is set for the requests that stop a worker until a request that
+	// affects all the PUs is processed
+	barrier *barrier
 }
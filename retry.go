@@ -0,0 +1,261 @@
+package trireme
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aporeto-inc/trireme/collector"
+	"github.com/aporeto-inc/trireme/policy"
+)
+
+// ResolveFailureMode defines the policy enforced on a PU while the resolution
+// of its policy is retried
+type ResolveFailureMode int
+
+const (
+	// ResolveFailClosed drops all the flows of the PU until its policy is resolved
+	ResolveFailClosed ResolveFailureMode = iota
+
+	// ResolveFailOpen accepts all the flows of the PU until its policy is resolved
+	ResolveFailOpen
+)
+
+const (
+	// DefaultRetryInitialDelay is the default delay before the first retry
+	DefaultRetryInitialDelay = time.Second
+
+	// DefaultRetryMaxDelay is the default maximum delay between two retries
+	DefaultRetryMaxDelay = 2 * time.Minute
+)
+
+// ResolverRetry defines how the resolution of a policy is retried when the
+// PolicyResolver fails. The delay between two retries is doubled each time.
+type ResolverRetry struct {
+	// Mode is the policy enforced on the PU while the resolution is retried
+	Mode ResolveFailureMode
+
+	// InitialDelay is the delay before the first retry
+	InitialDelay time.Duration
+
+	// MaxDelay is the maximum delay between two retries
+	MaxDelay time.Duration
+
+	// MaxAttempts is the number of retries before the PU is failed. The
+	// fallback policy of a failed PU is removed. The resolution is retried
+	// forever when it is zero.
+	MaxAttempts int
+}
+
+// pendingPU is the state of a PU waiting for its policy
+type pendingPU struct {
+	attempts int
+	timer    *time.Timer
+}
+
+// SetResolverRetry sets how the resolution of the policies is retried and where
+// the failures are reported. The resolution is not retried if retry is nil.
+func (t *trireme) SetResolverRetry(retry *ResolverRetry, eventCollector collector.EventCollector) {
+
+	if eventCollector == nil {
+		eventCollector = &collector.DefaultCollector{}
+	}
+
+	t.collector = eventCollector
+
+	if retry == nil {
+		t.retry = nil
+		return
+	}
+
+	r := *retry
+
+	if r.InitialDelay <= 0 {
+		r.InitialDelay = DefaultRetryInitialDelay
+	}
+
+	if r.MaxDelay < r.InitialDelay {
+		r.MaxDelay = DefaultRetryMaxDelay
+	}
+
+	t.retry = &r
+}
+
+// retryDelay returns the delay before the given retry
+func (r *ResolverRetry) retryDelay(attempt int) time.Duration {
+
+	delay := r.InitialDelay
+	for i := 1; i < attempt && delay < r.MaxDelay; i++ {
+		delay = delay * 2
+	}
+
+	if delay > r.MaxDelay {
+		delay = r.MaxDelay
+	}
+
+	return delay
+}
+
+// fallbackPolicy returns the policy enforced on a PU waiting for its policy
+func (r *ResolverRetry) fallbackPolicy(runtimeInfo *policy.PURuntime) *policy.PUPolicy {
+
+	var action policy.PUAction = policy.Police
+	if r.Mode == ResolveFailOpen {
+		action = policy.AllowAll
+	}
+
+	return policy.NewPUPolicy("", action, nil, nil, nil, nil, nil, nil, runtimeInfo.IPAddresses(), nil)
+}
+
+// doHandlePending enforces the fallback policy on a PU whose policy could not
+// be resolved and schedules the next resolution. The PU is failed when there
+// are no retries left.
+func (t *trireme) doHandlePending(ctx context.Context, contextID string, runtimeInfo *policy.PURuntime, resolveErr error) error {
+
+	t.stateLock.Lock()
+	p, ok := t.pending[contextID]
+	t.stateLock.Unlock()
+
+	if !ok {
+		fallback := t.retry.fallbackPolicy(runtimeInfo)
+		if err := t.applyPolicy(ctx, contextID, fallback); err != nil {
+			return fmt.Errorf("Cannot enforce the fallback policy of PU %s: %s", contextID, err)
+		}
+
+		t.setPolicy(contextID, fallback, PolicySourceFallback)
+		t.setState(contextID, PUStatePending, nil)
+
+		p = &pendingPU{}
+
+		t.stateLock.Lock()
+		t.pending[contextID] = p
+		t.stateLock.Unlock()
+	}
+
+	t.setError(contextID, resolveErr)
+
+	ip, _ := runtimeInfo.DefaultIPAddress()
+
+	if t.retry.MaxAttempts > 0 && p.attempts >= t.retry.MaxAttempts {
+		log.WithFields(log.Fields{
+			"package":   "trireme",
+			"contextID": contextID,
+			"error":     resolveErr.Error(),
+		}).Error("Giving up the resolution of the policy")
+
+		t.clearPending(contextID)
+		t.releaseFallback(contextID)
+		t.setState(contextID, PUStateFailed, resolveErr)
+		t.collector.CollectContainerEvent(contextID, ip, runtimeInfo.Tags(), collector.ContainerPolicyFailed)
+		t.notify(LifecycleEnforcementFailed, contextID, resolveErr)
+
+		return nil
+	}
+
+	p.attempts++
+	delay := t.retry.retryDelay(p.attempts)
+
+	log.WithFields(log.Fields{
+		"package":   "trireme",
+		"contextID": contextID,
+		"attempt":   p.attempts,
+		"delay":     delay,
+		"error":     resolveErr.Error(),
+	}).Warn("Policy resolution failed. Will retry")
+
+	t.collector.CollectContainerEvent(contextID, ip, runtimeInfo.Tags(), collector.ContainerPolicyPending)
+
+	t.stateLock.Lock()
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	p.timer = time.AfterFunc(delay, func() {
+		t.submit(&triremeRequest{
+			contextID:  contextID,
+			reqType:    resolveRetry,
+			returnChan: make(chan error, 1),
+		})
+	})
+	t.stateLock.Unlock()
+
+	return nil
+}
+
+// doRetryResolve resolves the policy of a pending PU again and enforces it
+func (t *trireme) doRetryResolve(ctx context.Context, contextID string) error {
+
+	if t.puState(contextID) != PUStatePending {
+		return nil
+	}
+
+	runtimeInfo, err := t.PURuntime(contextID)
+	if err != nil {
+		return fmt.Errorf("Retry failed because couldn't find runtime for contextID %s", contextID)
+	}
+
+	policyInfo, err := t.resolvePolicy(ctx, contextID, runtimeInfo)
+	if err == nil && policyInfo == nil {
+		err = fmt.Errorf("Nil policy returned for context: %s", contextID)
+	}
+
+	if err != nil {
+		return t.doHandlePending(ctx, contextID, runtimeInfo.(*policy.PURuntime), err)
+	}
+
+	// Create a copy as we are going to modify it locally
+	policyInfo = policyInfo.Clone()
+
+	if err := t.applyPolicy(ctx, contextID, policyInfo); err != nil {
+		t.clearPending(contextID)
+		t.releaseFallback(contextID)
+		t.setState(contextID, PUStateFailed, err)
+		t.notify(LifecycleEnforcementFailed, contextID, err)
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"package":   "trireme",
+		"contextID": contextID,
+	}).Info("Policy resolved after retry")
+
+	t.clearPending(contextID)
+	t.setPolicy(contextID, policyInfo, PolicySourceResolver)
+	t.setState(contextID, PUStateEnforced, nil)
+	t.notify(LifecyclePUEnforced, contextID, nil)
+
+	return nil
+}
+
+// clearPending stops the retries of a PU
+func (t *trireme) clearPending(contextID string) {
+
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+
+	if p, ok := t.pending[contextID]; ok && p.timer != nil {
+		p.timer.Stop()
+	}
+
+	delete(t.pending, contextID)
+}
+
+// releaseFallback removes the fallback policy of a PU whose policy could not
+// be resolved or enforced, so that a failed PU is not left open. The runtime
+// of the PU is kept until it is destroyed.
+func (t *trireme) releaseFallback(contextID string) {
+
+	t.deletePolicy(contextID)
+
+	errS := t.unsupervise(contextID)
+	errE := t.unenforce(contextID)
+
+	if errS != nil || errE != nil {
+		log.WithFields(log.Fields{
+			"package":         "trireme",
+			"contextID":       contextID,
+			"supervisorError": errS,
+			"enforcerError":   errE,
+		}).Debug("Error when releasing the fallback policy")
+	}
+}
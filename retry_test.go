@@ -0,0 +1,167 @@
+package trireme
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aporeto-inc/trireme/collector"
+	"github.com/aporeto-inc/trireme/monitor"
+	"github.com/aporeto-inc/trireme/policy"
+)
+
+// testCollector records the container events
+type testCollector struct {
+	collector.DefaultCollector
+	events []string
+	sync.Mutex
+}
+
+func (c *testCollector) CollectContainerEvent(contextID string, ip string, tags *policy.TagsMap, event string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.events = append(c.events, event)
+}
+
+func (c *testCollector) Events() []string {
+	c.Lock()
+	defer c.Unlock()
+
+	return append([]string(nil), c.events...)
+}
+
+func TestResolverRetry(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, _ := createMocks()
+	trireme := NewTrireme("serverID", tresolver, tsupervisor, tenforcer)
+	c := &testCollector{}
+	trireme.SetResolverRetry(&ResolverRetry{
+		Mode:         ResolveFailClosed,
+		InitialDelay: time.Millisecond,
+		MaxDelay:     2 * time.Millisecond,
+	}, c)
+	trireme.Start()
+	defer trireme.Stop()
+
+	var lock sync.Mutex
+	resolutions := 0
+	tresolver.MockResolvePolicy(t, func(contextID string, RuntimeReader policy.RuntimeReader) (*policy.PUPolicy, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		resolutions++
+		if resolutions <= 3 {
+			return nil, fmt.Errorf("Policy engine unavailable")
+		}
+		return policy.NewPUPolicy("SomeId", policy.AllowAll, nil, nil, nil, nil, nil, nil, RuntimeReader.IPAddresses(), nil), nil
+	})
+
+	enforced := make(chan *policy.PUPolicy, 10)
+	tenforcer.MockEnforce(t, func(contextID string, puInfo *policy.PUInfo) error {
+		enforced <- puInfo.Policy
+		return nil
+	})
+
+	s := trireme.Subscribe(LifecycleFilter{Types: []LifecycleEventType{LifecyclePUEnforced}}, 10)
+
+	contextID := "123123"
+	trireme.SetPURuntime(contextID, policy.NewPURuntimeWithDefaults())
+
+	if err := <-trireme.HandlePUEvent(contextID, monitor.EventStart); err != nil {
+		t.Errorf("Start was supposed to be nil while the resolution is retried, was %s", err)
+	}
+
+	if fallback := <-enforced; fallback.TriremeAction != policy.Police || fallback.ManagementID != "" {
+		t.Errorf("Expected the PU to be quarantined while the resolution is retried, got %+v", fallback)
+	}
+
+	if event := nextEvent(t, s); event.ContextID != contextID {
+		t.Errorf("Expected the PU to be enforced, got %+v", event)
+	}
+
+	if resolved := <-enforced; resolved.ManagementID != "SomeId" {
+		t.Errorf("Expected the resolved policy to be enforced, got %+v", resolved)
+	}
+
+	status, _ := trireme.PUStatus(contextID)
+	if status.State != PUStateEnforced || status.LastError == nil {
+		t.Errorf("Expected the PU to be enforced after the retries, got %+v", status)
+	}
+
+	if events := c.Events(); len(events) != 3 || events[0] != collector.ContainerPolicyPending {
+		t.Errorf("Expected the failures to be collected, got %v", events)
+	}
+}
+
+func TestResolverRetryGiveUp(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, _ := createMocks()
+	trireme := NewTrireme("serverID", tresolver, tsupervisor, tenforcer)
+	c := &testCollector{}
+	trireme.SetResolverRetry(&ResolverRetry{
+		Mode:         ResolveFailOpen,
+		InitialDelay: time.Millisecond,
+		MaxAttempts:  2,
+	}, c)
+	trireme.Start()
+	defer trireme.Stop()
+
+	tresolver.MockResolvePolicy(t, func(contextID string, RuntimeReader policy.RuntimeReader) (*policy.PUPolicy, error) {
+		return nil, fmt.Errorf("Policy engine unavailable")
+	})
+
+	released := countReleases(t, tsupervisor, tenforcer)
+
+	s := trireme.Subscribe(LifecycleFilter{}, 10)
+
+	contextID := "123123"
+	trireme.SetPURuntime(contextID, policy.NewPURuntimeWithDefaults())
+	<-trireme.HandlePUEvent(contextID, monitor.EventStart)
+
+	p, err := trireme.PUPolicy(contextID)
+	if err != nil || p.TriremeAction != policy.AllowAll {
+		t.Errorf("Expected the PU to be open while the resolution is retried, got %+v %s", p, err)
+	}
+
+	if event := nextEvent(t, s); event.Type != LifecycleEnforcementFailed || event.Error == nil {
+		t.Errorf("Expected the resolution to be given up, got %+v", event)
+	}
+
+	if status, _ := trireme.PUStatus(contextID); status.State != PUStateFailed {
+		t.Errorf("Expected the PU to be failed, got %+v", status)
+	}
+
+	if p, err := trireme.PUPolicy(contextID); err == nil {
+		t.Errorf("Expected the fallback policy of the failed PU to be removed, got %+v", p)
+	}
+
+	if *released != 2 {
+		t.Errorf("Expected the failed PU to be unsupervised and unenforced, got %d releases", *released)
+	}
+
+	if err := <-trireme.HandlePUEvent(contextID, monitor.EventDestroy); err != nil {
+		t.Errorf("Destroy was supposed to be nil, was %s", err)
+	}
+
+	if _, err := trireme.PURuntime(contextID); err == nil {
+		t.Errorf("Expected the runtime of the destroyed PU to be removed")
+	}
+
+	expected := []string{collector.ContainerPolicyPending, collector.ContainerPolicyPending, collector.ContainerPolicyFailed}
+	if events := c.Events(); fmt.Sprint(events) != fmt.Sprint(expected) {
+		t.Errorf("Expected the events %v, got %v", expected, events)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	r := &ResolverRetry{
+		InitialDelay: time.Second,
+		MaxDelay:     5 * time.Second,
+	}
+
+	for attempt, expected := range []time.Duration{time.Second, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if delay := r.retryDelay(attempt); delay != expected {
+			t.Errorf("Delay of attempt %d was supposed to be %s, was %s", attempt, expected, delay)
+		}
+	}
+}
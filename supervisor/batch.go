@@ -0,0 +1,108 @@
+package supervisor
+
+import (
+	"fmt"
+	"reflect"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aporeto-inc/trireme/policy"
+)
+
+// SuperviseBatch supervises several PUs. The updates of the PUs that keep
+// their addresses are programmed together when the implementation supports it.
+// The other PUs are supervised one by one.
+func (s *Config) SuperviseBatch(puInfos map[string]*policy.PUInfo) map[string]error {
+
+	results := map[string]error{}
+
+	s.Lock()
+	defer s.Unlock()
+
+	batch, ok := s.impl.(BatchImplementor)
+
+	versions := map[string]int{}
+	policies := map[string]*policy.PUPolicy{}
+	previous := map[string]*policy.PUPolicy{}
+
+	for contextID, containerInfo := range puInfos {
+		if containerInfo == nil || containerInfo.Policy == nil || containerInfo.Runtime == nil {
+			results[contextID] = fmt.Errorf("Runtime, Policy and ContainerInfo should not be nil")
+			continue
+		}
+
+		if err := validateAddresses(containerInfo.Policy); err != nil {
+			results[contextID] = err
+			continue
+		}
+
+		if !ok || !s.isBatchable(contextID, containerInfo) {
+			results[contextID] = s.doSupervise(contextID, containerInfo)
+			continue
+		}
+
+		if err := s.setupCgroup(contextID, containerInfo); err != nil {
+			results[contextID] = err
+			continue
+		}
+
+		cacheEntry, err := s.versionTracker.LockedModify(contextID, add, 1)
+		if err != nil {
+			results[contextID] = fmt.Errorf("Error finding PU in cache %s", err)
+			continue
+		}
+
+		cachedEntry := cacheEntry.(*cacheData)
+		previous[contextID] = cachedEntry.policy
+		cachedEntry.policy = containerInfo.Policy
+
+		versions[contextID] = cachedEntry.version
+		policies[contextID] = s.resolvePolicy(contextID, containerInfo.Policy)
+	}
+
+	if len(policies) == 0 {
+		return results
+	}
+
+	batchErr := batch.UpdateRulesBatch(versions, policies)
+	if batchErr != nil {
+		log.WithFields(log.Fields{
+			"package": "supervisor",
+			"error":   batchErr.Error(),
+		}).Warn("Batch update failed. Updating the PUs one by one")
+	}
+
+	for contextID, p := range policies {
+		// Nothing was programmed. The PUs that fail are found one by one and
+		// keep their previous rules.
+		if batchErr != nil {
+			if err := s.impl.UpdateRules(versions[contextID], contextID, p); err != nil {
+				s.rollbackVersion(contextID, previous[contextID])
+				results[contextID] = fmt.Errorf("Error in updating PU implementation. Previous policy is kept: %s", err)
+				continue
+			}
+		}
+
+		containerInfo := puInfos[contextID]
+		ip, _ := containerInfo.Runtime.DefaultIPAddress()
+		s.collector.CollectContainerEvent(contextID, ip, containerInfo.Runtime.Tags(), "update")
+
+		results[contextID] = nil
+	}
+
+	return results
+}
+
+// isBatchable returns true if the rules of a supervised PU can be updated in a
+// batch. The PUs that are new, adopted or that changed their addresses are
+// programmed on their own.
+func (s *Config) isBatchable(contextID string, containerInfo *policy.PUInfo) bool {
+
+	data, err := s.versionTracker.Get(contextID)
+	if err != nil {
+		return false
+	}
+
+	cachedEntry := data.(*cacheData)
+
+	return !cachedEntry.adopted && reflect.DeepEqual(cachedEntry.ips.Addresses(), containerInfo.Policy.IPAddresses().Addresses())
+}
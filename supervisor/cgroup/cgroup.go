@@ -0,0 +1,205 @@
+// Package cgroup manages the cgroups of the Linux services protected by Trireme.
+// Every processing unit gets its own cgroup below the trireme cgroup so that
+// its traffic can be matched by iptables. With the net_cls controller the
+// traffic is matched on the classid of the cgroup. With the unified hierarchy
+// of cgroup v2 it is matched on the path of the cgroup.
+package cgroup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// DefaultNetClsRoot is where the net_cls controller is mounted
+	DefaultNetClsRoot = "/sys/fs/cgroup/net_cls"
+	// DefaultUnifiedRoot is where the cgroup v2 hierarchy is mounted
+	DefaultUnifiedRoot = "/sys/fs/cgroup"
+	// TriremeBasePath is the cgroup holding the cgroups of all processing units
+	TriremeBasePath = "trireme"
+
+	procsFile       = "cgroup.procs"
+	classIDFile     = "net_cls.classid"
+	controllersFile = "cgroup.controllers"
+)
+
+// Version is the version of the cgroup hierarchy
+type Version int
+
+const (
+	// NetCls is the cgroup v1 hierarchy of the net_cls controller
+	NetCls Version = 1
+	// Unified is the cgroup v2 hierarchy
+	Unified Version = 2
+)
+
+// manager implements the Manager interface on a cgroup hierarchy
+type manager struct {
+	version Version
+	root    string
+}
+
+// NewManager returns a manager for the cgroup hierarchy of the host. The
+// unified hierarchy is used when it is mounted, the net_cls controller otherwise.
+func NewManager() Manager {
+
+	if _, err := os.Stat(filepath.Join(DefaultUnifiedRoot, controllersFile)); err == nil {
+		return NewUnifiedManager(DefaultUnifiedRoot)
+	}
+
+	return NewNetClsManager(DefaultNetClsRoot)
+}
+
+// NewNetClsManager returns a manager for the net_cls hierarchy mounted at root
+func NewNetClsManager(root string) Manager {
+
+	return &manager{
+		version: NetCls,
+		root:    root,
+	}
+}
+
+// NewUnifiedManager returns a manager for the cgroup v2 hierarchy mounted at root
+func NewUnifiedManager(root string) Manager {
+
+	return &manager{
+		version: Unified,
+		root:    root,
+	}
+}
+
+// Version implements the Version interface
+func (m *manager) Version() Version {
+
+	return m.version
+}
+
+// RelativePath implements the RelativePath interface
+func (m *manager) RelativePath(name string) string {
+
+	return filepath.Join(TriremeBasePath, name)
+}
+
+// path returns the absolute path of the cgroup of a processing unit
+func (m *manager) path(name string) string {
+
+	return filepath.Join(m.root, m.RelativePath(name))
+}
+
+// Creategroup implements the Creategroup interface
+func (m *manager) Creategroup(name string) error {
+
+	if name == "" {
+		return fmt.Errorf("Cgroup name cannot be empty")
+	}
+
+	if err := os.MkdirAll(m.path(name), 0755); err != nil {
+		return fmt.Errorf("Cannot create cgroup %s: %s", name, err)
+	}
+
+	return nil
+}
+
+// AssignMark implements the AssignMark interface. The classid is only set
+// with the net_cls controller since cgroup v2 has no classid.
+func (m *manager) AssignMark(name string, mark string) error {
+
+	classID, err := strconv.ParseUint(mark, 10, 32)
+	if err != nil {
+		return fmt.Errorf("Invalid mark %s: %s", mark, err)
+	}
+
+	if m.version == Unified {
+		return nil
+	}
+
+	file := filepath.Join(m.path(name), classIDFile)
+	if err := ioutil.WriteFile(file, []byte(strconv.FormatUint(classID, 10)), 0644); err != nil {
+		return fmt.Errorf("Cannot assign mark to cgroup %s: %s", name, err)
+	}
+
+	return nil
+}
+
+// AddProcess implements the AddProcess interface
+func (m *manager) AddProcess(name string, pid int) error {
+
+	if pid <= 0 {
+		return fmt.Errorf("Invalid pid %d", pid)
+	}
+
+	if err := m.writeProcess(m.path(name), pid); err != nil {
+		return fmt.Errorf("Cannot add process %d to cgroup %s: %s", pid, name, err)
+	}
+
+	return nil
+}
+
+// ListProcesses implements the ListProcesses interface
+func (m *manager) ListProcesses(name string) ([]int, error) {
+
+	data, err := ioutil.ReadFile(filepath.Join(m.path(name), procsFile))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list processes of cgroup %s: %s", name, err)
+	}
+
+	pids := []int{}
+	for _, field := range strings.Fields(string(data)) {
+		pid, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid process %s in cgroup %s", field, name)
+		}
+		pids = append(pids, pid)
+	}
+
+	return pids, nil
+}
+
+// DeleteCgroup implements the DeleteCgroup interface. The processes that are
+// still in the cgroup are moved back to the root cgroup first.
+func (m *manager) DeleteCgroup(name string) error {
+
+	if _, err := os.Stat(m.path(name)); os.IsNotExist(err) {
+		return nil
+	}
+
+	pids, err := m.ListProcesses(name)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"package": "cgroup",
+			"cgroup":  name,
+			"error":   err.Error(),
+		}).Debug("Cannot list the processes of the cgroup")
+	}
+
+	for _, pid := range pids {
+		if err := m.writeProcess(m.root, pid); err != nil {
+			log.WithFields(log.Fields{
+				"package": "cgroup",
+				"cgroup":  name,
+				"pid":     pid,
+				"error":   err.Error(),
+			}).Debug("Cannot move the process to the root cgroup")
+		}
+	}
+
+	// The control files of a cgroup cannot be removed. The directory itself
+	// is removed first, which succeeds on a cgroup file system.
+	if err := os.RemoveAll(m.path(name)); err != nil {
+		return fmt.Errorf("Cannot delete cgroup %s: %s", name, err)
+	}
+
+	return nil
+}
+
+// writeProcess moves a process to the cgroup at the given path
+func (m *manager) writeProcess(path string, pid int) error {
+
+	return ioutil.WriteFile(filepath.Join(path, procsFile), []byte(strconv.Itoa(pid)), 0644)
+}
@@ -0,0 +1,109 @@
+package cgroup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNetClsManager(t *testing.T) {
+
+	Convey("Given a net_cls manager", t, func() {
+		root, _ := ioutil.TempDir("", "net_cls")
+		defer os.RemoveAll(root)
+
+		m := NewNetClsManager(root)
+		So(m.Version(), ShouldEqual, NetCls)
+		So(m.RelativePath("pu1"), ShouldEqual, "trireme/pu1")
+
+		Convey("When I create a cgroup with an empty name", func() {
+			err := m.Creategroup("")
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When I create a cgroup and assign a mark", func() {
+			So(m.Creategroup("pu1"), ShouldBeNil)
+			err := m.AssignMark("pu1", "100")
+
+			Convey("The classid of the cgroup should be the mark", func() {
+				So(err, ShouldBeNil)
+				data, _ := ioutil.ReadFile(filepath.Join(root, "trireme", "pu1", classIDFile))
+				So(string(data), ShouldEqual, "100")
+			})
+		})
+
+		Convey("When I assign an invalid mark", func() {
+			So(m.Creategroup("pu1"), ShouldBeNil)
+			err := m.AssignMark("pu1", "mark")
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When I add a process", func() {
+			So(m.Creategroup("pu1"), ShouldBeNil)
+			err := m.AddProcess("pu1", 1234)
+
+			Convey("It should be listed", func() {
+				So(err, ShouldBeNil)
+				pids, err := m.ListProcesses("pu1")
+				So(err, ShouldBeNil)
+				So(pids, ShouldResemble, []int{1234})
+			})
+
+			Convey("When I delete the cgroup", func() {
+				err := m.DeleteCgroup("pu1")
+
+				Convey("The process should be moved to the root cgroup", func() {
+					So(err, ShouldBeNil)
+					data, _ := ioutil.ReadFile(filepath.Join(root, procsFile))
+					So(string(data), ShouldEqual, "1234")
+					_, err := os.Stat(filepath.Join(root, "trireme", "pu1"))
+					So(os.IsNotExist(err), ShouldBeTrue)
+				})
+			})
+		})
+
+		Convey("When I add an invalid process", func() {
+			So(m.Creategroup("pu1"), ShouldBeNil)
+			err := m.AddProcess("pu1", 0)
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When I delete a cgroup that does not exist", func() {
+			err := m.DeleteCgroup("unknown")
+			Convey("I should get no error", func() {
+				So(err, ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestUnifiedManager(t *testing.T) {
+
+	Convey("Given a cgroup v2 manager", t, func() {
+		root, _ := ioutil.TempDir("", "unified")
+		defer os.RemoveAll(root)
+
+		m := NewUnifiedManager(root)
+		So(m.Version(), ShouldEqual, Unified)
+
+		Convey("When I create a cgroup and assign a mark", func() {
+			So(m.Creategroup("pu1"), ShouldBeNil)
+			err := m.AssignMark("pu1", "100")
+
+			Convey("No classid should be written", func() {
+				So(err, ShouldBeNil)
+				_, err := os.Stat(filepath.Join(root, "trireme", "pu1", classIDFile))
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+		})
+	})
+}
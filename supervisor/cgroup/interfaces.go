@@ -0,0 +1,27 @@
+package cgroup
+
+// Manager creates a cgroup for every processing unit and moves its processes
+// into it. The cgroups are named after the context ID of the processing units.
+type Manager interface {
+
+	// Creategroup creates the cgroup of a processing unit.
+	Creategroup(name string) error
+
+	// AssignMark sets the classid of the cgroup to the mark of the processing unit.
+	AssignMark(name string, mark string) error
+
+	// AddProcess moves a process to the cgroup.
+	AddProcess(name string, pid int) error
+
+	// ListProcesses returns the processes in the cgroup.
+	ListProcesses(name string) ([]int, error)
+
+	// DeleteCgroup moves the remaining processes out of the cgroup and deletes it.
+	DeleteCgroup(name string) error
+
+	// Version returns the version of the cgroup hierarchy.
+	Version() Version
+
+	// RelativePath returns the path of the cgroup relative to the root of the hierarchy.
+	RelativePath(name string) string
+}
@@ -0,0 +1,59 @@
+package supervisor
+
+import (
+	"fmt"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aporeto-inc/trireme/policy"
+)
+
+// setupCgroup creates the cgroup of a Linux service, assigns the mark of the
+// service to it and moves the process of the service into it. It does nothing
+// unless the supervisor protects Linux services. It is safe to call it again
+// when the service is updated.
+func (s *Config) setupCgroup(contextID string, containerInfo *policy.PUInfo) error {
+
+	if s.cgroups == nil {
+		return nil
+	}
+
+	mark := containerInfo.Policy.Mark()
+	if mark == "" {
+		return fmt.Errorf("No mark found for Linux service %s", contextID)
+	}
+
+	if mark == strconv.Itoa(s.Mark) {
+		return fmt.Errorf("Mark %s of Linux service %s is reserved", mark, contextID)
+	}
+
+	if err := s.cgroups.Creategroup(contextID); err != nil {
+		return err
+	}
+
+	if err := s.cgroups.AssignMark(contextID, mark); err != nil {
+		return err
+	}
+
+	if pid := containerInfo.Runtime.Pid(); pid > 0 {
+		return s.cgroups.AddProcess(contextID, pid)
+	}
+
+	return nil
+}
+
+// deleteCgroup deletes the cgroup of a Linux service
+func (s *Config) deleteCgroup(contextID string) {
+
+	if s.cgroups == nil {
+		return
+	}
+
+	if err := s.cgroups.DeleteCgroup(contextID); err != nil {
+		log.WithFields(log.Fields{
+			"package":   "supervisor",
+			"contextID": contextID,
+			"error":     err.Error(),
+		}).Debug("Failed to delete the cgroup")
+	}
+}
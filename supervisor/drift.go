@@ -0,0 +1,138 @@
+package supervisor
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aporeto-inc/trireme/collector"
+)
+
+// DefaultDriftCheckInterval is the default interval at which the programmed
+// rules are compared with the expected ones
+const DefaultDriftCheckInterval = 60 * time.Second
+
+// SetDriftCheckInterval sets the interval at which the rules of the supervised
+// PUs are read back and repaired if needed. An interval of 0 disables the check.
+// It must be called before Start.
+func (s *Config) SetDriftCheckInterval(interval time.Duration) {
+
+	s.driftInterval = interval
+}
+
+// driftMonitor periodically checks the rules of all the supervised PUs
+func (s *Config) driftMonitor() {
+
+	ticker := time.NewTicker(s.driftInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.checkDrift()
+		}
+	}
+}
+
+// checkDrift verifies the global rules and the rules of every PU tracked in the
+// versionTracker
+func (s *Config) checkDrift() {
+
+	s.checkGlobalDrift()
+
+	for _, key := range s.versionTracker.KeyList() {
+		s.checkPUDrift(key.(string))
+	}
+}
+
+// checkGlobalDrift verifies the rules shared by all the PUs and the rules of the
+// exclusions. They are all programmed again when some of them are missing.
+func (s *Config) checkGlobalDrift() {
+
+	s.Lock()
+	defer s.Unlock()
+
+	drift, err := s.impl.VerifyGlobalRules(s.exclusions.List())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"package": "supervisor",
+			"error":   err.Error(),
+		}).Debug("Cannot verify the global rules")
+		return
+	}
+
+	if !drift {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"package": "supervisor",
+	}).Info("Global rules were modified outside of Trireme. Repairing")
+
+	if err := s.impl.Start(); err != nil {
+		log.WithFields(log.Fields{
+			"package": "supervisor",
+			"error":   err.Error(),
+		}).Error("Failed to repair the global rules")
+	}
+
+	s.reprogramExclusions()
+}
+
+// checkPUDrift compares the programmed rules of a PU with the ones expected from
+// its current policy. When they differ, the drift is reported and the rules are
+// programmed again.
+func (s *Config) checkPUDrift(contextID string) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	data, err := s.versionTracker.Get(contextID)
+	if err != nil {
+		// The PU was removed since the list of PUs was read
+		return
+	}
+
+	cachedEntry := data.(*cacheData)
+	if cachedEntry.adopted {
+		// The policy of the PU is not known until it is supervised again
+		return
+	}
+
+	oldVersion := cachedEntry.version
+	expected := s.resolvePolicy(contextID, cachedEntry.policy)
+
+	drift, err := s.impl.VerifyRules(oldVersion, contextID, expected)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"package":   "supervisor",
+			"contextID": contextID,
+			"error":     err.Error(),
+		}).Debug("Cannot verify the rules of the PU")
+		return
+	}
+
+	if !drift {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"package":   "supervisor",
+		"contextID": contextID,
+		"version":   oldVersion,
+	}).Info("Rules of the PU were modified outside of Trireme. Repairing")
+
+	ip, _ := expected.DefaultIPAddress()
+	s.collector.CollectContainerEvent(contextID, ip, nil, collector.ContainerDrift)
+
+	if err := s.reprogramPU(contextID, expected); err != nil {
+		log.WithFields(log.Fields{
+			"package":   "supervisor",
+			"contextID": contextID,
+			"error":     err.Error(),
+		}).Error("Failed to repair the rules of the PU. PU has been terminated")
+
+		s.collector.CollectContainerEvent(contextID, ip, nil, collector.ContainerFailed)
+	}
+}
@@ -0,0 +1,117 @@
+package supervisor
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aporeto-inc/trireme/policy"
+)
+
+// SetExclusionsFile sets the file in which the exclusions are kept across restarts.
+// An empty name keeps them in memory only. It must be called before Start.
+func (s *Config) SetExclusionsFile(file string) {
+
+	s.exclusions.SetFile(file)
+}
+
+// AddExcludedIP adds an exception for the destination parameter IP or CIDR, allowing all the traffic.
+func (s *Config) AddExcludedIP(ip string) error {
+
+	return s.AddExclusion(policy.NewExcludedIP(ip))
+}
+
+// RemoveExcludedIP removes the exception for the destination IP or CIDR given in parameter.
+func (s *Config) RemoveExcludedIP(ip string) error {
+
+	return s.RemoveExclusion(policy.NewExcludedIP(ip))
+}
+
+// AddExclusion implements the Excluder interface. The exclusion is programmed and
+// recorded in the state file.
+func (s *Config) AddExclusion(exclusion *policy.ExcludedIP) error {
+
+	if err := exclusion.Validate(); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.exclusions.Contains(exclusion) {
+		return nil
+	}
+
+	if err := s.impl.AddExclusion(exclusion); err != nil {
+		return fmt.Errorf("Cannot add exclusion %s: %s", exclusion.Key(), err)
+	}
+
+	if err := s.exclusions.Add(exclusion); err != nil {
+		s.impl.RemoveExclusion(exclusion)
+		return err
+	}
+
+	return nil
+}
+
+// RemoveExclusion implements the Excluder interface
+func (s *Config) RemoveExclusion(exclusion *policy.ExcludedIP) error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.exclusions.Contains(exclusion) {
+		return fmt.Errorf("Exclusion %s not found", exclusion.Key())
+	}
+
+	if err := s.impl.RemoveExclusion(exclusion); err != nil {
+		return fmt.Errorf("Cannot remove exclusion %s: %s", exclusion.Key(), err)
+	}
+
+	if err := s.exclusions.Remove(exclusion); err != nil {
+		s.impl.AddExclusion(exclusion)
+		return err
+	}
+
+	return nil
+}
+
+// ListExcludedIPs implements the Excluder interface
+func (s *Config) ListExcludedIPs() []*policy.ExcludedIP {
+
+	return s.exclusions.List()
+}
+
+// restoreExclusions programs the exclusions recorded in the state file. Rules left
+// by a previous run are removed first so that they are not duplicated.
+func (s *Config) restoreExclusions() {
+
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.exclusions.Load(); err != nil {
+		log.WithFields(log.Fields{
+			"package": "supervisor",
+			"error":   err.Error(),
+		}).Warn("Cannot load the exclusions")
+		return
+	}
+
+	s.reprogramExclusions()
+}
+
+// reprogramExclusions programs the recorded exclusions again. It must be called
+// with the lock held.
+func (s *Config) reprogramExclusions() {
+
+	for _, exclusion := range s.exclusions.List() {
+		s.impl.RemoveExclusion(exclusion)
+
+		if err := s.impl.AddExclusion(exclusion); err != nil {
+			log.WithFields(log.Fields{
+				"package":   "supervisor",
+				"exclusion": exclusion.Key(),
+				"error":     err.Error(),
+			}).Warn("Cannot restore exclusion")
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Package exclusions keeps the networks excluded from Trireme in a state file
+// so that they can be programmed again after a restart.
+package exclusions
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/aporeto-inc/trireme/policy"
+)
+
+// DefaultStateFile is the default location of the state file
+const DefaultStateFile = "/var/lib/trireme/exclusions.json"
+
+// Store holds the excluded IPs. Every change is written to the state file.
+// An empty state file name keeps the exclusions in memory only.
+type Store struct {
+	sync.Mutex
+	file       string
+	exclusions map[string]*policy.ExcludedIP
+}
+
+// NewStore returns a store persisting the exclusions in the given file
+func NewStore(file string) *Store {
+
+	return &Store{
+		file:       file,
+		exclusions: map[string]*policy.ExcludedIP{},
+	}
+}
+
+// SetFile changes the state file of the store. It must be called before Load.
+func (s *Store) SetFile(file string) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.file = file
+}
+
+// Load reads the exclusions from the state file. A missing file is not an error.
+func (s *Store) Load() error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.file == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Cannot read exclusions from %s: %s", s.file, err)
+	}
+
+	exclusions := []*policy.ExcludedIP{}
+	if err := json.Unmarshal(data, &exclusions); err != nil {
+		return fmt.Errorf("Invalid exclusions in %s: %s", s.file, err)
+	}
+
+	for _, e := range exclusions {
+		if err := e.Validate(); err != nil {
+			return fmt.Errorf("Invalid exclusion in %s: %s", s.file, err)
+		}
+		s.exclusions[e.Key()] = e
+	}
+
+	return nil
+}
+
+// Add records an exclusion. The exclusion is not recorded if it cannot be saved.
+func (s *Store) Add(e *policy.ExcludedIP) error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	previous, ok := s.exclusions[e.Key()]
+	s.exclusions[e.Key()] = e
+
+	if err := s.save(); err != nil {
+		if ok {
+			s.exclusions[e.Key()] = previous
+		} else {
+			delete(s.exclusions, e.Key())
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Remove deletes an exclusion. It returns an error if the exclusion is unknown.
+// The exclusion is kept if the removal cannot be saved.
+func (s *Store) Remove(e *policy.ExcludedIP) error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	previous, ok := s.exclusions[e.Key()]
+	if !ok {
+		return fmt.Errorf("Exclusion %s not found", e.Key())
+	}
+
+	delete(s.exclusions, e.Key())
+
+	if err := s.save(); err != nil {
+		s.exclusions[e.Key()] = previous
+		return err
+	}
+
+	return nil
+}
+
+// Contains returns true if the exclusion is recorded
+func (s *Store) Contains(e *policy.ExcludedIP) bool {
+
+	s.Lock()
+	defer s.Unlock()
+
+	_, ok := s.exclusions[e.Key()]
+	return ok
+}
+
+// List returns a copy of the exclusions sorted by key
+func (s *Store) List() []*policy.ExcludedIP {
+
+	s.Lock()
+	defer s.Unlock()
+
+	return s.list()
+}
+
+func (s *Store) list() []*policy.ExcludedIP {
+
+	keys := make([]string, 0, len(s.exclusions))
+	for k := range s.exclusions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	list := make([]*policy.ExcludedIP, 0, len(keys))
+	for _, k := range keys {
+		e := *s.exclusions[k]
+		list = append(list, &e)
+	}
+
+	return list
+}
+
+// save writes the state file atomically. It must be called with the lock held.
+func (s *Store) save() error {
+
+	if s.file == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.list(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("Cannot encode exclusions: %s", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.file), 0700); err != nil {
+		return fmt.Errorf("Cannot create directory for %s: %s", s.file, err)
+	}
+
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("Cannot write exclusions to %s: %s", tmp, err)
+	}
+
+	if err := os.Rename(tmp, s.file); err != nil {
+		return fmt.Errorf("Cannot write exclusions to %s: %s", s.file, err)
+	}
+
+	return nil
+}
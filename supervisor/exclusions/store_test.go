@@ -0,0 +1,119 @@
+package exclusions
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aporeto-inc/trireme/policy"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStore(t *testing.T) {
+
+	Convey("Given a store with a state file", t, func() {
+		dir, _ := ioutil.TempDir("", "exclusions")
+		defer os.RemoveAll(dir)
+
+		file := filepath.Join(dir, "state", "exclusions.json")
+		s := NewStore(file)
+
+		metadata := &policy.ExcludedIP{
+			Address:   "169.254.169.254",
+			Protocol:  "tcp",
+			Port:      "80",
+			Direction: policy.ExcludeOutgoing,
+		}
+		monitoring := policy.NewExcludedIP("10.10.0.0/16")
+
+		Convey("When I load it and the file does not exist", func() {
+			err := s.Load()
+			Convey("I should get no error and no exclusions", func() {
+				So(err, ShouldBeNil)
+				So(s.List(), ShouldBeEmpty)
+			})
+		})
+
+		Convey("When I add exclusions", func() {
+			So(s.Add(monitoring), ShouldBeNil)
+			So(s.Add(metadata), ShouldBeNil)
+
+			Convey("They should be listed", func() {
+				So(s.List(), ShouldResemble, []*policy.ExcludedIP{monitoring, metadata})
+				So(s.Contains(metadata), ShouldBeTrue)
+			})
+
+			Convey("They should be loaded by a new store", func() {
+				n := NewStore(file)
+				So(n.Load(), ShouldBeNil)
+				So(n.List(), ShouldResemble, []*policy.ExcludedIP{monitoring, metadata})
+			})
+
+			Convey("When I remove one", func() {
+				err := s.Remove(metadata)
+				Convey("It should be removed from the state file", func() {
+					So(err, ShouldBeNil)
+					n := NewStore(file)
+					So(n.Load(), ShouldBeNil)
+					So(n.List(), ShouldResemble, []*policy.ExcludedIP{monitoring})
+				})
+			})
+
+			Convey("When I remove an unknown exclusion", func() {
+				err := s.Remove(policy.NewExcludedIP("10.1.1.1"))
+				Convey("I should get an error", func() {
+					So(err, ShouldNotBeNil)
+				})
+			})
+		})
+
+		Convey("When the state file is invalid", func() {
+			os.MkdirAll(filepath.Dir(file), 0700)
+			ioutil.WriteFile(file, []byte(`[{"Address":"not an ip"}]`), 0600)
+			err := s.Load()
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+
+	Convey("Given a store whose state file cannot be written", t, func() {
+		dir, _ := ioutil.TempDir("", "exclusions")
+		defer os.RemoveAll(dir)
+
+		// The directory of the state file is a file
+		blocker := filepath.Join(dir, "state")
+		ioutil.WriteFile(blocker, []byte{}, 0600)
+		s := NewStore(filepath.Join(blocker, "exclusions.json"))
+
+		Convey("When I add an exclusion", func() {
+			err := s.Add(policy.NewExcludedIP("10.1.1.1"))
+			Convey("I should get an error and the exclusion should not be recorded", func() {
+				So(err, ShouldNotBeNil)
+				So(s.List(), ShouldBeEmpty)
+			})
+		})
+
+		Convey("When I remove a recorded exclusion", func() {
+			recorded := policy.NewExcludedIP("10.1.1.1")
+			s.exclusions[recorded.Key()] = recorded
+
+			err := s.Remove(recorded)
+			Convey("I should get an error and the exclusion should be kept", func() {
+				So(err, ShouldNotBeNil)
+				So(s.Contains(recorded), ShouldBeTrue)
+			})
+		})
+	})
+
+	Convey("Given a store without a state file", t, func() {
+		s := NewStore("")
+
+		Convey("Exclusions should be kept in memory", func() {
+			So(s.Load(), ShouldBeNil)
+			So(s.Add(policy.NewExcludedIP("10.1.1.1")), ShouldBeNil)
+			So(s.List(), ShouldHaveLength, 1)
+		})
+	})
+}
@@ -0,0 +1,264 @@
+package fqdn
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// resolvConf is the file holding the name servers of the host
+	resolvConf = "/etc/resolv.conf"
+	// defaultNameServer is used when no name server is configured
+	defaultNameServer = "127.0.0.1:53"
+	// queryTimeout is the time to wait for the answer of a name server
+	queryTimeout = 2 * time.Second
+	// maxMessageSize is the maximum size of a DNS answer over UDP
+	maxMessageSize = 4096
+)
+
+// Resolver resolves a DNS name into a list of IPv4 addresses. It also returns
+// the time the answer can be cached for.
+type Resolver interface {
+	Resolve(name string) ([]string, time.Duration, error)
+}
+
+// dnsResolver queries a list of name servers over UDP, and over TCP when their
+// answers do not fit in a UDP message
+type dnsResolver struct {
+	servers []string
+	timeout time.Duration
+}
+
+// NewDNSResolver returns a Resolver that queries the given name servers in order.
+// Servers are given as host:port.
+func NewDNSResolver(servers []string) Resolver {
+
+	return &dnsResolver{
+		servers: servers,
+		timeout: queryTimeout,
+	}
+}
+
+// NewSystemResolver returns a Resolver that uses the name servers configured
+// in /etc/resolv.conf
+func NewSystemResolver() Resolver {
+
+	return NewDNSResolver(systemNameServers(resolvConf))
+}
+
+// Resolve implements the Resolver interface. The TTL returned is the lowest
+// TTL of the records in the answer.
+func (r *dnsResolver) Resolve(name string) ([]string, time.Duration, error) {
+
+	if len(r.servers) == 0 {
+		return nil, 0, fmt.Errorf("No name server configured")
+	}
+
+	var lastErr error
+	for _, server := range r.servers {
+		addresses, ttl, err := r.query(server, name)
+		if err == nil {
+			return addresses, ttl, nil
+		}
+		lastErr = err
+	}
+
+	return nil, 0, fmt.Errorf("Failed to resolve %s: %s", name, lastErr)
+}
+
+// query sends a single A query to the server and parses the answer. The query
+// is sent again over TCP when the answer over UDP is truncated.
+func (r *dnsResolver) query(server string, name string) ([]string, time.Duration, error) {
+
+	if !strings.HasSuffix(name, ".") {
+		name = name + "."
+	}
+
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Invalid name %s: %s", name, err)
+	}
+
+	id := uint16(rand.Uint32())
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               id,
+			RecursionDesired: true,
+		},
+		Questions: []dnsmessage.Question{
+			{
+				Name:  qname,
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET,
+			},
+		},
+	}
+
+	packet, err := query.Pack()
+	if err != nil {
+		return nil, 0, fmt.Errorf("Cannot build query: %s", err)
+	}
+
+	answer, err := r.exchangeUDP(server, id, packet)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if answer.Truncated {
+		if answer, err = r.exchangeTCP(server, id, packet); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return parseAnswer(answer)
+}
+
+// exchangeUDP sends the query to the server over UDP and returns its answer
+func (r *dnsResolver) exchangeUDP(server string, id uint16, packet []byte) (*dnsmessage.Message, error) {
+
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot reach name server %s: %s", server, err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(r.timeout)); err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(packet); err != nil {
+		return nil, fmt.Errorf("Cannot send query to %s: %s", server, err)
+	}
+
+	buffer := make([]byte, maxMessageSize)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("No answer from %s: %s", server, err)
+		}
+
+		var answer dnsmessage.Message
+		if err := answer.Unpack(buffer[:n]); err != nil || answer.ID != id || !answer.Response {
+			// Not the answer to our query. Keep waiting until the deadline
+			continue
+		}
+
+		return &answer, nil
+	}
+}
+
+// exchangeTCP sends the query to the server over TCP and returns its answer.
+// The messages are prefixed with their length.
+func (r *dnsResolver) exchangeTCP(server string, id uint16, packet []byte) (*dnsmessage.Message, error) {
+
+	conn, err := net.Dial("tcp", server)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot reach name server %s over TCP: %s", server, err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(r.timeout)); err != nil {
+		return nil, err
+	}
+
+	request := make([]byte, 2+len(packet))
+	binary.BigEndian.PutUint16(request, uint16(len(packet)))
+	copy(request[2:], packet)
+
+	if _, err := conn.Write(request); err != nil {
+		return nil, fmt.Errorf("Cannot send query to %s over TCP: %s", server, err)
+	}
+
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return nil, fmt.Errorf("No answer from %s over TCP: %s", server, err)
+	}
+
+	buffer := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(conn, buffer); err != nil {
+		return nil, fmt.Errorf("Incomplete answer from %s over TCP: %s", server, err)
+	}
+
+	var answer dnsmessage.Message
+	if err := answer.Unpack(buffer); err != nil || answer.ID != id || !answer.Response {
+		return nil, fmt.Errorf("Invalid answer from %s over TCP", server)
+	}
+
+	if answer.Truncated {
+		return nil, fmt.Errorf("Truncated answer from %s over TCP", server)
+	}
+
+	return &answer, nil
+}
+
+// parseAnswer extracts the addresses and the TTL from an answer
+func parseAnswer(answer *dnsmessage.Message) ([]string, time.Duration, error) {
+
+	if answer.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("Name server returned %s", answer.RCode)
+	}
+
+	addresses := []string{}
+	var ttl uint32
+	first := true
+
+	for _, rr := range answer.Answers {
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			addresses = append(addresses, net.IP(body.A[:]).String())
+		case *dnsmessage.CNAMEResource:
+		default:
+			continue
+		}
+
+		if first || rr.Header.TTL < ttl {
+			ttl = rr.Header.TTL
+			first = false
+		}
+	}
+
+	if len(addresses) == 0 {
+		return nil, 0, fmt.Errorf("No addresses found")
+	}
+
+	return addresses, time.Duration(ttl) * time.Second, nil
+}
+
+// systemNameServers returns the name servers of a resolv.conf file
+func systemNameServers(path string) []string {
+
+	servers := []string{}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return []string{defaultNameServer}
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+
+		if ip := net.ParseIP(fields[1]); ip != nil {
+			servers = append(servers, net.JoinHostPort(ip.String(), "53"))
+		}
+	}
+
+	if len(servers) == 0 {
+		return []string{defaultNameServer}
+	}
+
+	return servers
+}
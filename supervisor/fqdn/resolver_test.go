@@ -0,0 +1,217 @@
+package fqdn
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// stubRecord is an A record served by the stub name server
+type stubRecord struct {
+	address [4]byte
+	ttl     uint32
+}
+
+// stubUDPRecords is the number of records the stub name server sends over UDP.
+// The answers with more records are truncated.
+const stubUDPRecords = 2
+
+// stubAnswer returns the answer of the stub name server to a query
+func stubAnswer(records map[string][]stubRecord, packet []byte, udp bool) ([]byte, bool) {
+
+	var query dnsmessage.Message
+	if err := query.Unpack(packet); err != nil || len(query.Questions) != 1 {
+		return nil, false
+	}
+
+	question := query.Questions[0]
+	answer := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:       query.ID,
+			Response: true,
+		},
+		Questions: query.Questions,
+	}
+
+	rrs, ok := records[question.Name.String()]
+	if !ok {
+		answer.RCode = dnsmessage.RCodeNameError
+	}
+
+	if udp && len(rrs) > stubUDPRecords {
+		answer.Truncated = true
+		rrs = rrs[:1]
+	}
+
+	for _, rr := range rrs {
+		answer.Answers = append(answer.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  question.Name,
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET,
+				TTL:   rr.ttl,
+			},
+			Body: &dnsmessage.AResource{A: rr.address},
+		})
+	}
+
+	response, err := answer.Pack()
+	if err != nil {
+		return nil, false
+	}
+
+	return response, true
+}
+
+// startStubServer starts a local name server that answers A queries from the
+// records map over UDP and TCP. Unknown names get an NXDOMAIN answer.
+func startStubServer(t *testing.T, records map[string][]stubRecord) (string, func()) {
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot start stub name server: %s", err)
+	}
+
+	listener, err := net.Listen("tcp", conn.LocalAddr().String())
+	if err != nil {
+		conn.Close()
+		t.Fatalf("Cannot start stub name server over TCP: %s", err)
+	}
+
+	go func() {
+		buffer := make([]byte, maxMessageSize)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+
+			if response, ok := stubAnswer(records, buffer[:n], true); ok {
+				conn.WriteTo(response, addr)
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			length := make([]byte, 2)
+			if _, err := io.ReadFull(c, length); err != nil {
+				c.Close()
+				continue
+			}
+
+			packet := make([]byte, binary.BigEndian.Uint16(length))
+			if _, err := io.ReadFull(c, packet); err != nil {
+				c.Close()
+				continue
+			}
+
+			if response, ok := stubAnswer(records, packet, false); ok {
+				binary.BigEndian.PutUint16(length, uint16(len(response)))
+				c.Write(append(length, response...))
+			}
+			c.Close()
+		}
+	}()
+
+	return conn.LocalAddr().String(), func() {
+		conn.Close()
+		listener.Close()
+	}
+}
+
+func TestResolve(t *testing.T) {
+	Convey("Given a resolver using a local name server", t, func() {
+		server, stop := startStubServer(t, map[string][]stubRecord{
+			"api.example.com.": []stubRecord{
+				{address: [4]byte{10, 1, 1, 2}, ttl: 300},
+				{address: [4]byte{10, 1, 1, 1}, ttl: 60},
+			},
+			"empty.example.com.": []stubRecord{},
+			"many.example.com.": []stubRecord{
+				{address: [4]byte{10, 1, 2, 1}, ttl: 60},
+				{address: [4]byte{10, 1, 2, 2}, ttl: 60},
+				{address: [4]byte{10, 1, 2, 3}, ttl: 60},
+			},
+		})
+		defer stop()
+
+		r := NewDNSResolver([]string{server})
+
+		Convey("When I resolve a known name", func() {
+			addresses, ttl, err := r.Resolve("api.example.com")
+			Convey("I should get all the addresses and the lowest TTL", func() {
+				So(err, ShouldBeNil)
+				So(addresses, ShouldResemble, []string{"10.1.1.2", "10.1.1.1"})
+				So(ttl, ShouldEqual, 60*time.Second)
+			})
+		})
+
+		Convey("When I resolve a name whose answer is truncated over UDP", func() {
+			addresses, _, err := r.Resolve("many.example.com")
+			Convey("I should get all the addresses from the answer over TCP", func() {
+				So(err, ShouldBeNil)
+				So(addresses, ShouldResemble, []string{"10.1.2.1", "10.1.2.2", "10.1.2.3"})
+			})
+		})
+
+		Convey("When I resolve an unknown name", func() {
+			_, _, err := r.Resolve("unknown.example.com")
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When I resolve a name without addresses", func() {
+			_, _, err := r.Resolve("empty.example.com")
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+
+	Convey("Given a resolver with no name servers", t, func() {
+		r := NewDNSResolver([]string{})
+
+		Convey("When I resolve a name", func() {
+			_, _, err := r.Resolve("api.example.com")
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestSystemNameServers(t *testing.T) {
+	Convey("Given a resolv.conf file", t, func() {
+		file, err := ioutil.TempFile("", "resolv.conf")
+		So(err, ShouldBeNil)
+		defer os.Remove(file.Name())
+
+		file.WriteString("# comment\nsearch example.com\nnameserver 10.0.0.1\nnameserver fe80::1\nnameserver bad\n")
+		file.Close()
+
+		Convey("I should get all the valid name servers", func() {
+			So(systemNameServers(file.Name()), ShouldResemble, []string{"10.0.0.1:53", "[fe80::1]:53"})
+		})
+	})
+
+	Convey("Given a missing resolv.conf file", t, func() {
+		Convey("I should get the default name server", func() {
+			So(systemNameServers("/nonexistent/resolv.conf"), ShouldResemble, []string{defaultNameServer})
+		})
+	})
+}
@@ -0,0 +1,298 @@
+package fqdn
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// minTTL is the shortest time an answer is cached for. It protects the
+	// name servers from names with a zero TTL
+	minTTL = 5 * time.Second
+	// maxTTL is the longest time an answer is cached for
+	maxTTL = time.Hour
+	// retryInterval is the time to wait before resolving a name again after a failure
+	retryInterval = 10 * time.Second
+	// refreshInterval is the interval at which expired names are resolved again
+	refreshInterval = time.Second
+)
+
+// nameEntry holds the resolved addresses of a single name
+type nameEntry struct {
+	addresses  []string
+	expiration time.Time
+	contexts   map[string]bool
+}
+
+// Tracker keeps the addresses of the DNS names used by the processing units
+// up to date. When the addresses of a name change, the update handler is
+// called for every processing unit that uses the name.
+type Tracker struct {
+	resolver      Resolver
+	updateHandler func(contextID string)
+	names         map[string]*nameEntry
+	contexts      map[string][]string
+	stop          chan bool
+	stopOnce      *sync.Once
+	sync.Mutex
+}
+
+// NewTracker returns a new Tracker that uses the resolver to resolve names
+func NewTracker(resolver Resolver, updateHandler func(contextID string)) *Tracker {
+
+	return &Tracker{
+		resolver:      resolver,
+		updateHandler: updateHandler,
+		names:         map[string]*nameEntry{},
+		contexts:      map[string][]string{},
+		stop:          make(chan bool),
+		stopOnce:      &sync.Once{},
+	}
+}
+
+// Register associates the names with the processing unit, replacing any previous
+// association. Names that are not tracked yet have no addresses until they are
+// resolved in the background. The update handler is called for the processing
+// unit once they are.
+func (t *Tracker) Register(contextID string, names []string) {
+
+	unresolved := []string{}
+	registered := map[string]bool{}
+	now := time.Now()
+
+	t.Lock()
+	for _, name := range names {
+		registered[name] = true
+
+		entry, ok := t.names[name]
+		if !ok {
+			// The background refresh leaves the name alone while it is
+			// resolved for the first time
+			entry = &nameEntry{
+				contexts:   map[string]bool{},
+				expiration: now.Add(retryInterval),
+			}
+			t.names[name] = entry
+			unresolved = append(unresolved, name)
+		}
+		entry.contexts[contextID] = true
+	}
+
+	// Release the names that are not used anymore
+	for _, name := range t.contexts[contextID] {
+		if !registered[name] {
+			t.release(contextID, name)
+		}
+	}
+	t.contexts[contextID] = names
+	t.Unlock()
+
+	if len(unresolved) > 0 {
+		go t.resolveNames(unresolved, now)
+	}
+}
+
+// Unregister removes all the names associated with the processing unit
+func (t *Tracker) Unregister(contextID string) {
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.unregister(contextID)
+}
+
+// Addresses returns the current addresses of a name
+func (t *Tracker) Addresses(name string) []string {
+
+	t.Lock()
+	defer t.Unlock()
+
+	entry, ok := t.names[name]
+	if !ok {
+		return []string{}
+	}
+
+	return append([]string{}, entry.addresses...)
+}
+
+// Refresh resolves the name immediately, without waiting for its TTL to expire,
+// and notifies the processing units if its addresses changed
+func (t *Tracker) Refresh(name string) {
+
+	for _, contextID := range t.resolve(name, time.Now()) {
+		t.updateHandler(contextID)
+	}
+}
+
+// Start starts resolving the expired names in the background. A stopped tracker
+// can be started again.
+func (t *Tracker) Start() {
+
+	stop := make(chan bool)
+
+	t.Lock()
+	t.stop = stop
+	t.stopOnce = &sync.Once{}
+	t.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(refreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				t.refresh(now)
+			}
+		}
+	}()
+}
+
+// Stop stops the background resolution. It can be called several times.
+func (t *Tracker) Stop() {
+
+	t.Lock()
+	stop, stopOnce := t.stop, t.stopOnce
+	t.Unlock()
+
+	stopOnce.Do(func() {
+		close(stop)
+	})
+}
+
+// unregister must be called with the lock held
+func (t *Tracker) unregister(contextID string) {
+
+	for _, name := range t.contexts[contextID] {
+		t.release(contextID, name)
+	}
+
+	delete(t.contexts, contextID)
+}
+
+// release removes the association of a name with a processing unit and stops
+// tracking the name when it is not used anymore. It must be called with the lock held
+func (t *Tracker) release(contextID string, name string) {
+
+	entry, ok := t.names[name]
+	if !ok {
+		return
+	}
+
+	delete(entry.contexts, contextID)
+	if len(entry.contexts) == 0 {
+		delete(t.names, name)
+	}
+}
+
+// refresh resolves all the expired names and notifies the processing units
+// whose names have new addresses
+func (t *Tracker) refresh(now time.Time) {
+
+	expired := []string{}
+
+	t.Lock()
+	for name, entry := range t.names {
+		if !now.Before(entry.expiration) {
+			expired = append(expired, name)
+		}
+	}
+	t.Unlock()
+
+	t.resolveNames(expired, now)
+}
+
+// resolveNames resolves the names and notifies the processing units whose names
+// have new addresses
+func (t *Tracker) resolveNames(names []string, now time.Time) {
+
+	updated := map[string]bool{}
+	for _, name := range names {
+		for _, contextID := range t.resolve(name, now) {
+			updated[contextID] = true
+		}
+	}
+
+	for contextID := range updated {
+		t.updateHandler(contextID)
+	}
+}
+
+// resolve resolves a name and returns the processing units that must be updated
+// because the addresses of the name changed
+func (t *Tracker) resolve(name string, now time.Time) []string {
+
+	addresses, ttl, err := t.resolver.Resolve(name)
+
+	t.Lock()
+	defer t.Unlock()
+
+	entry, ok := t.names[name]
+	if !ok {
+		// The name was unregistered while it was being resolved
+		return nil
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"package": "fqdn",
+			"name":    name,
+			"error":   err.Error(),
+		}).Debug("Failed to resolve name. Keeping the previous addresses")
+
+		entry.expiration = now.Add(retryInterval)
+		return nil
+	}
+
+	if ttl < minTTL {
+		ttl = minTTL
+	}
+
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+
+	entry.expiration = now.Add(ttl)
+
+	sort.Strings(addresses)
+	if equal(entry.addresses, addresses) {
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"package":   "fqdn",
+		"name":      name,
+		"addresses": addresses,
+		"ttl":       ttl,
+	}).Debug("Addresses of name changed")
+
+	entry.addresses = addresses
+
+	contexts := []string{}
+	for contextID := range entry.contexts {
+		contexts = append(contexts, contextID)
+	}
+
+	return contexts
+}
+
+// equal compares two sorted lists of addresses
+func equal(a, b []string) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
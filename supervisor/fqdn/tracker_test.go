@@ -0,0 +1,215 @@
+package fqdn
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeResolver answers from a map that tests can modify
+type fakeResolver struct {
+	answers map[string][]string
+	ttl     time.Duration
+	queries int
+	sync.Mutex
+}
+
+func (r *fakeResolver) Resolve(name string) ([]string, time.Duration, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.queries++
+
+	addresses, ok := r.answers[name]
+	if !ok {
+		return nil, 0, fmt.Errorf("Unknown name")
+	}
+
+	return append([]string{}, addresses...), r.ttl, nil
+}
+
+func (r *fakeResolver) set(name string, addresses []string) {
+	r.Lock()
+	defer r.Unlock()
+
+	if addresses == nil {
+		delete(r.answers, name)
+		return
+	}
+	r.answers[name] = addresses
+}
+
+// waitUpdate returns the next PU updated by the tracker, or an empty string if
+// none is updated in time
+func waitUpdate(updates chan string) string {
+	select {
+	case contextID := <-updates:
+		return contextID
+	case <-time.After(time.Second):
+		return ""
+	}
+}
+
+// pendingUpdates returns the PUs already updated by the tracker
+func pendingUpdates(updates chan string) []string {
+	updated := []string{}
+	for {
+		select {
+		case contextID := <-updates:
+			updated = append(updated, contextID)
+		default:
+			return updated
+		}
+	}
+}
+
+// waitQueries waits until the resolver got the given number of queries
+func waitQueries(r *fakeResolver, queries int) {
+	for n := 0; n < 100; n++ {
+		r.Lock()
+		done := r.queries >= queries
+		r.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTracker(t *testing.T) {
+	Convey("Given a tracker", t, func() {
+		resolver := &fakeResolver{
+			answers: map[string][]string{
+				"api.example.com": []string{"10.1.1.2", "10.1.1.1"},
+			},
+			ttl: 30 * time.Second,
+		}
+
+		updates := make(chan string, 10)
+		tracker := NewTracker(resolver, func(contextID string) {
+			updates <- contextID
+		})
+
+		Convey("When I register a name", func() {
+			tracker.Register("pu1", []string{"api.example.com"})
+			resolved := waitUpdate(updates)
+
+			Convey("It should be resolved in the background and the PU updated", func() {
+				So(resolved, ShouldEqual, "pu1")
+				So(tracker.Addresses("api.example.com"), ShouldResemble, []string{"10.1.1.1", "10.1.1.2"})
+				So(resolver.queries, ShouldEqual, 1)
+			})
+
+			Convey("When a second PU registers the same name", func() {
+				tracker.Register("pu2", []string{"api.example.com"})
+
+				Convey("It should not be resolved again", func() {
+					So(resolver.queries, ShouldEqual, 1)
+				})
+
+				Convey("When the name changes after the TTL expires", func() {
+					resolver.set("api.example.com", []string{"10.1.1.3"})
+					tracker.refresh(time.Now().Add(31 * time.Second))
+
+					Convey("Both PUs should be updated", func() {
+						updated := pendingUpdates(updates)
+						sort.Strings(updated)
+						So(updated, ShouldResemble, []string{"pu1", "pu2"})
+						So(tracker.Addresses("api.example.com"), ShouldResemble, []string{"10.1.1.3"})
+					})
+				})
+			})
+
+			Convey("When I refresh before the TTL expires", func() {
+				resolver.set("api.example.com", []string{"10.1.1.3"})
+				tracker.refresh(time.Now().Add(10 * time.Second))
+
+				Convey("The name should not be resolved again", func() {
+					So(resolver.queries, ShouldEqual, 1)
+					So(pendingUpdates(updates), ShouldBeEmpty)
+				})
+			})
+
+			Convey("When the TTL expires and the addresses did not change", func() {
+				tracker.refresh(time.Now().Add(31 * time.Second))
+
+				Convey("No PU should be updated", func() {
+					So(resolver.queries, ShouldEqual, 2)
+					So(pendingUpdates(updates), ShouldBeEmpty)
+				})
+			})
+
+			Convey("When the resolution fails after the TTL expires", func() {
+				resolver.set("api.example.com", nil)
+				tracker.refresh(time.Now().Add(31 * time.Second))
+
+				Convey("The previous addresses should be kept", func() {
+					So(pendingUpdates(updates), ShouldBeEmpty)
+					So(tracker.Addresses("api.example.com"), ShouldResemble, []string{"10.1.1.1", "10.1.1.2"})
+				})
+			})
+
+			Convey("When I force a refresh of a name that changed", func() {
+				resolver.set("api.example.com", []string{"10.1.1.3"})
+				tracker.Refresh("api.example.com")
+
+				Convey("The PU should be updated before the TTL expires", func() {
+					So(pendingUpdates(updates), ShouldResemble, []string{"pu1"})
+					So(tracker.Addresses("api.example.com"), ShouldResemble, []string{"10.1.1.3"})
+				})
+			})
+
+			Convey("When I unregister the PU", func() {
+				tracker.Unregister("pu1")
+
+				Convey("The name should not be tracked anymore", func() {
+					So(tracker.Addresses("api.example.com"), ShouldBeEmpty)
+				})
+			})
+
+			Convey("When I register the PU again without the name", func() {
+				tracker.Register("pu1", []string{})
+
+				Convey("The name should not be tracked anymore", func() {
+					So(tracker.Addresses("api.example.com"), ShouldBeEmpty)
+				})
+			})
+		})
+
+		Convey("When I stop the tracker several times", func() {
+			So(tracker.Stop, ShouldNotPanic)
+			tracker.Start()
+			So(tracker.Stop, ShouldNotPanic)
+			So(tracker.Stop, ShouldNotPanic)
+
+			Convey("It should be possible to start it again", func() {
+				tracker.Start()
+				So(tracker.Stop, ShouldNotPanic)
+			})
+		})
+
+		Convey("When I register a name that cannot be resolved", func() {
+			tracker.Register("pu1", []string{"unknown.example.com"})
+			waitQueries(resolver, 1)
+
+			Convey("It should have no addresses", func() {
+				So(tracker.Addresses("unknown.example.com"), ShouldBeEmpty)
+				So(pendingUpdates(updates), ShouldBeEmpty)
+			})
+
+			Convey("When the name becomes resolvable", func() {
+				resolver.set("unknown.example.com", []string{"10.2.2.2"})
+				tracker.refresh(time.Now().Add(retryInterval))
+
+				Convey("The PU should be updated", func() {
+					So(pendingUpdates(updates), ShouldResemble, []string{"pu1"})
+					So(tracker.Addresses("unknown.example.com"), ShouldResemble, []string{"10.2.2.2"})
+				})
+			})
+		})
+	})
+}
@@ -0,0 +1,127 @@
+package supervisor
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/aporeto-inc/trireme/policy"
+)
+
+// validateAddresses returns an error if the address of a rule of the policy is
+// neither an IP address, a CIDR nor a DNS name, so that a mistyped address is
+// not resolved as a name
+func validateAddresses(p *policy.PUPolicy) error {
+
+	for _, l := range []*policy.IPRuleList{p.IngressACLs(), p.EgressACLs()} {
+		for _, rule := range l.Rules {
+			if err := rule.Validate(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// resolvePolicy returns the policy that must be programmed for the processing unit.
+// Rules that refer to DNS names are replaced by one rule per known address and
+// the names are tracked so that the rules are updated when the addresses change.
+// The names are resolved in the background, so the rules of a new name are
+// programmed once it is resolved. The policy is returned as is when it has no
+// such rules.
+func (s *Config) resolvePolicy(contextID string, p *policy.PUPolicy) *policy.PUPolicy {
+
+	ingress := p.IngressACLs()
+	egress := p.EgressACLs()
+
+	names := fqdnNames(ingress, egress)
+	if len(names) == 0 {
+		s.fqdn.Unregister(contextID)
+		return p
+	}
+
+	s.fqdn.Register(contextID, names)
+
+	resolved := p.Clone()
+	resolved.SetIngressACLs(s.expandFQDNRules(contextID, ingress))
+	resolved.SetEgressACLs(s.expandFQDNRules(contextID, egress))
+
+	return resolved
+}
+
+// expandFQDNRules replaces every rule that refers to a DNS name with one rule
+// per address of the name
+func (s *Config) expandFQDNRules(contextID string, l *policy.IPRuleList) *policy.IPRuleList {
+
+	rules := []policy.IPRule{}
+
+	for _, rule := range l.Rules {
+		if !rule.IsFQDN() {
+			rules = append(rules, rule)
+			continue
+		}
+
+		addresses := s.fqdn.Addresses(rule.Address)
+		if len(addresses) == 0 {
+			log.WithFields(log.Fields{
+				"package":   "supervisor",
+				"contextID": contextID,
+				"name":      rule.Address,
+			}).Debug("No address known for name. Rule is not programmed")
+		}
+
+		for _, address := range addresses {
+			expanded := rule
+			expanded.Address = address + "/32"
+			rules = append(rules, expanded)
+		}
+	}
+
+	return policy.NewIPRuleList(rules)
+}
+
+// refreshPU programs the rules of the processing unit again with the current
+// addresses of the DNS names it uses. The previous rules are kept if the new
+// ones cannot be programmed.
+func (s *Config) refreshPU(contextID string) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	if _, err := s.versionTracker.Get(contextID); err != nil {
+		return
+	}
+
+	cacheEntry, err := s.versionTracker.LockedModify(contextID, add, 1)
+	if err != nil {
+		return
+	}
+
+	cachedEntry := cacheEntry.(*cacheData)
+
+	if err := s.impl.UpdateRules(cachedEntry.version, contextID, s.resolvePolicy(contextID, cachedEntry.policy)); err != nil {
+		log.WithFields(log.Fields{
+			"package":   "supervisor",
+			"contextID": contextID,
+			"error":     err.Error(),
+		}).Error("Failed to update the rules after a DNS change. Previous rules are kept")
+
+		s.rollbackVersion(contextID, cachedEntry.policy)
+	}
+}
+
+// fqdnNames returns the DNS names used in the rule lists
+func fqdnNames(lists ...*policy.IPRuleList) []string {
+
+	names := []string{}
+	found := map[string]bool{}
+
+	for _, l := range lists {
+		for _, rule := range l.Rules {
+			if rule.IsFQDN() && !found[rule.Address] {
+				found[rule.Address] = true
+				names = append(names, rule.Address)
+			}
+		}
+	}
+
+	return names
+}
@@ -1,6 +1,10 @@
 package supervisor
 
-import "github.com/aporeto-inc/trireme/policy"
+import (
+	"context"
+
+	"github.com/aporeto-inc/trireme/policy"
+)
 
 // A Supervisor is implementing the node control plane that captures the packets.
 type Supervisor interface {
@@ -11,6 +15,10 @@ type Supervisor interface {
 	// Unsupervise unsupervises the given PU
 	Unsupervise(contextID string) error
 
+	// CleanOrphans removes the rules of the PUs recovered at start that were not
+	// supervised again. It must be called once the initial sync of the PUs is complete.
+	CleanOrphans() error
+
 	// Start starts the Supervisor.
 	Start() error
 
@@ -18,14 +26,56 @@ type Supervisor interface {
 	Stop() error
 }
 
+// A ContextSupervisor is a Supervisor that gives up when the context of a
+// request is done. The rules of a PU are never left half programmed.
+type ContextSupervisor interface {
+	Supervisor
+
+	// SuperviseWithContext is Supervise with a context.
+	SuperviseWithContext(ctx context.Context, contextID string, puInfo *policy.PUInfo) error
+
+	// UnsuperviseWithContext is Unsupervise with a context.
+	UnsuperviseWithContext(ctx context.Context, contextID string) error
+}
+
+// A BatchSupervisor is a Supervisor that programs the policies of several PUs
+// at once.
+type BatchSupervisor interface {
+	Supervisor
+
+	// SuperviseBatch supervises the PUs and returns the error of each of them.
+	SuperviseBatch(puInfos map[string]*policy.PUInfo) map[string]error
+}
+
+// An Uninstaller is a Supervisor that removes the rules of all the PUs. The
+// rules are left in place when a Supervisor is stopped so that they are
+// recovered when it is started again.
+type Uninstaller interface {
+	Supervisor
+
+	// CleanUp removes the rules of all the PUs. It must be called once the
+	// Supervisor is stopped.
+	CleanUp() error
+}
+
 // Excluder is an interface to remove specific IPs from the Trireme implementation
 type Excluder interface {
 
-	// AddExcludedIP adds an exception for the destination parameter IP, allowing all the traffic.
+	// AddExcludedIP adds an exception for the destination parameter IP or CIDR, allowing all the traffic.
 	AddExcludedIP(ip string) error
 
-	// RemoveExcludedIP removes the exception for the destination IP given in parameter.
+	// RemoveExcludedIP removes the exception for the destination IP or CIDR given in parameter.
 	RemoveExcludedIP(ip string) error
+
+	// AddExclusion adds an exception for a network, optionally restricted to a protocol,
+	// a port and a direction. Exclusions are kept across restarts.
+	AddExclusion(exclusion *policy.ExcludedIP) error
+
+	// RemoveExclusion removes an exception added with AddExclusion or AddExcludedIP.
+	RemoveExclusion(exclusion *policy.ExcludedIP) error
+
+	// ListExcludedIPs returns the current exceptions.
+	ListExcludedIPs() []*policy.ExcludedIP
 }
 
 // Implementor is the interface of the implementation based on iptables, ipsets, remote etc
@@ -40,15 +90,40 @@ type Implementor interface {
 	// DeleteRules
 	DeleteRules(version int, context string, ipAddresses *policy.IPMap) error
 
-	// Start initializes any defaults
+	// VerifyRules reads back the programmed rules and returns true if they
+	// differ from the rules expected for the policy
+	VerifyRules(version int, contextID string, policyrules *policy.PUPolicy) (bool, error)
+
+	// VerifyGlobalRules reads back the rules shared by all the PUs and the rules
+	// of the exclusions and returns true if some of them are missing
+	VerifyGlobalRules(exclusions []*policy.ExcludedIP) (bool, error)
+
+	// RecoverRules reports every PU found in the kernel state to adopt, with the
+	// version and the IP addresses of its rules
+	RecoverRules(adopt func(contextID string, version int, ips *policy.IPMap)) error
+
+	// Start initializes any defaults. It programs again the rules shared by all
+	// the PUs that are missing.
 	Start() error
 
-	// Stop cleans up state
+	// Stop stops the implementation. The rules of the PUs are left in place.
 	Stop() error
 
-	// AddExcludedIP adds an exception for the destination parameter IP, allowing all the traffic.
-	AddExcludedIP(ip string) error
+	// CleanUp removes the rules of all the PUs
+	CleanUp() error
 
-	// RemoveExcludedIP removes the exception for the destination IP given in parameter.
-	RemoveExcludedIP(ip string) error
+	// AddExclusion adds an exception for the network of the exclusion, allowing its traffic.
+	AddExclusion(exclusion *policy.ExcludedIP) error
+
+	// RemoveExclusion removes the exception for the network of the exclusion.
+	RemoveExclusion(exclusion *policy.ExcludedIP) error
+}
+
+// A BatchImplementor is an Implementor that updates the rules of several PUs
+// at once.
+type BatchImplementor interface {
+
+	// UpdateRulesBatch updates the rules of the PUs to the given versions. None
+	// of the updates is programmed if one of them fails.
+	UpdateRulesBatch(versions map[string]int, policies map[string]*policy.PUPolicy) error
 }
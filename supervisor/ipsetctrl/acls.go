@@ -2,9 +2,11 @@ package ipsetctrl
 
 import (
 	"fmt"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/aporeto-inc/trireme/policy"
+	"github.com/aporeto-inc/trireme/supervisor/provider"
 	"github.com/bvandewalle/go-ipset/ipset"
 )
 
@@ -46,39 +48,58 @@ func (i *Instance) createACLSets(version string, set string, rules *policy.IPRul
 	return nil
 }
 
-// AddAppSetRule adds an ACL rule to the Set
-func (i *Instance) addAppSetRules(version, setPrefix, ip string) error {
+// appSetRules returns the rules that match the application traffic against
+// the reject and allow sets of a PU
+func (i *Instance) appSetRules(version, setPrefix, ip string) [][]string {
 
-	if err := i.ipt.Insert(
-		i.appAckPacketIPTableContext, i.appPacketIPTableSection, 3,
-		"-m", "state", "--state", "NEW",
-		"-m", "set", "--match-set", setPrefix+rejectPrefix+version, "dst",
-		"-s", ip,
-		"-j", "DROP",
-	); err != nil {
-		log.WithFields(log.Fields{
-			"package":                      "ipsetctrl",
-			"i.appAckPacketIPTableContext": i.appAckPacketIPTableContext,
-			"error": err.Error(),
-		}).Debug("Error when adding app acl rule")
-		return err
+	return [][]string{
+		{
+			"-m", "state", "--state", "NEW",
+			"-m", "set", "--match-set", setPrefix + rejectPrefix + version, "dst",
+			"-s", ip,
+			"-j", "DROP",
+		},
+		{
+			"-m", "state", "--state", "NEW",
+			"-m", "set", "--match-set", setPrefix + allowPrefix + version, "dst",
+			"-s", ip,
+			"-j", "ACCEPT",
+		},
+	}
+}
 
+// netSetRules returns the rules that match the network traffic against
+// the reject and allow sets of a PU
+func (i *Instance) netSetRules(version, setPrefix, ip string) [][]string {
+
+	return [][]string{
+		{
+			"-m", "state", "--state", "NEW",
+			"-m", "set", "--match-set", setPrefix + rejectPrefix + version, "src",
+			"-d", ip,
+			"-j", "DROP",
+		},
+		{
+			"-m", "state", "--state", "NEW",
+			"-m", "set", "--match-set", setPrefix + allowPrefix + version, "src",
+			"-d", ip,
+			"-j", "ACCEPT",
+		},
 	}
+}
 
-	if err := i.ipt.Insert(
-		i.appAckPacketIPTableContext, i.appPacketIPTableSection, 3,
-		"-m", "state", "--state", "NEW",
-		"-m", "set", "--match-set", setPrefix+allowPrefix+version, "dst",
-		"-s", ip,
-		"-j", "ACCEPT",
-	); err != nil {
-		log.WithFields(log.Fields{
-			"package":                      "ipsetctrl",
-			"i.appAckPacketIPTableContext": i.appAckPacketIPTableContext,
-			"error": err.Error(),
-		}).Debug("Error when adding app acl rule")
-		return err
+// AddAppSetRule adds an ACL rule to the Set
+func (i *Instance) addAppSetRules(version, setPrefix, ip string) error {
 
+	for _, rule := range i.appSetRules(version, setPrefix, ip) {
+		if err := i.ipt.Insert(i.appAckPacketIPTableContext, i.appPacketIPTableSection, 3, rule...); err != nil {
+			log.WithFields(log.Fields{
+				"package":                      "ipsetctrl",
+				"i.appAckPacketIPTableContext": i.appAckPacketIPTableContext,
+				"error": err.Error(),
+			}).Debug("Error when adding app acl rule")
+			return err
+		}
 	}
 
 	return nil
@@ -87,108 +108,118 @@ func (i *Instance) addAppSetRules(version, setPrefix, ip string) error {
 // addNetSetRule
 func (i *Instance) addNetSetRules(version, setPrefix, ip string) error {
 
-	if err := i.ipt.Insert(
-		i.netPacketIPTableContext, i.netPacketIPTableSection, 2,
-		"-m", "state", "--state", "NEW",
-		"-m", "set", "--match-set", setPrefix+rejectPrefix+version, "src",
-		"-d", ip,
-		"-j", "DROP",
-	); err != nil {
-		log.WithFields(log.Fields{
-			"package":                   "ipsetctrl",
-			"i.netPacketIPTableContext": i.netPacketIPTableContext,
-			"error":                     err.Error(),
-		}).Debug("Error when adding app acl rule")
-		return err
-	}
-
-	if err := i.ipt.Insert(
-		i.netPacketIPTableContext, i.netPacketIPTableSection, 2,
-		"-m", "state", "--state", "NEW",
-		"-m", "set", "--match-set", setPrefix+allowPrefix+version, "src",
-		"-d", ip,
-		"-j", "ACCEPT",
-	); err != nil {
-		log.WithFields(log.Fields{
-			"package":                   "ipsetctrl",
-			"i.netPacketIPTableContext": i.netPacketIPTableContext,
-			"error":                     err.Error(),
-		}).Debug("Error when adding app acl rule")
-		return err
+	for _, rule := range i.netSetRules(version, setPrefix, ip) {
+		if err := i.ipt.Insert(i.netPacketIPTableContext, i.netPacketIPTableSection, 2, rule...); err != nil {
+			log.WithFields(log.Fields{
+				"package":                   "ipsetctrl",
+				"i.netPacketIPTableContext": i.netPacketIPTableContext,
+				"error":                     err.Error(),
+			}).Debug("Error when adding app acl rule")
+			return err
+		}
 	}
+
 	return nil
 }
 
 // deleteAppSetRule
 func (i *Instance) deleteAppSetRules(version, setPrefix, ip string) error {
 
-	if err := i.ipt.Delete(
-		i.appAckPacketIPTableContext, i.appPacketIPTableSection,
-		"-m", "state", "--state", "NEW",
-		"-m", "set", "--match-set", setPrefix+rejectPrefix+version, "dst",
-		"-s", ip,
-		"-j", "DROP",
-	); err != nil {
-		log.WithFields(log.Fields{
-			"package":                      "ipsetctrl",
-			"i.appAckPacketIPTableContext": i.appAckPacketIPTableContext,
-			"error": err.Error(),
-		}).Debug("Error when adding app acl rule")
-	}
-
-	if err := i.ipt.Delete(
-		i.appAckPacketIPTableContext, i.appPacketIPTableSection,
-		"-m", "state", "--state", "NEW",
-		"-m", "set", "--match-set", setPrefix+allowPrefix+version, "dst",
-		"-s", ip,
-		"-j", "ACCEPT",
-	); err != nil {
-		log.WithFields(log.Fields{
-			"package":                   "ipsetctrl",
-			"i.netPacketIPTableContext": i.netPacketIPTableContext,
-			"chain":                     i.appPacketIPTableSection,
-			"error":                     err.Error(),
-		}).Debug("Error when removing ingress app acl rule")
-
+	for _, rule := range i.appSetRules(version, setPrefix, ip) {
+		if err := i.ipt.Delete(i.appAckPacketIPTableContext, i.appPacketIPTableSection, rule...); err != nil {
+			log.WithFields(log.Fields{
+				"package":                      "ipsetctrl",
+				"i.appAckPacketIPTableContext": i.appAckPacketIPTableContext,
+				"chain":                        i.appPacketIPTableSection,
+				"error":                        err.Error(),
+			}).Debug("Error when removing app acl rule")
+		}
 	}
+
 	return nil
 }
 
 // deleteNetSetRule
 func (i *Instance) deleteNetSetRules(version, setPrefix, ip string) error {
-	if err := i.ipt.Delete(
-		i.netPacketIPTableContext, i.netPacketIPTableSection,
-		"-m", "state", "--state", "NEW",
-		"-m", "set", "--match-set", setPrefix+rejectPrefix+version, "src",
-		"-d", ip,
-		"-j", "DROP",
-	); err != nil {
-		log.WithFields(log.Fields{
-			"package":                   "ipsetctrl",
-			"i.netPacketIPTableContext": i.netPacketIPTableContext,
-			"chain":                     i.appPacketIPTableSection,
-			"error":                     err.Error(),
-		}).Debug("Error when removing ingress app acl rule")
-
-	}
-	if err := i.ipt.Delete(
-		i.netPacketIPTableContext, i.netPacketIPTableSection,
-		"-m", "state", "--state", "NEW",
-		"-m", "set", "--match-set", setPrefix+allowPrefix+version, "src",
-		"-d", ip,
-		"-j", "ACCEPT",
-	); err != nil {
-		log.WithFields(log.Fields{
-			"package":                   "ipsetctrl",
-			"i.netPacketIPTableContext": i.netPacketIPTableContext,
-			"chain":                     i.appPacketIPTableSection,
-			"error":                     err.Error(),
-		}).Debug("Error when removing ingress app acl rule")
 
+	for _, rule := range i.netSetRules(version, setPrefix, ip) {
+		if err := i.ipt.Delete(i.netPacketIPTableContext, i.netPacketIPTableSection, rule...); err != nil {
+			log.WithFields(log.Fields{
+				"package":                   "ipsetctrl",
+				"i.netPacketIPTableContext": i.netPacketIPTableContext,
+				"chain":                     i.netPacketIPTableSection,
+				"error":                     err.Error(),
+			}).Debug("Error when removing net acl rule")
+		}
 	}
+
 	return nil
 }
 
+// verifySetRules returns true if any of the rules matching the traffic of a PU
+// against its sets is missing
+func (i *Instance) verifySetRules(version, appSetPrefix, netSetPrefix, ip string) (bool, error) {
+
+	for _, rule := range i.appSetRules(version, appSetPrefix, ip) {
+		exists, err := i.ipt.Exists(i.appAckPacketIPTableContext, i.appPacketIPTableSection, rule...)
+		if err != nil {
+			return false, fmt.Errorf("Cannot check app acl rule: %s", err)
+		}
+		if !exists {
+			return true, nil
+		}
+	}
+
+	for _, rule := range i.netSetRules(version, netSetPrefix, ip) {
+		exists, err := i.ipt.Exists(i.netPacketIPTableContext, i.netPacketIPTableSection, rule...)
+		if err != nil {
+			return false, fmt.Errorf("Cannot check net acl rule: %s", err)
+		}
+		if !exists {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// verifyACLSets returns true if any of the entries of the ACLs is missing
+// from the sets of a PU
+func (i *Instance) verifyACLSets(version string, set string, rules *policy.IPRuleList) (bool, error) {
+
+	allowSet, err := i.ips.NewIpset(set+allowPrefix+version, "hash:net,port", &ipset.Params{})
+	if err != nil {
+		return false, fmt.Errorf("Couldn't open IPSet: %s", err)
+	}
+
+	rejectSet, err := i.ips.NewIpset(set+rejectPrefix+version, "hash:net,port", &ipset.Params{})
+	if err != nil {
+		return false, fmt.Errorf("Couldn't open IPSet: %s", err)
+	}
+
+	for _, rule := range rules.Rules {
+		var target provider.Ipset
+		switch rule.Action {
+		case policy.Accept:
+			target = allowSet
+		case policy.Reject:
+			target = rejectSet
+		default:
+			continue
+		}
+
+		found, err := target.Test(rule.Address + "," + rule.Port)
+		if err != nil {
+			return false, fmt.Errorf("Couldn't test IPSet entry: %s", err)
+		}
+		if !found {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
 func (i *Instance) deleteSet(set string) error {
 	ipSet, err := i.ips.NewIpset(set, "hash:net,port", &ipset.Params{})
 	if err != nil {
@@ -212,6 +243,11 @@ func (i *Instance) setupIpset(target, container string) error {
 	}
 
 	for _, net := range i.targetNetworks {
+		// The set is kept across restarts
+		if found, err := ips.Test(net); err == nil && found {
+			continue
+		}
+
 		if err = ips.Add(net, 0); err != nil {
 			log.WithFields(log.Fields{
 				"package": "supervisor",
@@ -288,10 +324,99 @@ func (i *Instance) deleteIpsetOption(ip string) error {
 	return i.targetSet.Del(ip)
 }
 
-// setupTrapRules
-func (i *Instance) setupTrapRules(set string) error {
+// exclusionRules returns the rules that accept the traffic of an exclusion
+// restricted to a port, in the direction of the exclusion. Exclusions without
+// a port are handled in the target set.
+func (i *Instance) exclusionRules(exclusion *policy.ExcludedIP) [][]string {
+
+	protocol := strings.ToLower(exclusion.Protocol)
+
+	rules := func(appPortFlag, netPortFlag string) [][]string {
+		return [][]string{
+			{
+				i.appPacketIPTableContext, i.appPacketIPTableSection,
+				"-d", exclusion.Address,
+				"-p", protocol, appPortFlag, exclusion.Port,
+				"-m", "comment", "--comment", "Trireme excluded IP",
+				"-j", "ACCEPT",
+			},
+			{
+				i.appAckPacketIPTableContext, i.appPacketIPTableSection,
+				"-d", exclusion.Address,
+				"-p", protocol, appPortFlag, exclusion.Port,
+				"-m", "comment", "--comment", "Trireme excluded IP",
+				"-j", "ACCEPT",
+			},
+			{
+				i.netPacketIPTableContext, i.netPacketIPTableSection,
+				"-s", exclusion.Address,
+				"-p", protocol, netPortFlag, exclusion.Port,
+				"-m", "comment", "--comment", "Trireme excluded IP",
+				"-j", "ACCEPT",
+			},
+		}
+	}
+
+	switch exclusion.Direction {
+	case policy.ExcludeOutgoing:
+		return rules("--dport", "--sport")
+	case policy.ExcludeIncoming:
+		return rules("--sport", "--dport")
+	default:
+		return append(rules("--dport", "--sport"), rules("--sport", "--dport")...)
+	}
+}
+
+// addExclusion adds an exclusion to the target set or, when it is restricted
+// to a port, as rules ahead of the trap rules
+func (i *Instance) addExclusion(exclusion *policy.ExcludedIP) error {
+
+	if exclusion.Port == "" {
+		return i.addIpsetOption(exclusion.Address)
+	}
+
+	for _, rule := range i.exclusionRules(exclusion) {
+		if err := i.ipt.Insert(rule[0], rule[1], 1, rule[2:]...); err != nil {
+			log.WithFields(log.Fields{
+				"package": "ipsetctrl",
+				"table":   rule[0],
+				"chain":   rule[1],
+				"error":   err.Error(),
+			}).Debug("Failed to add exclusion rule")
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteExclusion removes an exclusion added by addExclusion
+func (i *Instance) deleteExclusion(exclusion *policy.ExcludedIP) error {
 
-	rules := [][]string{
+	if exclusion.Port == "" {
+		return i.deleteIpsetOption(exclusion.Address)
+	}
+
+	for _, rule := range i.exclusionRules(exclusion) {
+		if err := i.ipt.Delete(rule[0], rule[1], rule[2:]...); err != nil {
+			log.WithFields(log.Fields{
+				"package": "ipsetctrl",
+				"table":   rule[0],
+				"chain":   rule[1],
+				"error":   err.Error(),
+			}).Debug("Failed to delete exclusion rule")
+			return err
+		}
+	}
+
+	return nil
+}
+
+// trapRules returns the rules sending the traffic between the PUs and the
+// networks of the set to the enforcer
+func (i *Instance) trapRules(set string) [][]string {
+
+	return [][]string{
 		// Application Syn and Syn/Ack in RAW
 		{
 			i.appPacketIPTableContext, i.appPacketIPTableSection,
@@ -346,9 +471,18 @@ func (i *Instance) setupTrapRules(set string) error {
 			"-j", "DROP",
 		},
 	}
+}
+
+// setupTrapRules
+func (i *Instance) setupTrapRules(set string) error {
 
 	fmt.Println("Going into the loop")
-	for _, tr := range rules {
+	for _, tr := range i.trapRules(set) {
+		// The rules are kept across restarts
+		if exists, err := i.ipt.Exists(tr[0], tr[1], tr[2:]...); err == nil && exists {
+			continue
+		}
+
 		if err := i.ipt.Append(tr[0], tr[1], tr[2:]...); err != nil {
 			log.WithFields(log.Fields{
 				"package": "supervisor",
@@ -361,6 +495,32 @@ func (i *Instance) setupTrapRules(set string) error {
 	return nil
 }
 
+// ruleMatchSet returns the name of the set matched by a rule as returned by iptables -S
+func ruleMatchSet(rule string) (string, bool) {
+
+	fields := strings.Fields(rule)
+	for i := 0; i < len(fields)-1; i++ {
+		if fields[i] == "--match-set" {
+			return fields[i+1], true
+		}
+	}
+
+	return "", false
+}
+
+// ruleAddress returns the address that follows the flag in a rule as returned by iptables -S
+func ruleAddress(rule string, flag string) (string, bool) {
+
+	fields := strings.Fields(rule)
+	for i := 0; i < len(fields)-1; i++ {
+		if fields[i] == flag {
+			return strings.TrimSuffix(fields[i+1], "/32"), true
+		}
+	}
+
+	return "", false
+}
+
 // cleanIPSets cleans all the ipsets
 func (i *Instance) cleanIPSets() error {
 
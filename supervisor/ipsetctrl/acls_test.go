@@ -635,6 +635,9 @@ func TestSetupTrapRules(t *testing.T) {
 
 		})
 		Convey("When I add the trap rules and iptables fails ", func() {
+			iptables.MockExists(t, func(table string, chain string, rulespec ...string) (bool, error) {
+				return false, nil
+			})
 			iptables.MockAppend(t, func(table string, chain string, rulespec ...string) error {
 				if matchSpec("ContainerSet", rulespec) {
 					return fmt.Errorf("Error")
@@ -651,3 +654,72 @@ func TestSetupTrapRules(t *testing.T) {
 
 	})
 }
+
+func TestAddExclusion(t *testing.T) {
+	Convey("Given an ipset controller with a valid target set", t, func() {
+		i, _ := NewInstance("0:1", "2:3", []string{"172.17.0.0/24"}, 0x1000, true)
+		iptables := provider.NewTestIptablesProvider()
+		i.ipt = iptables
+		ipsets := provider.NewTestIpsetProvider()
+		i.ips = ipsets
+
+		options := []string{}
+		ipsets.MockNewIpset(t, func(name string, hasht string, p *ipset.Params) (provider.Ipset, error) {
+			testset := provider.NewTestIpset()
+			testset.MockAddOption(t, func(entry string, option string, timeout int) error {
+				options = append(options, entry+" "+option)
+				return nil
+			})
+			return testset, nil
+		})
+
+		i.targetSet, _ = ipsets.NewIpset("target", "hash:net", &ipset.Params{})
+
+		rules := [][]string{}
+		iptables.MockInsert(t, func(table string, chain string, pos int, rulespec ...string) error {
+			rules = append(rules, append([]string{table, chain}, rulespec...))
+			return nil
+		})
+
+		Convey("When I add an exclusion without a port", func() {
+			err := i.addExclusion(policy.NewExcludedIP("10.10.0.0/16"))
+			Convey("It should be added to the target set as nomatch", func() {
+				So(err, ShouldBeNil)
+				So(options, ShouldResemble, []string{"10.10.0.0/16 nomatch"})
+				So(rules, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When I add an outgoing exclusion with a port", func() {
+			err := i.addExclusion(&policy.ExcludedIP{
+				Address:   "169.254.169.254",
+				Protocol:  "tcp",
+				Port:      "80",
+				Direction: policy.ExcludeOutgoing,
+			})
+			Convey("Rules for the port should be inserted", func() {
+				So(err, ShouldBeNil)
+				So(options, ShouldBeEmpty)
+				So(rules, ShouldResemble, [][]string{
+					{"raw", "OUTPUT", "-d", "169.254.169.254", "-p", "tcp", "--dport", "80", "-m", "comment", "--comment", "Trireme excluded IP", "-j", "ACCEPT"},
+					{"mangle", "OUTPUT", "-d", "169.254.169.254", "-p", "tcp", "--dport", "80", "-m", "comment", "--comment", "Trireme excluded IP", "-j", "ACCEPT"},
+					{"mangle", "INPUT", "-s", "169.254.169.254", "-p", "tcp", "--sport", "80", "-m", "comment", "--comment", "Trireme excluded IP", "-j", "ACCEPT"},
+				})
+			})
+		})
+
+		Convey("When I add an exclusion with a port and iptables fails", func() {
+			iptables.MockInsert(t, func(table string, chain string, pos int, rulespec ...string) error {
+				return fmt.Errorf("Error")
+			})
+			err := i.addExclusion(&policy.ExcludedIP{
+				Address:  "10.10.0.0/16",
+				Protocol: "udp",
+				Port:     "53",
+			})
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
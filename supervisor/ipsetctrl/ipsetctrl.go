@@ -3,6 +3,7 @@ package ipsetctrl
 import (
 	"fmt"
 	"strconv"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/aporeto-inc/trireme/policy"
@@ -64,14 +65,13 @@ func NewInstance(networkQueues, applicationQueues string, targetNetworks []strin
 	return i, nil
 }
 
-// DefaultIPAddress returns the default IP address for the processing unit
-func (i *Instance) defaultIP(addresslist map[string]string) (string, bool) {
+// ipAddresses returns all the IP addresses of the processing unit, starting
+// with the address of the default namespace
+func (i *Instance) ipAddresses(addresslist map[string]string) ([]string, bool) {
 
-	if ip, ok := addresslist[policy.DefaultNamespace]; ok {
-		return ip, true
-	}
+	addresses := policy.NewIPMap(addresslist).Addresses()
 
-	return "0.0.0.0/0", false
+	return addresses, len(addresses) > 0
 }
 
 // chainPrefix returns the chain name for the specific PU
@@ -90,13 +90,12 @@ func (i *Instance) ConfigureRules(version int, contextID string, policyrules *po
 		return fmt.Errorf("No policy rules provided -nil ")
 	}
 
-	// Currently processing only containers with one IP address
-	ipAddress, ok := i.defaultIP(policyrules.IPAddresses().IPs)
+	ipAddresses, ok := i.ipAddresses(policyrules.IPAddresses().IPs)
 	if !ok {
 		return fmt.Errorf("No ip address found")
 	}
 
-	if err := i.addAllRules(version, appSetPrefix, netSetPrefix, policyrules.IngressACLs(), policyrules.EgressACLs(), ipAddress); err != nil {
+	if err := i.addAllRules(version, appSetPrefix, netSetPrefix, policyrules.IngressACLs(), policyrules.EgressACLs(), ipAddresses); err != nil {
 		return err
 	}
 
@@ -108,16 +107,21 @@ func (i *Instance) DeleteRules(version int, contextID string, ipAddresses *polic
 
 	appSetPrefix, netSetPrefix := i.setPrefix(contextID)
 
-	// Currently processing only containers with one IP address
-	ipAddress, ok := i.defaultIP(ipAddresses.IPs)
+	if ipAddresses == nil {
+		return fmt.Errorf("Provided map of IP addresses is nil")
+	}
+
+	addresses, ok := i.ipAddresses(ipAddresses.IPs)
 	if !ok {
 		return fmt.Errorf("No ip address found")
 	}
 
-	i.delContainerFromSet(ipAddress)
+	for _, ipAddress := range addresses {
+		i.delContainerFromSet(ipAddress)
 
-	i.deleteAppSetRules(strconv.Itoa(version), appSetPrefix, ipAddress)
-	i.deleteNetSetRules(strconv.Itoa(version), netSetPrefix, ipAddress)
+		i.deleteAppSetRules(strconv.Itoa(version), appSetPrefix, ipAddress)
+		i.deleteNetSetRules(strconv.Itoa(version), netSetPrefix, ipAddress)
+	}
 
 	i.deleteSet(appSetPrefix + allowPrefix + strconv.Itoa(version))
 	i.deleteSet(appSetPrefix + rejectPrefix + strconv.Itoa(version))
@@ -133,20 +137,23 @@ func (i *Instance) UpdateRules(version int, contextID string, policyrules *polic
 
 	appSetPrefix, netSetPrefix := i.setPrefix(contextID)
 
-	// Currently processing only containers with one IP address
-	ipAddress, ok := i.defaultIP(policyrules.IPAddresses().IPs)
+	// The addresses of the PU are the same in both versions. The supervisor
+	// programs a new version from scratch when they change.
+	ipAddresses, ok := i.ipAddresses(policyrules.IPAddresses().IPs)
 	if !ok {
 		return fmt.Errorf("No ip address found")
 	}
 
-	if err := i.addAllRules(version, appSetPrefix, netSetPrefix, policyrules.IngressACLs(), policyrules.EgressACLs(), ipAddress); err != nil {
+	if err := i.addAllRules(version, appSetPrefix, netSetPrefix, policyrules.IngressACLs(), policyrules.EgressACLs(), ipAddresses); err != nil {
 		return err
 	}
 
 	previousVersion := strconv.Itoa(version - 1)
 
-	i.deleteAppSetRules(previousVersion, appSetPrefix, ipAddress)
-	i.deleteNetSetRules(previousVersion, netSetPrefix, ipAddress)
+	for _, ipAddress := range ipAddresses {
+		i.deleteAppSetRules(previousVersion, appSetPrefix, ipAddress)
+		i.deleteNetSetRules(previousVersion, netSetPrefix, ipAddress)
+	}
 
 	i.deleteSet(appSetPrefix + allowPrefix + previousVersion)
 	i.deleteSet(appSetPrefix + rejectPrefix + previousVersion)
@@ -157,12 +164,63 @@ func (i *Instance) UpdateRules(version int, contextID string, policyrules *polic
 
 }
 
-func (i *Instance) addAllRules(version int, appSetPrefix, netSetPrefix string, appACLs *policy.IPRuleList, netACLs *policy.IPRuleList, ip string) error {
+// VerifyRules implements the VerifyRules interface. It checks that the PU is
+// still in the container set, that its sets hold all the entries of the ACLs and
+// that the rules matching the sets are programmed.
+func (i *Instance) VerifyRules(version int, contextID string, policyrules *policy.PUPolicy) (bool, error) {
+
+	appSetPrefix, netSetPrefix := i.setPrefix(contextID)
+
+	if policyrules == nil {
+		return false, fmt.Errorf("No policy rules provided -nil ")
+	}
+
+	ipAddresses, ok := i.ipAddresses(policyrules.IPAddresses().IPs)
+	if !ok {
+		return false, fmt.Errorf("No ip address found")
+	}
+
+	if i.containerSet == nil {
+		return false, fmt.Errorf("Container set is nil. Invalid operation")
+	}
+
+	for _, ipAddress := range ipAddresses {
+		found, err := i.containerSet.Test(ipAddress)
+		if err != nil {
+			return false, fmt.Errorf("Couldn't test container set: %s", err)
+		}
+		if !found {
+			return true, nil
+		}
+	}
 
 	versionstring := strconv.Itoa(version)
 
-	if err := i.addContainerToSet(ip); err != nil {
-		return err
+	if drift, err := i.verifyACLSets(versionstring, appSetPrefix, policyrules.IngressACLs()); err != nil || drift {
+		return drift, err
+	}
+
+	if drift, err := i.verifyACLSets(versionstring, netSetPrefix, policyrules.EgressACLs()); err != nil || drift {
+		return drift, err
+	}
+
+	for _, ipAddress := range ipAddresses {
+		if drift, err := i.verifySetRules(versionstring, appSetPrefix, netSetPrefix, ipAddress); err != nil || drift {
+			return drift, err
+		}
+	}
+
+	return false, nil
+}
+
+func (i *Instance) addAllRules(version int, appSetPrefix, netSetPrefix string, appACLs *policy.IPRuleList, netACLs *policy.IPRuleList, ips []string) error {
+
+	versionstring := strconv.Itoa(version)
+
+	for _, ip := range ips {
+		if err := i.addContainerToSet(ip); err != nil {
+			return err
+		}
 	}
 
 	if err := i.createACLSets(versionstring, appSetPrefix, appACLs); err != nil {
@@ -173,17 +231,112 @@ func (i *Instance) addAllRules(version int, appSetPrefix, netSetPrefix string, a
 		return err
 	}
 
-	if err := i.addAppSetRules(versionstring, appSetPrefix, ip); err != nil {
-		return err
+	for _, ip := range ips {
+		if err := i.addAppSetRules(versionstring, appSetPrefix, ip); err != nil {
+			return err
+		}
+
+		if err := i.addNetSetRules(versionstring, netSetPrefix, ip); err != nil {
+			return err
+		}
 	}
 
-	if err := i.addNetSetRules(versionstring, netSetPrefix, ip); err != nil {
-		return err
+	return nil
+}
+
+// VerifyGlobalRules implements the VerifyGlobalRules interface. It checks the trap
+// rules and the rules of the exclusions restricted to a port. The other
+// exclusions are entries of the target set.
+func (i *Instance) VerifyGlobalRules(exclusions []*policy.ExcludedIP) (bool, error) {
+
+	rules := i.trapRules(triremeSet)
+	for _, exclusion := range exclusions {
+		if exclusion.Port != "" {
+			rules = append(rules, i.exclusionRules(exclusion)...)
+		}
 	}
+
+	for _, rule := range rules {
+		exists, err := i.ipt.Exists(rule[0], rule[1], rule[2:]...)
+		if err != nil {
+			return false, fmt.Errorf("Cannot check rule in chain %s: %s", rule[1], err)
+		}
+
+		if !exists {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// RecoverRules implements the RecoverRules interface. Every PU found in the rules
+// that match the application traffic against its allow set is reported once with
+// the addresses of all its rules.
+func (i *Instance) RecoverRules(adopt func(contextID string, version int, ips *policy.IPMap)) error {
+
+	rules, err := i.ipt.List(i.appAckPacketIPTableContext, i.appPacketIPTableSection)
+	if err != nil {
+		return fmt.Errorf("Cannot list rules of %s: %s", i.appPacketIPTableSection, err)
+	}
+
+	type recovered struct {
+		contextID string
+		version   int
+		ips       *policy.IPMap
+	}
+
+	found := map[string]*recovered{}
+	order := []string{}
+
+	for _, rule := range rules {
+		set, ok := ruleMatchSet(rule)
+		if !ok || !strings.HasPrefix(set, appChainPrefix) {
+			continue
+		}
+
+		name := strings.TrimPrefix(set, appChainPrefix)
+		sep := strings.LastIndex(name, "-"+allowPrefix)
+		if sep <= 0 {
+			continue
+		}
+
+		version, err := strconv.Atoi(name[sep+len(allowPrefix)+1:])
+		if err != nil {
+			continue
+		}
+
+		pu, ok := found[set]
+		if !ok {
+			pu = &recovered{
+				contextID: name[:sep],
+				version:   version,
+				ips:       policy.NewIPMap(nil),
+			}
+			found[set] = pu
+			order = append(order, set)
+		}
+
+		// The namespaces of the addresses are not known. The first one is
+		// recorded as the default one.
+		if ip, ok := ruleAddress(rule, "-s"); ok {
+			if _, ok := pu.ips.Get(policy.DefaultNamespace); !ok {
+				pu.ips.Add(policy.DefaultNamespace, ip)
+			} else {
+				pu.ips.Add(ip, ip)
+			}
+		}
+	}
+
+	for _, set := range order {
+		adopt(found[set].contextID, found[set].version, found[set].ips)
+	}
+
 	return nil
 }
 
-// Start implements the start of the interface
+// Start implements the start of the interface. Existing PU sets and rules are
+// left in place so that they can be recovered.
 func (i *Instance) Start() error {
 	if err := i.setupIpset(triremeSet, containerSet); err != nil {
 		return err
@@ -194,12 +347,17 @@ func (i *Instance) Start() error {
 	return nil
 }
 
-// Stop implements the stop interface
+// Stop implements the stop interface. The PU sets and rules are left in place
+// so that they are recovered when the supervisor is started again.
 func (i *Instance) Stop() error {
-	i.cleanACLs()
 	return nil
 }
 
+// CleanUp removes the sets and the rules of all the PUs
+func (i *Instance) CleanUp() error {
+	return i.cleanACLs()
+}
+
 func (i *Instance) cleanACLs() error {
 	log.WithFields(log.Fields{
 		"package": "ipsetctrl",
@@ -213,14 +371,14 @@ func (i *Instance) cleanACLs() error {
 	return nil
 }
 
-// AddExcludedIP implements the interface
-func (i *Instance) AddExcludedIP(ip string) error {
+// AddExclusion implements the interface
+func (i *Instance) AddExclusion(exclusion *policy.ExcludedIP) error {
 
-	return i.addIpsetOption(ip)
+	return i.addExclusion(exclusion)
 }
 
-// RemoveExcludedIP implements the interface
-func (i *Instance) RemoveExcludedIP(ip string) error {
+// RemoveExclusion implements the interface
+func (i *Instance) RemoveExclusion(exclusion *policy.ExcludedIP) error {
 
-	return i.deleteIpsetOption(ip)
+	return i.deleteExclusion(exclusion)
 }
@@ -49,41 +49,43 @@ func TestNewInstance(t *testing.T) {
 	})
 }
 
-func TestDefaultIP(t *testing.T) {
-	Convey("Given an iptables controller", t, func() {
+func TestIPAddresses(t *testing.T) {
+	Convey("Given an ipset controller", t, func() {
 		i, _ := NewInstance("0:1", "2:3", []string{"172.17.0.0/24"}, 0x1000, true)
-		Convey("When I get the default IP address of a list that has the default namespace", func() {
+		Convey("When I get the IP addresses of a list that has the default namespace", func() {
 			addresslist := map[string]string{
 				policy.DefaultNamespace: "10.1.1.1",
 			}
-			address, status := i.defaultIP(addresslist)
+			addresses, status := i.ipAddresses(addresslist)
 
 			Convey("I should get the right IP", func() {
-				So(address, ShouldResemble, "10.1.1.1")
+				So(addresses, ShouldResemble, []string{"10.1.1.1"})
 				So(status, ShouldBeTrue)
 			})
 		})
 
-		Convey("When I provide list with no matching default", func() {
-			addresslist := map[string]string{}
-			address, status := i.defaultIP(addresslist)
+		Convey("When I get the IP addresses of a PU attached to several networks", func() {
+			addresslist := map[string]string{
+				"frontend":              "10.2.2.2",
+				policy.DefaultNamespace: "10.1.1.1",
+				"backend":               "10.3.3.3",
+				"none":                  "",
+			}
+			addresses, status := i.ipAddresses(addresslist)
 
-			Convey("I should get back the default IP and false status", func() {
-				So(address, ShouldResemble, "0.0.0.0/0")
-				So(status, ShouldBeFalse)
+			Convey("I should get all the addresses starting with the default one", func() {
+				So(addresses, ShouldResemble, []string{"10.1.1.1", "10.3.3.3", "10.2.2.2"})
+				So(status, ShouldBeTrue)
 			})
 		})
-	})
-}
 
-func TestSetPrefix(t *testing.T) {
-	Convey("When I test the creation of the name of the chain", t, func() {
-		i, _ := NewInstance("0:1", "2:3", []string{"172.17.0.0/24"}, 0x1000, true)
-		Convey("With a contextID of Context and version of 1", func() {
-			app, net := i.setPrefix("Context")
-			Convey("I should get the right names", func() {
-				So(app, ShouldResemble, "TRIREME-App-Context-")
-				So(net, ShouldResemble, "TRIREME-Net-Context-")
+		Convey("When I provide list with no addresses", func() {
+			addresslist := map[string]string{}
+			addresses, status := i.ipAddresses(addresslist)
+
+			Convey("I should get no addresses and false status", func() {
+				So(addresses, ShouldBeEmpty)
+				So(status, ShouldBeFalse)
 			})
 		})
 	})
@@ -314,3 +316,152 @@ func TestUpdateRules(t *testing.T) {
 
 	})
 }
+
+func TestVerifyRules(t *testing.T) {
+	Convey("Given an ipset controller with programmed sets", t, func() {
+
+		i, _ := NewInstance("0:1", "2:3", []string{"172.17.0.0/24"}, 0x1000, true)
+		iptables := provider.NewTestIptablesProvider()
+		i.ipt = iptables
+		ipsets := provider.NewTestIpsetProvider()
+		i.ips = ipsets
+
+		rules := policy.NewIPRuleList([]policy.IPRule{
+			policy.IPRule{
+				Address:  "192.30.253.0/24",
+				Port:     "80",
+				Protocol: "TCP",
+				Action:   policy.Reject,
+			},
+
+			policy.IPRule{
+				Address:  "192.30.253.0/24",
+				Port:     "443",
+				Protocol: "TCP",
+				Action:   policy.Accept,
+			},
+		})
+
+		ipl := policy.NewIPMap(map[string]string{})
+		ipl.IPs[policy.DefaultNamespace] = "172.17.0.1"
+		policyrules := policy.NewPUPolicy("Context",
+			policy.Police,
+			rules,
+			rules,
+			nil,
+			nil,
+			nil,
+			nil, ipl, nil)
+
+		entries := map[string]map[string]bool{
+			"container":               {"172.17.0.1": true},
+			"TRIREME-App-context-A-1": {"192.30.253.0/24,443": true},
+			"TRIREME-App-context-R-1": {"192.30.253.0/24,80": true},
+			"TRIREME-Net-context-A-1": {"192.30.253.0/24,443": true},
+			"TRIREME-Net-context-R-1": {"192.30.253.0/24,80": true},
+		}
+
+		ipsets.MockNewIpset(t, func(name string, hasht string, p *ipset.Params) (provider.Ipset, error) {
+			testset := provider.NewTestIpset()
+			testset.MockTest(t, func(entry string) (bool, error) {
+				return entries[name][entry], nil
+			})
+			return testset, nil
+		})
+
+		i.containerSet, _ = ipsets.NewIpset("container", "hash:ip", &ipset.Params{})
+
+		iptables.MockExists(t, func(table string, chain string, rulespec ...string) (bool, error) {
+			return true, nil
+		})
+
+		Convey("When I verify rules that are all programmed", func() {
+			drift, err := i.VerifyRules(1, "context", policyrules)
+			Convey("I should get no drift", func() {
+				So(err, ShouldBeNil)
+				So(drift, ShouldBeFalse)
+			})
+		})
+
+		Convey("When the container was removed from the container set", func() {
+			delete(entries["container"], "172.17.0.1")
+			drift, err := i.VerifyRules(1, "context", policyrules)
+			Convey("I should get a drift", func() {
+				So(err, ShouldBeNil)
+				So(drift, ShouldBeTrue)
+			})
+		})
+
+		Convey("When an entry is missing from a set", func() {
+			delete(entries["TRIREME-Net-context-A-1"], "192.30.253.0/24,443")
+			drift, err := i.VerifyRules(1, "context", policyrules)
+			Convey("I should get a drift", func() {
+				So(err, ShouldBeNil)
+				So(drift, ShouldBeTrue)
+			})
+		})
+
+		Convey("When a rule matching the sets is missing", func() {
+			iptables.MockExists(t, func(table string, chain string, rulespec ...string) (bool, error) {
+				return !matchSpec("TRIREME-App-context-R-1", rulespec), nil
+			})
+			drift, err := i.VerifyRules(1, "context", policyrules)
+			Convey("I should get a drift", func() {
+				So(err, ShouldBeNil)
+				So(drift, ShouldBeTrue)
+			})
+		})
+
+		Convey("When the rules cannot be read", func() {
+			iptables.MockExists(t, func(table string, chain string, rulespec ...string) (bool, error) {
+				return false, fmt.Errorf("Error")
+			})
+			_, err := i.VerifyRules(1, "context", policyrules)
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestRecoverRules(t *testing.T) {
+	Convey("Given an ipset controller with programmed sets", t, func() {
+
+		i, _ := NewInstance("0:1", "2:3", []string{"172.17.0.0/24"}, 0x1000, true)
+		iptables := provider.NewTestIptablesProvider()
+		i.ipt = iptables
+
+		iptables.MockList(t, func(table string, chain string) ([]string, error) {
+			return []string{
+				"-P OUTPUT ACCEPT",
+				"-A OUTPUT -m set --match-set TriremeSet dst -j ACCEPT",
+				"-A OUTPUT -s 172.17.0.1/32 -m state --state NEW -m set --match-set TRIREME-App-Context-R-1 dst -j DROP",
+				"-A OUTPUT -s 172.17.0.1/32 -m state --state NEW -m set --match-set TRIREME-App-Context-A-1 dst -j ACCEPT",
+			}, nil
+		})
+
+		Convey("When I recover the rules", func() {
+			found := map[string]int{}
+			var address string
+			err := i.RecoverRules(func(contextID string, version int, ips *policy.IPMap) {
+				found[contextID] = version
+				address, _ = ips.Get(policy.DefaultNamespace)
+			})
+			Convey("I should get the PU with its version and address", func() {
+				So(err, ShouldBeNil)
+				So(found, ShouldResemble, map[string]int{"Context": 1})
+				So(address, ShouldEqual, "172.17.0.1")
+			})
+		})
+
+		Convey("When I recover the rules and they cannot be listed", func() {
+			iptables.MockList(t, func(table string, chain string) ([]string, error) {
+				return nil, fmt.Errorf("Error")
+			})
+			err := i.RecoverRules(func(contextID string, version int, ips *policy.IPMap) {})
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
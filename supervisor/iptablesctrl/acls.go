@@ -71,35 +71,59 @@ func (i *Instance) trapRules(appChain string, netChain string, network string, a
 	}
 }
 
-// exclusionChainRules provides the list of rules that are used to send traffic to
-// a particular chain
-func (i *Instance) exclusionChainRules(ip string) [][]string {
+// exclusionChainRules provides the list of rules that are used to accept the
+// traffic of an excluded network. Without a port, the exclusion applies in both
+// directions and the rules match all the connections. With a port, they only
+// match the connections to that port in the direction of the exclusion.
+func (i *Instance) exclusionChainRules(exclusion *policy.ExcludedIP) [][]string {
+
+	if exclusion.Port == "" || exclusion.Direction == policy.ExcludeOutgoing {
+		return i.exclusionRules(exclusion, "--dport", "--sport")
+	}
+
+	if exclusion.Direction == policy.ExcludeIncoming {
+		return i.exclusionRules(exclusion, "--sport", "--dport")
+	}
+
+	return append(i.exclusionRules(exclusion, "--dport", "--sport"), i.exclusionRules(exclusion, "--sport", "--dport")...)
+}
+
+// exclusionRules returns the rules of an exclusion with the port matched by the
+// given flags on the application and the network side
+func (i *Instance) exclusionRules(exclusion *policy.ExcludedIP, appPortFlag, netPortFlag string) [][]string {
+
+	protocol := strings.ToLower(exclusion.Protocol)
+
+	match := func(flag string, protocolRequired bool) []string {
+		spec := []string{}
+		if protocol != "" {
+			spec = append(spec, "-p", protocol)
+			if exclusion.Port != "" {
+				spec = append(spec, flag, exclusion.Port)
+			}
+		} else if protocolRequired {
+			spec = append(spec, "-p", "tcp")
+		}
+		return append(spec, "-m", "comment", "--comment", "Trireme excluded IP", "-j", "ACCEPT")
+	}
 
 	return [][]string{
-		{
+		append([]string{
 			i.appPacketIPTableContext,
 			i.appPacketIPTableSection,
-			"-d", ip,
-			"-m", "comment", "--comment", "Trireme excluded IP",
-			"-j", "ACCEPT",
-		},
-		{
+			"-d", exclusion.Address,
+		}, match(appPortFlag, false)...),
+		append([]string{
 			i.appAckPacketIPTableContext,
 			i.appPacketIPTableSection,
-			"-d", ip,
-			"-p", "tcp",
-			"-m", "comment", "--comment", "Trireme excluded IP",
-			"-j", "ACCEPT",
-		},
-		{
+			"-d", exclusion.Address,
+		}, match(appPortFlag, true)...),
+		append([]string{
 			i.netPacketIPTableContext,
 			i.netPacketIPTableSection,
-			"-s", ip,
-			"-m", "comment", "--comment", "Trireme excluded IP",
-			"-j", "ACCEPT",
-		},
+			"-s", exclusion.Address,
+		}, match(netPortFlag, false)...),
 	}
-
 }
 
 // addContainerChain adds a chain for the specific container and redirects traffic there
@@ -269,6 +293,44 @@ func (i *Instance) addAppACLs(chain string, ip string, rules *policy.IPRuleList)
 	return nil
 }
 
+// addACLs adds the ACLs of the policy to the chains of a PU. All the new flows
+// of a quarantined PU are dropped, while the default rules of the ACLs only
+// drop the new TCP flows.
+func (i *Instance) addACLs(appChain, netChain, ip string, policyrules *policy.PUPolicy) error {
+
+	if err := i.addAppACLs(appChain, ip, policyrules.IngressACLs()); err != nil {
+		return err
+	}
+
+	if err := i.addNetACLs(netChain, ip, policyrules.EgressACLs()); err != nil {
+		return err
+	}
+
+	if !policyrules.Quarantined() {
+		return nil
+	}
+
+	return i.processRulesFromList(i.quarantineRules(appChain, netChain), "Append")
+}
+
+// quarantineRules returns the rules dropping the new flows of every protocol in
+// the chains of a PU
+func (i *Instance) quarantineRules(appChain, netChain string) [][]string {
+
+	return [][]string{
+		{
+			i.appAckPacketIPTableContext, appChain,
+			"-m", "state", "--state", "NEW",
+			"-j", "DROP",
+		},
+		{
+			i.netPacketIPTableContext, netChain,
+			"-m", "state", "--state", "NEW",
+			"-j", "DROP",
+		},
+	}
+}
+
 // addNetACLs adds iptables rules that manage traffic from external services. The
 // explicit rules are added with the higest priority since they are direct allows.
 func (i *Instance) addNetACLs(chain, ip string, rules *policy.IPRuleList) error {
@@ -403,13 +465,27 @@ func (i *Instance) deleteAllContainerChains(appChain, netChain string) error {
 	return nil
 }
 
-func (i *Instance) acceptMarkedPackets() error {
-	table := i.appAckPacketIPTableContext
-	chain := i.appPacketIPTableSection
-	err := i.ipt.Insert(table, chain, 1,
+// markRule returns the rule accepting the packets marked by the enforcer
+func (i *Instance) markRule() []string {
+
+	return []string{
+		i.appAckPacketIPTableContext, i.appPacketIPTableSection,
 		"-m", "mark",
 		"--mark", strconv.Itoa(i.mark),
-		"-j", "ACCEPT")
+		"-j", "ACCEPT",
+	}
+}
+
+func (i *Instance) acceptMarkedPackets() error {
+	rule := i.markRule()
+	table, chain, rulespec := rule[0], rule[1], rule[2:]
+
+	// The rule is kept across restarts
+	if exists, err := i.ipt.Exists(table, chain, rulespec...); err == nil && exists {
+		return nil
+	}
+
+	err := i.ipt.Insert(table, chain, 1, rulespec...)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"package": "iptablesctrl",
@@ -422,10 +498,8 @@ func (i *Instance) acceptMarkedPackets() error {
 
 func (i *Instance) removeMarkRule() error {
 
-	i.ipt.Delete(i.appAckPacketIPTableContext, i.appPacketIPTableSection,
-		"-m", "mark",
-		"--mark", strconv.Itoa(i.mark),
-		"-j", "ACCEPT")
+	rule := i.markRule()
+	i.ipt.Delete(rule[0], rule[1], rule[2:]...)
 	return nil
 }
 
@@ -480,16 +554,64 @@ func (i *Instance) cleanACLSection(context, section, chainPrefix string) {
 	}
 }
 
+// parseChainName returns the context ID and the version of a PU chain name
+// without its prefix
+func parseChainName(name string) (string, int, error) {
+
+	sep := strings.LastIndex(name, "-")
+	if sep <= 0 {
+		return "", 0, fmt.Errorf("Invalid chain name %s", name)
+	}
+
+	version, err := strconv.Atoi(name[sep+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("Invalid version in chain name %s", name)
+	}
+
+	return name[:sep], version, nil
+}
+
+// ruleAddresses finds the rules that refer to target in a list of rules as
+// returned by iptables -S and returns the addresses that follow the flag
+func ruleAddresses(rules []string, target string, flag string) []string {
+
+	addresses := []string{}
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+
+		found := false
+		for _, field := range fields {
+			if field == target {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			continue
+		}
+
+		for i := 0; i < len(fields)-1; i++ {
+			if fields[i] == flag {
+				addresses = append(addresses, strings.TrimSuffix(fields[i+1], "/32"))
+				break
+			}
+		}
+	}
+
+	return addresses
+}
+
 // addExclusionChainRules adds exclusion chain rules
-func (i *Instance) addExclusionChainRules(ip string) error {
+func (i *Instance) addExclusionChainRules(exclusion *policy.ExcludedIP) error {
 
-	return i.processRulesFromList(i.exclusionChainRules(ip), "Insert")
+	return i.processRulesFromList(i.exclusionChainRules(exclusion), "Insert")
 
 }
 
 // deleteExclusionChainRules removes exclusion chain rules
-func (i *Instance) deleteExclusionChainRules(ip string) error {
+func (i *Instance) deleteExclusionChainRules(exclusion *policy.ExcludedIP) error {
 
-	return i.processRulesFromList(i.exclusionChainRules(ip), "Delete")
+	return i.processRulesFromList(i.exclusionChainRules(exclusion), "Delete")
 
 }
@@ -2,6 +2,7 @@ package iptablesctrl
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -565,6 +566,9 @@ func TestAcceptMarkedPackets(t *testing.T) {
 		i.ipt = iptables
 
 		Convey("When I install the rule for marked packets ", func() {
+			iptables.MockExists(t, func(table string, chain string, rulespec ...string) (bool, error) {
+				return false, nil
+			})
 			iptables.MockInsert(t, func(table string, chain string, pos int, rulespec ...string) error {
 				if matchSpec("mark", rulespec) == nil && matchSpec("--mark", rulespec) == nil && matchSpec("ACCEPT", rulespec) == nil {
 					return nil
@@ -578,6 +582,9 @@ func TestAcceptMarkedPackets(t *testing.T) {
 		})
 
 		Convey("When I install the rule for marked packets and it fails ", func() {
+			iptables.MockExists(t, func(table string, chain string, rulespec ...string) (bool, error) {
+				return false, nil
+			})
 			iptables.MockInsert(t, func(table string, chain string, pos int, rulespec ...string) error {
 				return fmt.Errorf("Error")
 			})
@@ -586,6 +593,16 @@ func TestAcceptMarkedPackets(t *testing.T) {
 				So(err, ShouldNotBeNil)
 			})
 		})
+
+		Convey("When the rule for marked packets is already installed ", func() {
+			iptables.MockInsert(t, func(table string, chain string, pos int, rulespec ...string) error {
+				return fmt.Errorf("Error")
+			})
+			err := i.acceptMarkedPackets()
+			Convey("I should get no error and the rule should not be inserted again", func() {
+				So(err, ShouldBeNil)
+			})
+		})
 	})
 }
 
@@ -641,6 +658,66 @@ func TestRemoveMarkRule(t *testing.T) {
 // 	})
 // }
 
+func TestExclusionChainRules(t *testing.T) {
+	Convey("Given an iptables controller", t, func() {
+		i, _ := NewInstance("0:1", "2:3", []string{"172.17.0.0/24"}, 0x1000, true)
+
+		Convey("When I get the rules of an exclusion without a port", func() {
+			rules := i.exclusionChainRules(policy.NewExcludedIP("10.10.0.0/16"))
+			Convey("The traffic from and to the network should be accepted", func() {
+				So(rules, ShouldResemble, [][]string{
+					{"raw", "OUTPUT", "-d", "10.10.0.0/16", "-m", "comment", "--comment", "Trireme excluded IP", "-j", "ACCEPT"},
+					{"mangle", "OUTPUT", "-d", "10.10.0.0/16", "-p", "tcp", "-m", "comment", "--comment", "Trireme excluded IP", "-j", "ACCEPT"},
+					{"mangle", "INPUT", "-s", "10.10.0.0/16", "-m", "comment", "--comment", "Trireme excluded IP", "-j", "ACCEPT"},
+				})
+			})
+		})
+
+		Convey("When I get the rules of an outgoing exclusion with a port", func() {
+			rules := i.exclusionChainRules(&policy.ExcludedIP{
+				Address:   "169.254.169.254",
+				Protocol:  "TCP",
+				Port:      "80",
+				Direction: policy.ExcludeOutgoing,
+			})
+			Convey("Only the connections to the port should be accepted", func() {
+				So(rules, ShouldResemble, [][]string{
+					{"raw", "OUTPUT", "-d", "169.254.169.254", "-p", "tcp", "--dport", "80", "-m", "comment", "--comment", "Trireme excluded IP", "-j", "ACCEPT"},
+					{"mangle", "OUTPUT", "-d", "169.254.169.254", "-p", "tcp", "--dport", "80", "-m", "comment", "--comment", "Trireme excluded IP", "-j", "ACCEPT"},
+					{"mangle", "INPUT", "-s", "169.254.169.254", "-p", "tcp", "--sport", "80", "-m", "comment", "--comment", "Trireme excluded IP", "-j", "ACCEPT"},
+				})
+			})
+		})
+
+		Convey("When I get the rules of an incoming exclusion with a port", func() {
+			rules := i.exclusionChainRules(&policy.ExcludedIP{
+				Address:   "10.10.0.0/16",
+				Protocol:  "udp",
+				Port:      "9100",
+				Direction: policy.ExcludeIncoming,
+			})
+			Convey("Only the connections from the network to the port should be accepted", func() {
+				So(rules, ShouldResemble, [][]string{
+					{"raw", "OUTPUT", "-d", "10.10.0.0/16", "-p", "udp", "--sport", "9100", "-m", "comment", "--comment", "Trireme excluded IP", "-j", "ACCEPT"},
+					{"mangle", "OUTPUT", "-d", "10.10.0.0/16", "-p", "udp", "--sport", "9100", "-m", "comment", "--comment", "Trireme excluded IP", "-j", "ACCEPT"},
+					{"mangle", "INPUT", "-s", "10.10.0.0/16", "-p", "udp", "--dport", "9100", "-m", "comment", "--comment", "Trireme excluded IP", "-j", "ACCEPT"},
+				})
+			})
+		})
+
+		Convey("When I get the rules of an exclusion with a port in both directions", func() {
+			rules := i.exclusionChainRules(&policy.ExcludedIP{
+				Address:  "10.10.0.0/16",
+				Protocol: "tcp",
+				Port:     "1000:2000",
+			})
+			Convey("The connections in both directions should be accepted", func() {
+				So(len(rules), ShouldEqual, 6)
+			})
+		})
+	})
+}
+
 func TestAddExclusionChainRules(t *testing.T) {
 	Convey("Given an iptables controller", t, func() {
 		i, _ := NewInstance("0:1", "2:3", []string{"172.17.0.0/24"}, 0x1000, false)
@@ -651,7 +728,7 @@ func TestAddExclusionChainRules(t *testing.T) {
 			iptables.MockInsert(t, func(table string, chain string, pos int, rulespec ...string) error {
 				return nil
 			})
-			err := i.addExclusionChainRules("172.17.0.1")
+			err := i.addExclusionChainRules(policy.NewExcludedIP("172.17.0.1"))
 			Convey("I should get no error", func() {
 				So(err, ShouldBeNil)
 			})
@@ -664,7 +741,7 @@ func TestAddExclusionChainRules(t *testing.T) {
 				}
 				return nil
 			})
-			err := i.addExclusionChainRules("172.17.0.1")
+			err := i.addExclusionChainRules(policy.NewExcludedIP("172.17.0.1"))
 			Convey("I should get  error", func() {
 				So(err, ShouldNotBeNil)
 			})
@@ -677,7 +754,7 @@ func TestAddExclusionChainRules(t *testing.T) {
 				}
 				return nil
 			})
-			err := i.addExclusionChainRules("172.17.0.1")
+			err := i.addExclusionChainRules(policy.NewExcludedIP("172.17.0.1"))
 			Convey("I should get  error", func() {
 				So(err, ShouldNotBeNil)
 			})
@@ -690,7 +767,7 @@ func TestAddExclusionChainRules(t *testing.T) {
 				}
 				return nil
 			})
-			err := i.addExclusionChainRules("172.17.0.1")
+			err := i.addExclusionChainRules(policy.NewExcludedIP("172.17.0.1"))
 			Convey("I should get  error", func() {
 				So(err, ShouldNotBeNil)
 			})
@@ -710,7 +787,7 @@ func TestDeleteExclusionChainRules(t *testing.T) {
 			iptables.MockDelete(t, func(table string, chain string, rulespec ...string) error {
 				return nil
 			})
-			err := i.deleteExclusionChainRules("172.17.0.1")
+			err := i.deleteExclusionChainRules(policy.NewExcludedIP("172.17.0.1"))
 			Convey("I should get no error", func() {
 				So(err, ShouldBeNil)
 			})
@@ -720,7 +797,7 @@ func TestDeleteExclusionChainRules(t *testing.T) {
 			iptables.MockDelete(t, func(table string, chain string, rulespec ...string) error {
 				return nil
 			})
-			err := i.deleteExclusionChainRules("172.17.0.1")
+			err := i.deleteExclusionChainRules(policy.NewExcludedIP("172.17.0.1"))
 			Convey("I should still get no error", func() {
 				So(err, ShouldBeNil)
 			})
@@ -729,3 +806,88 @@ func TestDeleteExclusionChainRules(t *testing.T) {
 	})
 
 }
+
+// batchChain returns the rules recorded in the batch for a chain, in the order
+// they are evaluated
+func batchChain(b *ruleBatch, table, chain string) [][]string {
+
+	rules := [][]string{}
+	for _, command := range b.tables[table].commands {
+		c, rulespec, ok := ruleSpec(command)
+		if !ok || c != chain {
+			continue
+		}
+
+		if command[0] == "-I" {
+			rules = append([][]string{rulespec}, rules...)
+			continue
+		}
+		rules = append(rules, rulespec)
+	}
+
+	return rules
+}
+
+// dropsNewFlow returns true if the first rule matching a new flow of the
+// protocol to any address drops it
+func dropsNewFlow(rules [][]string, protocol string) bool {
+
+	for _, rulespec := range rules {
+		matched := true
+		target := ""
+
+		for n := 0; n < len(rulespec)-1; n++ {
+			value := rulespec[n+1]
+			switch rulespec[n] {
+			case "-p":
+				matched = matched && value == protocol
+			case "--state":
+				matched = matched && strings.Contains(value, "NEW")
+			case "-d", "-s":
+				matched = matched && value == "0.0.0.0/0"
+			case "--dport", "--sport":
+				matched = false
+			case "-j":
+				target = value
+			}
+		}
+
+		if matched {
+			return target == "DROP"
+		}
+	}
+
+	return false
+}
+
+func TestQuarantineRules(t *testing.T) {
+	Convey("Given an iptables controller", t, func() {
+		i, _ := NewInstance("0:1", "2:3", []string{"172.17.0.0/24"}, 0x1000, true)
+
+		ipl := policy.NewIPMap(map[string]string{policy.DefaultNamespace: "172.17.0.1"})
+		p := policy.NewPUPolicy("Context", policy.Police, nil, nil, nil, nil, nil, nil, ipl, nil)
+		appChain, netChain := i.chainName("Context", 1)
+
+		Convey("When I program a PU that is not quarantined", func() {
+			b := newRuleBatch()
+			So(i.batch(b).addPURules("Context", appChain, netChain, p), ShouldBeNil)
+
+			Convey("Only its new TCP flows should be dropped by default", func() {
+				So(dropsNewFlow(batchChain(b, i.appAckPacketIPTableContext, appChain), "tcp"), ShouldBeTrue)
+				So(dropsNewFlow(batchChain(b, i.appAckPacketIPTableContext, appChain), "udp"), ShouldBeFalse)
+			})
+		})
+
+		Convey("When I program a quarantined PU", func() {
+			b := newRuleBatch()
+			So(i.batch(b).addPURules("Context", appChain, netChain, p.Quarantine()), ShouldBeNil)
+
+			Convey("Its new UDP and ICMP flows should be dropped in both directions", func() {
+				for _, protocol := range []string{"tcp", "udp", "icmp"} {
+					So(dropsNewFlow(batchChain(b, i.appAckPacketIPTableContext, appChain), protocol), ShouldBeTrue)
+					So(dropsNewFlow(batchChain(b, i.netPacketIPTableContext, netChain), protocol), ShouldBeTrue)
+				}
+			})
+		})
+	})
+}
@@ -0,0 +1,241 @@
+package iptablesctrl
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ruleBatch records iptables operations instead of executing them, and renders
+// them as an iptables-restore payload. It implements the IptablesProvider
+// interface so that the same rule helpers can be used to program a batch.
+type ruleBatch struct {
+	tables map[string]*tableBatch
+	order  []string
+}
+
+// tableBatch holds the operations recorded for a single table
+type tableBatch struct {
+	chains   []string
+	commands [][]string
+}
+
+// newRuleBatch returns an empty rule batch
+func newRuleBatch() *ruleBatch {
+	return &ruleBatch{
+		tables: map[string]*tableBatch{},
+		order:  []string{},
+	}
+}
+
+// table returns the batch of the given table, creating it if needed
+func (b *ruleBatch) table(table string) *tableBatch {
+
+	t, ok := b.tables[table]
+	if !ok {
+		t = &tableBatch{}
+		b.tables[table] = t
+		b.order = append(b.order, table)
+	}
+
+	return t
+}
+
+func (b *ruleBatch) record(table string, command ...string) {
+	t := b.table(table)
+	t.commands = append(t.commands, command)
+}
+
+// Append records an append operation
+func (b *ruleBatch) Append(table, chain string, rulespec ...string) error {
+	b.record(table, append([]string{"-A", chain}, rulespec...)...)
+	return nil
+}
+
+// Insert records an insert operation
+func (b *ruleBatch) Insert(table, chain string, pos int, rulespec ...string) error {
+	b.record(table, append([]string{"-I", chain, strconv.Itoa(pos)}, rulespec...)...)
+	return nil
+}
+
+// Delete records a delete operation
+func (b *ruleBatch) Delete(table, chain string, rulespec ...string) error {
+	b.record(table, append([]string{"-D", chain}, rulespec...)...)
+	return nil
+}
+
+// Exists is not supported by a batch since nothing is applied until the
+// payload is restored
+func (b *ruleBatch) Exists(table, chain string, rulespec ...string) (bool, error) {
+	return false, fmt.Errorf("Cannot check rules of a rule batch")
+}
+
+// List is not supported by a batch since nothing is applied until the
+// payload is restored
+func (b *ruleBatch) List(table, chain string) ([]string, error) {
+	return nil, fmt.Errorf("Cannot list rules of a rule batch")
+}
+
+// ListChains is not supported by a batch since nothing is applied until the
+// payload is restored
+func (b *ruleBatch) ListChains(table string) ([]string, error) {
+	return nil, fmt.Errorf("Cannot list chains of a rule batch")
+}
+
+// ClearChain records a flush operation
+func (b *ruleBatch) ClearChain(table, chain string) error {
+	b.record(table, "-F", chain)
+	return nil
+}
+
+// DeleteChain records a delete chain operation
+func (b *ruleBatch) DeleteChain(table, chain string) error {
+	b.record(table, "-X", chain)
+	return nil
+}
+
+// NewChain records the declaration of a new chain
+func (b *ruleBatch) NewChain(table, chain string) error {
+	t := b.table(table)
+	t.chains = append(t.chains, chain)
+	return nil
+}
+
+// payload renders the batch in the iptables-restore format. Tables are rendered
+// in the order they were first used and every table is terminated by a COMMIT.
+func (b *ruleBatch) payload() []byte {
+
+	var buffer bytes.Buffer
+
+	for _, name := range b.order {
+		t := b.tables[name]
+
+		buffer.WriteString("*" + name + "\n")
+
+		for _, chain := range t.chains {
+			buffer.WriteString(":" + chain + " - [0:0]\n")
+		}
+
+		for _, command := range t.commands {
+			args := make([]string, len(command))
+			for i, arg := range command {
+				args[i] = quoteArg(arg)
+			}
+			buffer.WriteString(strings.Join(args, " ") + "\n")
+		}
+
+		buffer.WriteString("COMMIT\n")
+	}
+
+	return buffer.Bytes()
+}
+
+// quoteArg quotes the arguments that iptables-restore would otherwise split
+func quoteArg(arg string) string {
+
+	if arg == "" || strings.ContainsAny(arg, " \t\"") {
+		return strconv.Quote(arg)
+	}
+
+	return arg
+}
+
+// ruleSpec returns the chain and the rule specification of an append or
+// insert command. It returns false for any other command.
+func ruleSpec(command []string) (string, []string, bool) {
+
+	switch command[0] {
+	case "-A":
+		return command[1], command[2:], true
+	case "-I":
+		return command[1], command[3:], true
+	default:
+		return "", nil, false
+	}
+}
+
+// batch returns a copy of the instance whose rule operations are recorded in
+// the given batch instead of being applied one at a time
+func (i *Instance) batch(b *ruleBatch) *Instance {
+
+	batched := *i
+	batched.ipt = b
+
+	return &batched
+}
+
+// verify reads back the programmed chains and rules and returns true if they
+// differ from the ones recorded in the batch. The chains created by the batch
+// must hold exactly the recorded rules.
+func (i *Instance) verify(b *ruleBatch) (bool, error) {
+
+	for _, table := range b.order {
+		t := b.tables[table]
+
+		chains, err := i.ipt.ListChains(table)
+		if err != nil {
+			return false, fmt.Errorf("Cannot list chains of table %s: %s", table, err)
+		}
+
+		existing := map[string]bool{}
+		for _, chain := range chains {
+			existing[chain] = true
+		}
+
+		for _, chain := range t.chains {
+			if !existing[chain] {
+				return true, nil
+			}
+		}
+
+		expected := map[string]int{}
+		for _, command := range t.commands {
+			chain, rulespec, ok := ruleSpec(command)
+			if !ok {
+				continue
+			}
+
+			expected[chain]++
+
+			exists, err := i.ipt.Exists(table, chain, rulespec...)
+			if err != nil {
+				return false, fmt.Errorf("Cannot check rule in chain %s: %s", chain, err)
+			}
+
+			if !exists {
+				return true, nil
+			}
+		}
+
+		for _, chain := range t.chains {
+			rules, err := i.ipt.List(table, chain)
+			if err != nil {
+				return false, fmt.Errorf("Cannot list rules of chain %s: %s", chain, err)
+			}
+
+			count := 0
+			for _, rule := range rules {
+				if strings.HasPrefix(rule, "-A ") {
+					count++
+				}
+			}
+
+			if count != expected[chain] {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// commit applies all the operations of a batch in a single iptables-restore call
+func (i *Instance) commit(b *ruleBatch) error {
+
+	if err := i.restore.Restore(b.payload()); err != nil {
+		return fmt.Errorf("Failed to program rules: %s", err)
+	}
+
+	return nil
+}
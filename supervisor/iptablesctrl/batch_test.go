@@ -0,0 +1,52 @@
+package iptablesctrl
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRuleBatch(t *testing.T) {
+	Convey("Given an empty rule batch", t, func() {
+		b := newRuleBatch()
+
+		Convey("When I render it", func() {
+			payload := b.payload()
+			Convey("The payload should be empty", func() {
+				So(payload, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When I record operations in several tables", func() {
+			So(b.Append("mangle", "INPUT", "-j", "chain"), ShouldBeNil)
+			So(b.NewChain("mangle", "chain"), ShouldBeNil)
+			So(b.Insert("raw", "chain", 1, "-m", "comment", "--comment", "a comment", "-j", "DROP"), ShouldBeNil)
+			So(b.NewChain("raw", "chain"), ShouldBeNil)
+			So(b.Delete("mangle", "INPUT", "-j", "oldchain"), ShouldBeNil)
+			So(b.ClearChain("mangle", "oldchain"), ShouldBeNil)
+			So(b.DeleteChain("mangle", "oldchain"), ShouldBeNil)
+
+			Convey("The payload should have one section per table in the order they were used", func() {
+				So(string(b.payload()), ShouldEqual, "*mangle\n"+
+					":chain - [0:0]\n"+
+					"-A INPUT -j chain\n"+
+					"-D INPUT -j oldchain\n"+
+					"-F oldchain\n"+
+					"-X oldchain\n"+
+					"COMMIT\n"+
+					"*raw\n"+
+					":chain - [0:0]\n"+
+					"-I chain 1 -m comment --comment \"a comment\" -j DROP\n"+
+					"COMMIT\n")
+			})
+		})
+
+		Convey("When I try to list the chains", func() {
+			chains, err := b.ListChains("mangle")
+			Convey("I should get an error", func() {
+				So(chains, ShouldBeNil)
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
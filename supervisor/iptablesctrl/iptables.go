@@ -3,9 +3,11 @@ package iptablesctrl
 import (
 	"fmt"
 	"strconv"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/aporeto-inc/trireme/policy"
+	"github.com/aporeto-inc/trireme/supervisor/cgroup"
 	"github.com/aporeto-inc/trireme/supervisor/provider"
 )
 
@@ -22,11 +24,13 @@ type Instance struct {
 	targetNetworks             []string
 	mark                       int
 	ipt                        provider.IptablesProvider
+	restore                    provider.IptablesRestoreProvider
 	appPacketIPTableContext    string
 	appAckPacketIPTableContext string
 	appPacketIPTableSection    string
 	netPacketIPTableContext    string
 	netPacketIPTableSection    string
+	cgroups                    cgroup.Manager
 }
 
 // NewInstance creates a new iptables controller instance
@@ -37,12 +41,18 @@ func NewInstance(networkQueues, applicationQueues string, targetNetworks []strin
 		return nil, fmt.Errorf("Cannot initialize IPtables provider")
 	}
 
+	restore, err := provider.NewGoIPTablesRestoreProvider()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot initialize IPtables restore provider")
+	}
+
 	i := &Instance{
 		networkQueues:     networkQueues,
 		applicationQueues: applicationQueues,
 		targetNetworks:    targetNetworks,
 		mark:              mark,
 		ipt:               ipt,
+		restore:           restore,
 		appPacketIPTableContext:    "raw",
 		appAckPacketIPTableContext: "mangle",
 		netPacketIPTableContext:    "mangle",
@@ -67,135 +77,307 @@ func (i *Instance) chainName(contextID string, version int) (app, net string) {
 	return app, net
 }
 
-// DefaultIPAddress returns the default IP address for the processing unit
-func (i *Instance) defaultIP(addresslist map[string]string) (string, bool) {
+// ipAddresses returns all the IP addresses of the processing unit, starting
+// with the address of the default namespace
+func (i *Instance) ipAddresses(addresslist map[string]string) ([]string, bool) {
 
-	if ip, ok := addresslist[policy.DefaultNamespace]; ok {
-		return ip, true
-	}
+	addresses := policy.NewIPMap(addresslist).Addresses()
 
-	return "0.0.0.0/0", false
+	return addresses, len(addresses) > 0
 }
 
 // ConfigureRules implmenets the ConfigureRules interface
 func (i *Instance) ConfigureRules(version int, contextID string, policyrules *policy.PUPolicy) error {
 
 	appChain, netChain := i.chainName(contextID, version)
-	// policyrules.DefaultIPAddress()
 
-	// Supporting only one ip
-	ipAddress, ok := i.defaultIP(policyrules.IPAddresses().IPs)
-	if !ok {
-		return fmt.Errorf("No ip address found ")
-	}
+	// Render all the ACLs in a single batch
+	b := newRuleBatch()
 
-	// Configure all the ACLs
-	if err := i.addContainerChain(appChain, netChain); err != nil {
+	if err := i.batch(b).addPURules(contextID, appChain, netChain, policyrules); err != nil {
 		return err
 	}
 
-	if err := i.addChainRules(appChain, netChain, ipAddress); err != nil {
-		return err
+	return i.commit(b)
+}
+
+// addPURules adds the chains and all the rules of a PU. The traffic of Linux
+// services is matched on their cgroup and the one of containers on their addresses.
+func (i *Instance) addPURules(contextID, appChain, netChain string, policyrules *policy.PUPolicy) error {
+
+	if i.cgroups != nil {
+		return i.addAllServerRules(contextID, appChain, netChain, policyrules)
 	}
 
-	if err := i.addPacketTrap(appChain, netChain, ipAddress); err != nil {
-		return err
+	ipAddresses, ok := i.ipAddresses(policyrules.IPAddresses().IPs)
+	if !ok {
+		return fmt.Errorf("No ip address found ")
 	}
 
-	if err := i.addAppACLs(appChain, ipAddress, policyrules.IngressACLs()); err != nil {
+	return i.addAllRules(appChain, netChain, ipAddresses, policyrules)
+}
+
+// addAllRules adds the chains and all the rules of a PU. The traffic of every
+// address of the PU is sent to its chains.
+func (i *Instance) addAllRules(appChain, netChain string, ipAddresses []string, policyrules *policy.PUPolicy) error {
+
+	if err := i.addContainerChain(appChain, netChain); err != nil {
 		return err
 	}
 
-	if err := i.addNetACLs(netChain, ipAddress, policyrules.EgressACLs()); err != nil {
+	for _, ipAddress := range ipAddresses {
+		if err := i.addChainRules(appChain, netChain, ipAddress); err != nil {
+			return err
+		}
+	}
+
+	if err := i.addPacketTrap(appChain, netChain, ipAddresses[0]); err != nil {
 		return err
 	}
 
-	return nil
+	return i.addACLs(appChain, netChain, ipAddresses[0], policyrules)
 }
 
 // DeleteRules implements the DeleteRules interface
 func (i *Instance) DeleteRules(version int, contextID string, ipAddresses *policy.IPMap) error {
 
-	// Supporting only one ip
+	if i.cgroups != nil {
+		appChain, netChain := i.chainName(contextID, version)
+
+		if err := i.deleteServerChainRules(appChain, netChain); err != nil {
+			log.WithFields(log.Fields{
+				"package":   "iptablesctrl",
+				"contextID": contextID,
+				"error":     err.Error(),
+			}).Debug("Failed to delete the server specific rules")
+		}
+
+		return i.deleteAllContainerChains(appChain, netChain)
+	}
+
 	if ipAddresses == nil {
 		return fmt.Errorf("Provided map of IP addresses is nil")
 	}
 
-	ipAddress, ok := i.defaultIP(ipAddresses.IPs)
+	addresses, ok := i.ipAddresses(ipAddresses.IPs)
 	if !ok {
 		return fmt.Errorf("No ip address found ")
 	}
 
 	appChain, netChain := i.chainName(contextID, version)
 
-	i.deleteChainRules(appChain, netChain, ipAddress)
+	for _, ipAddress := range addresses {
+		i.deleteChainRules(appChain, netChain, ipAddress)
+	}
 
 	i.deleteAllContainerChains(appChain, netChain)
 
 	return nil
 }
 
-// UpdateRules implements the update part of the interface
+// UpdateRules implements the update part of the interface. The new version is
+// programmed in one batch before the previous version is removed.
 func (i *Instance) UpdateRules(version int, contextID string, policyrules *policy.PUPolicy) error {
 
+	b := newRuleBatch()
+
+	if err := i.addUpdateRules(b, version, contextID, policyrules); err != nil {
+		return err
+	}
+
+	if err := i.commit(b); err != nil {
+		return err
+	}
+
+	i.deletePreviousRules(version, contextID, policyrules)
+
+	return nil
+}
+
+// UpdateRulesBatch updates the rules of several PUs with a single
+// iptables-restore. None of the updates is programmed if one of them fails.
+func (i *Instance) UpdateRulesBatch(versions map[string]int, policies map[string]*policy.PUPolicy) error {
+
+	b := newRuleBatch()
+
+	for contextID, policyrules := range policies {
+		if err := i.addUpdateRules(b, versions[contextID], contextID, policyrules); err != nil {
+			return fmt.Errorf("Cannot update the rules of %s: %s", contextID, err)
+		}
+	}
+
+	if err := i.commit(b); err != nil {
+		return err
+	}
+
+	for contextID, policyrules := range policies {
+		i.deletePreviousRules(versions[contextID], contextID, policyrules)
+	}
+
+	return nil
+}
+
+// deletePreviousRules removes the chains of the previous version of a PU once
+// its new version is programmed. The rules and chains that are already gone,
+// because they were flushed or were recovered with other addresses, are
+// ignored.
+func (i *Instance) deletePreviousRules(version int, contextID string, policyrules *policy.PUPolicy) {
+
+	if err := i.DeleteRules(version-1, contextID, policyrules.IPAddresses()); err != nil {
+		log.WithFields(log.Fields{
+			"package":   "iptablesctrl",
+			"contextID": contextID,
+			"version":   version - 1,
+			"error":     err.Error(),
+		}).Debug("Cannot delete the rules of the previous version")
+	}
+}
+
+// addUpdateRules records in the batch the chains of the new version of a PU
+func (i *Instance) addUpdateRules(b *ruleBatch, version int, contextID string, policyrules *policy.PUPolicy) error {
+
 	if policyrules == nil {
 		return fmt.Errorf("Policy rules cannot be nil")
 	}
 
-	// Supporting only one ip
-	ipAddress, ok := i.defaultIP(policyrules.IPAddresses().IPs)
+	if i.cgroups != nil {
+		return i.addServerUpdateRules(b, version, contextID, policyrules)
+	}
+
+	// The addresses of the PU are the same in both versions. The supervisor
+	// programs a new version from scratch when they change.
+	ipAddresses, ok := i.ipAddresses(policyrules.IPAddresses().IPs)
 	if !ok {
 		return fmt.Errorf("No ip address found ")
 	}
 
 	appChain, netChain := i.chainName(contextID, version)
 
-	oldAppChain, oldNetChain := i.chainName(contextID, version-1)
+	r := i.batch(b)
 
 	//Add a new chain for this update and map all rules there
-	if err := i.addContainerChain(appChain, netChain); err != nil {
+	if err := r.addContainerChain(appChain, netChain); err != nil {
 		return err
 	}
 
-	if err := i.addPacketTrap(appChain, netChain, ipAddress); err != nil {
+	if err := r.addPacketTrap(appChain, netChain, ipAddresses[0]); err != nil {
 		return err
 	}
 
-	if err := i.addAppACLs(appChain, ipAddress, policyrules.IngressACLs()); err != nil {
+	if err := r.addACLs(appChain, netChain, ipAddresses[0], policyrules); err != nil {
 		return err
 	}
 
-	if err := i.addNetACLs(netChain, ipAddress, policyrules.EgressACLs()); err != nil {
-		return err
+	for _, ipAddress := range ipAddresses {
+		// Add mapping to new chain
+		if err := r.addChainRules(appChain, netChain, ipAddress); err != nil {
+			return err
+		}
 	}
 
-	// Add mapping to new chain
-	if err := i.addChainRules(appChain, netChain, ipAddress); err != nil {
-		return err
+	return nil
+}
+
+// VerifyRules implements the VerifyRules interface. The rules expected for the
+// policy are rendered in a batch and compared with the programmed ones.
+func (i *Instance) VerifyRules(version int, contextID string, policyrules *policy.PUPolicy) (bool, error) {
+
+	if policyrules == nil {
+		return false, fmt.Errorf("Policy rules cannot be nil")
 	}
 
-	//Remove mapping from old chain
-	if err := i.deleteChainRules(oldAppChain, oldNetChain, ipAddress); err != nil {
-		return err
+	appChain, netChain := i.chainName(contextID, version)
+
+	b := newRuleBatch()
+
+	if err := i.batch(b).addPURules(contextID, appChain, netChain, policyrules); err != nil {
+		return false, err
 	}
 
-	// Delete the old chain to clean up
-	if err := i.deleteAllContainerChains(oldAppChain, oldNetChain); err != nil {
-		return err
+	return i.verify(b)
+}
+
+// VerifyGlobalRules implements the VerifyGlobalRules interface. It checks the rule
+// accepting the marked packets and the rules of the exclusions.
+func (i *Instance) VerifyGlobalRules(exclusions []*policy.ExcludedIP) (bool, error) {
+
+	rules := [][]string{i.markRule()}
+	for _, exclusion := range exclusions {
+		rules = append(rules, i.exclusionChainRules(exclusion)...)
+	}
+
+	return i.verifyRules(rules)
+}
+
+// verifyRules returns true if one of the rules is not programmed
+func (i *Instance) verifyRules(rules [][]string) (bool, error) {
+
+	for _, rule := range rules {
+		exists, err := i.ipt.Exists(rule[0], rule[1], rule[2:]...)
+		if err != nil {
+			return false, fmt.Errorf("Cannot check rule in chain %s: %s", rule[1], err)
+		}
+
+		if !exists {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// RecoverRules implements the RecoverRules interface. Every PU chain found in the
+// kernel is reported with the IP addresses of the rules that jump to it.
+func (i *Instance) RecoverRules(adopt func(contextID string, version int, ips *policy.IPMap)) error {
+
+	chains, err := i.ipt.ListChains(i.netPacketIPTableContext)
+	if err != nil {
+		return fmt.Errorf("Cannot list chains: %s", err)
+	}
+
+	rules, err := i.ipt.List(i.netPacketIPTableContext, i.netPacketIPTableSection)
+	if err != nil {
+		return fmt.Errorf("Cannot list rules of %s: %s", i.netPacketIPTableSection, err)
+	}
+
+	for _, chain := range chains {
+		if !strings.HasPrefix(chain, netChainPrefix) {
+			continue
+		}
+
+		contextID, version, err := parseChainName(strings.TrimPrefix(chain, netChainPrefix))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"package": "iptablesctrl",
+				"chain":   chain,
+			}).Debug("Ignoring chain with an invalid name")
+			continue
+		}
+
+		// The namespaces of the addresses are not known. The first one is
+		// recorded as the default one.
+		ips := policy.NewIPMap(nil)
+		for n, ip := range ruleAddresses(rules, chain, "-d") {
+			if n == 0 {
+				ips.Add(policy.DefaultNamespace, ip)
+				continue
+			}
+			ips.Add(ip, ip)
+		}
+
+		adopt(contextID, version, ips)
 	}
 
 	return nil
 }
 
-// Start starts the iptables controller
+// Start starts the iptables controller. Existing PU chains are left in place
+// so that they can be recovered.
 func (i *Instance) Start() error {
 	log.WithFields(log.Fields{
 		"package": "iptablesctrl",
 	}).Debug("Start the supervisor")
 
-	// Clean any previous ACLs
-	i.cleanACLs()
-
 	if i.acceptMarkedPackets() != nil {
 		log.WithFields(log.Fields{
 			"package": "supervisor",
@@ -207,25 +389,30 @@ func (i *Instance) Start() error {
 	return nil
 }
 
-// Stop stops the supervisor
+// Stop stops the supervisor. The PU chains are left in place so that they are
+// recovered when the supervisor is started again.
 func (i *Instance) Stop() error {
 	log.WithFields(log.Fields{
 		"package": "iptablesctrl",
 	}).Debug("Stop the supervisor")
 
-	// Clean any previous ACLs that we have installed
-	i.cleanACLs()
 	return nil
 }
 
-// AddExcludedIP adds an exception for the destination parameter IP, allowing all the traffic.
-func (i *Instance) AddExcludedIP(ip string) error {
+// CleanUp removes the chains and the rules of all the PUs and the mark rule
+func (i *Instance) CleanUp() error {
+
+	return i.cleanACLs()
+}
+
+// AddExclusion adds an exception for the network of the exclusion, allowing its traffic.
+func (i *Instance) AddExclusion(exclusion *policy.ExcludedIP) error {
 
-	return i.addExclusionChainRules(ip)
+	return i.addExclusionChainRules(exclusion)
 }
 
-// RemoveExcludedIP removes the exception for the destion IP given in parameter.
-func (i *Instance) RemoveExcludedIP(ip string) error {
+// RemoveExclusion removes the exception for the network of the exclusion.
+func (i *Instance) RemoveExclusion(exclusion *policy.ExcludedIP) error {
 
-	return i.deleteExclusionChainRules(ip)
+	return i.deleteExclusionChainRules(exclusion)
 }
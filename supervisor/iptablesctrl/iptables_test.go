@@ -2,6 +2,7 @@ package iptablesctrl
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/aporeto-inc/trireme/policy"
@@ -58,27 +59,42 @@ func TestChainName(t *testing.T) {
 	})
 }
 
-func TestDefaultIP(t *testing.T) {
+func TestIPAddresses(t *testing.T) {
 	Convey("Given an iptables controller", t, func() {
 		i, _ := NewInstance("0:1", "2:3", []string{"172.17.0.0/24"}, 0x1000, true)
-		Convey("When I get the default IP address of a list that has the default namespace", func() {
+		Convey("When I get the IP addresses of a list that has the default namespace", func() {
 			addresslist := map[string]string{
 				policy.DefaultNamespace: "10.1.1.1",
 			}
-			address, status := i.defaultIP(addresslist)
+			addresses, status := i.ipAddresses(addresslist)
 
 			Convey("I should get the right IP", func() {
-				So(address, ShouldResemble, "10.1.1.1")
+				So(addresses, ShouldResemble, []string{"10.1.1.1"})
 				So(status, ShouldBeTrue)
 			})
 		})
 
-		Convey("When I provide list with no matching default", func() {
+		Convey("When I get the IP addresses of a PU attached to several networks", func() {
+			addresslist := map[string]string{
+				"frontend":              "10.2.2.2",
+				policy.DefaultNamespace: "10.1.1.1",
+				"backend":               "10.3.3.3",
+				"none":                  "",
+			}
+			addresses, status := i.ipAddresses(addresslist)
+
+			Convey("I should get all the addresses starting with the default one", func() {
+				So(addresses, ShouldResemble, []string{"10.1.1.1", "10.3.3.3", "10.2.2.2"})
+				So(status, ShouldBeTrue)
+			})
+		})
+
+		Convey("When I provide list with no addresses", func() {
 			addresslist := map[string]string{}
-			address, status := i.defaultIP(addresslist)
+			addresses, status := i.ipAddresses(addresslist)
 
-			Convey("I should get back the default IP and false status", func() {
-				So(address, ShouldResemble, "0.0.0.0/0")
+			Convey("I should get no addresses and false status", func() {
+				So(addresses, ShouldBeEmpty)
 				So(status, ShouldBeFalse)
 			})
 		})
@@ -90,6 +106,8 @@ func TestConfigureRules(t *testing.T) {
 		i, _ := NewInstance("0:1", "2:3", []string{"172.17.0.0/24"}, 0x1000, true)
 		iptables := provider.NewTestIptablesProvider()
 		i.ipt = iptables
+		restore := provider.NewTestIptablesRestoreProvider()
+		i.restore = restore
 
 		rules := policy.NewIPRuleList([]policy.IPRule{
 			policy.IPRule{
@@ -120,16 +138,42 @@ func TestConfigureRules(t *testing.T) {
 				nil,
 				nil, ipl, nil)
 
-			iptables.MockAppend(t, func(table string, chain string, rulespec ...string) error {
+			var payload string
+			restore.MockRestore(t, func(p []byte) error {
+				payload = string(p)
 				return nil
 			})
+			iptables.MockAppend(t, func(table string, chain string, rulespec ...string) error {
+				return fmt.Errorf("Rules must not be applied one by one")
+			})
 			iptables.MockNewChain(t, func(table string, chain string) error {
-				return nil
+				return fmt.Errorf("Chains must not be created one by one")
 			})
 			err := i.ConfigureRules(1, "Context", policyrules)
 			Convey("It should succeed", func() {
 				So(err, ShouldBeNil)
 			})
+			Convey("All the rules should be applied in a single payload", func() {
+				So(payload, ShouldEqual, "*raw\n"+
+					":TRIREME-App-Context-1 - [0:0]\n"+
+					"-A OUTPUT -s 172.17.0.1 -m comment --comment \"Container specific chain\" -j TRIREME-App-Context-1\n"+
+					"-A TRIREME-App-Context-1 -d 172.17.0.0/24 -p tcp --tcp-flags FIN,SYN,RST,PSH,URG SYN -j NFQUEUE --queue-balance 2:3\n"+
+					"COMMIT\n"+
+					"*mangle\n"+
+					":TRIREME-App-Context-1 - [0:0]\n"+
+					":TRIREME-Net-Context-1 - [0:0]\n"+
+					"-A OUTPUT -s 172.17.0.1 -p tcp -m comment --comment \"Container specific chain\" -j TRIREME-App-Context-1\n"+
+					"-A INPUT -d 172.17.0.1 -m comment --comment \"Container specific chain\" -j TRIREME-Net-Context-1\n"+
+					"-A TRIREME-App-Context-1 -d 172.17.0.0/24 -p tcp --tcp-flags SYN,ACK ACK -m connbytes --connbytes :3 --connbytes-dir original --connbytes-mode packets -j NFQUEUE --queue-balance 2:3\n"+
+					"-A TRIREME-Net-Context-1 -s 172.17.0.0/24 -p tcp -m connbytes --connbytes :3 --connbytes-dir original --connbytes-mode packets -j NFQUEUE --queue-balance 0:1\n"+
+					"-I TRIREME-App-Context-1 1 -p TCP -m state --state NEW -d 192.30.253.0/24 --dport 80 -j DROP\n"+
+					"-A TRIREME-App-Context-1 -p TCP -m state --state NEW -d 192.30.253.0/24 --dport 443 -j ACCEPT\n"+
+					"-A TRIREME-App-Context-1 -d 0.0.0.0/0 -p tcp -m state --state NEW -j DROP\n"+
+					"-I TRIREME-Net-Context-1 1 -p TCP -s 192.30.253.0/24 --dport 80 -j DROP\n"+
+					"-A TRIREME-Net-Context-1 -p TCP -s 192.30.253.0/24 --dport 443 -j ACCEPT\n"+
+					"-A TRIREME-Net-Context-1 -s 0.0.0.0/0 -p tcp -m state --state NEW -j DROP\n"+
+					"COMMIT\n")
+			})
 
 		})
 
@@ -149,7 +193,7 @@ func TestConfigureRules(t *testing.T) {
 			})
 		})
 
-		Convey("With a set of policy rules and valid IP, where add container chain fails", func() {
+		Convey("With a set of policy rules and valid IP, where the restore fails", func() {
 
 			ipl := policy.NewIPMap(map[string]string{})
 			ipl.IPs[policy.DefaultNamespace] = "172.17.0.1"
@@ -162,11 +206,8 @@ func TestConfigureRules(t *testing.T) {
 				nil,
 				nil, ipl, nil)
 
-			iptables.MockAppend(t, func(table string, chain string, rulespec ...string) error {
-				return nil
-			})
-			iptables.MockNewChain(t, func(table string, chain string) error {
-				return fmt.Errorf("Failed to add container chain")
+			restore.MockRestore(t, func(payload []byte) error {
+				return fmt.Errorf("Failed to restore")
 			})
 			err := i.ConfigureRules(1, "Context", policyrules)
 			Convey("I should get an error ", func() {
@@ -175,31 +216,6 @@ func TestConfigureRules(t *testing.T) {
 
 		})
 
-		Convey("With a set of policy rules and valid IP, where add ACLs fails", func() {
-
-			ipl := policy.NewIPMap(map[string]string{})
-			ipl.IPs[policy.DefaultNamespace] = "172.17.0.1"
-			policyrules := policy.NewPUPolicy("Context",
-				policy.Police,
-				rules,
-				rules,
-				nil,
-				nil,
-				nil,
-				nil, ipl, nil)
-
-			iptables.MockAppend(t, func(table string, chain string, rulespec ...string) error {
-				return fmt.Errorf("Failed to add container chain")
-			})
-			iptables.MockNewChain(t, func(table string, chain string) error {
-				return nil
-			})
-			err := i.ConfigureRules(1, "Context", policyrules)
-			Convey("I should get an error ", func() {
-				So(err, ShouldNotBeNil)
-			})
-		})
-
 	})
 }
 
@@ -253,6 +269,8 @@ func TestUpdateRules(t *testing.T) {
 		i, _ := NewInstance("0:1", "2:3", []string{"172.17.0.0/24"}, 0x1000, true)
 		iptables := provider.NewTestIptablesProvider()
 		i.ipt = iptables
+		restore := provider.NewTestIptablesRestoreProvider()
+		i.restore = restore
 
 		rules := policy.NewIPRuleList([]policy.IPRule{
 			policy.IPRule{
@@ -296,44 +314,87 @@ func TestUpdateRules(t *testing.T) {
 		})
 
 		Convey("I try to update with a valid default IP address ", func() {
+			var payload string
+			steps := []string{}
+			restore.MockRestore(t, func(p []byte) error {
+				payload = string(p)
+				steps = append(steps, "restore")
+				return nil
+			})
 			iptables.MockDelete(t, func(table string, chain string, rulespec ...string) error {
-				if matchSpec("TRIREME-App-Context-0", rulespec) == nil || matchSpec("TRIREME-Net-Context-0", rulespec) == nil {
-					return nil
-				}
-				return fmt.Errorf("Error")
+				steps = append(steps, "-D "+chain+" "+strings.Join(rulespec, " "))
+				return nil
 			})
 			iptables.MockClearChain(t, func(table string, chain string) error {
-				if chain == "TRIREME-App-Context-0" || chain == "TRIREME-Net-Context-0" {
-					return nil
-				}
-				return fmt.Errorf("Error")
+				steps = append(steps, "-F "+chain)
+				return nil
 			})
 			iptables.MockDeleteChain(t, func(table string, chain string) error {
-				if chain == "TRIREME-App-Context-0" || chain == "TRIREME-Net-Context-0" {
-					return nil
-				}
-				return fmt.Errorf("Error")
+				steps = append(steps, "-X "+chain)
+				return nil
 			})
-			iptables.MockAppend(t, func(table string, chain string, rulespec ...string) error {
-				if chain == "TRIREME-App-Context-1" || chain == "TRIREME-Net-Context-1" {
-					return nil
-				}
-				if matchSpec("TRIREME-App-Context-1", rulespec) == nil || matchSpec("TRIREME-Net-Context-1", rulespec) == nil {
-					return nil
-				}
-				return fmt.Errorf("Error")
+
+			ipl := policy.NewIPMap(map[string]string{})
+			ipl.IPs[policy.DefaultNamespace] = "172.17.0.1"
+			policyrules := policy.NewPUPolicy("Context",
+				policy.Police,
+				rules,
+				rules,
+				nil,
+				nil,
+				nil,
+				nil, ipl, nil)
+
+			err := i.UpdateRules(1, "Context", policyrules)
+			Convey("I should get no error", func() {
+				So(err, ShouldBeNil)
 			})
-			iptables.MockInsert(t, func(table string, chain string, pos int, rulespec ...string) error {
-				if chain == "TRIREME-App-Context-1" || chain == "TRIREME-Net-Context-1" {
-					return nil
-				}
-				return fmt.Errorf("Error")
+			Convey("The new chains should be programmed in one payload before the old ones are removed", func() {
+				So(payload, ShouldContainSubstring, ":TRIREME-App-Context-1 - [0:0]\n")
+				So(payload, ShouldContainSubstring, ":TRIREME-Net-Context-1 - [0:0]\n")
+				So(payload, ShouldContainSubstring, "-A INPUT -d 172.17.0.1 -m comment --comment \"Container specific chain\" -j TRIREME-Net-Context-1\n")
+				So(payload, ShouldNotContainSubstring, "Context-0")
+				So(steps[0], ShouldEqual, "restore")
+				So(steps, ShouldContain, "-D INPUT -d 172.17.0.1 -m comment --comment Container specific chain -j TRIREME-Net-Context-0")
+				So(steps, ShouldContain, "-X TRIREME-Net-Context-0")
+				So(steps, ShouldContain, "-X TRIREME-App-Context-0")
 			})
-			iptables.MockNewChain(t, func(table string, chain string) error {
-				if chain == "TRIREME-App-Context-1" || chain == "TRIREME-Net-Context-1" {
-					return nil
-				}
-				return fmt.Errorf("Error")
+		})
+
+		Convey("I try to update and the chains of the previous version are gone", func() {
+			restore.MockRestore(t, func(p []byte) error {
+				return nil
+			})
+			iptables.MockDelete(t, func(table string, chain string, rulespec ...string) error {
+				return fmt.Errorf("Bad rule (does a matching rule exist in that chain?)")
+			})
+			iptables.MockClearChain(t, func(table string, chain string) error {
+				return fmt.Errorf("No chain/target/match by that name")
+			})
+			iptables.MockDeleteChain(t, func(table string, chain string) error {
+				return fmt.Errorf("No chain/target/match by that name")
+			})
+
+			ipl := policy.NewIPMap(map[string]string{})
+			ipl.IPs[policy.DefaultNamespace] = "172.17.0.1"
+			policyrules := policy.NewPUPolicy("Context",
+				policy.Police,
+				rules,
+				rules,
+				nil,
+				nil,
+				nil,
+				nil, ipl, nil)
+
+			err := i.UpdateRules(1, "Context", policyrules)
+			Convey("I should get no error", func() {
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("I try to update and the restore fails", func() {
+			restore.MockRestore(t, func(p []byte) error {
+				return fmt.Errorf("Failed to restore")
 			})
 
 			ipl := policy.NewIPMap(map[string]string{})
@@ -348,11 +409,275 @@ func TestUpdateRules(t *testing.T) {
 				nil, ipl, nil)
 
 			err := i.UpdateRules(1, "Context", policyrules)
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+	})
+}
+
+func TestUpdateRulesBatch(t *testing.T) {
+	Convey("Given an iptables controllers", t, func() {
+		i, _ := NewInstance("0:1", "2:3", []string{"172.17.0.0/24"}, 0x1000, true)
+		iptables := provider.NewTestIptablesProvider()
+		i.ipt = iptables
+		restore := provider.NewTestIptablesRestoreProvider()
+		i.restore = restore
+
+		restores := 0
+		var payload string
+		restore.MockRestore(t, func(p []byte) error {
+			restores++
+			payload = string(p)
+			return nil
+		})
+		deleted := map[string]bool{}
+		iptables.MockDeleteChain(t, func(table string, chain string) error {
+			deleted[chain] = true
+			return nil
+		})
+
+		policies := map[string]*policy.PUPolicy{}
+		for contextID, ip := range map[string]string{"First": "172.17.0.1", "Second": "172.17.0.2"} {
+			ipl := policy.NewIPMap(map[string]string{policy.DefaultNamespace: ip})
+			policies[contextID] = policy.NewPUPolicy(contextID, policy.Police, nil, nil, nil, nil, nil, nil, ipl, nil)
+		}
+
+		Convey("When I update the rules of several PUs", func() {
+			err := i.UpdateRulesBatch(map[string]int{"First": 1, "Second": 3}, policies)
+
 			Convey("I should get no error", func() {
 				So(err, ShouldBeNil)
 			})
+
+			Convey("All the updates should be in a single payload and the old chains should be removed", func() {
+				So(restores, ShouldEqual, 1)
+				So(payload, ShouldContainSubstring, "-A INPUT -d 172.17.0.1 -m comment --comment \"Container specific chain\" -j TRIREME-Net-First-1\n")
+				So(payload, ShouldContainSubstring, "-A INPUT -d 172.17.0.2 -m comment --comment \"Container specific chain\" -j TRIREME-Net-Second-3\n")
+				So(deleted, ShouldContainKey, "TRIREME-Net-First-0")
+				So(deleted, ShouldContainKey, "TRIREME-Net-Second-2")
+			})
 		})
 
+		Convey("When the policy of one of the PUs is invalid", func() {
+			policies["Second"] = policy.NewPUPolicy("Second", policy.Police, nil, nil, nil, nil, nil, nil, policy.NewIPMap(map[string]string{}), nil)
+			err := i.UpdateRulesBatch(map[string]int{"First": 1, "Second": 3}, policies)
+
+			Convey("I should get an error and nothing should be programmed", func() {
+				So(err, ShouldNotBeNil)
+				So(restores, ShouldEqual, 0)
+				So(deleted, ShouldBeEmpty)
+			})
+		})
+	})
+}
+
+func TestVerifyRules(t *testing.T) {
+	Convey("Given an iptables controller", t, func() {
+		i, _ := NewInstance("0:1", "2:3", []string{"172.17.0.0/24"}, 0x1000, true)
+		iptables := provider.NewTestIptablesProvider()
+		i.ipt = iptables
+
+		rules := policy.NewIPRuleList([]policy.IPRule{
+			policy.IPRule{
+				Address:  "192.30.253.0/24",
+				Port:     "80",
+				Protocol: "TCP",
+				Action:   policy.Reject,
+			},
+
+			policy.IPRule{
+				Address:  "192.30.253.0/24",
+				Port:     "443",
+				Protocol: "TCP",
+				Action:   policy.Accept,
+			},
+		})
+
+		ipl := policy.NewIPMap(map[string]string{})
+		ipl.IPs[policy.DefaultNamespace] = "172.17.0.1"
+		policyrules := policy.NewPUPolicy("Context",
+			policy.Police,
+			rules,
+			rules,
+			nil,
+			nil,
+			nil,
+			nil, ipl, nil)
+
+		// Number of rules programmed in the PU chains
+		programmed := map[string]int{
+			"raw/TRIREME-App-Context-1":    1,
+			"mangle/TRIREME-App-Context-1": 4,
+			"mangle/TRIREME-Net-Context-1": 4,
+		}
+
+		iptables.MockListChains(t, func(table string) ([]string, error) {
+			return []string{"INPUT", "OUTPUT", "TRIREME-App-Context-1", "TRIREME-Net-Context-1"}, nil
+		})
+		iptables.MockExists(t, func(table string, chain string, rulespec ...string) (bool, error) {
+			return true, nil
+		})
+		iptables.MockList(t, func(table string, chain string) ([]string, error) {
+			list := []string{"-N " + chain}
+			for n := 0; n < programmed[table+"/"+chain]; n++ {
+				list = append(list, "-A "+chain+" -j ACCEPT")
+			}
+			return list, nil
+		})
+
+		Convey("When I verify with a nil policy", func() {
+			_, err := i.VerifyRules(1, "Context", nil)
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When I verify rules that are all programmed", func() {
+			drift, err := i.VerifyRules(1, "Context", policyrules)
+			Convey("I should get no drift", func() {
+				So(err, ShouldBeNil)
+				So(drift, ShouldBeFalse)
+			})
+		})
+
+		Convey("When a chain of the PU is missing", func() {
+			iptables.MockListChains(t, func(table string) ([]string, error) {
+				return []string{"INPUT", "OUTPUT", "TRIREME-App-Context-1"}, nil
+			})
+			drift, err := i.VerifyRules(1, "Context", policyrules)
+			Convey("I should get a drift", func() {
+				So(err, ShouldBeNil)
+				So(drift, ShouldBeTrue)
+			})
+		})
+
+		Convey("When a rule of the PU is missing", func() {
+			iptables.MockExists(t, func(table string, chain string, rulespec ...string) (bool, error) {
+				return matchSpec("ACCEPT", rulespec) != nil, nil
+			})
+			drift, err := i.VerifyRules(1, "Context", policyrules)
+			Convey("I should get a drift", func() {
+				So(err, ShouldBeNil)
+				So(drift, ShouldBeTrue)
+			})
+		})
+
+		Convey("When a rule was added to a chain of the PU", func() {
+			programmed["mangle/TRIREME-Net-Context-1"] = 5
+			drift, err := i.VerifyRules(1, "Context", policyrules)
+			Convey("I should get a drift", func() {
+				So(err, ShouldBeNil)
+				So(drift, ShouldBeTrue)
+			})
+		})
+
+		Convey("When the chains cannot be read", func() {
+			iptables.MockListChains(t, func(table string) ([]string, error) {
+				return nil, fmt.Errorf("Error")
+			})
+			_, err := i.VerifyRules(1, "Context", policyrules)
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestVerifyGlobalRules(t *testing.T) {
+	Convey("Given an iptables controller with an exclusion", t, func() {
+		i, _ := NewInstance("0:1", "2:3", []string{"172.17.0.0/24"}, 0x1000, true)
+		iptables := provider.NewTestIptablesProvider()
+		i.ipt = iptables
+
+		exclusions := []*policy.ExcludedIP{policy.NewExcludedIP("10.10.0.0/16")}
+
+		Convey("When all the global rules are programmed", func() {
+			iptables.MockExists(t, func(table string, chain string, rulespec ...string) (bool, error) {
+				return true, nil
+			})
+			drift, err := i.VerifyGlobalRules(exclusions)
+			Convey("I should get no drift", func() {
+				So(err, ShouldBeNil)
+				So(drift, ShouldBeFalse)
+			})
+		})
+
+		Convey("When the mark rule is missing", func() {
+			iptables.MockExists(t, func(table string, chain string, rulespec ...string) (bool, error) {
+				return matchSpec("--mark", rulespec) != nil, nil
+			})
+			drift, err := i.VerifyGlobalRules(exclusions)
+			Convey("I should get a drift", func() {
+				So(err, ShouldBeNil)
+				So(drift, ShouldBeTrue)
+			})
+		})
+
+		Convey("When a rule of the exclusion is missing", func() {
+			iptables.MockExists(t, func(table string, chain string, rulespec ...string) (bool, error) {
+				return matchSpec("10.10.0.0/16", rulespec) != nil, nil
+			})
+			drift, err := i.VerifyGlobalRules(exclusions)
+			Convey("I should get a drift", func() {
+				So(err, ShouldBeNil)
+				So(drift, ShouldBeTrue)
+			})
+		})
+
+		Convey("When the rules cannot be read", func() {
+			iptables.MockExists(t, func(table string, chain string, rulespec ...string) (bool, error) {
+				return false, fmt.Errorf("Error")
+			})
+			_, err := i.VerifyGlobalRules(exclusions)
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestRecoverRules(t *testing.T) {
+	Convey("Given an iptables controller with programmed PU chains", t, func() {
+		i, _ := NewInstance("0:1", "2:3", []string{"172.17.0.0/24"}, 0x1000, true)
+		iptables := provider.NewTestIptablesProvider()
+		i.ipt = iptables
+
+		iptables.MockListChains(t, func(table string) ([]string, error) {
+			return []string{"INPUT", "TRIREME-App-Context-1", "TRIREME-Net-Context-1", "TRIREME-Net-Other-2", "TRIREME-Net-Invalid"}, nil
+		})
+		iptables.MockList(t, func(table string, chain string) ([]string, error) {
+			return []string{
+				"-P INPUT ACCEPT",
+				"-A INPUT -d 172.17.0.1/32 -m comment --comment \"Container specific chain\" -j TRIREME-Net-Context-1",
+			}, nil
+		})
+
+		Convey("When I recover the rules", func() {
+			found := map[string]int{}
+			addresses := map[string]string{}
+			err := i.RecoverRules(func(contextID string, version int, ips *policy.IPMap) {
+				found[contextID] = version
+				addresses[contextID], _ = ips.Get(policy.DefaultNamespace)
+			})
+			Convey("I should get every PU with its version and address", func() {
+				So(err, ShouldBeNil)
+				So(found, ShouldResemble, map[string]int{"Context": 1, "Other": 2})
+				So(addresses["Context"], ShouldEqual, "172.17.0.1")
+				So(addresses["Other"], ShouldEqual, "")
+			})
+		})
+
+		Convey("When I recover the rules and the chains cannot be listed", func() {
+			iptables.MockListChains(t, func(table string) ([]string, error) {
+				return nil, fmt.Errorf("Error")
+			})
+			err := i.RecoverRules(func(contextID string, version int, ips *policy.IPMap) {})
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
 	})
 }
 
@@ -382,6 +707,9 @@ func TestStart(t *testing.T) {
 		})
 
 		Convey("When I start the controller and I fail to insert the mark rule", func() {
+			iptables.MockExists(t, func(table string, chain string, rulespec ...string) (bool, error) {
+				return false, nil
+			})
 			iptables.MockInsert(t, func(table string, chain string, pos int, rulespec ...string) error {
 				return fmt.Errorf("Error")
 			})
@@ -408,14 +736,58 @@ func TestStop(t *testing.T) {
 		iptables := provider.NewTestIptablesProvider()
 		i.ipt = iptables
 
-		Convey("When I stop the controller, I should get no error ", func() {
+		Convey("When I stop the controller, I should get no error and the chains should be kept", func() {
+			removed := []string{}
+			iptables.MockClearChain(t, func(table string, chain string) error {
+				removed = append(removed, chain)
+				return nil
+			})
+			iptables.MockDeleteChain(t, func(table string, chain string) error {
+				removed = append(removed, chain)
+				return nil
+			})
+			iptables.MockDelete(t, func(table string, chain string, rulespec ...string) error {
+				removed = append(removed, chain)
+				return nil
+			})
+
 			err := i.Stop()
 			So(err, ShouldBeNil)
+			So(removed, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestCleanUp(t *testing.T) {
+	Convey("Given an iptables controller with programmed PU chains", t, func() {
+		i, _ := NewInstance("0:1", "2:3", []string{"172.17.0.0/24"}, 0x1000, true)
+		iptables := provider.NewTestIptablesProvider()
+		i.ipt = iptables
+
+		iptables.MockListChains(t, func(table string) ([]string, error) {
+			return []string{"INPUT", "TRIREME-App-Context-1", "TRIREME-Net-Context-1"}, nil
+		})
+
+		Convey("When I clean up the controller, the PU chains should be removed", func() {
+			deleted := map[string]bool{}
+			iptables.MockClearChain(t, func(table string, chain string) error {
+				return nil
+			})
+			iptables.MockDeleteChain(t, func(table string, chain string) error {
+				deleted[chain] = true
+				return nil
+			})
+			iptables.MockDelete(t, func(table string, chain string, rulespec ...string) error {
+				return nil
+			})
+
+			So(i.CleanUp(), ShouldBeNil)
+			So(deleted, ShouldResemble, map[string]bool{"TRIREME-App-Context-1": true, "TRIREME-Net-Context-1": true})
 		})
 	})
 }
 
-func TestAddExcludedIP(t *testing.T) {
+func TestAddExclusion(t *testing.T) {
 	Convey("Given an iptables controller", t, func() {
 		i, _ := NewInstance("0:1", "2:3", []string{"172.17.0.0/24"}, 0x1000, true)
 		iptables := provider.NewTestIptablesProvider()
@@ -429,7 +801,7 @@ func TestAddExcludedIP(t *testing.T) {
 				return fmt.Errorf("Error")
 			})
 
-			err := i.AddExcludedIP("10.1.1.0")
+			err := i.AddExclusion(policy.NewExcludedIP("10.1.1.0"))
 			Convey("I should get no error", func() {
 				So(err, ShouldBeNil)
 			})
@@ -440,7 +812,7 @@ func TestAddExcludedIP(t *testing.T) {
 				return fmt.Errorf("Error")
 			})
 
-			err := i.AddExcludedIP("10.1.1.0")
+			err := i.AddExclusion(policy.NewExcludedIP("10.1.1.0"))
 			Convey("I should get  error", func() {
 				So(err, ShouldNotBeNil)
 			})
@@ -449,7 +821,7 @@ func TestAddExcludedIP(t *testing.T) {
 	})
 }
 
-func TestRemoveExcludedIP(t *testing.T) {
+func TestRemoveExclusion(t *testing.T) {
 	Convey("Given an iptables controller", t, func() {
 		i, _ := NewInstance("0:1", "2:3", []string{"172.17.0.0/24"}, 0x1000, true)
 		iptables := provider.NewTestIptablesProvider()
@@ -463,7 +835,7 @@ func TestRemoveExcludedIP(t *testing.T) {
 				return fmt.Errorf("Error")
 			})
 
-			err := i.RemoveExcludedIP("10.1.1.0")
+			err := i.RemoveExclusion(policy.NewExcludedIP("10.1.1.0"))
 			Convey("I should get no error", func() {
 				So(err, ShouldBeNil)
 			})
@@ -474,7 +846,7 @@ func TestRemoveExcludedIP(t *testing.T) {
 				return fmt.Errorf("Error")
 			})
 
-			err := i.RemoveExcludedIP("10.1.1.0")
+			err := i.RemoveExclusion(policy.NewExcludedIP("10.1.1.0"))
 			Convey("I should get  error", func() {
 				So(err, ShouldNotBeNil)
 			})
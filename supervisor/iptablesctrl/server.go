@@ -0,0 +1,269 @@
+package iptablesctrl
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aporeto-inc/trireme/policy"
+	"github.com/aporeto-inc/trireme/supervisor/cgroup"
+)
+
+// NewServerInstance creates a new iptables controller instance for Linux
+// services. The traffic of a service is matched on its cgroup and on the ports
+// it listens on instead of its IP address.
+func NewServerInstance(networkQueues, applicationQueues string, targetNetworks []string, mark int, cgroups cgroup.Manager) (*Instance, error) {
+
+	if cgroups == nil {
+		return nil, fmt.Errorf("Cgroup manager cannot be nil")
+	}
+
+	// Host processes are seen in the OUTPUT and INPUT sections like the
+	// processes of a remote enforcer
+	i, err := NewInstance(networkQueues, applicationQueues, targetNetworks, mark, true)
+	if err != nil {
+		return nil, err
+	}
+
+	i.cgroups = cgroups
+
+	return i, nil
+}
+
+// cgroupMatch returns the match of the traffic of the cgroup of a Linux service
+func (i *Instance) cgroupMatch(contextID string, mark string) []string {
+
+	if i.cgroups.Version() == cgroup.Unified {
+		return []string{"-m", "cgroup", "--path", i.cgroups.RelativePath(contextID)}
+	}
+
+	return []string{"-m", "cgroup", "--cgroup", mark}
+}
+
+// serverChainRules provides the list of rules that are used to send the traffic
+// of a Linux service to its chains. The application traffic is matched on the
+// cgroup of the service and its source ports. The network traffic is matched on
+// the connection mark of the connections of the service, so that the replies
+// to the connections it initiates are seen, and on its ports for the
+// connections it accepts.
+func (i *Instance) serverChainRules(contextID, appChain, netChain, mark string, ports []string) [][]string {
+
+	match := i.cgroupMatch(contextID, mark)
+
+	rules := [][]string{
+		append(append([]string{
+			i.appPacketIPTableContext,
+			i.appPacketIPTableSection,
+		}, match...),
+			"-m", "comment", "--comment", "Server specific chain",
+			"-j", appChain,
+		),
+		append(append([]string{
+			i.appAckPacketIPTableContext,
+			i.appPacketIPTableSection,
+		}, match...),
+			"-p", "tcp",
+			"-m", "comment", "--comment", "Server specific chain",
+			"-j", appChain,
+		),
+		{
+			i.netPacketIPTableContext,
+			i.netPacketIPTableSection,
+			"-p", "tcp",
+			"-m", "connmark", "--mark", mark,
+			"-m", "comment", "--comment", "Server specific chain",
+			"-j", netChain,
+		},
+	}
+
+	if len(ports) == 0 {
+		return rules
+	}
+
+	// The replies of a listening socket are not attributed to its cgroup. They
+	// are matched on the ports of the service instead.
+	portList := strings.Join(ports, ",")
+
+	return append(rules,
+		[]string{
+			i.appPacketIPTableContext,
+			i.appPacketIPTableSection,
+			"-p", "tcp",
+			"-m", "multiport", "--sports", portList,
+			"-m", "comment", "--comment", "Server specific chain",
+			"-j", appChain,
+		},
+		[]string{
+			i.appAckPacketIPTableContext,
+			i.appPacketIPTableSection,
+			"-p", "tcp",
+			"-m", "multiport", "--sports", portList,
+			"-m", "comment", "--comment", "Server specific chain",
+			"-j", appChain,
+		},
+		[]string{
+			i.netPacketIPTableContext,
+			i.netPacketIPTableSection,
+			"-p", "tcp",
+			"-m", "multiport", "--dports", portList,
+			"-m", "comment", "--comment", "Server specific chain",
+			"-j", netChain,
+		},
+	)
+}
+
+// markRules provides the rules that mark the packets of a Linux service so that
+// the datapath can identify the service from the packet mark. The connections
+// of the service get its mark, which is restored on the network packets.
+func (i *Instance) markRules(appChain string, netChain string, mark string) [][]string {
+
+	return [][]string{
+		{
+			i.appPacketIPTableContext, appChain,
+			"-j", "MARK", "--set-mark", mark,
+		},
+		{
+			i.appAckPacketIPTableContext, appChain,
+			"-j", "CONNMARK", "--set-mark", mark,
+		},
+		{
+			i.netPacketIPTableContext, netChain,
+			"-j", "CONNMARK", "--restore-mark",
+		},
+	}
+}
+
+// addAllServerRules adds the chains and all the rules of a Linux service
+func (i *Instance) addAllServerRules(contextID, appChain, netChain string, policyrules *policy.PUPolicy) error {
+
+	mark := policyrules.Mark()
+	if mark == "" {
+		return fmt.Errorf("No mark found for the Linux service")
+	}
+
+	if err := i.addContainerChain(appChain, netChain); err != nil {
+		return err
+	}
+
+	// The mark must be set before the packets are queued
+	if err := i.processRulesFromList(i.markRules(appChain, netChain, mark), "Append"); err != nil {
+		return err
+	}
+
+	if err := i.processRulesFromList(i.serverChainRules(contextID, appChain, netChain, mark, policyrules.Ports()), "Append"); err != nil {
+		return err
+	}
+
+	if err := i.addPacketTrap(appChain, netChain, ""); err != nil {
+		return err
+	}
+
+	return i.addACLs(appChain, netChain, "", policyrules)
+}
+
+// addServerUpdateRules records a new version of the rules of a Linux service in
+// the batch
+func (i *Instance) addServerUpdateRules(b *ruleBatch, version int, contextID string, policyrules *policy.PUPolicy) error {
+
+	appChain, netChain := i.chainName(contextID, version)
+
+	return i.batch(b).addAllServerRules(contextID, appChain, netChain, policyrules)
+}
+
+// deleteServerChainRules deletes the rules that send the traffic of a Linux
+// service to its chains
+func (i *Instance) deleteServerChainRules(appChain, netChain string) error {
+
+	rules, err := i.serverJumpRules(appChain, netChain)
+	if err != nil {
+		return err
+	}
+
+	return i.processRulesFromList(rules, "Delete")
+}
+
+// serverJumpRules reads the rules that jump to the chains of a Linux service.
+// The rules depend on the ports of the service which are not known when the
+// service is deleted, so they are found in the programmed rules.
+func (i *Instance) serverJumpRules(appChain, netChain string) ([][]string, error) {
+
+	sections := [][]string{
+		{i.appPacketIPTableContext, i.appPacketIPTableSection, appChain},
+		{i.appAckPacketIPTableContext, i.appPacketIPTableSection, appChain},
+		{i.netPacketIPTableContext, i.netPacketIPTableSection, netChain},
+	}
+
+	jumps := [][]string{}
+	for _, s := range sections {
+		rules, err := i.ipt.List(s[0], s[1])
+		if err != nil {
+			return nil, fmt.Errorf("Cannot list rules of %s: %s", s[1], err)
+		}
+
+		for _, rule := range rules {
+			fields := splitRule(rule)
+			if len(fields) < 2 || fields[0] != "-A" || fields[1] != s[1] {
+				continue
+			}
+
+			if !jumpsTo(fields, s[2]) {
+				continue
+			}
+
+			log.WithFields(log.Fields{
+				"package": "iptablesctrl",
+				"chain":   s[2],
+				"rule":    rule,
+			}).Debug("Found server specific rule")
+
+			jumps = append(jumps, append([]string{s[0], s[1]}, fields[2:]...))
+		}
+	}
+
+	return jumps, nil
+}
+
+// jumpsTo returns true if the rule jumps to the chain
+func jumpsTo(fields []string, chain string) bool {
+
+	for n := 0; n < len(fields)-1; n++ {
+		if fields[n] == "-j" && fields[n+1] == chain {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitRule splits a rule as returned by iptables -S in its arguments. Quoted
+// arguments such as comments are kept in one piece.
+func splitRule(rule string) []string {
+
+	fields := []string{}
+	current := []rune{}
+	quoted := false
+	inField := false
+
+	for _, c := range rule {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			inField = true
+		case c == ' ' && !quoted:
+			if inField {
+				fields = append(fields, string(current))
+				current = []rune{}
+				inField = false
+			}
+		default:
+			current = append(current, c)
+			inField = true
+		}
+	}
+
+	if inField {
+		fields = append(fields, string(current))
+	}
+
+	return fields
+}
@@ -0,0 +1,216 @@
+package iptablesctrl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/aporeto-inc/trireme/policy"
+	"github.com/aporeto-inc/trireme/supervisor/cgroup"
+	"github.com/aporeto-inc/trireme/supervisor/provider"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func serverPolicy(mark string, ports []string) *policy.PUPolicy {
+
+	rules := policy.NewIPRuleList([]policy.IPRule{
+		policy.IPRule{
+			Address:  "192.30.253.0/24",
+			Port:     "443",
+			Protocol: "TCP",
+			Action:   policy.Accept,
+		},
+	})
+
+	p := policy.NewPUPolicy("Context", policy.Police, rules, rules, nil, nil, nil, nil, nil, nil)
+	p.SetMark(mark)
+	p.SetPorts(ports)
+
+	return p
+}
+
+func TestNewServerInstance(t *testing.T) {
+
+	Convey("When I create a new server iptables instance", t, func() {
+
+		Convey("If I provide a cgroup manager", func() {
+			i, err := NewServerInstance("0:1", "2:3", []string{"172.17.0.0/24"}, 0x1000, cgroup.NewNetClsManager("/tmp"))
+			Convey("It should succeed with the host sections", func() {
+				So(err, ShouldBeNil)
+				So(i.appPacketIPTableSection, ShouldResemble, "OUTPUT")
+				So(i.netPacketIPTableSection, ShouldResemble, "INPUT")
+				So(i.cgroups, ShouldNotBeNil)
+			})
+		})
+
+		Convey("If I provide no cgroup manager", func() {
+			i, err := NewServerInstance("0:1", "2:3", []string{"172.17.0.0/24"}, 0x1000, nil)
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+				So(i, ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestServerChainRules(t *testing.T) {
+
+	Convey("Given a server iptables instance with the unified hierarchy", t, func() {
+		i, _ := NewServerInstance("0:1", "2:3", []string{"172.17.0.0/24"}, 0x1000, cgroup.NewUnifiedManager("/tmp"))
+
+		Convey("The traffic should be matched on the path of the cgroup", func() {
+			rules := i.serverChainRules("Context", "app", "net", "100", nil)
+			So(rules, ShouldHaveLength, 3)
+			So(rules[0], ShouldResemble, []string{
+				"raw", "OUTPUT",
+				"-m", "cgroup", "--path", "trireme/Context",
+				"-m", "comment", "--comment", "Server specific chain",
+				"-j", "app",
+			})
+		})
+
+		Convey("The network traffic of the connections of the service should be matched on their mark", func() {
+			rules := i.serverChainRules("Context", "app", "net", "100", nil)
+			So(rules[2], ShouldResemble, []string{
+				"mangle", "INPUT",
+				"-p", "tcp",
+				"-m", "connmark", "--mark", "100",
+				"-m", "comment", "--comment", "Server specific chain",
+				"-j", "net",
+			})
+		})
+	})
+}
+
+func TestServerConfigureRules(t *testing.T) {
+
+	Convey("Given a server iptables controller", t, func() {
+		root, _ := ioutil.TempDir("", "net_cls")
+		defer os.RemoveAll(root)
+
+		i, _ := NewServerInstance("0:1", "2:3", []string{"172.17.0.0/24"}, 0x1000, cgroup.NewNetClsManager(root))
+		iptables := provider.NewTestIptablesProvider()
+		i.ipt = iptables
+		restore := provider.NewTestIptablesRestoreProvider()
+		i.restore = restore
+
+		Convey("With a Linux service that listens on two ports", func() {
+			var payload string
+			restore.MockRestore(t, func(p []byte) error {
+				payload = string(p)
+				return nil
+			})
+
+			err := i.ConfigureRules(1, "Context", serverPolicy("100", []string{"80", "443"}))
+
+			Convey("The traffic should be matched on the cgroup and the ports", func() {
+				So(err, ShouldBeNil)
+				So(payload, ShouldEqual, "*raw\n"+
+					":TRIREME-App-Context-1 - [0:0]\n"+
+					"-A TRIREME-App-Context-1 -j MARK --set-mark 100\n"+
+					"-A OUTPUT -m cgroup --cgroup 100 -m comment --comment \"Server specific chain\" -j TRIREME-App-Context-1\n"+
+					"-A OUTPUT -p tcp -m multiport --sports 80,443 -m comment --comment \"Server specific chain\" -j TRIREME-App-Context-1\n"+
+					"-A TRIREME-App-Context-1 -d 172.17.0.0/24 -p tcp --tcp-flags FIN,SYN,RST,PSH,URG SYN -j NFQUEUE --queue-balance 2:3\n"+
+					"COMMIT\n"+
+					"*mangle\n"+
+					":TRIREME-App-Context-1 - [0:0]\n"+
+					":TRIREME-Net-Context-1 - [0:0]\n"+
+					"-A TRIREME-App-Context-1 -j CONNMARK --set-mark 100\n"+
+					"-A TRIREME-Net-Context-1 -j CONNMARK --restore-mark\n"+
+					"-A OUTPUT -m cgroup --cgroup 100 -p tcp -m comment --comment \"Server specific chain\" -j TRIREME-App-Context-1\n"+
+					"-A INPUT -p tcp -m connmark --mark 100 -m comment --comment \"Server specific chain\" -j TRIREME-Net-Context-1\n"+
+					"-A OUTPUT -p tcp -m multiport --sports 80,443 -m comment --comment \"Server specific chain\" -j TRIREME-App-Context-1\n"+
+					"-A INPUT -p tcp -m multiport --dports 80,443 -m comment --comment \"Server specific chain\" -j TRIREME-Net-Context-1\n"+
+					"-A TRIREME-App-Context-1 -d 172.17.0.0/24 -p tcp --tcp-flags SYN,ACK ACK -m connbytes --connbytes :3 --connbytes-dir original --connbytes-mode packets -j NFQUEUE --queue-balance 2:3\n"+
+					"-A TRIREME-Net-Context-1 -s 172.17.0.0/24 -p tcp -m connbytes --connbytes :3 --connbytes-dir original --connbytes-mode packets -j NFQUEUE --queue-balance 0:1\n"+
+					"-A TRIREME-App-Context-1 -p TCP -m state --state NEW -d 192.30.253.0/24 --dport 443 -j ACCEPT\n"+
+					"-A TRIREME-App-Context-1 -d 0.0.0.0/0 -p tcp -m state --state NEW -j DROP\n"+
+					"-A TRIREME-Net-Context-1 -p TCP -s 192.30.253.0/24 --dport 443 -j ACCEPT\n"+
+					"-A TRIREME-Net-Context-1 -s 0.0.0.0/0 -p tcp -m state --state NEW -j DROP\n"+
+					"COMMIT\n")
+			})
+		})
+
+		Convey("With a Linux service without a mark", func() {
+			err := i.ConfigureRules(1, "Context", serverPolicy("", nil))
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestServerDeleteRules(t *testing.T) {
+
+	Convey("Given a server iptables controller", t, func() {
+		i, _ := NewServerInstance("0:1", "2:3", []string{"172.17.0.0/24"}, 0x1000, cgroup.NewNetClsManager("/tmp"))
+		iptables := provider.NewTestIptablesProvider()
+		i.ipt = iptables
+
+		iptables.MockList(t, func(table, chain string) ([]string, error) {
+			if chain == "INPUT" {
+				return []string{
+					"-P INPUT ACCEPT",
+					"-A INPUT -p tcp -m multiport --dports 80,443 -m comment --comment \"Server specific chain\" -j TRIREME-Net-Context-1",
+					"-A INPUT -p tcp -m multiport --dports 22 -m comment --comment \"Server specific chain\" -j TRIREME-Net-Other-1",
+				}, nil
+			}
+			return []string{
+				"-A OUTPUT -m cgroup --cgroup 100 -m comment --comment \"Server specific chain\" -j TRIREME-App-Context-1",
+			}, nil
+		})
+
+		deleted := [][]string{}
+		iptables.MockDelete(t, func(table, chain string, rulespec ...string) error {
+			deleted = append(deleted, append([]string{table, chain}, rulespec...))
+			return nil
+		})
+		iptables.MockClearChain(t, func(table, chain string) error {
+			return nil
+		})
+		iptables.MockDeleteChain(t, func(table, chain string) error {
+			return nil
+		})
+
+		Convey("When I delete the rules of a Linux service", func() {
+			err := i.DeleteRules(1, "Context", policy.NewIPMap(nil))
+
+			Convey("Only the rules that jump to its chains should be deleted", func() {
+				So(err, ShouldBeNil)
+				So(deleted, ShouldHaveLength, 3)
+				So(deleted[2], ShouldResemble, []string{
+					"mangle", "INPUT",
+					"-p", "tcp", "-m", "multiport", "--dports", "80,443",
+					"-m", "comment", "--comment", "Server specific chain",
+					"-j", "TRIREME-Net-Context-1",
+				})
+			})
+		})
+
+		Convey("When the rules cannot be listed", func() {
+			iptables.MockList(t, func(table, chain string) ([]string, error) {
+				return nil, fmt.Errorf("Error")
+			})
+			err := i.DeleteRules(1, "Context", nil)
+
+			Convey("The chains should still be deleted", func() {
+				So(err, ShouldBeNil)
+				So(deleted, ShouldBeEmpty)
+			})
+		})
+	})
+}
+
+func TestSplitRule(t *testing.T) {
+
+	Convey("When I split a rule with a quoted comment", t, func() {
+		fields := splitRule("-A OUTPUT -m comment --comment \"Server specific chain\" -j TRIREME-App-Context-1")
+
+		Convey("The comment should be kept in one piece", func() {
+			So(fields, ShouldResemble, []string{
+				"-A", "OUTPUT", "-m", "comment", "--comment", "Server specific chain", "-j", "TRIREME-App-Context-1",
+			})
+		})
+	})
+}
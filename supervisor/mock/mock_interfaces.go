@@ -49,6 +49,16 @@ func (_mr *_MockSupervisorRecorder) Unsupervise(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Unsupervise", arg0)
 }
 
+func (_m *MockSupervisor) CleanOrphans() error {
+	ret := _m.ctrl.Call(_m, "CleanOrphans")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockSupervisorRecorder) CleanOrphans() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CleanOrphans")
+}
+
 func (_m *MockSupervisor) Start() error {
 	ret := _m.ctrl.Call(_m, "Start")
 	ret0, _ := ret[0].(error)
@@ -110,6 +120,36 @@ func (_mr *_MockExcluderRecorder) RemoveExcludedIP(arg0 interface{}) *gomock.Cal
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "RemoveExcludedIP", arg0)
 }
 
+func (_m *MockExcluder) AddExclusion(exclusion *policy.ExcludedIP) error {
+	ret := _m.ctrl.Call(_m, "AddExclusion", exclusion)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockExcluderRecorder) AddExclusion(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "AddExclusion", arg0)
+}
+
+func (_m *MockExcluder) RemoveExclusion(exclusion *policy.ExcludedIP) error {
+	ret := _m.ctrl.Call(_m, "RemoveExclusion", exclusion)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockExcluderRecorder) RemoveExclusion(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RemoveExclusion", arg0)
+}
+
+func (_m *MockExcluder) ListExcludedIPs() []*policy.ExcludedIP {
+	ret := _m.ctrl.Call(_m, "ListExcludedIPs")
+	ret0, _ := ret[0].([]*policy.ExcludedIP)
+	return ret0
+}
+
+func (_mr *_MockExcluderRecorder) ListExcludedIPs() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ListExcludedIPs")
+}
+
 // Mock of Implementor interface
 type MockImplementor struct {
 	ctrl     *gomock.Controller
@@ -161,6 +201,38 @@ func (_mr *_MockImplementorRecorder) DeleteRules(arg0, arg1, arg2 interface{}) *
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "DeleteRules", arg0, arg1, arg2)
 }
 
+func (_m *MockImplementor) VerifyRules(version int, contextID string, policyrules *policy.PUPolicy) (bool, error) {
+	ret := _m.ctrl.Call(_m, "VerifyRules", version, contextID, policyrules)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockImplementorRecorder) VerifyRules(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "VerifyRules", arg0, arg1, arg2)
+}
+
+func (_m *MockImplementor) VerifyGlobalRules(exclusions []*policy.ExcludedIP) (bool, error) {
+	ret := _m.ctrl.Call(_m, "VerifyGlobalRules", exclusions)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockImplementorRecorder) VerifyGlobalRules(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "VerifyGlobalRules", arg0)
+}
+
+func (_m *MockImplementor) RecoverRules(adopt func(string, int, *policy.IPMap)) error {
+	ret := _m.ctrl.Call(_m, "RecoverRules", adopt)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockImplementorRecorder) RecoverRules(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RecoverRules", arg0)
+}
+
 func (_m *MockImplementor) Start() error {
 	ret := _m.ctrl.Call(_m, "Start")
 	ret0, _ := ret[0].(error)
@@ -181,22 +253,32 @@ func (_mr *_MockImplementorRecorder) Stop() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Stop")
 }
 
-func (_m *MockImplementor) AddExcludedIP(ip string) error {
-	ret := _m.ctrl.Call(_m, "AddExcludedIP", ip)
+func (_m *MockImplementor) CleanUp() error {
+	ret := _m.ctrl.Call(_m, "CleanUp")
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-func (_mr *_MockImplementorRecorder) AddExcludedIP(arg0 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "AddExcludedIP", arg0)
+func (_mr *_MockImplementorRecorder) CleanUp() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CleanUp")
 }
 
-func (_m *MockImplementor) RemoveExcludedIP(ip string) error {
-	ret := _m.ctrl.Call(_m, "RemoveExcludedIP", ip)
+func (_m *MockImplementor) AddExclusion(exclusion *policy.ExcludedIP) error {
+	ret := _m.ctrl.Call(_m, "AddExclusion", exclusion)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-func (_mr *_MockImplementorRecorder) RemoveExcludedIP(arg0 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "RemoveExcludedIP", arg0)
+func (_mr *_MockImplementorRecorder) AddExclusion(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "AddExclusion", arg0)
+}
+
+func (_m *MockImplementor) RemoveExclusion(exclusion *policy.ExcludedIP) error {
+	ret := _m.ctrl.Call(_m, "RemoveExclusion", exclusion)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockImplementorRecorder) RemoveExclusion(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RemoveExclusion", arg0)
 }
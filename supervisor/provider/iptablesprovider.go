@@ -8,6 +8,8 @@ type IptablesProvider interface {
 	Append(table, chain string, rulespec ...string) error
 	Insert(table, chain string, pos int, rulespec ...string) error
 	Delete(table, chain string, rulespec ...string) error
+	Exists(table, chain string, rulespec ...string) (bool, error)
+	List(table, chain string) ([]string, error)
 	ListChains(table string) ([]string, error)
 	ClearChain(table, chain string) error
 	DeleteChain(table, chain string) error
@@ -0,0 +1,45 @@
+package provider
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+)
+
+// IptablesRestoreProvider is an abstraction of the iptables-restore utility. It
+// applies a complete rule set payload in a single transaction.
+type IptablesRestoreProvider interface {
+	Restore(payload []byte) error
+}
+
+// goIptablesRestoreProvider applies payloads by invoking iptables-restore
+type goIptablesRestoreProvider struct {
+	path string
+}
+
+// NewGoIPTablesRestoreProvider returns an IptablesRestoreProvider that invokes the
+// iptables-restore binary with the --noflush option so that existing rules are kept.
+func NewGoIPTablesRestoreProvider() (IptablesRestoreProvider, error) {
+
+	path, err := exec.LookPath("iptables-restore")
+	if err != nil {
+		return nil, fmt.Errorf("Cannot find iptables-restore %s", err)
+	}
+
+	return &goIptablesRestoreProvider{
+		path: path,
+	}, nil
+}
+
+// Restore applies the payload. Every table in the payload is committed atomically.
+func (r *goIptablesRestoreProvider) Restore(payload []byte) error {
+
+	cmd := exec.Command(r.path, "--noflush")
+	cmd.Stdin = bytes.NewReader(payload)
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to restore iptables rules %s: %s", err, string(bytes.TrimSpace(out)))
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package provider
+
+import (
+	"sync"
+	"testing"
+)
+
+type iptablesRestoreProviderMockedMethods struct {
+	restoreMock func(payload []byte) error
+}
+
+// TestIptablesRestoreProvider is a test implementation for IptablesRestoreProvider
+type TestIptablesRestoreProvider interface {
+	IptablesRestoreProvider
+	MockRestore(t *testing.T, impl func(payload []byte) error)
+}
+
+// A testIptablesRestoreProvider is an empty IptablesRestoreProvider that can be easily mocked.
+type testIptablesRestoreProvider struct {
+	mocks       map[*testing.T]*iptablesRestoreProviderMockedMethods
+	lock        *sync.Mutex
+	currentTest *testing.T
+}
+
+// NewTestIptablesRestoreProvider returns a new TestIptablesRestoreProvider.
+func NewTestIptablesRestoreProvider() TestIptablesRestoreProvider {
+	return &testIptablesRestoreProvider{
+		lock:  &sync.Mutex{},
+		mocks: map[*testing.T]*iptablesRestoreProviderMockedMethods{},
+	}
+}
+
+func (m *testIptablesRestoreProvider) MockRestore(t *testing.T, impl func(payload []byte) error) {
+
+	m.currentMocks(t).restoreMock = impl
+}
+
+func (m *testIptablesRestoreProvider) Restore(payload []byte) error {
+
+	if mock := m.currentMocks(m.currentTest); mock != nil && mock.restoreMock != nil {
+		return mock.restoreMock(payload)
+	}
+
+	return nil
+}
+
+func (m *testIptablesRestoreProvider) currentMocks(t *testing.T) *iptablesRestoreProviderMockedMethods {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	mocks := m.mocks[t]
+
+	if mocks == nil {
+		mocks = &iptablesRestoreProviderMockedMethods{}
+		m.mocks[t] = mocks
+	}
+
+	m.currentTest = t
+	return mocks
+}
@@ -3,8 +3,10 @@
 package supervisorproxy
 
 import (
+	"context"
 	"fmt"
 	"strconv"
+	"sync"
 
 	log "github.com/Sirupsen/logrus"
 
@@ -16,6 +18,7 @@ import (
 	"github.com/aporeto-inc/trireme/policy"
 	"github.com/aporeto-inc/trireme/remote/launch"
 	"github.com/aporeto-inc/trireme/supervisor"
+	"github.com/aporeto-inc/trireme/supervisor/exclusions"
 )
 
 //ProxyInfo is a struct used to store state for the remote launcher.
@@ -27,17 +30,28 @@ type ProxyInfo struct {
 	networkQueues     string
 	applicationQueues string
 	targetNetworks    []string
-	ExcludedIP        []string
+	exclusions        *exclusions.Store
 	prochdl           ProcessMon.ProcessManager
 	rpchdl            rpcwrapper.RPCClient
 	initDone          map[string]bool
+
+	sync.Mutex
 }
 
 //Supervise Calls Supervise on the remote supervisor
 func (s *ProxyInfo) Supervise(contextID string, puInfo *policy.PUInfo) error {
 
+	return s.SuperviseWithContext(context.Background(), contextID, puInfo)
+}
+
+//SuperviseWithContext is Supervise giving up when the context is done
+func (s *ProxyInfo) SuperviseWithContext(ctx context.Context, contextID string, puInfo *policy.PUInfo) error {
+
+	s.Lock()
+	defer s.Unlock()
+
 	if _, ok := s.initDone[contextID]; !ok {
-		err := s.InitRemoteSupervisor(contextID, puInfo)
+		err := s.initRemoteSupervisor(ctx, contextID, puInfo)
 		if err != nil {
 			return err
 		}
@@ -59,7 +73,7 @@ func (s *ProxyInfo) Supervise(contextID string, puInfo *policy.PUInfo) error {
 		},
 	}
 
-	if err := s.rpchdl.RemoteCall(contextID, "Server.Supervise", req, &rpcwrapper.Response{}); err != nil {
+	if err := s.rpchdl.RemoteCallWithContext(ctx, contextID, "Server.Supervise", req, &rpcwrapper.Response{}); err != nil {
 		log.WithFields(log.Fields{
 			"package":   "remsupervisor",
 			"contextID": contextID,
@@ -75,6 +89,16 @@ func (s *ProxyInfo) Supervise(contextID string, puInfo *policy.PUInfo) error {
 // Unsupervise exported stops enforcing policy for the given IP.
 func (s *ProxyInfo) Unsupervise(contextID string) error {
 
+	return s.UnsuperviseWithContext(context.Background(), contextID)
+}
+
+// UnsuperviseWithContext is Unsupervise giving up the remote call when the
+// context is done
+func (s *ProxyInfo) UnsuperviseWithContext(ctx context.Context, contextID string) error {
+
+	s.Lock()
+	defer s.Unlock()
+
 	delete(s.initDone, contextID)
 
 	request := &rpcwrapper.Request{
@@ -83,7 +107,7 @@ func (s *ProxyInfo) Unsupervise(contextID string) error {
 		},
 	}
 
-	if err := s.rpchdl.RemoteCall(contextID, "Server.Unsupervise", request, &rpcwrapper.Response{}); err != nil {
+	if err := s.rpchdl.RemoteCallWithContext(ctx, contextID, "Server.Unsupervise", request, &rpcwrapper.Response{}); err != nil {
 		log.WithFields(log.Fields{
 			"package":   "remsupervisor",
 			"contextID": contextID,
@@ -102,10 +126,23 @@ func (s *ProxyInfo) Unsupervise(contextID string) error {
 	return nil
 }
 
-//Start This method does nothing and is implemented for completeness
-// THe work done is done in the InitRemoteSupervisor method in the remote enforcer
+//CleanOrphans This method does nothing. The remote enforcers own the rules of their PU
+func (s *ProxyInfo) CleanOrphans() error {
+
+	return nil
+}
+
+//Start loads the exclusions that are sent to the remote enforcers.
+// The rest of the work is done in the InitRemoteSupervisor method in the remote enforcer
 func (s *ProxyInfo) Start() error {
 
+	if err := s.exclusions.Load(); err != nil {
+		log.WithFields(log.Fields{
+			"package": "remsupervisor",
+			"error":   err.Error(),
+		}).Warn("Cannot load the exclusions")
+	}
+
 	return nil
 }
 
@@ -136,6 +173,7 @@ func NewProxySupervisor(collector collector.EventCollector, enforcer enforcer.Po
 		prochdl:           ProcessMon.GetProcessMonHdl(),
 		rpchdl:            rpchdl,
 		initDone:          make(map[string]bool),
+		exclusions:        exclusions.NewStore(exclusions.DefaultStateFile),
 	}
 
 	return s, nil
@@ -145,14 +183,21 @@ func NewProxySupervisor(collector collector.EventCollector, enforcer enforcer.Po
 //InitRemoteSupervisor calls initsupervisor method on the remote
 func (s *ProxyInfo) InitRemoteSupervisor(contextID string, puInfo *policy.PUInfo) error {
 
+	return s.initRemoteSupervisor(context.Background(), contextID, puInfo)
+}
+
+//initRemoteSupervisor initializes the remote supervisor until the context is done
+func (s *ProxyInfo) initRemoteSupervisor(ctx context.Context, contextID string, puInfo *policy.PUInfo) error {
+
 	request := &rpcwrapper.Request{
 		Payload: &rpcwrapper.InitSupervisorPayload{
 			CaptureMethod:  rpcwrapper.IPTables,
 			TargetNetworks: s.targetNetworks,
+			ExcludedIPs:    s.exclusions.List(),
 		},
 	}
 
-	if err := s.rpchdl.RemoteCall(contextID, "Server.InitSupervisor", request, &rpcwrapper.Response{}); err != nil {
+	if err := s.rpchdl.RemoteCallWithContext(ctx, contextID, "Server.InitSupervisor", request, &rpcwrapper.Response{}); err != nil {
 		log.WithFields(log.Fields{
 			"package":   "remsupervisor",
 			"contextID": contextID,
@@ -166,16 +211,92 @@ func (s *ProxyInfo) InitRemoteSupervisor(contextID string, puInfo *policy.PUInfo
 
 }
 
-//AddExcludedIP call addexcluded ip on the remote supervisor
+// SetExclusionsFile sets the file in which the exclusions are kept across restarts.
+// It must be called before Start.
+func (s *ProxyInfo) SetExclusionsFile(file string) {
+
+	s.exclusions.SetFile(file)
+}
+
+//AddExcludedIP adds an exception for the destination parameter IP or CIDR on all the remote supervisors
 func (s *ProxyInfo) AddExcludedIP(ip string) error {
 
-	//This is unimplemented right now
-	return nil
+	return s.AddExclusion(policy.NewExcludedIP(ip))
 }
 
-// RemoveExcludedIP removes the exception for the destion IP given in parameter.
+// RemoveExcludedIP removes the exception for the destination IP or CIDR given in parameter.
 func (s *ProxyInfo) RemoveExcludedIP(ip string) error {
 
-	//This is unimplemented right now
+	return s.RemoveExclusion(policy.NewExcludedIP(ip))
+}
+
+//AddExclusion records the exclusion and adds it to all the remote supervisors. The
+//remote supervisors started later receive it when they are initialized.
+func (s *ProxyInfo) AddExclusion(exclusion *policy.ExcludedIP) error {
+
+	if err := exclusion.Validate(); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.exclusions.Contains(exclusion) {
+		return nil
+	}
+
+	if err := s.exclusions.Add(exclusion); err != nil {
+		return err
+	}
+
+	return s.remoteExclusionCall("Server.AddExclusion", exclusion)
+}
+
+//RemoveExclusion removes the exclusion from all the remote supervisors
+func (s *ProxyInfo) RemoveExclusion(exclusion *policy.ExcludedIP) error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.exclusions.Remove(exclusion); err != nil {
+		return err
+	}
+
+	return s.remoteExclusionCall("Server.RemoveExclusion", exclusion)
+}
+
+//ListExcludedIPs returns the exclusions sent to the remote supervisors
+func (s *ProxyInfo) ListExcludedIPs() []*policy.ExcludedIP {
+
+	return s.exclusions.List()
+}
+
+// remoteExclusionCall sends an exclusion to all the initialized remote supervisors.
+// It must be called with the lock held.
+func (s *ProxyInfo) remoteExclusionCall(method string, exclusion *policy.ExcludedIP) error {
+
+	failed := 0
+	for contextID := range s.initDone {
+		request := &rpcwrapper.Request{
+			Payload: &rpcwrapper.ExcludeIPPayload{
+				Exclusion: exclusion,
+			},
+		}
+
+		if err := s.rpchdl.RemoteCall(contextID, method, request, &rpcwrapper.Response{}); err != nil {
+			log.WithFields(log.Fields{
+				"package":   "remsupervisor",
+				"contextID": contextID,
+				"method":    method,
+				"error":     err.Error(),
+			}).Debug("Failed to send exclusion to remote supervisor")
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Exclusion %s failed on %d remote supervisors", exclusion.Key(), failed)
+	}
+
 	return nil
 }
@@ -9,10 +9,11 @@ import (
 )
 
 type mockedMethods struct {
-	SuperviseMock   func(string, *policy.PUInfo) error
-	UnsuperviseMock func(string) error
-	StartMock       func() error
-	StopMock        func() error
+	SuperviseMock    func(string, *policy.PUInfo) error
+	UnsuperviseMock  func(string) error
+	CleanOrphansMock func() error
+	StartMock        func() error
+	StopMock         func() error
 }
 
 // TestSupervisorLauncher is a mock
@@ -55,6 +56,9 @@ func (m *testSupervisorLauncher) MockSupervise(t *testing.T, impl func(string, *
 func (m *testSupervisorLauncher) MockUnsupervise(t *testing.T, impl func(string) error) {
 	m.currentMocks(t).UnsuperviseMock = impl
 }
+func (m *testSupervisorLauncher) MockCleanOrphans(t *testing.T, impl func() error) {
+	m.currentMocks(t).CleanOrphansMock = impl
+}
 func (m *testSupervisorLauncher) MockStart(t *testing.T, impl func() error) {
 	m.currentMocks(t).StartMock = impl
 }
@@ -78,6 +82,14 @@ func (m *testSupervisorLauncher) Unsupervise(contextID string) error {
 	return nil
 }
 
+func (m *testSupervisorLauncher) CleanOrphans() error {
+	if mock := m.currentMocks(m.currentTest); mock != nil && mock.CleanOrphansMock != nil {
+		return mock.CleanOrphansMock()
+
+	}
+	return nil
+}
+
 func (m *testSupervisorLauncher) Start() error {
 	if mock := m.currentMocks(m.currentTest); mock != nil && mock.StartMock != nil {
 		return mock.StartMock()
@@ -0,0 +1,125 @@
+package supervisor
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aporeto-inc/trireme/policy"
+)
+
+// adoptPU records a PU found in the kernel state at start. Its rules are left in
+// place until the PU is supervised again or cleaned as an orphan. When several
+// versions of a PU are found, only the latest one is kept.
+func (s *Config) adoptPU(contextID string, version int, ips *policy.IPMap) {
+
+	log.WithFields(log.Fields{
+		"package":   "supervisor",
+		"contextID": contextID,
+		"version":   version,
+	}).Debug("Recovered PU from the kernel state")
+
+	if data, err := s.versionTracker.Get(contextID); err == nil {
+		cachedEntry := data.(*cacheData)
+
+		if cachedEntry.version >= version {
+			s.impl.DeleteRules(version, contextID, ips)
+			return
+		}
+
+		s.impl.DeleteRules(cachedEntry.version, contextID, cachedEntry.ips)
+	}
+
+	s.versionTracker.AddOrUpdate(contextID, &cacheData{
+		version: version,
+		ips:     ips,
+		adopted: true,
+	})
+}
+
+// doAdoptPU takes over the rules of a PU recovered at start with the policy it
+// is supervised with
+func (s *Config) doAdoptPU(contextID string, containerInfo *policy.PUInfo) error {
+
+	data, err := s.versionTracker.Get(contextID)
+	if err != nil {
+		return fmt.Errorf("Error finding PU in cache %s", err)
+	}
+
+	if err := s.setupCgroup(contextID, containerInfo); err != nil {
+		s.doUnsupervise(contextID)
+		return err
+	}
+
+	cachedEntry := data.(*cacheData)
+	cachedEntry.adopted = false
+	cachedEntry.policy = containerInfo.Policy
+
+	if err := s.reprogramPU(contextID, s.resolvePolicy(contextID, containerInfo.Policy)); err != nil {
+		return fmt.Errorf("Error in adopting PU implementation. PU has been terminated")
+	}
+
+	ip, _ := containerInfo.Runtime.DefaultIPAddress()
+	s.collector.CollectContainerEvent(contextID, ip, containerInfo.Runtime.Tags(), "start")
+
+	return nil
+}
+
+// reprogramPU programs the rules of the PU from scratch in a new version, so that
+// nothing depends on the state of the previous one, and then removes whatever is
+// left of the previous version. The PU is removed if the rules cannot be programmed.
+// It must be called with the lock held.
+func (s *Config) reprogramPU(contextID string, p *policy.PUPolicy) error {
+
+	data, err := s.versionTracker.Get(contextID)
+	if err != nil {
+		return fmt.Errorf("Error finding PU in cache %s", err)
+	}
+
+	cachedEntry := data.(*cacheData)
+	oldVersion := cachedEntry.version
+	oldIPs := cachedEntry.ips
+
+	cacheEntry, err := s.versionTracker.LockedModify(contextID, add, 1)
+	if err != nil {
+		return fmt.Errorf("Error finding PU in cache %s", err)
+	}
+
+	cachedEntry = cacheEntry.(*cacheData)
+	cachedEntry.ips = p.IPAddresses()
+
+	if err := s.impl.ConfigureRules(cachedEntry.version, contextID, p); err != nil {
+		s.impl.DeleteRules(oldVersion, contextID, oldIPs)
+		s.doUnsupervise(contextID)
+		return err
+	}
+
+	s.impl.DeleteRules(oldVersion, contextID, oldIPs)
+
+	return nil
+}
+
+// CleanOrphans implements the CleanOrphans interface. The rules of the PUs that
+// were recovered at start but were not supervised again are removed.
+func (s *Config) CleanOrphans() error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	for _, key := range s.versionTracker.KeyList() {
+		contextID := key.(string)
+
+		data, err := s.versionTracker.Get(contextID)
+		if err != nil || !data.(*cacheData).adopted {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"package":   "supervisor",
+			"contextID": contextID,
+		}).Debug("Removing the rules of an orphan PU")
+
+		s.doUnsupervise(contextID)
+	}
+
+	return nil
+}
@@ -1,14 +1,21 @@
 package supervisor
 
 import (
+	"context"
 	"fmt"
+	"reflect"
 	"strconv"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/aporeto-inc/trireme/cache"
 	"github.com/aporeto-inc/trireme/collector"
 	"github.com/aporeto-inc/trireme/enforcer"
 	"github.com/aporeto-inc/trireme/policy"
+	"github.com/aporeto-inc/trireme/supervisor/cgroup"
+	"github.com/aporeto-inc/trireme/supervisor/exclusions"
+	"github.com/aporeto-inc/trireme/supervisor/fqdn"
 	"github.com/aporeto-inc/trireme/supervisor/ipsetctrl"
 	"github.com/aporeto-inc/trireme/supervisor/iptablesctrl"
 )
@@ -39,6 +46,8 @@ const (
 type cacheData struct {
 	version int
 	ips     *policy.IPMap
+	policy  *policy.PUPolicy
+	adopted bool
 }
 
 // Config is the structure holding all information about the supervisor
@@ -56,6 +65,17 @@ type Config struct {
 	Mark int
 
 	impl Implementor
+
+	fqdn *fqdn.Tracker
+
+	exclusions *exclusions.Store
+
+	cgroups cgroup.Manager
+
+	driftInterval time.Duration
+	stop          chan bool
+
+	sync.Mutex
 }
 
 // NewSupervisor will create a new connection supervisor that uses IPTables
@@ -91,14 +111,42 @@ func NewSupervisor(collector collector.EventCollector, enforcerInstance enforcer
 		networkQueues:     strconv.Itoa(int(filterQueue.NetworkQueue)) + ":" + strconv.Itoa(int(filterQueue.NetworkQueue+filterQueue.NumberOfNetworkQueues-1)),
 		applicationQueues: strconv.Itoa(int(filterQueue.ApplicationQueue)) + ":" + strconv.Itoa(int(filterQueue.ApplicationQueue+filterQueue.NumberOfApplicationQueues-1)),
 		Mark:              filterQueue.MarkValue,
+		driftInterval:     DefaultDriftCheckInterval,
+		stop:              make(chan bool, 1),
 	}
 
+	s.fqdn = fqdn.NewTracker(fqdn.NewSystemResolver(), s.refreshPU)
+
 	remote := false
 	if mode == RemoteContainer {
 		remote = true
 	}
 
+	// The exclusions of the remote supervisors are kept by the proxy
+	if remote {
+		s.exclusions = exclusions.NewStore("")
+	} else {
+		s.exclusions = exclusions.NewStore(exclusions.DefaultStateFile)
+	}
+
 	var err error
+
+	// Linux services are matched on their cgroup which is only supported
+	// by the iptables implementation
+	if mode == LocalServer {
+		if implementation != IPTables {
+			return nil, fmt.Errorf("LocalServer mode requires the IPTables implementation")
+		}
+
+		s.cgroups = cgroup.NewManager()
+		s.impl, err = iptablesctrl.NewServerInstance(s.networkQueues, s.applicationQueues, s.targetNetworks, s.Mark, s.cgroups)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to initialize supervisor controllers")
+		}
+
+		return s, nil
+	}
+
 	switch implementation {
 	case IPSets:
 		s.impl, err = ipsetctrl.NewInstance(s.networkQueues, s.applicationQueues, s.targetNetworks, s.Mark, remote)
@@ -116,17 +164,47 @@ func NewSupervisor(collector collector.EventCollector, enforcerInstance enforcer
 // it invokes the various handlers that process the parameter policy.
 func (s *Config) Supervise(contextID string, containerInfo *policy.PUInfo) error {
 
+	return s.SuperviseWithContext(context.Background(), contextID, containerInfo)
+}
+
+// SuperviseWithContext is Supervise giving up when the context is done before
+// the rules are programmed
+func (s *Config) SuperviseWithContext(ctx context.Context, contextID string, containerInfo *policy.PUInfo) error {
+
 	if containerInfo == nil || containerInfo.Policy == nil || containerInfo.Runtime == nil {
 		return fmt.Errorf("Runtime, Policy and ContainerInfo should not be nil")
 	}
 
-	_, err := s.versionTracker.Get(contextID)
+	if err := validateAddresses(containerInfo.Policy); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("Supervise of %s abandoned: %s", contextID, err)
+	}
+
+	return s.doSupervise(contextID, containerInfo)
+}
+
+// doSupervise creates, adopts or updates a PU. It must be called with the lock
+// held
+func (s *Config) doSupervise(contextID string, containerInfo *policy.PUInfo) error {
+
+	data, err := s.versionTracker.Get(contextID)
 
 	if err != nil {
 		// ContextID is not found in Cache, New PU: Do create.
 		return s.doCreatePU(contextID, containerInfo)
 	}
 
+	if data.(*cacheData).adopted {
+		// Rules of the PU were recovered at start. Take them over
+		return s.doAdoptPU(contextID, containerInfo)
+	}
+
 	// Context already in the cache. Just run update
 	return s.doUpdatePU(contextID, containerInfo)
 }
@@ -136,6 +214,26 @@ func (s *Config) Supervise(contextID string, containerInfo *policy.PUInfo) error
 // as much cleanup as possible to avoid stale state
 func (s *Config) Unsupervise(contextID string) error {
 
+	return s.UnsuperviseWithContext(context.Background(), contextID)
+}
+
+// UnsuperviseWithContext is Unsupervise giving up when the context is done
+// before the rules are removed
+func (s *Config) UnsuperviseWithContext(ctx context.Context, contextID string) error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("Unsupervise of %s abandoned: %s", contextID, err)
+	}
+
+	return s.doUnsupervise(contextID)
+}
+
+// doUnsupervise removes the PU. It must be called with the lock held
+func (s *Config) doUnsupervise(contextID string) error {
+
 	version, err := s.versionTracker.Get(contextID)
 
 	if err != nil {
@@ -148,6 +246,10 @@ func (s *Config) Unsupervise(contextID string) error {
 
 	s.versionTracker.Remove(contextID)
 
+	s.fqdn.Unregister(contextID)
+
+	s.deleteCgroup(contextID)
+
 	return nil
 }
 
@@ -161,17 +263,61 @@ func (s *Config) Start() error {
 		return fmt.Errorf("Filter of marked packets was not set")
 	}
 
+	s.Lock()
+	err := s.impl.RecoverRules(s.adoptPU)
+	s.Unlock()
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"package": "supervisor",
+			"error":   err.Error(),
+		}).Warn("Cannot recover the rules of the existing PUs")
+	}
+
+	s.restoreExclusions()
+
+	s.fqdn.Start()
+
+	if s.driftInterval > 0 {
+		go s.driftMonitor()
+	}
+
 	return nil
 }
 
 // Stop stops the supervisor
 func (s *Config) Stop() error {
 
+	s.fqdn.Stop()
+
+	if s.driftInterval > 0 {
+		select {
+		case s.stop <- true:
+		default:
+		}
+	}
+
 	s.impl.Stop()
 
 	return nil
 }
 
+// CleanUp removes the rules of all the PUs. It must be called once the
+// supervisor is stopped, when Trireme is uninstalled.
+func (s *Config) CleanUp() error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	for _, contextID := range s.versionTracker.KeyList() {
+		s.fqdn.Unregister(contextID.(string))
+		s.deleteCgroup(contextID.(string))
+		s.versionTracker.Remove(contextID)
+	}
+
+	return s.impl.CleanUp()
+}
+
 func (s *Config) doCreatePU(contextID string, containerInfo *policy.PUInfo) error {
 
 	log.WithFields(log.Fields{
@@ -184,16 +330,22 @@ func (s *Config) doCreatePU(contextID string, containerInfo *policy.PUInfo) erro
 	cacheEntry := &cacheData{
 		version: version,
 		ips:     containerInfo.Policy.IPAddresses(),
+		policy:  containerInfo.Policy,
 	}
 
 	// Version the policy so that we can do hitless policy changes
 	if err := s.versionTracker.AddOrUpdate(contextID, cacheEntry); err != nil {
-		s.Unsupervise(contextID)
+		s.doUnsupervise(contextID)
 		return err
 	}
 
-	if err := s.impl.ConfigureRules(version, contextID, containerInfo.Policy); err != nil {
-		s.Unsupervise(contextID)
+	if err := s.setupCgroup(contextID, containerInfo); err != nil {
+		s.doUnsupervise(contextID)
+		return err
+	}
+
+	if err := s.impl.ConfigureRules(version, contextID, s.resolvePolicy(contextID, containerInfo.Policy)); err != nil {
+		s.doUnsupervise(contextID)
 		return err
 	}
 
@@ -207,6 +359,30 @@ func (s *Config) doCreatePU(contextID string, containerInfo *policy.PUInfo) erro
 //and the invokes the various handlers that process all policies.
 func (s *Config) doUpdatePU(contextID string, containerInfo *policy.PUInfo) error {
 
+	data, err := s.versionTracker.Get(contextID)
+	if err != nil {
+		return fmt.Errorf("Error finding PU in cache %s", err)
+	}
+
+	if err := s.setupCgroup(contextID, containerInfo); err != nil {
+		return err
+	}
+
+	// Addresses were added or removed. The rules of the PU are programmed
+	// again from scratch with the new addresses.
+	if !reflect.DeepEqual(data.(*cacheData).ips.Addresses(), containerInfo.Policy.IPAddresses().Addresses()) {
+		data.(*cacheData).policy = containerInfo.Policy
+
+		if err := s.reprogramPU(contextID, s.resolvePolicy(contextID, containerInfo.Policy)); err != nil {
+			return fmt.Errorf("Error in updating PU implementation. PU has been terminated")
+		}
+
+		ip, _ := containerInfo.Runtime.DefaultIPAddress()
+		s.collector.CollectContainerEvent(contextID, ip, containerInfo.Runtime.Tags(), "update")
+
+		return nil
+	}
+
 	cacheEntry, err := s.versionTracker.LockedModify(contextID, add, 1)
 
 	if err != nil {
@@ -214,10 +390,12 @@ func (s *Config) doUpdatePU(contextID string, containerInfo *policy.PUInfo) erro
 	}
 
 	cachedEntry := cacheEntry.(*cacheData)
+	previous := cachedEntry.policy
+	cachedEntry.policy = containerInfo.Policy
 
-	if err := s.impl.UpdateRules(cachedEntry.version, contextID, containerInfo.Policy); err != nil {
-		s.Unsupervise(contextID)
-		return fmt.Errorf("Error in updating PU implementation. PU has been terminated")
+	if err := s.impl.UpdateRules(cachedEntry.version, contextID, s.resolvePolicy(contextID, containerInfo.Policy)); err != nil {
+		s.rollbackVersion(contextID, previous)
+		return fmt.Errorf("Error in updating PU implementation. Previous policy is kept: %s", err)
 	}
 
 	ip, _ := containerInfo.Runtime.DefaultIPAddress()
@@ -226,16 +404,21 @@ func (s *Config) doUpdatePU(contextID string, containerInfo *policy.PUInfo) erro
 	return nil
 }
 
-// AddExcludedIP adds an exception for the destination parameter IP, allowing all the traffic.
-func (s *Config) AddExcludedIP(ip string) error {
+// rollbackVersion restores the version and the policy of a PU whose new version
+// could not be programmed. The previous version is still programmed, so it
+// stays tracked and is deleted with the PU. It must be called with the lock
+// held.
+func (s *Config) rollbackVersion(contextID string, previous *policy.PUPolicy) {
 
-	return s.impl.AddExcludedIP(ip)
-}
+	cacheEntry, err := s.versionTracker.LockedModify(contextID, add, -1)
+	if err != nil {
+		return
+	}
 
-// RemoveExcludedIP removes the exception for the destion IP given in parameter.
-func (s *Config) RemoveExcludedIP(ip string) error {
+	cacheEntry.(*cacheData).policy = previous
 
-	return s.impl.AddExcludedIP(ip)
+	// The names of the previous policy are tracked again
+	s.resolvePolicy(contextID, previous)
 }
 
 func add(a, b interface{}) interface{} {
@@ -1,13 +1,22 @@
 package supervisor
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/aporeto-inc/trireme/collector"
 	"github.com/aporeto-inc/trireme/enforcer"
 	"github.com/aporeto-inc/trireme/enforcer/utils/tokens"
 	"github.com/aporeto-inc/trireme/policy"
+	"github.com/aporeto-inc/trireme/supervisor/cgroup"
+	"github.com/aporeto-inc/trireme/supervisor/fqdn"
 	mock_supervisor "github.com/aporeto-inc/trireme/supervisor/mock"
 	"github.com/golang/mock/gomock"
 	. "github.com/smartystreets/goconvey/convey"
@@ -119,6 +128,15 @@ func TestSupervise(t *testing.T) {
 			})
 		})
 
+		Convey("When I supervise a new PU with a canceled context", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			err := s.SuperviseWithContext(ctx, "contextID", puInfo)
+			Convey("I should get an error and no rules should be programmed", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
 		Convey("When I supervise a new PU with valid policy, but there is an error", func() {
 			impl.EXPECT().ConfigureRules(0, "errorPU", puInfo.Policy).Return(fmt.Errorf("Error"))
 			impl.EXPECT().DeleteRules(0, "errorPU", gomock.Any()).Return(nil)
@@ -141,14 +159,187 @@ func TestSupervise(t *testing.T) {
 		Convey("When I send supervise command for a second time, and the update fails", func() {
 			impl.EXPECT().ConfigureRules(0, "contextID", puInfo.Policy).Return(nil)
 			impl.EXPECT().UpdateRules(1, "contextID", gomock.Any()).Return(fmt.Errorf("Error"))
-			impl.EXPECT().DeleteRules(1, "contextID", gomock.Any()).Return(nil)
 			s.Supervise("contextID", puInfo)
 			err := s.Supervise("contextID", puInfo)
-			Convey("I should get an error", func() {
+			Convey("I should get an error and the previous version should be kept", func() {
 				So(err, ShouldNotBeNil)
+				data, err := s.versionTracker.Get("contextID")
+				So(err, ShouldBeNil)
+				So(data.(*cacheData).version, ShouldEqual, 0)
+			})
+
+			Convey("When I update it again, the next version should follow the kept one", func() {
+				impl.EXPECT().UpdateRules(1, "contextID", gomock.Any()).Return(nil)
+				So(s.Supervise("contextID", puInfo), ShouldBeNil)
+			})
+		})
+
+		Convey("When I send supervise command for a second time with a new address, it should reprogram the PU", func() {
+			connected := createPUInfo()
+			connected.Policy.SetIPAddresses(policy.NewIPMap(map[string]string{
+				policy.DefaultNamespace: "172.17.0.1",
+				"backend":               "10.1.1.1",
+			}))
+			impl.EXPECT().ConfigureRules(0, "contextID", puInfo.Policy).Return(nil)
+			impl.EXPECT().ConfigureRules(1, "contextID", connected.Policy).Return(nil)
+			impl.EXPECT().DeleteRules(0, "contextID", puInfo.Policy.IPAddresses()).Return(nil)
+			s.Supervise("contextID", puInfo)
+			err := s.Supervise("contextID", connected)
+			Convey("I should not get an error", func() {
+				So(err, ShouldBeNil)
+			})
+		})
+
+	})
+}
+
+// batchImplementor is an implementor that supports batch updates
+type batchImplementor struct {
+	*mock_supervisor.MockImplementor
+	updateBatch func(versions map[string]int, policies map[string]*policy.PUPolicy) error
+}
+
+func (b *batchImplementor) UpdateRulesBatch(versions map[string]int, policies map[string]*policy.PUPolicy) error {
+	return b.updateBatch(versions, policies)
+}
+
+func TestSuperviseBatch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	Convey("Given a supervisor with two supervised PUs", t, func() {
+		c := &collector.DefaultCollector{}
+		secrets := tokens.NewPSKSecrets([]byte("test password"))
+		e := enforcer.NewDefaultDatapathEnforcer("serverID", c, nil, secrets, false)
+
+		s, _ := NewSupervisor(c, e, []string{"172.17.0.0/24"}, LocalContainer, IPTables)
+		impl := &batchImplementor{MockImplementor: mock_supervisor.NewMockImplementor(ctrl)}
+		s.impl = impl
+
+		puInfo := createPUInfo()
+
+		impl.EXPECT().ConfigureRules(0, "first", puInfo.Policy).Return(nil)
+		impl.EXPECT().ConfigureRules(0, "second", puInfo.Policy).Return(nil)
+		s.Supervise("first", puInfo)
+		s.Supervise("second", puInfo)
+
+		Convey("When I update both PUs in a batch", func() {
+			var batched map[string]int
+			impl.updateBatch = func(versions map[string]int, policies map[string]*policy.PUPolicy) error {
+				batched = versions
+				return nil
+			}
+
+			results := s.SuperviseBatch(map[string]*policy.PUInfo{"first": puInfo, "second": puInfo})
+
+			Convey("Both PUs should be updated in a single batch", func() {
+				So(results["first"], ShouldBeNil)
+				So(results["second"], ShouldBeNil)
+				So(batched, ShouldResemble, map[string]int{"first": 1, "second": 1})
+			})
+		})
+
+		Convey("When the batch fails and one of the PUs cannot be updated", func() {
+			impl.updateBatch = func(versions map[string]int, policies map[string]*policy.PUPolicy) error {
+				return fmt.Errorf("Error")
+			}
+			impl.EXPECT().UpdateRules(1, "first", gomock.Any()).Return(nil)
+			impl.EXPECT().UpdateRules(1, "second", gomock.Any()).Return(fmt.Errorf("Error"))
+
+			results := s.SuperviseBatch(map[string]*policy.PUInfo{"first": puInfo, "second": puInfo})
+
+			Convey("Only the failed PU should get an error", func() {
+				So(results["first"], ShouldBeNil)
+				So(results["second"], ShouldNotBeNil)
+			})
+
+			Convey("The failed PU should stay supervised with its previous version", func() {
+				cacheEntry, err := s.versionTracker.Get("second")
+				So(err, ShouldBeNil)
+				So(cacheEntry.(*cacheData).version, ShouldEqual, 0)
 			})
 		})
 
+		Convey("When a new PU is in the batch", func() {
+			impl.updateBatch = func(versions map[string]int, policies map[string]*policy.PUPolicy) error {
+				return nil
+			}
+			impl.EXPECT().ConfigureRules(0, "third", puInfo.Policy).Return(nil)
+
+			results := s.SuperviseBatch(map[string]*policy.PUInfo{"first": puInfo, "third": puInfo})
+
+			Convey("It should be configured on its own", func() {
+				So(results["first"], ShouldBeNil)
+				So(results["third"], ShouldBeNil)
+			})
+		})
+	})
+}
+
+// chainImplementor records the versions of the rules programmed for each PU.
+// The updates are programmed atomically and fail when commitErr is set.
+type chainImplementor struct {
+	*mock_supervisor.MockImplementor
+	chains    map[string]map[int]bool
+	commitErr error
+}
+
+func newChainImplementor(ctrl *gomock.Controller) *chainImplementor {
+	return &chainImplementor{
+		MockImplementor: mock_supervisor.NewMockImplementor(ctrl),
+		chains:          map[string]map[int]bool{},
+	}
+}
+
+func (c *chainImplementor) ConfigureRules(version int, contextID string, p *policy.PUPolicy) error {
+	c.chains[contextID] = map[int]bool{version: true}
+	return nil
+}
+
+func (c *chainImplementor) UpdateRules(version int, contextID string, p *policy.PUPolicy) error {
+	if c.commitErr != nil {
+		return c.commitErr
+	}
+	c.chains[contextID][version] = true
+	delete(c.chains[contextID], version-1)
+	return nil
+}
+
+func (c *chainImplementor) DeleteRules(version int, contextID string, ips *policy.IPMap) error {
+	delete(c.chains[contextID], version)
+	return nil
+}
+
+func TestFailedUpdate(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	Convey("Given a supervisor with a supervised PU", t, func() {
+		c := &collector.DefaultCollector{}
+		secrets := tokens.NewPSKSecrets([]byte("test password"))
+		e := enforcer.NewDefaultDatapathEnforcer("serverID", c, nil, secrets, false)
+
+		s, _ := NewSupervisor(c, e, []string{"172.17.0.0/24"}, LocalContainer, IPTables)
+		impl := newChainImplementor(ctrl)
+		s.impl = impl
+
+		puInfo := createPUInfo()
+		So(s.Supervise("contextID", puInfo), ShouldBeNil)
+
+		Convey("When the commit of an update fails", func() {
+			impl.commitErr = fmt.Errorf("iptables-restore failed")
+			err := s.Supervise("contextID", puInfo)
+
+			Convey("The previous version should be left programmed", func() {
+				So(err, ShouldNotBeNil)
+				So(impl.chains["contextID"], ShouldResemble, map[int]bool{0: true})
+			})
+
+			Convey("When I unsupervise the PU, no chain should be left", func() {
+				So(s.Unsupervise("contextID"), ShouldBeNil)
+				So(impl.chains["contextID"], ShouldBeEmpty)
+			})
+		})
 	})
 }
 
@@ -187,6 +378,38 @@ func TestUnsupervise(t *testing.T) {
 	})
 }
 
+func TestCleanUp(t *testing.T) {
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	Convey("Given a supervisor with a supervised PU", t, func() {
+		c := &collector.DefaultCollector{}
+		secrets := tokens.NewPSKSecrets([]byte("test password"))
+		e := enforcer.NewDefaultDatapathEnforcer("serverID", c, nil, secrets, false)
+
+		s, _ := NewSupervisor(c, e, []string{"172.17.0.0/24"}, LocalContainer, IPTables)
+		impl := mock_supervisor.NewMockImplementor(ctrl)
+		s.impl = impl
+
+		puInfo := createPUInfo()
+		impl.EXPECT().ConfigureRules(0, "contextID", puInfo.Policy).Return(nil)
+		So(s.Supervise("contextID", puInfo), ShouldBeNil)
+
+		Convey("When I stop it, the rules should be left in place", func() {
+			impl.EXPECT().Stop().Return(nil)
+			So(s.Stop(), ShouldBeNil)
+			So(s.versionTracker.KeyList(), ShouldHaveLength, 1)
+
+			Convey("When I clean it up, the rules of the PUs should be removed", func() {
+				impl.EXPECT().CleanUp().Return(nil)
+				So(s.CleanUp(), ShouldBeNil)
+				So(s.versionTracker.KeyList(), ShouldBeEmpty)
+			})
+		})
+	})
+}
+
 func TestStart(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -202,6 +425,7 @@ func TestStart(t *testing.T) {
 
 		Convey("When I try to start it and the implementor works", func() {
 			impl.EXPECT().Start().Return(nil)
+			impl.EXPECT().RecoverRules(gomock.Any()).Return(nil)
 			err := s.Start()
 			Convey("I should get no errors", func() {
 				So(err, ShouldBeNil)
@@ -217,3 +441,580 @@ func TestStart(t *testing.T) {
 		})
 	})
 }
+
+// testResolver is a fqdn.Resolver answering from a map
+type testResolver struct {
+	sync.Mutex
+	answers map[string][]string
+}
+
+func (r *testResolver) set(name string, addresses []string) {
+	r.Lock()
+	defer r.Unlock()
+	r.answers[name] = addresses
+}
+
+func (r *testResolver) Resolve(name string) ([]string, time.Duration, error) {
+	r.Lock()
+	defer r.Unlock()
+	if addresses, ok := r.answers[name]; ok {
+		return addresses, time.Minute, nil
+	}
+	return nil, 0, fmt.Errorf("Unknown name")
+}
+
+func TestFQDNRules(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	Convey("Given a supervisor with a DNS resolver", t, func() {
+		c := &collector.DefaultCollector{}
+		secrets := tokens.NewPSKSecrets([]byte("test password"))
+		e := enforcer.NewDefaultDatapathEnforcer("serverID", c, nil, secrets, false)
+
+		s, _ := NewSupervisor(c, e, []string{"172.17.0.0/24"}, LocalContainer, IPTables)
+		impl := mock_supervisor.NewMockImplementor(ctrl)
+		s.impl = impl
+
+		resolver := &testResolver{
+			answers: map[string][]string{
+				"api.example.com": []string{"10.1.1.1", "10.1.1.2"},
+			},
+		}
+		s.fqdn = fqdn.NewTracker(resolver, s.refreshPU)
+
+		rules := policy.NewIPRuleList([]policy.IPRule{
+			policy.IPRule{
+				Address:  "api.example.com",
+				Port:     "443",
+				Protocol: "TCP",
+				Action:   policy.Accept,
+			},
+			policy.IPRule{
+				Address:  "192.30.253.0/24",
+				Port:     "80",
+				Protocol: "TCP",
+				Action:   policy.Accept,
+			},
+		})
+
+		puInfo := createPUInfo()
+		puInfo.Policy.SetEgressACLs(rules)
+
+		Convey("When I supervise a PU with a rule on a DNS name", func() {
+			var configured *policy.PUPolicy
+			impl.EXPECT().ConfigureRules(0, "contextID", gomock.Any()).Do(func(version int, contextID string, p *policy.PUPolicy) {
+				configured = p
+			}).Return(nil)
+
+			resolved := make(chan *policy.PUPolicy, 1)
+			impl.EXPECT().UpdateRules(1, "contextID", gomock.Any()).Do(func(version int, contextID string, p *policy.PUPolicy) {
+				resolved <- p
+			}).Return(nil)
+
+			err := s.Supervise("contextID", puInfo)
+
+			Convey("The rules that do not refer to a name should be programmed right away", func() {
+				So(err, ShouldBeNil)
+				So(configured.EgressACLs().Rules, ShouldResemble, []policy.IPRule{
+					{Address: "192.30.253.0/24", Port: "80", Protocol: "TCP", Action: policy.Accept},
+				})
+				So(configured.IngressACLs().Rules, ShouldResemble, puInfo.Policy.IngressACLs().Rules)
+			})
+
+			var updated *policy.PUPolicy
+			select {
+			case updated = <-resolved:
+			case <-time.After(time.Second):
+			}
+
+			Convey("The rule should be replaced by one rule per address once the name is resolved", func() {
+				So(updated, ShouldNotBeNil)
+				So(updated.EgressACLs().Rules, ShouldResemble, []policy.IPRule{
+					{Address: "10.1.1.1/32", Port: "443", Protocol: "TCP", Action: policy.Accept},
+					{Address: "10.1.1.2/32", Port: "443", Protocol: "TCP", Action: policy.Accept},
+					{Address: "192.30.253.0/24", Port: "80", Protocol: "TCP", Action: policy.Accept},
+				})
+			})
+
+			Convey("When the addresses of the name change", func() {
+				var updated *policy.PUPolicy
+				impl.EXPECT().UpdateRules(2, "contextID", gomock.Any()).Do(func(version int, contextID string, p *policy.PUPolicy) {
+					updated = p
+				}).Return(nil)
+
+				resolver.set("api.example.com", []string{"10.1.1.3"})
+				s.fqdn.Refresh("api.example.com")
+
+				Convey("The rules should be updated with the new addresses", func() {
+					So(updated.EgressACLs().Rules, ShouldResemble, []policy.IPRule{
+						{Address: "10.1.1.3/32", Port: "443", Protocol: "TCP", Action: policy.Accept},
+						{Address: "192.30.253.0/24", Port: "80", Protocol: "TCP", Action: policy.Accept},
+					})
+				})
+			})
+
+			Convey("When the rules cannot be updated after the addresses change", func() {
+				impl.EXPECT().UpdateRules(2, "contextID", gomock.Any()).Return(fmt.Errorf("Error"))
+
+				resolver.set("api.example.com", []string{"10.1.1.3"})
+				s.fqdn.Refresh("api.example.com")
+
+				Convey("The PU should stay supervised with the previous version", func() {
+					cacheEntry, err := s.versionTracker.Get("contextID")
+					So(err, ShouldBeNil)
+					So(cacheEntry.(*cacheData).version, ShouldEqual, 1)
+				})
+			})
+		})
+
+		Convey("When I supervise a PU with a mistyped address", func() {
+			for _, address := range []string{"10.0.0.300/24", "10.0.0.300", "api example.com"} {
+				mistyped := createPUInfo()
+				mistyped.Policy.SetEgressACLs(policy.NewIPRuleList([]policy.IPRule{
+					policy.IPRule{Address: address, Port: "443", Protocol: "TCP", Action: policy.Accept},
+				}))
+				So(s.Supervise("contextID", mistyped), ShouldNotBeNil)
+			}
+
+			Convey("The address should not be resolved as a name", func() {
+				So(s.fqdn.Addresses("10.0.0.300"), ShouldBeEmpty)
+				_, err := s.versionTracker.Get("contextID")
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When I refresh a PU that is not supervised", func() {
+			s.refreshPU("unknown")
+			Convey("Nothing should be programmed", func() {
+				So(s.fqdn.Addresses("api.example.com"), ShouldBeEmpty)
+			})
+		})
+	})
+}
+
+// testCollector records the container events
+type testCollector struct {
+	collector.DefaultCollector
+	events []string
+}
+
+func (c *testCollector) CollectContainerEvent(contextID string, ip string, tags *policy.TagsMap, event string) {
+	c.events = append(c.events, event)
+}
+
+func TestDriftCheck(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	Convey("Given a supervisor with a supervised PU", t, func() {
+		c := &testCollector{}
+		secrets := tokens.NewPSKSecrets([]byte("test password"))
+		e := enforcer.NewDefaultDatapathEnforcer("serverID", c, nil, secrets, false)
+
+		s, _ := NewSupervisor(c, e, []string{"172.17.0.0/24"}, LocalContainer, IPTables)
+		impl := mock_supervisor.NewMockImplementor(ctrl)
+		s.impl = impl
+
+		puInfo := createPUInfo()
+		impl.EXPECT().ConfigureRules(0, "contextID", puInfo.Policy).Return(nil)
+		s.Supervise("contextID", puInfo)
+		c.events = []string{}
+
+		impl.EXPECT().VerifyGlobalRules(gomock.Any()).Return(false, nil).AnyTimes()
+
+		Convey("When the rules did not drift", func() {
+			impl.EXPECT().VerifyRules(0, "contextID", puInfo.Policy).Return(false, nil)
+			s.checkDrift()
+
+			Convey("Nothing should be reported or programmed", func() {
+				So(c.events, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When the rules cannot be verified", func() {
+			impl.EXPECT().VerifyRules(0, "contextID", puInfo.Policy).Return(false, fmt.Errorf("Error"))
+			s.checkDrift()
+
+			Convey("Nothing should be reported or programmed", func() {
+				So(c.events, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When the rules drifted", func() {
+			impl.EXPECT().VerifyRules(0, "contextID", puInfo.Policy).Return(true, nil)
+			impl.EXPECT().ConfigureRules(1, "contextID", puInfo.Policy).Return(nil)
+			impl.EXPECT().DeleteRules(0, "contextID", gomock.Any()).Return(nil)
+			s.checkDrift()
+
+			Convey("The drift should be reported and the rules programmed in a new version", func() {
+				So(c.events, ShouldResemble, []string{collector.ContainerDrift})
+
+				impl.EXPECT().VerifyRules(1, "contextID", puInfo.Policy).Return(false, nil)
+				s.checkDrift()
+			})
+		})
+
+		Convey("When the rules drifted and cannot be repaired", func() {
+			impl.EXPECT().VerifyRules(0, "contextID", puInfo.Policy).Return(true, nil)
+			impl.EXPECT().ConfigureRules(1, "contextID", puInfo.Policy).Return(fmt.Errorf("Error"))
+			impl.EXPECT().DeleteRules(0, "contextID", gomock.Any()).Return(nil)
+			impl.EXPECT().DeleteRules(1, "contextID", gomock.Any()).Return(nil)
+			s.checkDrift()
+
+			Convey("The PU should be terminated", func() {
+				So(c.events, ShouldResemble, []string{collector.ContainerDrift, collector.ContainerFailed})
+				_, err := s.versionTracker.Get("contextID")
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+
+	Convey("Given a supervisor with an exclusion", t, func() {
+		c := &collector.DefaultCollector{}
+		secrets := tokens.NewPSKSecrets([]byte("test password"))
+		e := enforcer.NewDefaultDatapathEnforcer("serverID", c, nil, secrets, false)
+
+		dir, _ := ioutil.TempDir("", "supervisor")
+		defer os.RemoveAll(dir)
+
+		s, _ := NewSupervisor(c, e, []string{"172.17.0.0/24"}, LocalContainer, IPTables)
+		impl := mock_supervisor.NewMockImplementor(ctrl)
+		s.impl = impl
+		s.SetExclusionsFile(filepath.Join(dir, "exclusions.json"))
+
+		exclusion := policy.NewExcludedIP("10.10.0.0/16")
+		impl.EXPECT().AddExclusion(exclusion).Return(nil)
+		So(s.AddExclusion(exclusion), ShouldBeNil)
+
+		Convey("When the global rules did not drift", func() {
+			impl.EXPECT().VerifyGlobalRules([]*policy.ExcludedIP{exclusion}).Return(false, nil)
+			s.checkDrift()
+
+			Convey("Nothing should be programmed", func() {
+				So(s.ListExcludedIPs(), ShouldHaveLength, 1)
+			})
+		})
+
+		Convey("When the global rules cannot be verified", func() {
+			impl.EXPECT().VerifyGlobalRules([]*policy.ExcludedIP{exclusion}).Return(false, fmt.Errorf("Error"))
+			s.checkDrift()
+
+			Convey("Nothing should be programmed", func() {
+				So(s.ListExcludedIPs(), ShouldHaveLength, 1)
+			})
+		})
+
+		Convey("When the mark rule or the rules of the exclusions are missing", func() {
+			impl.EXPECT().VerifyGlobalRules([]*policy.ExcludedIP{exclusion}).Return(true, nil)
+			impl.EXPECT().Start().Return(nil)
+			impl.EXPECT().RemoveExclusion(exclusion).Return(nil)
+			impl.EXPECT().AddExclusion(exclusion).Return(nil)
+			s.checkDrift()
+
+			Convey("The global rules and the exclusions should be programmed again", func() {
+				So(s.ListExcludedIPs(), ShouldResemble, []*policy.ExcludedIP{exclusion})
+			})
+		})
+	})
+
+	Convey("Given a supervisor", t, func() {
+		c := &collector.DefaultCollector{}
+		secrets := tokens.NewPSKSecrets([]byte("test password"))
+		e := enforcer.NewDefaultDatapathEnforcer("serverID", c, nil, secrets, false)
+
+		s, _ := NewSupervisor(c, e, []string{"172.17.0.0/24"}, LocalContainer, IPTables)
+
+		Convey("The drift check should be enabled by default", func() {
+			So(s.driftInterval, ShouldEqual, DefaultDriftCheckInterval)
+		})
+
+		Convey("When I set the drift check interval", func() {
+			s.SetDriftCheckInterval(time.Second)
+			Convey("It should be used", func() {
+				So(s.driftInterval, ShouldEqual, time.Second)
+			})
+		})
+	})
+}
+
+func TestRecoverRules(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	Convey("Given a supervisor started with rules already programmed", t, func() {
+		c := &testCollector{}
+		secrets := tokens.NewPSKSecrets([]byte("test password"))
+		e := enforcer.NewDefaultDatapathEnforcer("serverID", c, nil, secrets, false)
+
+		s, _ := NewSupervisor(c, e, []string{"172.17.0.0/24"}, LocalContainer, IPTables)
+		impl := mock_supervisor.NewMockImplementor(ctrl)
+		s.impl = impl
+		s.SetDriftCheckInterval(0)
+
+		ips := policy.NewIPMap(map[string]string{policy.DefaultNamespace: "172.17.0.1"})
+		impl.EXPECT().Start().Return(nil)
+		impl.EXPECT().RecoverRules(gomock.Any()).Do(func(adopt func(contextID string, version int, ips *policy.IPMap)) {
+			adopt("contextID", 3, ips)
+			adopt("contextID", 2, ips)
+			adopt("orphan", 1, ips)
+		}).Return(nil)
+		impl.EXPECT().DeleteRules(2, "contextID", ips).Return(nil)
+		impl.EXPECT().Stop().Return(nil)
+		s.Start()
+		defer s.Stop()
+
+		Convey("The latest version of every PU should be adopted", func() {
+			data, err := s.versionTracker.Get("contextID")
+			So(err, ShouldBeNil)
+			So(data.(*cacheData).version, ShouldEqual, 3)
+			So(data.(*cacheData).adopted, ShouldBeTrue)
+		})
+
+		Convey("When an adopted PU is supervised again", func() {
+			puInfo := createPUInfo()
+			impl.EXPECT().ConfigureRules(4, "contextID", puInfo.Policy).Return(nil)
+			impl.EXPECT().DeleteRules(3, "contextID", ips).Return(nil)
+			err := s.Supervise("contextID", puInfo)
+
+			Convey("Its rules should be programmed in a new version", func() {
+				So(err, ShouldBeNil)
+				So(c.events, ShouldResemble, []string{"start"})
+				data, _ := s.versionTracker.Get("contextID")
+				So(data.(*cacheData).version, ShouldEqual, 4)
+				So(data.(*cacheData).adopted, ShouldBeFalse)
+			})
+
+			Convey("When I clean the orphans", func() {
+				impl.EXPECT().DeleteRules(1, "orphan", ips).Return(nil)
+				err := s.CleanOrphans()
+
+				Convey("Only the PUs that were not supervised again should be removed", func() {
+					So(err, ShouldBeNil)
+					_, err := s.versionTracker.Get("orphan")
+					So(err, ShouldNotBeNil)
+					_, err = s.versionTracker.Get("contextID")
+					So(err, ShouldBeNil)
+				})
+			})
+		})
+
+		Convey("When an adopted PU cannot be programmed", func() {
+			puInfo := createPUInfo()
+			impl.EXPECT().ConfigureRules(4, "contextID", puInfo.Policy).Return(fmt.Errorf("Error"))
+			impl.EXPECT().DeleteRules(3, "contextID", ips).Return(nil)
+			impl.EXPECT().DeleteRules(4, "contextID", gomock.Any()).Return(nil)
+			err := s.Supervise("contextID", puInfo)
+
+			Convey("I should get an error and the PU should be removed", func() {
+				So(err, ShouldNotBeNil)
+				_, err := s.versionTracker.Get("contextID")
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestExclusions(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	Convey("Given a supervisor with a state file for the exclusions", t, func() {
+		c := &collector.DefaultCollector{}
+		secrets := tokens.NewPSKSecrets([]byte("test password"))
+		e := enforcer.NewDefaultDatapathEnforcer("serverID", c, nil, secrets, false)
+
+		dir, _ := ioutil.TempDir("", "supervisor")
+		defer os.RemoveAll(dir)
+		file := filepath.Join(dir, "exclusions.json")
+
+		s, _ := NewSupervisor(c, e, []string{"172.17.0.0/24"}, LocalContainer, IPTables)
+		impl := mock_supervisor.NewMockImplementor(ctrl)
+		s.impl = impl
+		s.SetExclusionsFile(file)
+
+		metadata := &policy.ExcludedIP{
+			Address:   "169.254.169.254",
+			Protocol:  "tcp",
+			Port:      "80",
+			Direction: policy.ExcludeOutgoing,
+		}
+
+		Convey("When I add an exclusion", func() {
+			impl.EXPECT().AddExclusion(metadata).Return(nil)
+			err := s.AddExclusion(metadata)
+
+			Convey("It should be programmed and listed", func() {
+				So(err, ShouldBeNil)
+				So(s.ListExcludedIPs(), ShouldResemble, []*policy.ExcludedIP{metadata})
+			})
+
+			Convey("When I add it again, it should not be programmed twice", func() {
+				So(s.AddExclusion(metadata), ShouldBeNil)
+			})
+
+			Convey("When a new supervisor is started with the same state file", func() {
+				n, _ := NewSupervisor(c, e, []string{"172.17.0.0/24"}, LocalContainer, IPTables)
+				nimpl := mock_supervisor.NewMockImplementor(ctrl)
+				n.impl = nimpl
+				n.SetExclusionsFile(file)
+				n.SetDriftCheckInterval(0)
+
+				nimpl.EXPECT().Start().Return(nil)
+				nimpl.EXPECT().RecoverRules(gomock.Any()).Return(nil)
+				nimpl.EXPECT().RemoveExclusion(metadata).Return(nil)
+				nimpl.EXPECT().AddExclusion(metadata).Return(nil)
+				nimpl.EXPECT().Stop().Return(nil)
+				n.Start()
+				defer n.Stop()
+
+				Convey("The exclusion should be programmed again", func() {
+					So(n.ListExcludedIPs(), ShouldResemble, []*policy.ExcludedIP{metadata})
+				})
+			})
+
+			Convey("When I remove it", func() {
+				impl.EXPECT().RemoveExclusion(metadata).Return(nil)
+				err := s.RemoveExclusion(metadata)
+
+				Convey("It should not be listed anymore", func() {
+					So(err, ShouldBeNil)
+					So(s.ListExcludedIPs(), ShouldBeEmpty)
+				})
+			})
+		})
+
+		Convey("When I add an excluded CIDR", func() {
+			impl.EXPECT().AddExclusion(policy.NewExcludedIP("10.10.0.0/16")).Return(nil)
+			err := s.AddExcludedIP("10.10.0.0/16")
+
+			Convey("It should be programmed", func() {
+				So(err, ShouldBeNil)
+			})
+
+			Convey("When I remove it", func() {
+				impl.EXPECT().RemoveExclusion(policy.NewExcludedIP("10.10.0.0/16")).Return(nil)
+				err := s.RemoveExcludedIP("10.10.0.0/16")
+				Convey("I should get no error", func() {
+					So(err, ShouldBeNil)
+				})
+			})
+		})
+
+		Convey("When I add an invalid exclusion", func() {
+			err := s.AddExclusion(&policy.ExcludedIP{Address: "10.10.0.0/16", Port: "80"})
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When I add an exclusion with a direction but without a port", func() {
+			for _, direction := range []policy.ExclusionDirection{policy.ExcludeOutgoing, policy.ExcludeIncoming} {
+				err := s.AddExclusion(&policy.ExcludedIP{Address: "10.10.0.0/16", Protocol: "tcp", Direction: direction})
+				So(err, ShouldNotBeNil)
+			}
+			Convey("It should not be recorded", func() {
+				So(s.ListExcludedIPs(), ShouldBeEmpty)
+			})
+		})
+
+		Convey("When I add an incoming exclusion with a port", func() {
+			incoming := &policy.ExcludedIP{Address: "10.10.0.0/16", Protocol: "udp", Port: "9100", Direction: policy.ExcludeIncoming}
+			impl.EXPECT().AddExclusion(incoming).Return(nil)
+			err := s.AddExclusion(incoming)
+			Convey("It should be programmed", func() {
+				So(err, ShouldBeNil)
+				So(s.ListExcludedIPs(), ShouldResemble, []*policy.ExcludedIP{incoming})
+			})
+		})
+
+		Convey("When the exclusion cannot be programmed", func() {
+			impl.EXPECT().AddExclusion(metadata).Return(fmt.Errorf("Error"))
+			err := s.AddExclusion(metadata)
+			Convey("I should get an error and it should not be recorded", func() {
+				So(err, ShouldNotBeNil)
+				So(s.ListExcludedIPs(), ShouldBeEmpty)
+			})
+		})
+
+		Convey("When I remove an unknown exclusion", func() {
+			err := s.RemoveExclusion(metadata)
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestLocalServer(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	Convey("Given a supervisor for Linux services", t, func() {
+		c := &collector.DefaultCollector{}
+		secrets := tokens.NewPSKSecrets([]byte("test password"))
+		e := enforcer.NewDefaultDatapathEnforcer("serverID", c, nil, secrets, false)
+
+		Convey("When I ask for the ipsets implementation", func() {
+			s, err := NewSupervisor(c, e, []string{"172.17.0.0/24"}, LocalServer, IPSets)
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+				So(s, ShouldBeNil)
+			})
+		})
+
+		root, _ := ioutil.TempDir("", "net_cls")
+		defer os.RemoveAll(root)
+
+		s, _ := NewSupervisor(c, e, []string{"172.17.0.0/24"}, LocalServer, IPTables)
+		impl := mock_supervisor.NewMockImplementor(ctrl)
+		s.impl = impl
+		s.cgroups = cgroup.NewNetClsManager(root)
+
+		puInfo := createPUInfo()
+		puInfo.Runtime.SetPid(1234)
+
+		Convey("When I supervise a Linux service", func() {
+			puInfo.Policy.SetMark("100")
+			impl.EXPECT().ConfigureRules(0, "service", puInfo.Policy).Return(nil)
+			err := s.Supervise("service", puInfo)
+
+			Convey("Its process should be moved to a cgroup with its mark", func() {
+				So(err, ShouldBeNil)
+				pids, err := s.cgroups.ListProcesses("service")
+				So(err, ShouldBeNil)
+				So(pids, ShouldResemble, []int{1234})
+				classID, _ := ioutil.ReadFile(filepath.Join(root, "trireme", "service", "net_cls.classid"))
+				So(string(classID), ShouldEqual, "100")
+			})
+
+			Convey("When I unsupervise it, its cgroup should be deleted", func() {
+				impl.EXPECT().DeleteRules(0, "service", gomock.Any()).Return(nil)
+				So(s.Unsupervise("service"), ShouldBeNil)
+				_, err := os.Stat(filepath.Join(root, "trireme", "service"))
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+		})
+
+		Convey("When I supervise a Linux service without a mark", func() {
+			impl.EXPECT().DeleteRules(0, "service", gomock.Any()).Return(nil)
+			err := s.Supervise("service", puInfo)
+
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+				_, err := s.versionTracker.Get("service")
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When I supervise a Linux service with the mark of the enforcer", func() {
+			puInfo.Policy.SetMark(strconv.Itoa(s.Mark))
+			impl.EXPECT().DeleteRules(0, "service", gomock.Any()).Return(nil)
+			err := s.Supervise("service", puInfo)
+
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
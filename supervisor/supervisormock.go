@@ -15,6 +15,9 @@ type mockedMethods struct {
 	// Unsupervise unsupervises the given PU
 	unsuperviseMock func(contextID string) error
 
+	// CleanOrphans removes the PUs that were recovered but not supervised again
+	cleanOrphansMock func() error
+
 	// Start starts the Supervisor.
 	startMock func() error
 
@@ -27,6 +30,7 @@ type TestSupervisor interface {
 	Supervisor
 	MockSupervise(t *testing.T, impl func(contextID string, puInfo *policy.PUInfo) error)
 	MockUnsupervise(t *testing.T, impl func(contextID string) error)
+	MockCleanOrphans(t *testing.T, impl func() error)
 	MockStart(t *testing.T, impl func() error)
 	MockStop(t *testing.T, impl func() error)
 }
@@ -56,6 +60,11 @@ func (m *testSupervisor) MockUnsupervise(t *testing.T, impl func(contextID strin
 	m.currentMocks(t).unsuperviseMock = impl
 }
 
+func (m *testSupervisor) MockCleanOrphans(t *testing.T, impl func() error) {
+
+	m.currentMocks(t).cleanOrphansMock = impl
+}
+
 func (m *testSupervisor) MockStart(t *testing.T, impl func() error) {
 
 	m.currentMocks(t).startMock = impl
@@ -84,6 +93,15 @@ func (m *testSupervisor) Unsupervise(contextID string) error {
 	return nil
 }
 
+func (m *testSupervisor) CleanOrphans() error {
+
+	if mock := m.currentMocks(m.currentTest); mock != nil && mock.cleanOrphansMock != nil {
+		return mock.cleanOrphansMock()
+	}
+
+	return nil
+}
+
 func (m *testSupervisor) Start() error {
 
 	if mock := m.currentMocks(m.currentTest); mock != nil && mock.startMock != nil {
@@ -1,9 +1,13 @@
 package trireme
 
 import (
+	"context"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/aporeto-inc/trireme/cache"
+	"github.com/aporeto-inc/trireme/collector"
 	"github.com/aporeto-inc/trireme/enforcer"
 	"github.com/aporeto-inc/trireme/monitor"
 	"github.com/aporeto-inc/trireme/policy"
@@ -20,7 +24,43 @@ type trireme struct {
 	enforcer   enforcer.PolicyEnforcer
 	resolver   PolicyResolver
 	stop       chan bool
-	requests   chan *triremeRequest
+
+	// queues are the queues of the workers. The requests of a PU are always
+	// processed in order by the same worker.
+	queues     []chan *triremeRequest
+	globalLock sync.Mutex
+
+	// policies are the policies enforced on the active PUs
+	policies map[string]*policy.PUPolicy
+
+	// status is the status of the PUs that are not destroyed
+	status map[string]*PUStatus
+
+	// history is the last policies applied to the PUs that are not destroyed
+	history     map[string][]*PolicyRecord
+	historySize int
+
+	// notifier sends the lifecycle events of the PUs to the subscribers
+	notifier lifecycleNotifier
+
+	// pending is the state of the PUs whose policy resolution is retried
+	pending   map[string]*pendingPU
+	retry     *ResolverRetry
+	collector collector.EventCollector
+
+	// paused is the state of the paused PUs
+	paused       map[string]*pausedPU
+	pauseMode    PauseMode
+	pauseRelease time.Duration
+
+	// syncMonitors is the number of monitors that synchronize the existing PUs
+	// and syncCompleted the number of them that completed
+	syncMonitors  int
+	syncCompleted int
+
+	// stateLock protects the maps of the state of the PUs, which are accessed
+	// by all the workers
+	stateLock sync.Mutex
 }
 
 // NewTrireme returns a reference to the trireme object based on the parameter subelements.
@@ -33,9 +73,20 @@ func NewTrireme(serverID string, resolver PolicyResolver, supervisor supervisor.
 		enforcer:   enforcer,
 		resolver:   resolver,
 		stop:       make(chan bool),
-		requests:   make(chan *triremeRequest),
+		policies:   map[string]*policy.PUPolicy{},
+		status:     map[string]*PUStatus{},
+		history:    map[string][]*PolicyRecord{},
+		pending:    map[string]*pendingPU{},
+		collector:  &collector.DefaultCollector{},
+		notifier: lifecycleNotifier{
+			subscriptions: map[*Subscription]bool{},
+		},
+		paused: map[string]*pausedPU{},
 	}
 
+	trireme.SetConcurrency(DefaultWorkers, DefaultQueueSize)
+	trireme.SetPolicyHistory(DefaultPolicyHistory)
+
 	return trireme
 }
 
@@ -59,18 +110,34 @@ func (t *trireme) Start() error {
 		return fmt.Errorf("Error starting enforcer: %s", err)
 	}
 
-	// Starting main trireme routine
-	go t.run()
+	// Starting the trireme workers. They run until the next Stop.
+	stop := make(chan bool)
+	t.stateLock.Lock()
+	t.stop = stop
+	t.stateLock.Unlock()
+
+	for _, queue := range t.queues {
+		go t.worker(queue, stop)
+	}
 
 	return nil
 }
 
 // Stop stops the supervisor and enforcer. It also stops handling new request
-// for PU Creation/Update and Policy Updates
+// for PU Creation/Update and Policy Updates. Stopping a stopped trireme does
+// nothing.
 func (t *trireme) Stop() error {
 
-	// send the stop signal for the trireme worker routine.
-	t.stop <- true
+	// send the stop signal to the trireme workers.
+	t.stateLock.Lock()
+	select {
+	case <-t.stop:
+		t.stateLock.Unlock()
+		return nil
+	default:
+		close(t.stop)
+	}
+	t.stateLock.Unlock()
 
 	if err := t.supervisor.Stop(); err != nil {
 		log.WithFields(log.Fields{
@@ -104,7 +171,34 @@ func (t *trireme) HandlePUEvent(contextID string, event monitor.Event) <-chan er
 		returnChan: c,
 	}
 
-	t.requests <- req
+	t.submit(req)
+
+	return c
+}
+
+// RegisterSynchronization registers a monitor that synchronizes the existing
+// PUs. The PUs that are gone are only cleaned once all of them have completed.
+func (t *trireme) RegisterSynchronization() {
+
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+
+	t.syncMonitors++
+}
+
+// HandleSynchronizationComplete implements the logic needed once all the existing
+// PUs have been synchronized. The rules of the PUs that are gone are removed
+// when every registered monitor has completed its synchronization.
+func (t *trireme) HandleSynchronizationComplete() <-chan error {
+
+	c := make(chan error, 1)
+
+	req := &triremeRequest{
+		reqType:    synchronizationComplete,
+		returnChan: c,
+	}
+
+	t.submit(req)
 
 	return c
 }
@@ -121,7 +215,7 @@ func (t *trireme) UpdatePolicy(contextID string, newPolicy *policy.PUPolicy) <-c
 		returnChan: c,
 	}
 
-	t.requests <- req
+	t.submit(req)
 
 	return c
 }
@@ -158,7 +252,18 @@ func addTransmitterLabel(contextID string, containerInfo *policy.PUInfo) {
 	}
 }
 
-func (t *trireme) doHandleCreate(contextID string) error {
+// addServerInfo copies the packet mark and the ports of a Linux service from
+// its runtime to the policy, where the supervisor and the enforcer use them to
+// identify its traffic. The policy of other processing units is left untouched.
+func addServerInfo(containerInfo *policy.PUInfo) {
+
+	if mark := containerInfo.Runtime.Mark(); mark != "" {
+		containerInfo.Policy.SetMark(mark)
+		containerInfo.Policy.SetPorts(containerInfo.Runtime.Ports())
+	}
+}
+
+func (t *trireme) doHandleCreate(ctx context.Context, contextID string) error {
 
 	log.WithFields(log.Fields{
 		"package":   "trireme",
@@ -178,7 +283,7 @@ func (t *trireme) doHandleCreate(contextID string) error {
 	}
 
 	runtimeInfo := cachedElement.(*policy.PURuntime)
-	policyInfo, err := t.resolver.ResolvePolicy(contextID, runtimeInfo)
+	policyInfo, err := t.resolvePolicy(ctx, contextID, runtimeInfo)
 
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -187,6 +292,11 @@ func (t *trireme) doHandleCreate(contextID string) error {
 			"runtimeInfo": runtimeInfo,
 			"error":       err.Error(),
 		}).Debug("Error returned when resolving the context")
+
+		if t.retry != nil {
+			return t.doHandlePending(ctx, contextID, runtimeInfo, fmt.Errorf("Policy Error for this context: %s. %s", contextID, err))
+		}
+
 		return fmt.Errorf("Policy Error for this context: %s. Container killed. %s", contextID, err)
 	}
 
@@ -195,9 +305,12 @@ func (t *trireme) doHandleCreate(contextID string) error {
 			"package":     "trireme",
 			"contextID":   contextID,
 			"runtimeInfo": runtimeInfo,
-			"error":       err.Error(),
 		}).Debug("Nil policy returned when resolving the context")
 
+		if t.retry != nil {
+			return t.doHandlePending(ctx, contextID, runtimeInfo, fmt.Errorf("Nil policy returned for context: %s", contextID))
+		}
+
 		return fmt.Errorf("Nil policy returned for context: %s. Container killed", contextID)
 	}
 
@@ -208,7 +321,9 @@ func (t *trireme) doHandleCreate(contextID string) error {
 
 	addTransmitterLabel(contextID, containerInfo)
 
-	err = t.enforcer.Enforce(contextID, containerInfo)
+	addServerInfo(containerInfo)
+
+	err = t.enforce(ctx, contextID, containerInfo)
 
 	if err != nil {
 		//t.supervisor.Unsupervise(contextID)
@@ -221,7 +336,7 @@ func (t *trireme) doHandleCreate(contextID string) error {
 		return fmt.Errorf("Not able to setup enforcer: %s", err)
 	}
 
-	err = t.supervisor.Supervise(contextID, containerInfo)
+	err = t.supervise(ctx, contextID, containerInfo)
 
 	if err != nil {
 		t.enforcer.Unenforce(contextID)
@@ -233,6 +348,10 @@ func (t *trireme) doHandleCreate(contextID string) error {
 		return fmt.Errorf("Not able to setup supervisor: %s", err)
 	}
 
+	t.setPolicy(contextID, containerInfo.Policy, PolicySourceResolver)
+	t.clearPause(contextID)
+	t.clearPending(contextID)
+
 	log.WithFields(log.Fields{
 		"package":   "trireme",
 		"contextID": contextID,
@@ -241,12 +360,28 @@ func (t *trireme) doHandleCreate(contextID string) error {
 	return nil
 }
 
-func (t *trireme) doHandleDelete(contextID string) error {
+func (t *trireme) doHandleDelete(ctx context.Context, contextID string) error {
 	log.WithFields(log.Fields{
 		"package":   "trireme",
 		"contextID": contextID,
 	}).Debug("Started HandleDelete")
 
+	// The state of the PU is only removed if the teardown is carried through
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("Delete abandoned for contextID %s: %s", contextID, err)
+	}
+
+	// The resources of a PU that never got a policy or that was released
+	// during a pause are already gone
+	_, enforced := t.activePolicy(contextID)
+	if p, ok := t.pausedState(contextID); !enforced || ok && p.released {
+		t.clearPause(contextID)
+		t.clearPending(contextID)
+		t.deletePolicy(contextID)
+		t.cache.Remove(contextID)
+		return nil
+	}
+
 	_, err := t.PURuntime(contextID)
 
 	if err != nil {
@@ -259,16 +394,20 @@ func (t *trireme) doHandleDelete(contextID string) error {
 		return fmt.Errorf("Error getting Runtime out of cache for ContextID %s : %s", contextID, err)
 	}
 
-	errS := t.supervisor.Unsupervise(contextID)
-	errE := t.enforcer.Unenforce(contextID)
+	t.clearPause(contextID)
+	t.clearPending(contextID)
+	t.deletePolicy(contextID)
+
+	errS := t.unsupervise(contextID)
+	errE := t.unenforce(contextID)
 	t.cache.Remove(contextID)
 
 	if errS != nil || errE != nil {
 		log.WithFields(log.Fields{
 			"package":         "trireme",
 			"contextID":       contextID,
-			"supervisorError": errS.Error(),
-			"enforcerError":   errE.Error(),
+			"supervisorError": errS,
+			"enforcerError":   errE,
 		}).Debug("Error when deleting")
 
 		return fmt.Errorf("Delete Error for contextID %s. supervisor %s, enforcer %s", contextID, errS, errE)
@@ -282,25 +421,114 @@ func (t *trireme) doHandleDelete(contextID string) error {
 	return nil
 }
 
-func (t *trireme) doHandleEvent(contextID string, event monitor.Event) error {
+// doHandleEvent moves a PU through its lifecycle. The events that are not
+// accepted in the current state of the PU are rejected.
+func (t *trireme) doHandleEvent(ctx context.Context, contextID string, event monitor.Event) error {
 	// Notify The PolicyResolver that an event occurred:
 	t.resolver.HandlePUEvent(contextID, event)
 
+	if !isLifecycleEvent(event) {
+		return nil
+	}
+
+	state := t.puState(contextID)
+	if !acceptsEvent(state, event) {
+		if state == "" {
+			return fmt.Errorf("Invalid event %s for unknown PU %s", event, contextID)
+		}
+		return fmt.Errorf("Invalid event %s for PU %s in state %s", event, contextID, state)
+	}
+
 	switch event {
+	case monitor.EventCreate:
+		if state != PUStateCreated {
+			t.setState(contextID, PUStateCreated, nil)
+		}
+
 	case monitor.EventStart:
-		return t.doHandleCreate(contextID)
+		t.setState(contextID, PUStateResolving, nil)
+
+		if err := t.doHandleCreate(ctx, contextID); err != nil {
+			t.setState(contextID, PUStateFailed, err)
+			t.notify(LifecycleEnforcementFailed, contextID, err)
+			return err
+		}
+
+		// The PU waits for its policy while the resolution is retried
+		if t.puState(contextID) == PUStatePending {
+			return nil
+		}
+
+		t.setState(contextID, PUStateEnforced, nil)
+		t.notify(LifecyclePUEnforced, contextID, nil)
+
 	case monitor.EventStop:
-		return t.doHandleDelete(contextID)
+		err := t.doHandleDelete(ctx, contextID)
+		t.setState(contextID, PUStateStopped, err)
+		return err
+
+	case monitor.EventDestroy:
+		if state == "" {
+			return nil
+		}
+
+		// A PU destroyed without being stopped is stopped first. What is
+		// released depends on the policy programmed for the PU, whatever its
+		// state.
+		err := t.doHandleDelete(ctx, contextID)
+
+		t.notify(LifecyclePURemoved, contextID, err)
+		t.deleteStatus(contextID)
+		return err
+
+	case monitor.EventUpdate:
+		// A PU without policy gets the new runtime when it starts
+		if state == PUStateCreated || state == PUStateFailed {
+			return nil
+		}
+
+		err := t.doHandleUpdate(ctx, contextID)
+		t.setError(contextID, err)
+		return err
+
+	case monitor.EventPause:
+		// A pending PU keeps its fallback policy
+		if state == PUStatePending {
+			return nil
+		}
+
+		if err := t.doHandlePause(ctx, contextID); err != nil {
+			t.setError(contextID, err)
+			return err
+		}
+
+		t.setState(contextID, PUStatePaused, nil)
+
+	case monitor.EventUnpause:
+		if state == PUStatePending {
+			return nil
+		}
+
+		if err := t.doHandleUnpause(ctx, contextID); err != nil {
+			t.setError(contextID, err)
+			return err
+		}
+
+		t.setState(contextID, PUStateEnforced, nil)
 	}
+
 	return nil
 }
 
-func (t *trireme) doUpdatePolicy(contextID string, newPolicy *policy.PUPolicy) error {
+// doHandleUpdate resolves the policy of a PU again after its runtime changed and
+// updates the PU with it. The addresses of the PU are updated in the enforcer
+// and the supervisor from the new policy.
+func (t *trireme) doHandleUpdate(ctx context.Context, contextID string) error {
 
 	log.WithFields(log.Fields{
 		"package":   "trireme",
 		"contextID": contextID,
-	}).Debug("Start to update a policy")
+	}).Debug("Started HandleUpdate")
 
 	runtimeInfo, err := t.PURuntime(contextID)
 
@@ -309,15 +537,121 @@ func (t *trireme) doUpdatePolicy(contextID string, newPolicy *policy.PUPolicy) e
 			"package":   "trireme",
 			"contextID": contextID,
 			"error":     err.Error(),
-		}).Debug("Policy Update failed because couldn't find runtime for contextID")
-		return fmt.Errorf("Policy Update failed because couldn't find runtime for contextID %s", contextID)
+		}).Debug("Update failed because couldn't find runtime for contextID")
+		return fmt.Errorf("Update failed because couldn't find runtime for contextID %s", contextID)
 	}
 
-	containerInfo := policy.PUInfoFromPolicyAndRuntime(contextID, newPolicy, runtimeInfo.(*policy.PURuntime))
+	policyInfo, err := t.resolvePolicy(ctx, contextID, runtimeInfo)
 
-	addTransmitterLabel(contextID, containerInfo)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"package":   "trireme",
+			"contextID": contextID,
+			"error":     err.Error(),
+		}).Debug("Error returned when resolving the context")
+		return fmt.Errorf("Policy Error for this context: %s. %s", contextID, err)
+	}
+
+	if policyInfo == nil {
+		return fmt.Errorf("Nil policy returned for context: %s", contextID)
+	}
+
+	// Create a copy as we are going to modify it locally
+	return t.doUpdatePolicy(ctx, contextID, policyInfo.Clone(), PolicySourceResolver)
+}
+
+func (t *trireme) doUpdatePolicy(ctx context.Context, contextID string, newPolicy *policy.PUPolicy, source PolicySource) error {
+
+	state, err := t.updatableState(contextID)
+	if err != nil {
+		return err
+	}
+
+	err = t.updatePolicy(ctx, contextID, newPolicy, source)
+
+	t.policyUpdated(contextID, state, err)
+
+	return err
+}
+
+// updatableState returns the state of a PU whose policy can be updated
+func (t *trireme) updatableState(contextID string) (PUState, error) {
+
+	state := t.puState(contextID)
+
+	switch state {
+	case PUStateEnforced, PUStatePending, PUStatePaused:
+		return state, nil
+	case "":
+		return state, fmt.Errorf("Cannot update the policy of unknown PU %s", contextID)
+	default:
+		return state, fmt.Errorf("Cannot update the policy of PU %s in state %s", contextID, state)
+	}
+}
+
+// policyUpdated records the result of the update of the policy of a PU that
+// was in the given state
+func (t *trireme) policyUpdated(contextID string, state PUState, err error) {
+
+	if err != nil {
+		t.setError(contextID, err)
+		t.notify(LifecycleEnforcementFailed, contextID, err)
+		return
+	}
+
+	// A pending PU gets its policy
+	if state == PUStatePending {
+		t.clearPending(contextID)
+		t.setState(contextID, PUStateEnforced, nil)
+		t.notify(LifecyclePUEnforced, contextID, nil)
+		return
+	}
+
+	t.notify(LifecyclePolicyUpdated, contextID, nil)
+}
+
+// updatePolicy sets a new policy for an enforced or paused PU
+func (t *trireme) updatePolicy(ctx context.Context, contextID string, newPolicy *policy.PUPolicy, source PolicySource) error {
+
+	// A paused PU that is quarantined or released gets its new policy when it
+	// is unpaused
+	if t.isFrozen(contextID) {
+		if _, err := t.PURuntime(contextID); err != nil {
+			return fmt.Errorf("Policy Update failed because couldn't find runtime for contextID %s", contextID)
+		}
+
+		log.WithFields(log.Fields{
+			"package":   "trireme",
+			"contextID": contextID,
+		}).Debug("Policy of paused PU will be updated when it is unpaused")
+
+		t.setPolicy(contextID, newPolicy, source)
+		return nil
+	}
+
+	if err := t.applyPolicy(ctx, contextID, newPolicy); err != nil {
+		return err
+	}
+
+	t.setPolicy(contextID, newPolicy, source)
+
+	return nil
+}
+
+// applyPolicy enforces a policy on an existing PU
+func (t *trireme) applyPolicy(ctx context.Context, contextID string, newPolicy *policy.PUPolicy) error {
+
+	log.WithFields(log.Fields{
+		"package":   "trireme",
+		"contextID": contextID,
+	}).Debug("Start to update a policy")
+
+	containerInfo, err := t.puInfo(contextID, newPolicy)
+	if err != nil {
+		return err
+	}
 
-	err = t.enforcer.Enforce(contextID, containerInfo)
+	err = t.enforce(ctx, contextID, containerInfo)
 
 	if err != nil {
 
@@ -329,7 +663,7 @@ func (t *trireme) doUpdatePolicy(contextID string, newPolicy *policy.PUPolicy) e
 		return fmt.Errorf("Policy Update failed for Enforcer %s", err)
 	}
 
-	err = t.supervisor.Supervise(contextID, containerInfo)
+	err = t.supervise(ctx, contextID, containerInfo)
 
 	if err != nil {
 		t.enforcer.Unenforce(contextID)
@@ -338,7 +672,7 @@ func (t *trireme) doUpdatePolicy(contextID string, newPolicy *policy.PUPolicy) e
 			"trireme":     t,
 			"contextID":   contextID,
 			"policy":      newPolicy,
-			"runtimeInfo": runtimeInfo,
+			"runtimeInfo": containerInfo.Runtime,
 			"error":       err,
 		}).Error("Policy Update failed for Supervisor")
 		return fmt.Errorf("Policy Update failed for Supervisor %s", err)
@@ -352,12 +686,60 @@ func (t *trireme) doUpdatePolicy(contextID string, newPolicy *policy.PUPolicy) e
 	return nil
 }
 
+// puInfo returns the information given to the enforcer and the supervisor to
+// enforce a policy on an existing PU
+func (t *trireme) puInfo(contextID string, newPolicy *policy.PUPolicy) (*policy.PUInfo, error) {
+
+	runtimeInfo, err := t.PURuntime(contextID)
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"package":   "trireme",
+			"contextID": contextID,
+			"error":     err.Error(),
+		}).Debug("Policy Update failed because couldn't find runtime for contextID")
+		return nil, fmt.Errorf("Policy Update failed because couldn't find runtime for contextID %s", contextID)
+	}
+
+	containerInfo := policy.PUInfoFromPolicyAndRuntime(contextID, newPolicy, runtimeInfo.(*policy.PURuntime))
+
+	addTransmitterLabel(contextID, containerInfo)
+
+	addServerInfo(containerInfo)
+
+	return containerInfo, nil
+}
+
 func (t *trireme) handleRequest(request *triremeRequest) error {
+
+	ctx := request.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	// The caller is not waiting anymore
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("Request for contextID %s abandoned: %s", request.contextID, err)
+	}
+
 	switch request.reqType {
 	case handleEvent:
-		return t.doHandleEvent(request.contextID, request.eventType)
+		return t.doHandleEvent(ctx, request.contextID, request.eventType)
 	case policyUpdate:
-		return t.doUpdatePolicy(request.contextID, request.policyInfo)
+		return t.doUpdatePolicy(ctx, request.contextID, request.policyInfo, PolicySourceUpdate)
+	case synchronizationComplete:
+		return t.doSynchronizationComplete()
+	case pauseExpired:
+		return t.doReleasePU(ctx, request.contextID)
+	case resolveRetry:
+		return t.doRetryResolve(ctx, request.contextID)
+	case enforcerExit:
+		return t.doHandleEnforcerExit(request.contextID, request.status)
+	case policyRollback:
+		return t.doRollbackPolicy(ctx, request.contextID, request.version)
+	case policiesUpdate:
+		request.results = t.doUpdatePolicies(ctx, request.policies, request.atomic)
+		return nil
 	default:
 		log.WithFields(log.Fields{
 			"package": "trireme",
@@ -367,21 +749,64 @@ func (t *trireme) handleRequest(request *triremeRequest) error {
 	}
 }
 
-func (t *trireme) run() {
-	for {
-		select {
-		case <-t.stop:
-			log.WithFields(log.Fields{
-				"package": "trireme",
-			}).Debug("Stopping trireme worker.")
-			return
-		case req := <-t.requests:
-			log.WithFields(log.Fields{
-				"package":   "trireme",
-				"type":      req.reqType,
-				"contextID": req.contextID,
-			}).Debug("Handling Trireme Request.")
-			req.returnChan <- t.handleRequest(req)
-		}
+// doSynchronizationComplete cleans the PUs that were not synchronized once
+// every registered monitor has completed its synchronization. The PUs adopted
+// from the rules left by a previous run are kept until then.
+func (t *trireme) doSynchronizationComplete() error {
+
+	t.stateLock.Lock()
+	t.syncCompleted++
+	completed := t.syncCompleted >= t.syncMonitors
+	t.stateLock.Unlock()
+
+	if !completed {
+		log.WithFields(log.Fields{
+			"package": "trireme",
+		}).Debug("Waiting for the synchronization of the other monitors")
+		return nil
 	}
+
+	return t.supervisor.CleanOrphans()
+}
+
+// activePolicy returns the policy enforced on a PU
+func (t *trireme) activePolicy(contextID string) (*policy.PUPolicy, bool) {
+
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+
+	p, ok := t.policies[contextID]
+
+	return p, ok
+}
+
+// setPolicy sets the policy enforced on a PU and records it in its history
+func (t *trireme) setPolicy(contextID string, p *policy.PUPolicy, source PolicySource) {
+
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+
+	t.policies[contextID] = p
+
+	if status, ok := t.status[contextID]; ok {
+		status.PolicyVersion++
+		status.PolicyUpdatedAt = time.Now()
+
+		t.recordPolicy(contextID, &PolicyRecord{
+			Version:   status.PolicyVersion,
+			VersionID: p.VersionID,
+			Hash:      p.Hash,
+			AppliedBy: source,
+			AppliedAt: status.PolicyUpdatedAt,
+			Policy:    p,
+		})
+	}
+}
+
+func (t *trireme) deletePolicy(contextID string) {
+
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+
+	delete(t.policies, contextID)
 }
@@ -3,6 +3,7 @@ package trireme
 import (
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/aporeto-inc/trireme/enforcer"
 	"github.com/aporeto-inc/trireme/monitor"
@@ -308,6 +309,57 @@ func TestStop(t *testing.T) {
 	doTestCreate(t, trireme, tresolver, tsupervisor, tenforcer, tmonitor, contextID, runtime)
 }
 
+func TestSynchronizationComplete(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, _ := createMocks()
+	trireme := NewTrireme("serverID", tresolver, tsupervisor, tenforcer)
+	trireme.Start()
+
+	cleanCount := 0
+	tsupervisor.MockCleanOrphans(t, func() error {
+		cleanCount++
+		return nil
+	})
+
+	if err := <-trireme.HandleSynchronizationComplete(); err != nil {
+		t.Errorf("Synchronization complete was supposed to be nil, was %s", err)
+	}
+
+	if cleanCount != 1 {
+		t.Errorf("Synchronization complete didn't go to Supervisor")
+	}
+}
+
+func TestSynchronizationCompleteWithMonitors(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, _ := createMocks()
+	trireme := NewTrireme("serverID", tresolver, tsupervisor, tenforcer)
+	trireme.RegisterSynchronization()
+	trireme.RegisterSynchronization()
+	trireme.Start()
+	defer trireme.Stop()
+
+	cleanCount := 0
+	tsupervisor.MockCleanOrphans(t, func() error {
+		cleanCount++
+		return nil
+	})
+
+	if err := <-trireme.HandleSynchronizationComplete(); err != nil {
+		t.Errorf("Synchronization complete was supposed to be nil, was %s", err)
+	}
+
+	if cleanCount != 0 {
+		t.Errorf("Orphans were cleaned before all the monitors completed their synchronization")
+	}
+
+	if err := <-trireme.HandleSynchronizationComplete(); err != nil {
+		t.Errorf("Synchronization complete was supposed to be nil, was %s", err)
+	}
+
+	if cleanCount != 1 {
+		t.Errorf("Orphans were not cleaned once all the monitors completed their synchronization")
+	}
+}
+
 func TestTransmitterLabel(t *testing.T) {
 
 	// If management ID is set, use it as the TransmitterLabel
@@ -339,3 +391,164 @@ func TestTransmitterLabel(t *testing.T) {
 	}
 
 }
+
+func TestRuntimeUpdate(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, tmonitor := createMocks()
+	trireme := NewTrireme("serverID", tresolver, tsupervisor, tenforcer)
+	trireme.Start()
+	contextID := "123123"
+	runtime := policy.NewPURuntimeWithDefaults()
+	runtime.SetIPAddresses(policy.NewIPMap(map[string]string{"bridge": "10.10.10.10"}))
+
+	doTestCreate(t, trireme, tresolver, tsupervisor, tenforcer, tmonitor, contextID, runtime)
+
+	// The PU joins a network
+	updated := runtime.Clone()
+	updated.SetIPAddresses(policy.NewIPMap(map[string]string{"bridge": "10.10.10.10", "front": "10.1.0.2"}))
+
+	tresolver.MockResolvePolicy(t, func(contextID string, RuntimeReader policy.RuntimeReader) (*policy.PUPolicy, error) {
+		return policy.NewPUPolicy("SomeId", policy.AllowAll, nil, nil, nil, nil, nil, nil, RuntimeReader.IPAddresses(), nil), nil
+	})
+
+	enforced := 0
+	tenforcer.MockEnforce(t, func(contextID string, puInfo *policy.PUInfo) error {
+		if _, ok := puInfo.Policy.IPAddresses().Get("front"); !ok {
+			t.Errorf("Policy given to Enforcer doesn't have the new address")
+		}
+		enforced++
+		return nil
+	})
+
+	supervised := 0
+	tsupervisor.MockSupervise(t, func(contextID string, puInfo *policy.PUInfo) error {
+		if !reflect.DeepEqual(puInfo.Runtime, updated) {
+			t.Errorf("Runtime given to Supervisor is not the updated one. Received %v, expected %v", puInfo.Runtime, updated)
+		}
+		supervised++
+		return nil
+	})
+
+	if err := trireme.SetPURuntime(contextID, updated); err != nil {
+		t.Errorf("Error while setting the Runtime in Trireme,  %s", err)
+	}
+
+	if err := <-trireme.HandlePUEvent(contextID, monitor.EventUpdate); err != nil {
+		t.Errorf("Update was supposed to be nil, was %s", err)
+	}
+
+	if enforced != 1 || supervised != 1 {
+		t.Errorf("Update didn't go to Enforcer and Supervisor")
+	}
+
+	if err := <-trireme.HandlePUEvent("unknown", monitor.EventUpdate); err == nil {
+		t.Errorf("Update of an unknown PU was supposed to fail")
+	}
+}
+
+func TestPauseQuarantine(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, tmonitor := createMocks()
+	trireme := NewTrireme("serverID", tresolver, tsupervisor, tenforcer)
+	trireme.SetPauseBehavior(PauseQuarantine, 0)
+	trireme.Start()
+	contextID := "123123"
+	runtime := policy.NewPURuntimeWithDefaults()
+
+	doTestCreate(t, trireme, tresolver, tsupervisor, tenforcer, tmonitor, contextID, runtime)
+
+	resolved := 0
+	tresolver.MockResolvePolicy(t, func(contextID string, RuntimeReader policy.RuntimeReader) (*policy.PUPolicy, error) {
+		resolved++
+		return nil, nil
+	})
+
+	var enforced *policy.PUPolicy
+	tenforcer.MockEnforce(t, func(contextID string, puInfo *policy.PUInfo) error {
+		enforced = puInfo.Policy
+		return nil
+	})
+	tsupervisor.MockSupervise(t, func(contextID string, puInfo *policy.PUInfo) error {
+		return nil
+	})
+
+	if err := <-trireme.HandlePUEvent(contextID, monitor.EventPause); err != nil {
+		t.Errorf("Pause was supposed to be nil, was %s", err)
+	}
+
+	if enforced == nil || enforced.TriremeAction != policy.Police || len(enforced.ReceiverRules().TagSelectors) != 0 {
+		t.Errorf("Paused PU was not quarantined")
+	}
+
+	// A policy update is kept until the PU is unpaused
+	enforced = nil
+	ipl := policy.NewIPMap(map[string]string{policy.DefaultNamespace: "127.0.0.1"})
+	newPolicy := policy.NewPUPolicy("", policy.AllowAll, nil, nil, nil, nil, nil, nil, ipl, nil)
+	if err := <-trireme.UpdatePolicy(contextID, newPolicy); err != nil {
+		t.Errorf("Update was supposed to be nil, was %s", err)
+	}
+	if enforced != nil {
+		t.Errorf("Policy of quarantined PU was updated")
+	}
+
+	if err := <-trireme.HandlePUEvent(contextID, monitor.EventUnpause); err != nil {
+		t.Errorf("Unpause was supposed to be nil, was %s", err)
+	}
+
+	if enforced == nil || enforced.TriremeAction != policy.AllowAll {
+		t.Errorf("Policy of unpaused PU was not restored")
+	}
+
+	if resolved != 0 {
+		t.Errorf("Policy was resolved again")
+	}
+}
+
+func TestPauseRelease(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, tmonitor := createMocks()
+	trireme := NewTrireme("serverID", tresolver, tsupervisor, tenforcer)
+	trireme.SetPauseBehavior(PauseKeep, 10*time.Millisecond)
+	trireme.Start()
+	contextID := "123123"
+	runtime := policy.NewPURuntimeWithDefaults()
+
+	doTestCreate(t, trireme, tresolver, tsupervisor, tenforcer, tmonitor, contextID, runtime)
+
+	released := make(chan bool, 2)
+	tsupervisor.MockUnsupervise(t, func(contextID string) error {
+		released <- true
+		return nil
+	})
+	tenforcer.MockUnenforce(t, func(contextID string) error {
+		released <- true
+		return nil
+	})
+
+	if err := <-trireme.HandlePUEvent(contextID, monitor.EventPause); err != nil {
+		t.Errorf("Pause was supposed to be nil, was %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-released:
+		case <-time.After(time.Second):
+			t.Fatalf("Paused PU was not released")
+		}
+	}
+
+	restored := 0
+	tenforcer.MockEnforce(t, func(contextID string, puInfo *policy.PUInfo) error {
+		restored++
+		return nil
+	})
+	tsupervisor.MockSupervise(t, func(contextID string, puInfo *policy.PUInfo) error {
+		restored++
+		return nil
+	})
+
+	if err := <-trireme.HandlePUEvent(contextID, monitor.EventUnpause); err != nil {
+		t.Errorf("Unpause was supposed to be nil, was %s", err)
+	}
+
+	if restored != 2 {
+		t.Errorf("Released PU was not restored")
+	}
+}
@@ -0,0 +1,145 @@
+package trireme
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// DefaultWorkers is the default number of workers processing the requests
+	// of the PUs
+	DefaultWorkers = 8
+
+	// DefaultQueueSize is the default number of requests queued for each worker
+	DefaultQueueSize = 100
+)
+
+// barrier stops all the workers until a request that affects all the PUs is
+// processed
+type barrier struct {
+	arrived sync.WaitGroup
+	release chan struct{}
+}
+
+// SetConcurrency sets the number of workers processing the requests and the
+// size of their queues
+func (t *trireme) SetConcurrency(workers int, queueSize int) {
+
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+
+	t.queues = make([]chan *triremeRequest, workers)
+	for i := range t.queues {
+		t.queues[i] = make(chan *triremeRequest, queueSize)
+	}
+}
+
+// submit queues a request. The requests of a PU are queued for the same worker.
+// It blocks while the queue of the worker is full, which slows down the
+// monitors when the workers are late.
+func (t *trireme) submit(req *triremeRequest) {
+
+	if req.contextID == "" {
+		t.submitGlobal(req)
+		return
+	}
+
+	t.queue(req.contextID) <- req
+}
+
+// queue returns the queue of the worker of a PU
+func (t *trireme) queue(contextID string) chan *triremeRequest {
+
+	h := fnv.New32a()
+	h.Write([]byte(contextID))
+
+	return t.queues[h.Sum32()%uint32(len(t.queues))]
+}
+
+// submitGlobal queues a request that affects all the PUs. It is processed once
+// all the requests queued before it are processed, while the workers wait. It
+// fails if trireme is stopped before the workers reach it.
+func (t *trireme) submitGlobal(req *triremeRequest) {
+
+	// The barriers are queued in the same order for all the workers
+	t.globalLock.Lock()
+	defer t.globalLock.Unlock()
+
+	b := &barrier{
+		release: make(chan struct{}),
+	}
+	b.arrived.Add(len(t.queues))
+
+	for _, queue := range t.queues {
+		queue <- &triremeRequest{barrier: b}
+	}
+
+	arrived := make(chan struct{})
+	go func() {
+		b.arrived.Wait()
+		close(arrived)
+	}()
+
+	stop := t.stopChannel()
+	go func() {
+		// The workers started again go through the abandoned barrier
+		defer close(b.release)
+
+		select {
+		case <-arrived:
+			req.returnChan <- t.handleRequest(req)
+		case <-stop:
+			req.returnChan <- fmt.Errorf("Trireme stopped before the request was processed")
+		}
+	}()
+}
+
+// stopChannel returns the channel closed when the current workers are stopped
+func (t *trireme) stopChannel() chan bool {
+
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+
+	return t.stop
+}
+
+// worker processes the requests of its queue in order until the stop channel
+// is closed
+func (t *trireme) worker(queue chan *triremeRequest, stop chan bool) {
+
+	for {
+		select {
+		case <-stop:
+			log.WithFields(log.Fields{
+				"package": "trireme",
+			}).Debug("Stopping trireme worker.")
+			return
+		case req := <-queue:
+			if req.barrier != nil {
+				req.barrier.arrived.Done()
+
+				select {
+				case <-req.barrier.release:
+				case <-stop:
+					return
+				}
+				continue
+			}
+
+			log.WithFields(log.Fields{
+				"package":   "trireme",
+				"type":      req.reqType,
+				"contextID": req.contextID,
+			}).Debug("Handling Trireme Request.")
+			req.returnChan <- t.handleRequest(req)
+		}
+	}
+}
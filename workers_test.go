@@ -0,0 +1,218 @@
+package trireme
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aporeto-inc/trireme/monitor"
+)
+
+func TestPerContextOrdering(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, _ := createMocks()
+	trireme := NewTrireme("serverID", tresolver, tsupervisor, tenforcer)
+	trireme.SetConcurrency(4, 5)
+	trireme.Start()
+	defer trireme.Stop()
+
+	contexts := 20
+	events := 50
+
+	var lock sync.Mutex
+	received := map[string][]monitor.Event{}
+
+	tresolver.MockHandlePUEvent(t, func(contextID string, event monitor.Event) {
+		lock.Lock()
+		slow := len(received[contextID])%7 == 0
+		lock.Unlock()
+
+		// Some requests are slow
+		if slow {
+			time.Sleep(time.Millisecond)
+		}
+
+		lock.Lock()
+		received[contextID] = append(received[contextID], event)
+		lock.Unlock()
+	})
+
+	var wg sync.WaitGroup
+	for c := 0; c < contexts; c++ {
+		wg.Add(1)
+		go func(contextID string) {
+			defer wg.Done()
+
+			results := []<-chan error{}
+			for e := 0; e < events; e++ {
+				results = append(results, trireme.HandlePUEvent(contextID, monitor.Event(fmt.Sprintf("event-%d", e))))
+			}
+
+			for _, result := range results {
+				<-result
+			}
+		}(fmt.Sprintf("context-%d", c))
+	}
+	wg.Wait()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if len(received) != contexts {
+		t.Fatalf("Expected the events of %d contexts, got %d", contexts, len(received))
+	}
+
+	for contextID, got := range received {
+		if len(got) != events {
+			t.Errorf("Expected %d events for %s, got %d", events, contextID, len(got))
+		}
+
+		for e, event := range got {
+			if event != monitor.Event(fmt.Sprintf("event-%d", e)) {
+				t.Errorf("Events of %s out of order: got %s at position %d", contextID, event, e)
+				break
+			}
+		}
+	}
+}
+
+func TestParallelContexts(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, _ := createMocks()
+	trireme := NewTrireme("serverID", tresolver, tsupervisor, tenforcer).(*trireme)
+	trireme.Start()
+	defer trireme.Stop()
+
+	slow := "slow"
+	fast := ""
+	for i := 0; fast == ""; i++ {
+		if id := fmt.Sprintf("fast-%d", i); trireme.queue(id) != trireme.queue(slow) {
+			fast = id
+		}
+	}
+
+	unblock := make(chan bool)
+	tresolver.MockHandlePUEvent(t, func(contextID string, event monitor.Event) {
+		if contextID == slow {
+			<-unblock
+		}
+	})
+
+	slowResult := trireme.HandlePUEvent(slow, monitor.EventCreate)
+
+	select {
+	case <-trireme.HandlePUEvent(fast, monitor.EventCreate):
+	case <-time.After(time.Second):
+		t.Fatalf("A slow PU blocked the requests of another PU")
+	}
+
+	close(unblock)
+	<-slowResult
+}
+
+func TestBackpressure(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, _ := createMocks()
+	trireme := NewTrireme("serverID", tresolver, tsupervisor, tenforcer)
+	trireme.SetConcurrency(1, 1)
+
+	// The queue is full with one request until trireme is started
+	trireme.HandlePUEvent("123", monitor.EventCreate)
+
+	submitted := make(chan (<-chan error))
+	go func() {
+		submitted <- trireme.HandlePUEvent("123", monitor.EventCreate)
+	}()
+
+	select {
+	case <-submitted:
+		t.Fatalf("Request was accepted while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	trireme.Start()
+	defer trireme.Stop()
+
+	select {
+	case result := <-submitted:
+		<-result
+	case <-time.After(time.Second):
+		t.Fatalf("Request was not accepted once the queue was processed")
+	}
+}
+
+func TestSynchronizationBarrier(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, _ := createMocks()
+	trireme := NewTrireme("serverID", tresolver, tsupervisor, tenforcer)
+	trireme.SetConcurrency(4, 10)
+
+	var lock sync.Mutex
+	handled := 0
+	handledAtClean := -1
+
+	tresolver.MockHandlePUEvent(t, func(contextID string, event monitor.Event) {
+		time.Sleep(time.Millisecond)
+
+		lock.Lock()
+		handled++
+		lock.Unlock()
+	})
+
+	tsupervisor.MockCleanOrphans(t, func() error {
+		lock.Lock()
+		handledAtClean = handled
+		lock.Unlock()
+		return nil
+	})
+
+	for i := 0; i < 8; i++ {
+		trireme.HandlePUEvent(fmt.Sprintf("context-%d", i), monitor.EventCreate)
+	}
+
+	result := trireme.HandleSynchronizationComplete()
+
+	trireme.Start()
+	defer trireme.Stop()
+
+	if err := <-result; err != nil {
+		t.Errorf("Synchronization was supposed to be nil, was %s", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if handledAtClean != 8 {
+		t.Errorf("Orphans were cleaned after %d events instead of 8", handledAtClean)
+	}
+}
+
+func TestStopWithBarrier(t *testing.T) {
+	tresolver, tsupervisor, tenforcer, _ := createMocks()
+	trireme := NewTrireme("serverID", tresolver, tsupervisor, tenforcer)
+	trireme.SetConcurrency(2, 10)
+
+	// The workers never reach the barrier before trireme is stopped
+	result := trireme.HandleSynchronizationComplete()
+
+	trireme.Stop()
+
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Errorf("Synchronization was supposed to fail when trireme is stopped")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Synchronization was still waiting after trireme was stopped")
+	}
+
+	if err := trireme.Stop(); err != nil {
+		t.Errorf("Second stop was supposed to be nil, was %s", err)
+	}
+
+	trireme.Start()
+	defer trireme.Stop()
+
+	select {
+	case <-trireme.HandlePUEvent("123", monitor.EventCreate):
+	case <-time.After(time.Second):
+		t.Fatalf("Request was not processed after the abandoned barrier")
+	}
+}